@@ -0,0 +1,250 @@
+package main
+
+import (
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+)
+
+// Optionally implemented by the protocol plugins that can recognize
+// their traffic on ports that are not configured.
+type ProtocolDetector interface {
+	// Returns a score between 0 (not this protocol) and 100 (surely
+	// this protocol) for the first bytes sent in one direction of a
+	// TCP stream.
+	Detect(data []byte) int
+}
+
+const (
+	DetectionScoreCertain = 100
+
+	// how often, in packet time, the idle streams are looked for
+	detectionExpiryInterval = time.Second
+)
+
+// A TCP segment kept while the protocol of the stream is unknown.
+type detectionSegment struct {
+	pkt *Packet
+	fin bool
+	seq uint32
+}
+
+// A stream on an unconfigured port for which the protocol was not yet
+// decided.
+type undecidedStream struct {
+	tuple    *IpPortTuple
+	segments []detectionSegment
+	data     [2][]byte
+
+	// timestamp of the last packet, the stream is forgotten when it
+	// stays idle for TCP_STREAM_EXPIRY
+	lastTs time.Time
+
+	// set when no protocol could be recognized, the rest of the stream
+	// is ignored
+	rejected bool
+}
+
+type ProtocolDetection struct {
+	// config
+	Enabled  bool
+	MaxBytes int
+	MinScore int
+
+	detectors map[string]ProtocolDetector
+	streams   map[HashableIpPortTuple]*undecidedStream
+
+	// packet time at which the idle streams are next looked for
+	nextExpiry time.Time
+}
+
+type tomlProtocolDetection struct {
+	Enabled   bool
+	Max_bytes int
+	Min_score int
+}
+
+var protocolDetection ProtocolDetection
+
+func (detection *ProtocolDetection) InitDefaults() {
+	detection.Enabled = false
+	detection.MaxBytes = 1024
+	detection.MinScore = 50
+}
+
+func (detection *ProtocolDetection) setFromConfig() error {
+	config := _Config.Protocol_detection
+
+	detection.Enabled = config.Enabled
+	if _ConfigMeta.IsDefined("protocol_detection", "max_bytes") {
+		if config.Max_bytes <= 0 {
+			return MsgError("Invalid protocol_detection.max_bytes: %d", config.Max_bytes)
+		}
+		detection.MaxBytes = config.Max_bytes
+	}
+	if _ConfigMeta.IsDefined("protocol_detection", "min_score") {
+		if config.Min_score <= 0 || config.Min_score > DetectionScoreCertain {
+			return MsgError("Invalid protocol_detection.min_score: %d", config.Min_score)
+		}
+		detection.MinScore = config.Min_score
+	}
+
+	return nil
+}
+
+// Only the protocols enabled in the configuration file are candidates.
+// In test mode, all registered detectors are.
+func (detection *ProtocolDetection) Init(test_mode bool) error {
+
+	detection.InitDefaults()
+
+	if !test_mode {
+		err := detection.setFromConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	detection.detectors = map[string]ProtocolDetector{}
+	for name, plugin := range protocolPlugins {
+		detector, ok := plugin.(ProtocolDetector)
+		if !ok {
+			continue
+		}
+		if _, exists := _Config.Protocols[name]; exists || test_mode {
+			detection.detectors[name] = detector
+		}
+	}
+
+	detection.streams = make(map[HashableIpPortTuple]*undecidedStream)
+
+	return nil
+}
+
+// Returns the protocol with the best score over the data buffered in
+// the two directions, or nil if none reaches the minimum score.
+func (detection *ProtocolDetection) bestProtocol(stream *undecidedStream) (ProtocolPlugin, int) {
+	var best ProtocolPlugin
+	bestScore := 0
+
+	for name, detector := range detection.detectors {
+		for dir := 0; dir < 2; dir++ {
+			if len(stream.data[dir]) == 0 {
+				continue
+			}
+			score := detector.Detect(stream.data[dir])
+			DEBUG("detect", "Protocol %s scored %d", name, score)
+			if score > bestScore {
+				best = protocolPlugins[name]
+				bestScore = score
+			}
+		}
+	}
+
+	if bestScore < detection.MinScore {
+		return nil, bestScore
+	}
+	return best, bestScore
+}
+
+// Called by FollowTcp for the segments of streams that are not on a
+// configured port. Buffers them until one of the protocols recognizes
+// the stream and then replays them as if the port was configured.
+func (detection *ProtocolDetection) AddPacket(tcphdr *layers.TCP, pkt *Packet) {
+
+	detection.expireStreams(pkt.ts)
+
+	stream, exists := detection.streams[pkt.tuple.raw]
+	var dir uint8 = TcpDirectionOriginal
+	if !exists {
+		stream, exists = detection.streams[pkt.tuple.revRaw]
+		if exists {
+			dir = TcpDirectionReverse
+		} else {
+			if len(pkt.payload) == 0 {
+				// nothing to look at
+				return
+			}
+			stream = &undecidedStream{tuple: &pkt.tuple}
+			detection.streams[pkt.tuple.raw] = stream
+		}
+	}
+
+	stream.lastTs = pkt.ts
+
+	if stream.rejected {
+		return
+	}
+
+	// the capture buffer can be reused by the sniffer
+	payload := make([]byte, len(pkt.payload))
+	copy(payload, pkt.payload)
+	stream.segments = append(stream.segments, detectionSegment{
+		pkt: &Packet{ts: pkt.ts, tuple: pkt.tuple, payload: payload},
+		fin: tcphdr.FIN,
+		seq: tcphdr.Seq,
+	})
+	if len(stream.data[dir]) < detection.MaxBytes {
+		stream.data[dir] = append(stream.data[dir], pkt.payload...)
+	}
+
+	// decide as soon as a protocol is certain, otherwise wait until
+	// enough data was seen
+	protocol, score := detection.bestProtocol(stream)
+	if score < DetectionScoreCertain && !detection.isFull(stream) && !tcphdr.FIN {
+		// wait for more data
+		return
+	}
+
+	if protocol == nil {
+		DEBUG("detect", "Protocol not recognized, ignoring stream %s", stream.tuple)
+		stream.rejected = true
+		stream.segments = nil
+		stream.data = [2][]byte{nil, nil}
+		return
+	}
+
+	DEBUG("detect", "Stream %s detected as %s", stream.tuple, protocolPluginName(protocol))
+
+	delete(detection.streams, stream.tuple.raw)
+
+	// create the TCP stream and feed it what we have seen so far
+	tcpStream := &TcpStream{id: GetId(), tuple: stream.tuple, protocol: protocol}
+	tcpStreamsMap[stream.tuple.raw] = tcpStream
+
+	for _, segment := range stream.segments {
+		hdr := layers.TCP{Seq: segment.seq, FIN: segment.fin}
+		FollowTcp(&hdr, segment.pkt)
+	}
+}
+
+func (detection *ProtocolDetection) isFull(stream *undecidedStream) bool {
+	return len(stream.data[0]) >= detection.MaxBytes ||
+		len(stream.data[1]) >= detection.MaxBytes
+}
+
+// Forgets the streams that were idle for TCP_STREAM_EXPIRY. Runs on the
+// packet path, so that the streams map is only used from there.
+func (detection *ProtocolDetection) expireStreams(ts time.Time) {
+	if ts.Before(detection.nextExpiry) {
+		return
+	}
+	detection.nextExpiry = ts.Add(detectionExpiryInterval)
+
+	for key, stream := range detection.streams {
+		if ts.Sub(stream.lastTs) > TCP_STREAM_EXPIRY {
+			DEBUG("detect", "Undecided stream %s expired", stream.tuple)
+			delete(detection.streams, key)
+		}
+	}
+}
+
+// Returns the name under which the plugin was registered.
+func protocolPluginName(plugin ProtocolPlugin) string {
+	for name, p := range protocolPlugins {
+		if p == plugin {
+			return name
+		}
+	}
+	return ""
+}
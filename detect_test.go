@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket/layers"
+)
+
+func TestDetect_http(t *testing.T) {
+
+	if score := HttpMod.Detect([]byte("GET /index.html HTTP/1.1\r\nHost: localhost\r\n")); score != DetectionScoreCertain {
+		t.Errorf("HTTP request scored %d", score)
+	}
+	if score := HttpMod.Detect([]byte("HTTP/1.1 200 OK\r\n")); score != DetectionScoreCertain {
+		t.Errorf("HTTP response scored %d", score)
+	}
+	if score := HttpMod.Detect([]byte("GET /very/long/url")); score != 50 {
+		t.Errorf("Incomplete HTTP request scored %d", score)
+	}
+	if score := HttpMod.Detect([]byte("GET key\r\n")); score != 0 {
+		t.Errorf("Memcache like request scored %d", score)
+	}
+}
+
+func TestDetect_redis(t *testing.T) {
+
+	if score := RedisMod.Detect([]byte("*2\r\n$3\r\nget\r\n$3\r\nkey\r\n")); score != DetectionScoreCertain {
+		t.Errorf("Redis request scored %d", score)
+	}
+	if score := RedisMod.Detect([]byte("*2\r\n$3\r\nfoo\r\n$3\r\nkey\r\n")); score != 0 {
+		t.Errorf("Unknown Redis command scored %d", score)
+	}
+	if score := RedisMod.Detect([]byte("+OK\r\n")); score >= DetectionScoreCertain {
+		t.Errorf("Simple reply scored %d", score)
+	}
+}
+
+func TestDetect_mysql(t *testing.T) {
+
+	greeting, _ := hex.DecodeString("4a0000000a352e352e33382d3075627" +
+		"56e7475302e31342e30342e3100")
+	if score := MysqlMod.Detect(greeting); score != DetectionScoreCertain {
+		t.Errorf("MySQL greeting scored %d", score)
+	}
+
+	query := append([]byte{0x0a, 0x00, 0x00, 0x00, 0x03}, []byte("select 1")...)
+	query[0] = byte(len(query) - 4)
+	if score := MysqlMod.Detect(query); score != DetectionScoreCertain {
+		t.Errorf("MySQL query scored %d", score)
+	}
+
+	if score := MysqlMod.Detect([]byte("GET / HTTP/1.1\r\n")); score != 0 {
+		t.Errorf("HTTP request scored %d as MySQL", score)
+	}
+}
+
+func TestDetect_pgsql(t *testing.T) {
+
+	ssl, _ := hex.DecodeString("0000000804d2162f")
+	if score := PgsqlMod.Detect(ssl); score != DetectionScoreCertain {
+		t.Errorf("SSL request scored %d", score)
+	}
+
+	query, _ := hex.DecodeString("510000000e73656c65637420313b00")
+	if score := PgsqlMod.Detect(query); score != DetectionScoreCertain {
+		t.Errorf("Simple query scored %d", score)
+	}
+}
+
+func TestDetect_thrift(t *testing.T) {
+
+	call, _ := hex.DecodeString("800100010000000470696e670000000000")
+	if score := ThriftMod.Detect(call); score != DetectionScoreCertain {
+		t.Errorf("Thrift call scored %d", score)
+	}
+
+	framed, _ := hex.DecodeString("00000011800100010000000470696e670000000000")
+	if score := ThriftMod.Detect(framed); score != DetectionScoreCertain {
+		t.Errorf("Framed Thrift call scored %d", score)
+	}
+
+	compact, _ := hex.DecodeString("0000000a82210103616464150200")
+	if score := ThriftMod.Detect(compact); score != DetectionScoreCertain {
+		t.Errorf("Framed compact Thrift call scored %d", score)
+	}
+
+	if score := ThriftMod.Detect([]byte("GET / HTTP/1.1\r\n")); score != 0 {
+		t.Errorf("HTTP request scored %d as Thrift", score)
+	}
+}
+
+func TestDetect_unconfiguredPort(t *testing.T) {
+
+	savedHttp, savedDetection := HttpMod, protocolDetection
+	defer func() {
+		HttpMod, protocolDetection = savedHttp, savedDetection
+	}()
+
+	HttpMod.Init(true)
+	protocolDetection.Init(true)
+	protocolDetection.Enabled = true
+
+	tuple := NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 34567,
+		net.ParseIP("192.168.0.2"), 4242)
+
+	pkt := &Packet{
+		ts:      time.Now(),
+		tuple:   tuple,
+		payload: []byte("GET /index.html HTTP/1.1\r\n"),
+	}
+	FollowTcp(&layers.TCP{Seq: 1}, pkt)
+
+	stream, exists := tcpStreamsMap[tuple.raw]
+	if !exists {
+		t.Fatalf("No TCP stream created for the detected protocol")
+	}
+	if stream.protocol != ProtocolPlugin(&HttpMod) {
+		t.Errorf("Stream not bound to the HTTP plugin")
+	}
+	if _, exists := protocolDetection.streams[tuple.raw]; exists {
+		t.Errorf("Detected stream still waiting for detection")
+	}
+
+	delete(tcpStreamsMap, tuple.raw)
+}
+
+func TestDetect_idleStreamExpiry(t *testing.T) {
+
+	savedDetection := protocolDetection
+	defer func() {
+		protocolDetection = savedDetection
+	}()
+
+	protocolDetection.Init(true)
+	protocolDetection.Enabled = true
+
+	rejected := NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 34567,
+		net.ParseIP("192.168.0.2"), 4242)
+	undecided := NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 34568,
+		net.ParseIP("192.168.0.2"), 4242)
+	other := NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 34569,
+		net.ParseIP("192.168.0.2"), 4242)
+
+	start := time.Now()
+	protocolDetection.AddPacket(&layers.TCP{Seq: 1, FIN: true},
+		&Packet{ts: start, tuple: rejected, payload: []byte("\x00\x01\x02")})
+	protocolDetection.AddPacket(&layers.TCP{Seq: 1},
+		&Packet{ts: start, tuple: undecided, payload: []byte("GET /very/long/url")})
+
+	// packets of the rejected stream keep it alive
+	protocolDetection.AddPacket(&layers.TCP{Seq: 4},
+		&Packet{ts: start.Add(TCP_STREAM_EXPIRY), tuple: rejected, payload: []byte("x")})
+
+	protocolDetection.AddPacket(&layers.TCP{Seq: 1},
+		&Packet{ts: start.Add(TCP_STREAM_EXPIRY + time.Second), tuple: other, payload: []byte("GET /")})
+
+	if _, exists := protocolDetection.streams[undecided.raw]; exists {
+		t.Errorf("Idle undecided stream not expired")
+	}
+	stream, exists := protocolDetection.streams[rejected.raw]
+	if !exists || !stream.rejected {
+		t.Errorf("Active rejected stream expired")
+	}
+	if _, exists := protocolDetection.streams[other.raw]; !exists {
+		t.Errorf("New stream not kept")
+	}
+}
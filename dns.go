@@ -0,0 +1,587 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	DnsHeaderLength = 12
+
+	// the messages sent over TCP are prefixed by their length
+	DnsTcpLengthPrefix = 2
+
+	// bounds the compression pointers followed in a single name
+	DnsMaxPointers = 32
+)
+
+// Resource record types
+const (
+	DnsTypeA     = 1
+	DnsTypeNS    = 2
+	DnsTypeCNAME = 5
+	DnsTypeSOA   = 6
+	DnsTypePTR   = 12
+	DnsTypeMX    = 15
+	DnsTypeTXT   = 16
+	DnsTypeAAAA  = 28
+	DnsTypeSRV   = 33
+)
+
+var DnsTypeNames = map[uint16]string{
+	1:   "A",
+	2:   "NS",
+	5:   "CNAME",
+	6:   "SOA",
+	12:  "PTR",
+	13:  "HINFO",
+	15:  "MX",
+	16:  "TXT",
+	28:  "AAAA",
+	33:  "SRV",
+	35:  "NAPTR",
+	41:  "OPT",
+	43:  "DS",
+	46:  "RRSIG",
+	47:  "NSEC",
+	48:  "DNSKEY",
+	99:  "SPF",
+	252: "AXFR",
+	255: "ANY",
+}
+
+var DnsClassNames = map[uint16]string{
+	1:   "IN",
+	3:   "CH",
+	4:   "HS",
+	255: "ANY",
+}
+
+var DnsRcodeNames = map[uint8]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+	6: "YXDOMAIN",
+	7: "YXRRSET",
+	8: "NXRRSET",
+	9: "NOTAUTH",
+}
+
+var DnsOpcodeNames = map[uint8]string{
+	0: "QUERY",
+	1: "IQUERY",
+	2: "STATUS",
+	4: "NOTIFY",
+	5: "UPDATE",
+}
+
+type DnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type DnsResourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	Ttl   uint32
+	Data  string
+}
+
+type DnsMessage struct {
+	Ts        time.Time
+	Tuple     IpPortTuple
+	Direction uint8
+	Transport string
+	Size      int
+
+	Id                 uint16
+	IsResponse         bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              uint8
+
+	Questions        []DnsQuestion
+	Answers          []DnsResourceRecord
+	AuthoritiesCount int
+	AdditionalsCount int
+}
+
+// Messages received over TCP, they can span several segments.
+type DnsStream struct {
+	tcpStream *TcpStream
+
+	data []byte
+}
+
+type Dns struct {
+	// config
+	Send_request        bool
+	Send_response       bool
+	Transaction_timeout time.Duration
+
+	transactions *IdTransactions
+
+	Publisher *PublisherType
+}
+
+var DnsMod Dns
+
+func init() {
+	RegisterProtocolPlugin("dns", &DnsMod)
+}
+
+func (dns *Dns) InitDefaults() {
+	dns.Send_request = true
+	dns.Send_response = true
+	dns.Transaction_timeout = TransactionTimeout
+}
+
+func (dns *Dns) setFromConfig() error {
+	if _ConfigMeta.IsDefined("protocols", "dns", "send_request") {
+		dns.Send_request = _Config.Protocols["dns"].Send_request
+	}
+	if _ConfigMeta.IsDefined("protocols", "dns", "send_response") {
+		dns.Send_response = _Config.Protocols["dns"].Send_response
+	}
+	timeout, err := configTransactionTimeout("dns")
+	if err != nil {
+		return err
+	}
+	dns.Transaction_timeout = timeout
+	return nil
+}
+
+func (dns *Dns) Init(test_mode bool) error {
+
+	dns.InitDefaults()
+
+	if !test_mode {
+		err := dns.setFromConfig()
+		if err != nil {
+			return err
+		}
+		dns.Publisher = &Publisher
+	}
+
+	dns.transactions = NewIdTransactions(dns.expireTransaction)
+	dns.transactions.Timeout = dns.Transaction_timeout
+
+	return nil
+}
+
+// Reads a possibly compressed domain name at the given offset. Returns
+// the name and the offset following it in the message.
+func dnsReadName(data []byte, offset int) (string, int, error) {
+
+	labels := []string{}
+	end := -1
+	pointers := 0
+
+	for {
+		if offset >= len(data) {
+			return "", 0, MsgError("DNS name out of the message")
+		}
+		length := int(data[offset])
+
+		switch length & 0xc0 {
+		case 0x00:
+			if length == 0 {
+				if end < 0 {
+					end = offset + 1
+				}
+				if len(labels) == 0 {
+					return ".", end, nil
+				}
+				return strings.Join(labels, "."), end, nil
+			}
+			if offset+1+length > len(data) {
+				return "", 0, MsgError("DNS label out of the message")
+			}
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+
+		case 0xc0:
+			if offset+2 > len(data) {
+				return "", 0, MsgError("DNS name pointer out of the message")
+			}
+			pointers += 1
+			if pointers > DnsMaxPointers {
+				return "", 0, MsgError("Too many DNS name pointers")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(Bytes_Ntohs(data[offset:offset+2]) & 0x3fff)
+
+		default:
+			return "", 0, MsgError("Unsupported DNS label type: %x", length)
+		}
+	}
+}
+
+// Formats the data of the common record types, the others are shown in
+// hexadecimal.
+func dnsRecordData(data []byte, offset int, rr *DnsResourceRecord, rdata []byte) (string, error) {
+
+	switch rr.Type {
+	case DnsTypeA:
+		if len(rdata) != net.IPv4len {
+			return "", MsgError("Invalid A record")
+		}
+		return net.IP(rdata).String(), nil
+
+	case DnsTypeAAAA:
+		if len(rdata) != net.IPv6len {
+			return "", MsgError("Invalid AAAA record")
+		}
+		return net.IP(rdata).String(), nil
+
+	case DnsTypeNS, DnsTypeCNAME, DnsTypePTR:
+		name, _, err := dnsReadName(data, offset)
+		return name, err
+
+	case DnsTypeMX:
+		if len(rdata) < 3 {
+			return "", MsgError("Invalid MX record")
+		}
+		name, _, err := dnsReadName(data, offset+2)
+		return fmt.Sprintf("%d %s", Bytes_Ntohs(rdata[0:2]), name), err
+
+	case DnsTypeSRV:
+		if len(rdata) < 7 {
+			return "", MsgError("Invalid SRV record")
+		}
+		name, _, err := dnsReadName(data, offset+6)
+		return fmt.Sprintf("%d %d %d %s", Bytes_Ntohs(rdata[0:2]),
+			Bytes_Ntohs(rdata[2:4]), Bytes_Ntohs(rdata[4:6]), name), err
+
+	case DnsTypeSOA:
+		mname, off, err := dnsReadName(data, offset)
+		if err != nil {
+			return "", err
+		}
+		rname, off, err := dnsReadName(data, off)
+		if err != nil {
+			return "", err
+		}
+		if off+20 > offset+len(rdata) {
+			return "", MsgError("Invalid SOA record")
+		}
+		return fmt.Sprintf("%s %s %d", mname, rname, Bytes_Ntohl(data[off:off+4])), nil
+
+	case DnsTypeTXT:
+		strs := []string{}
+		for i := 0; i < len(rdata); {
+			length := int(rdata[i])
+			if i+1+length > len(rdata) {
+				return "", MsgError("Invalid TXT record")
+			}
+			strs = append(strs, string(rdata[i+1:i+1+length]))
+			i += 1 + length
+		}
+		return strings.Join(strs, " "), nil
+	}
+
+	return fmt.Sprintf("%x", rdata), nil
+}
+
+func dnsReadQuestion(data []byte, offset int) (DnsQuestion, int, error) {
+	var question DnsQuestion
+
+	name, off, err := dnsReadName(data, offset)
+	if err != nil {
+		return question, 0, err
+	}
+	if off+4 > len(data) {
+		return question, 0, MsgError("DNS question out of the message")
+	}
+	question.Name = name
+	question.Type = Bytes_Ntohs(data[off : off+2])
+	question.Class = Bytes_Ntohs(data[off+2 : off+4])
+
+	return question, off + 4, nil
+}
+
+func dnsReadResourceRecord(data []byte, offset int) (DnsResourceRecord, int, error) {
+	var rr DnsResourceRecord
+
+	name, off, err := dnsReadName(data, offset)
+	if err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(data) {
+		return rr, 0, MsgError("DNS resource record out of the message")
+	}
+	rr.Name = name
+	rr.Type = Bytes_Ntohs(data[off : off+2])
+	rr.Class = Bytes_Ntohs(data[off+2 : off+4])
+	rr.Ttl = Bytes_Ntohl(data[off+4 : off+8])
+	length := int(Bytes_Ntohs(data[off+8 : off+10]))
+	off += 10
+	if off+length > len(data) {
+		return rr, 0, MsgError("DNS record data out of the message")
+	}
+
+	rr.Data, err = dnsRecordData(data, off, &rr, data[off:off+length])
+	if err != nil {
+		return rr, 0, err
+	}
+
+	return rr, off + length, nil
+}
+
+// Decodes the header, the questions and the answers of a message. The
+// authority and additional records are only counted.
+func decodeDnsMessage(data []byte) (*DnsMessage, error) {
+
+	if len(data) < DnsHeaderLength {
+		return nil, MsgError("DNS message too short: %d bytes", len(data))
+	}
+
+	m := &DnsMessage{Size: len(data)}
+	m.Id = Bytes_Ntohs(data[0:2])
+	flags := Bytes_Ntohs(data[2:4])
+	m.IsResponse = flags&0x8000 != 0
+	m.Opcode = uint8(flags>>11) & 0x0f
+	m.Authoritative = flags&0x0400 != 0
+	m.Truncated = flags&0x0200 != 0
+	m.RecursionDesired = flags&0x0100 != 0
+	m.RecursionAvailable = flags&0x0080 != 0
+	m.Rcode = uint8(flags & 0x000f)
+
+	qdcount := int(Bytes_Ntohs(data[4:6]))
+	ancount := int(Bytes_Ntohs(data[6:8]))
+	m.AuthoritiesCount = int(Bytes_Ntohs(data[8:10]))
+	m.AdditionalsCount = int(Bytes_Ntohs(data[10:12]))
+
+	offset := DnsHeaderLength
+	for i := 0; i < qdcount; i++ {
+		question, off, err := dnsReadQuestion(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		m.Questions = append(m.Questions, question)
+		offset = off
+	}
+
+	for i := 0; i < ancount; i++ {
+		rr, off, err := dnsReadResourceRecord(data, offset)
+		if err != nil {
+			if m.Truncated {
+				// keep what fits in the truncated message
+				break
+			}
+			return nil, err
+		}
+		m.Answers = append(m.Answers, rr)
+		offset = off
+	}
+
+	return m, nil
+}
+
+func (dns *Dns) ParseUdp(pkt *Packet) {
+	defer RECOVER("ParseDnsUdp exception")
+
+	m, err := decodeDnsMessage(pkt.payload)
+	if err != nil {
+		DEBUG("dns", "Ignoring DNS datagram: %s", err)
+		return
+	}
+
+	m.Ts = pkt.ts
+	m.Tuple = pkt.tuple
+	m.Direction = TcpDirectionOriginal
+	m.Transport = "udp"
+
+	dns.handleDns(m)
+}
+
+func (dns *Dns) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	defer RECOVER("ParseDnsTcp exception")
+
+	stream, _ := tcp.data[dir].(*DnsStream)
+
+	if stream == nil {
+		stream = &DnsStream{tcpStream: tcp, data: pkt.payload}
+		tcp.data[dir] = stream
+	} else {
+		// concatenate bytes
+		stream.data = append(stream.data, pkt.payload...)
+		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
+			DEBUG("dns", "Stream data too large, dropping TCP stream")
+			tcp.data[dir] = nil
+			return
+		}
+	}
+
+	for len(stream.data) >= DnsTcpLengthPrefix {
+		length := int(Bytes_Ntohs(stream.data[0:2]))
+		if len(stream.data) < DnsTcpLengthPrefix+length {
+			// wait for more data
+			break
+		}
+
+		m, err := decodeDnsMessage(stream.data[DnsTcpLengthPrefix : DnsTcpLengthPrefix+length])
+		stream.data = stream.data[DnsTcpLengthPrefix+length:]
+		if err != nil {
+			DEBUG("dns", "Ignoring DNS message: %s", err)
+			continue
+		}
+
+		m.Ts = pkt.ts
+		m.Tuple = *tcp.tuple
+		m.Direction = dir
+		m.Transport = "tcp"
+
+		dns.handleDns(m)
+	}
+}
+
+func (dns *Dns) ReceivedFin(tcp *TcpStream, dir uint8) {
+	// nothing to do, the messages are length delimited
+}
+
+func (dns *Dns) GapInStream(tcp *TcpStream, dir uint8) {
+	// nothing to do, the parser starts over after the gap
+}
+
+func (dns *Dns) ConnectionExpired(tcp *TcpStream) {
+	// nothing to do, the pending queries expire on their own
+}
+
+func (dns *Dns) handleDns(m *DnsMessage) {
+	if !m.IsResponse {
+		dns.transactions.AddRequest(&m.Tuple, m.Direction, uint32(m.Id), m.Ts, m)
+		return
+	}
+
+	trans := dns.transactions.MatchResponse(&m.Tuple, m.Direction, uint32(m.Id), m.Ts)
+	if trans == nil {
+		return
+	}
+	err := dns.publishTransaction(trans, m)
+	if err != nil {
+		WARN("Publish failure: %s", err)
+	}
+}
+
+// Called for the queries left without response.
+func (dns *Dns) expireTransaction(trans *IdTransaction) {
+	err := dns.publishTransaction(trans, nil)
+	if err != nil {
+		WARN("Publish failure: %s", err)
+	}
+}
+
+func dnsName(names map[uint16]string, value uint16) string {
+	if name, exists := names[value]; exists {
+		return name
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+func dnsRcodeName(rcode uint8) string {
+	if name, exists := DnsRcodeNames[rcode]; exists {
+		return name
+	}
+	return fmt.Sprintf("%d", rcode)
+}
+
+func dnsOpcodeName(opcode uint8) string {
+	if name, exists := DnsOpcodeNames[opcode]; exists {
+		return name
+	}
+	return fmt.Sprintf("%d", opcode)
+}
+
+// One record per line, in the zone file format.
+func dnsFormatRecords(records []DnsResourceRecord) string {
+	lines := []string{}
+	for _, rr := range records {
+		lines = append(lines, fmt.Sprintf("%s %d %s %s %s", rr.Name, rr.Ttl,
+			dnsName(DnsClassNames, rr.Class), dnsName(DnsTypeNames, rr.Type), rr.Data))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (dns *Dns) publishTransaction(t *IdTransaction, response *DnsMessage) error {
+
+	if dns.Publisher == nil {
+		return nil
+	}
+
+	event := Event{}
+
+	event.Type = "dns"
+	if response == nil {
+		event.Status = TIMEOUT_STATUS
+	} else if response.Rcode != 0 {
+		event.Status = ERROR_STATUS
+	} else {
+		event.Status = OK_STATUS
+	}
+	event.ResponseTime = t.ResponseTime
+
+	request := t.Data.(*DnsMessage)
+	event.Dns = bson.M{
+		"id":           request.Id,
+		"transport":    request.Transport,
+		"opcode":       dnsOpcodeName(request.Opcode),
+		"request_size": request.Size,
+	}
+	if len(request.Questions) > 0 {
+		question := request.Questions[0]
+		event.Dns["qname"] = question.Name
+		event.Dns["qtype"] = dnsName(DnsTypeNames, question.Type)
+		event.Dns["qclass"] = dnsName(DnsClassNames, question.Class)
+		if dns.Send_request {
+			event.RequestRaw = fmt.Sprintf("%s %s %s", question.Name,
+				dnsName(DnsClassNames, question.Class), dnsName(DnsTypeNames, question.Type))
+		}
+	}
+
+	if response != nil {
+		answers := []bson.M{}
+		for _, rr := range response.Answers {
+			answers = append(answers, bson.M{
+				"name":  rr.Name,
+				"type":  dnsName(DnsTypeNames, rr.Type),
+				"class": dnsName(DnsClassNames, rr.Class),
+				"ttl":   rr.Ttl,
+				"data":  rr.Data,
+			})
+		}
+		event.Dns = bson_concat(event.Dns, bson.M{
+			"rcode":             dnsRcodeName(response.Rcode),
+			"answers":           answers,
+			"answers_count":     len(response.Answers),
+			"authorities_count": response.AuthoritiesCount,
+			"additionals_count": response.AdditionalsCount,
+			"response_size":     response.Size,
+			"flags": bson.M{
+				"authoritative":       response.Authoritative,
+				"truncated":           response.Truncated,
+				"recursion_desired":   response.RecursionDesired,
+				"recursion_available": response.RecursionAvailable,
+			},
+		})
+		if dns.Send_response {
+			event.ResponseRaw = dnsFormatRecords(response.Answers)
+		}
+	}
+
+	return dns.Publisher.PublishEvent(t.Ts, &t.Src, &t.Dst, &event)
+}
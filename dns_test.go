@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func DnsModForTests() (*Dns, *recordingOutput) {
+	var dns Dns
+	dns.Init(true)
+	publisher, output := newRecordingPublisher()
+	dns.Publisher = publisher
+	return &dns, output
+}
+
+func dnsTestPacket(t *testing.T, tuple IpPortTuple, ts time.Time, hexstr string) *Packet {
+	payload, err := hex.DecodeString(hexstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Packet{ts: ts, tuple: tuple, payload: payload}
+}
+
+func TestDns_readName(t *testing.T) {
+
+	// www.example.com followed by a pointer to example.com
+	data, _ := hex.DecodeString("03777777076578616d706c6503636f6d0003617069c004")
+
+	name, off, err := dnsReadName(data, 0)
+	if err != nil || name != "www.example.com" || off != 17 {
+		t.Errorf("Wrong name: %s %d %v", name, off, err)
+	}
+	name, off, err = dnsReadName(data, 17)
+	if err != nil || name != "api.example.com" || off != 23 {
+		t.Errorf("Wrong name: %s %d %v", name, off, err)
+	}
+
+	// pointer to itself
+	data, _ = hex.DecodeString("c000")
+	if _, _, err = dnsReadName(data, 0); err == nil {
+		t.Errorf("Expected an error for a pointer loop")
+	}
+}
+
+func TestDns_udpTransaction(t *testing.T) {
+
+	dns, output := DnsModForTests()
+
+	query := NewIpPortTuple(4, net.IPv4(192, 168, 0, 1), 34567, net.IPv4(192, 168, 0, 53), 53)
+	response := NewIpPortTuple(4, net.IPv4(192, 168, 0, 53), 53, net.IPv4(192, 168, 0, 1), 34567)
+	ts := time.Now()
+
+	// www.example.com IN A
+	dns.ParseUdp(dnsTestPacket(t, query, ts,
+		"12340100000100000000000003777777076578616d706c6503636f6d0000010001"))
+
+	// CNAME web.example.com and its A record
+	dns.ParseUdp(dnsTestPacket(t, response, ts.Add(15*time.Millisecond),
+		"12348180000100020000000003777777076578616d706c6503636f6d0000010001c00c00"+
+			"0500010000012c000603776562c010c02d000100010000003c00045db8d822"))
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Type != "dns" || event.Status != OK_STATUS || event.ResponseTime != 15 {
+		t.Errorf("Wrong event: %v", event)
+	}
+	if event.Src_port != 34567 || event.Dst_port != 53 {
+		t.Errorf("Wrong endpoints: %d -> %d", event.Src_port, event.Dst_port)
+	}
+	if event.Dns["qname"] != "www.example.com" || event.Dns["qtype"] != "A" ||
+		event.Dns["rcode"] != "NOERROR" || event.Dns["transport"] != "udp" ||
+		event.Dns["answers_count"] != 2 {
+
+		t.Errorf("Wrong DNS fields: %v", event.Dns)
+	}
+	answers := event.Dns["answers"].([]bson.M)
+	if answers[0]["type"] != "CNAME" || answers[0]["data"] != "web.example.com" ||
+		answers[1]["name"] != "web.example.com" || answers[1]["data"] != "93.184.216.34" ||
+		answers[1]["ttl"] != uint32(60) {
+
+		t.Errorf("Wrong answers: %v", answers)
+	}
+	if event.RequestRaw != "www.example.com IN A" {
+		t.Errorf("Wrong raw request: %q", event.RequestRaw)
+	}
+	if event.ResponseRaw != "www.example.com 300 IN CNAME web.example.com\n"+
+		"web.example.com 60 IN A 93.184.216.34" {
+
+		t.Errorf("Wrong raw response: %q", event.ResponseRaw)
+	}
+	if dns.transactions.Pending() != 0 {
+		t.Errorf("Transaction not removed")
+	}
+}
+
+func TestDns_tcpNxdomain(t *testing.T) {
+
+	dns, output := DnsModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// nope.example.com IN MX, split in two segments
+	payload, _ := hex.DecodeString("0022beef01000001000000000000046e6f7065076578616d706c6503636f6d00000f0001")
+	dns.Parse(&Packet{ts: time.Now(), payload: payload[:10]}, &tcp, 0)
+	dns.Parse(&Packet{ts: time.Now(), payload: payload[10:]}, &tcp, 0)
+
+	// NXDOMAIN with the SOA of the zone in the authority section
+	payload, _ = hex.DecodeString("004fbeef81830001000000010000046e6f7065076578616d706c6503636f6d00000f00" +
+		"01c01100060001000003840021026e73c0110561646d696ec011000007e8000000010000" +
+		"00020000000300000004")
+	dns.Parse(&Packet{ts: time.Now(), payload: payload}, &tcp, 1)
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != ERROR_STATUS || event.Dns["rcode"] != "NXDOMAIN" ||
+		event.Dns["qtype"] != "MX" || event.Dns["transport"] != "tcp" ||
+		event.Dns["answers_count"] != 0 || event.Dns["authorities_count"] != 1 {
+
+		t.Errorf("Wrong DNS fields: %v", event.Dns)
+	}
+}
+
+func TestDns_unmatchedResponse(t *testing.T) {
+
+	dns, output := DnsModForTests()
+
+	response := NewIpPortTuple(4, net.IPv4(192, 168, 0, 53), 53, net.IPv4(192, 168, 0, 1), 34567)
+	dns.ParseUdp(dnsTestPacket(t, response, time.Now(),
+		"12348180000100000000000003777777076578616d706c6503636f6d0000010001"))
+
+	if len(output.events) != 0 {
+		t.Errorf("Unexpected event for a response without query")
+	}
+}
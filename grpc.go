@@ -0,0 +1,442 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Length of the prefix of each gRPC message: the compressed flag and
+// the message length.
+const GrpcMessagePrefixLength = 5
+
+// Names of the gRPC status codes
+var GrpcStatusNames = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// Counts the length prefixed messages sent in one direction of a call.
+// They can span several DATA frames.
+type GrpcMessages struct {
+	Count int
+	Bytes int
+
+	// prefix of the current message, while incomplete
+	prefix []byte
+	// bytes of the current message not received yet
+	remaining int
+}
+
+// A gRPC call, carried by one HTTP/2 stream.
+type GrpcCall struct {
+	tuple        TcpTuple
+	Src          Endpoint
+	Dst          Endpoint
+	ResponseTime int32
+	ts           time.Time
+
+	Path        string
+	Service     string
+	Method      string
+	Authority   string
+	ContentType string
+	Encoding    string
+
+	HttpStatus int
+	HasStatus  bool
+	StatusCode int
+	Message    string
+
+	Request  GrpcMessages
+	Response GrpcMessages
+
+	Reset     bool
+	ResetCode uint32
+
+	timer    *time.Timer
+	timedOut bool
+	done     bool
+}
+
+type Grpc struct {
+	// config
+	Send_request  bool
+	Send_response bool
+
+	Publisher *PublisherType
+}
+
+var GrpcMod Grpc
+
+func init() {
+	RegisterProtocolPlugin("grpc", &GrpcMod)
+}
+
+func (grpc *Grpc) InitDefaults() {
+	grpc.Send_request = true
+	grpc.Send_response = true
+}
+
+func (grpc *Grpc) setFromConfig() error {
+	if _ConfigMeta.IsDefined("protocols", "grpc", "send_request") {
+		grpc.Send_request = _Config.Protocols["grpc"].Send_request
+	}
+	if _ConfigMeta.IsDefined("protocols", "grpc", "send_response") {
+		grpc.Send_response = _Config.Protocols["grpc"].Send_response
+	}
+	return nil
+}
+
+func (grpc *Grpc) Init(test_mode bool) error {
+
+	grpc.InitDefaults()
+
+	if !test_mode {
+		err := grpc.setFromConfig()
+		if err != nil {
+			return err
+		}
+		grpc.Publisher = &Publisher
+	}
+
+	return nil
+}
+
+// The connection is followed from the client preface, the data seen
+// before it can't be decoded.
+func (grpc *Grpc) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	defer RECOVER("ParseGrpc exception")
+
+	if framer, ok := tcp.data[dir].(*Http2Framer); ok {
+		framer.parse(pkt.payload, pkt.ts)
+		return
+	}
+
+	if !http2HasPreface(pkt.payload) {
+		DEBUG("grpc", "No HTTP/2 connection preface, ignoring the segment")
+		return
+	}
+	conn := newHttp2Connection(tcp, dir, grpc)
+	conn.framer(dir).parse(pkt.payload, pkt.ts)
+}
+
+func (grpc *Grpc) ReceivedFin(tcp *TcpStream, dir uint8) {
+	// nothing to do, the calls end with their trailers
+}
+
+func (grpc *Grpc) GapInStream(tcp *TcpStream, dir uint8) {
+	if framer, ok := tcp.data[dir].(*Http2Framer); ok {
+		// the header compression state is lost
+		framer.conn.broken = true
+	}
+}
+
+func (grpc *Grpc) ConnectionExpired(tcp *TcpStream) {
+	// nothing to do, the pending calls expire on their own
+}
+
+// Splits a path of the form /package.Service/Method.
+func grpcSplitPath(path string) (service string, method string) {
+	if !strings.HasPrefix(path, "/") {
+		return "", ""
+	}
+	slash := strings.LastIndex(path, "/")
+	if slash == 0 {
+		return "", ""
+	}
+	return path[1:slash], path[slash+1:]
+}
+
+// Decodes the percent encoding of the grpc-message trailer. Invalid
+// sequences are kept as they are.
+func grpcDecodeMessage(value string) string {
+	if strings.IndexByte(value, '%') < 0 {
+		return value
+	}
+	decoded := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) {
+			b, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+			if err == nil {
+				decoded = append(decoded, byte(b))
+				i += 2
+				continue
+			}
+		}
+		decoded = append(decoded, value[i])
+	}
+	return string(decoded)
+}
+
+func grpcStatusName(code int) string {
+	if code >= 0 && code < len(GrpcStatusNames) {
+		return GrpcStatusNames[code]
+	}
+	return "UNKNOWN"
+}
+
+// Adds the data of a DATA frame, counting the messages as their
+// prefix is complete.
+func (messages *GrpcMessages) add(data []byte) {
+	for len(data) > 0 {
+		if messages.remaining > 0 {
+			n := messages.remaining
+			if n > len(data) {
+				n = len(data)
+			}
+			messages.remaining -= n
+			data = data[n:]
+			continue
+		}
+
+		n := GrpcMessagePrefixLength - len(messages.prefix)
+		if n > len(data) {
+			n = len(data)
+		}
+		messages.prefix = append(messages.prefix, data[:n]...)
+		data = data[n:]
+		if len(messages.prefix) < GrpcMessagePrefixLength {
+			return
+		}
+
+		length := int(Bytes_Ntohl(messages.prefix[1:5]))
+		messages.Count += 1
+		messages.Bytes += length
+		messages.remaining = length
+		messages.prefix = nil
+	}
+}
+
+func grpcCallOf(st *Http2Stream) *GrpcCall {
+	call, _ := st.data.(*GrpcCall)
+	return call
+}
+
+func (grpc *Grpc) newCall(conn *Http2Connection, fields []hpackField, ts time.Time) *GrpcCall {
+
+	tcp := conn.tcpStream
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	cmdline := procWatcher.FindProcessesTuple(tcp.tuple)
+
+	call := &GrpcCall{tuple: tuple, ts: ts}
+	call.Src = Endpoint{
+		Ip:   tuple.Src_ip.String(),
+		Port: tuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	call.Dst = Endpoint{
+		Ip:   tuple.Dst_ip.String(),
+		Port: tuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+	if conn.clientDir == TcpDirectionReverse {
+		call.Src, call.Dst = call.Dst, call.Src
+	}
+
+	for _, field := range fields {
+		switch field.name {
+		case ":path":
+			call.Path = field.value
+		case ":authority":
+			call.Authority = field.value
+		case "content-type":
+			call.ContentType = field.value
+		case "grpc-encoding":
+			call.Encoding = field.value
+		}
+	}
+	call.Service, call.Method = grpcSplitPath(call.Path)
+
+	DEBUG("grpc", "gRPC call %s", call.Path)
+
+	call.timer = time.AfterFunc(TransactionTimeout, func() { grpc.expireCall(call) })
+
+	return call
+}
+
+func (grpc *Grpc) http2Headers(conn *Http2Connection, st *Http2Stream, fromClient bool,
+	fields []hpackField, endStream bool, ts time.Time) {
+
+	call := grpcCallOf(st)
+
+	if fromClient {
+		if call == nil {
+			st.data = grpc.newCall(conn, fields, ts)
+		}
+		return
+	}
+
+	if call == nil {
+		return
+	}
+
+	// the status can come in the response headers when there are no
+	// messages (trailers only) or in the trailers
+	if status, exists := http2HeaderValue(fields, ":status"); exists {
+		call.HttpStatus, _ = strconv.Atoi(status)
+	}
+	if status, exists := http2HeaderValue(fields, "grpc-status"); exists {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			DEBUG("grpc", "Invalid grpc-status: %s", status)
+			code = 2 // UNKNOWN
+		}
+		call.HasStatus = true
+		call.StatusCode = code
+	}
+	if message, exists := http2HeaderValue(fields, "grpc-message"); exists {
+		call.Message = grpcDecodeMessage(message)
+	}
+
+	if endStream {
+		grpc.callDone(call, ts)
+	}
+}
+
+func (grpc *Grpc) http2Data(conn *Http2Connection, st *Http2Stream, fromClient bool,
+	data []byte, endStream bool, ts time.Time) {
+
+	call := grpcCallOf(st)
+	if call == nil {
+		return
+	}
+
+	if fromClient {
+		call.Request.add(data)
+		return
+	}
+
+	call.Response.add(data)
+	if endStream {
+		// ended without trailers, so without status
+		grpc.callDone(call, ts)
+	}
+}
+
+func (grpc *Grpc) http2Reset(conn *Http2Connection, st *Http2Stream, errorCode uint32,
+	ts time.Time) {
+
+	call := grpcCallOf(st)
+	if call == nil {
+		return
+	}
+	call.Reset = true
+	call.ResetCode = errorCode
+	grpc.callDone(call, ts)
+}
+
+func (grpc *Grpc) callDone(call *GrpcCall, ts time.Time) {
+	if call.done {
+		return
+	}
+	call.done = true
+	if call.timer != nil {
+		call.timer.Stop()
+	}
+
+	call.ResponseTime = int32(ts.Sub(call.ts).Nanoseconds() / 1e6)
+
+	err := grpc.publishCall(call)
+	if err != nil {
+		WARN("Publish failure: %s", err)
+	}
+}
+
+func (grpc *Grpc) expireCall(call *GrpcCall) {
+	if call.done {
+		return
+	}
+	call.done = true
+	call.timedOut = true
+	call.ResponseTime = TimeoutResponseTime
+
+	err := grpc.publishCall(call)
+	if err != nil {
+		WARN("Publish failure: %s", err)
+	}
+}
+
+func (grpc *Grpc) publishCall(call *GrpcCall) error {
+
+	if grpc.Publisher == nil {
+		return nil
+	}
+
+	event := Event{}
+
+	event.Type = "grpc"
+	if call.timedOut {
+		event.Status = TIMEOUT_STATUS
+	} else if call.HasStatus && call.StatusCode == 0 && !call.Reset {
+		event.Status = OK_STATUS
+	} else {
+		event.Status = ERROR_STATUS
+	}
+	event.ResponseTime = call.ResponseTime
+
+	event.Grpc = bson.M{
+		"path":    call.Path,
+		"service": call.Service,
+		"method":  call.Method,
+		"request": bson.M{
+			"messages": call.Request.Count,
+			"bytes":    call.Request.Bytes,
+		},
+		"response": bson.M{
+			"messages": call.Response.Count,
+			"bytes":    call.Response.Bytes,
+		},
+	}
+	if call.Authority != "" {
+		event.Grpc["authority"] = call.Authority
+	}
+	if call.ContentType != "" {
+		event.Grpc["content_type"] = call.ContentType
+	}
+	if call.Encoding != "" {
+		event.Grpc["encoding"] = call.Encoding
+	}
+	if call.HttpStatus != 0 {
+		event.Grpc["http_status"] = call.HttpStatus
+	}
+	if call.HasStatus {
+		event.Grpc["status_code"] = call.StatusCode
+		event.Grpc["status"] = grpcStatusName(call.StatusCode)
+	}
+	if call.Message != "" {
+		event.Grpc["message"] = call.Message
+	}
+	if call.Reset {
+		event.Grpc["reset_code"] = call.ResetCode
+	}
+
+	if grpc.Send_request {
+		event.RequestRaw = call.Path
+	}
+	if grpc.Send_response && call.HasStatus {
+		event.ResponseRaw = grpcStatusName(call.StatusCode)
+		if call.Message != "" {
+			event.ResponseRaw += ": " + call.Message
+		}
+	}
+
+	return grpc.Publisher.PublishEvent(call.ts, &call.Src, &call.Dst, &event)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func GrpcModForTests() (*Grpc, *recordingOutput) {
+	var grpc Grpc
+	grpc.Init(true)
+	publisher, output := newRecordingPublisher()
+	grpc.Publisher = publisher
+	return &grpc, output
+}
+
+func parseGrpcHexPayload(t *testing.T, grpc *Grpc, tcp *TcpStream, dir uint8, hexstr string) {
+	payload, err := hex.DecodeString(hexstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpc.Parse(&Packet{ts: time.Now(), payload: payload}, tcp, dir)
+}
+
+func TestGrpc_splitPath(t *testing.T) {
+	service, method := grpcSplitPath("/helloworld.Greeter/SayHello")
+	if service != "helloworld.Greeter" || method != "SayHello" {
+		t.Errorf("Wrong service and method: %s %s", service, method)
+	}
+	service, method = grpcSplitPath("/SayHello")
+	if service != "" || method != "" {
+		t.Errorf("Wrong service and method: %s %s", service, method)
+	}
+}
+
+func TestGrpc_decodeMessage(t *testing.T) {
+	if msg := grpcDecodeMessage("not%20found%"); msg != "not found%" {
+		t.Errorf("Wrong message: %q", msg)
+	}
+}
+
+func TestGrpc_unaryCall(t *testing.T) {
+
+	grpc, output := GrpcModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// preface, SETTINGS, POST /helloworld.Greeter/SayHello and a 7
+	// bytes message
+	parseGrpcHexPayload(t, grpc, &tcp, 0, "505249202a20485454502f322e300d0a0d0a534d0d0a0d0a00000004000000000000006b"+
+		"0104000000010085b9495339e484d7ab76ff0085b8824e5a4b839d29af0084b958d33f95"+
+		"6272d141fc1eca245f15852a4b631b87eb1968a0ff0088b83b5339ec327d7f8ba0e41d13"+
+		"9d09b8d800d87f008921ea496a4ac9f5597f8b1d75d0620d263d4c4d65640082497f864d"+
+		"833505b11f00000c00010000000100000000070a0a0a0a0a0a0a")
+
+	// SETTINGS, response headers, a 10 bytes message and grpc-status 0
+	parseGrpcHexPayload(t, grpc, &tcp, 1, "0000000400000000000000210104000000010085b8848d36a3821001008921ea496a4ac9"+
+		"f5597f8b1d75d0620d263d4c4d656400000f000000000001000000000a0a0a0a0a0a0a0a"+
+		"0a0a0a00000c01050000000100889acac8b21234da8f8107")
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Type != "grpc" || event.Status != OK_STATUS {
+		t.Errorf("Wrong event: %v", event)
+	}
+	call := event.Grpc
+	if call["service"] != "helloworld.Greeter" || call["method"] != "SayHello" ||
+		call["status_code"] != 0 || call["status"] != "OK" || call["http_status"] != 200 ||
+		call["authority"] != "localhost:50051" {
+
+		t.Errorf("Wrong call: %v", call)
+	}
+	request := call["request"].(bson.M)
+	response := call["response"].(bson.M)
+	if request["messages"] != 1 || request["bytes"] != 7 ||
+		response["messages"] != 1 || response["bytes"] != 10 {
+
+		t.Errorf("Wrong message counts: %v %v", request, response)
+	}
+	if event.RequestRaw != "/helloworld.Greeter/SayHello" || event.ResponseRaw != "OK" {
+		t.Errorf("Wrong raw messages: %q %q", event.RequestRaw, event.ResponseRaw)
+	}
+}
+
+func TestGrpc_streamingError(t *testing.T) {
+
+	grpc, output := GrpcModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// two messages of 3 and 20 bytes, the second split over two DATA
+	// frames
+	parseGrpcHexPayload(t, grpc, &tcp, 0, "505249202a20485454502f322e300d0a0d0a534d0d0a0d0a00000004000000000000006e"+
+		"0104000000010085b9495339e484d7ab76ff0085b8824e5a4b839d29af0084b958d33f98"+
+		"62c3da92cd69a42afb4f6a4b8ad34856369487b24da7b5250088b83b5339ec327d7f8ba0"+
+		"e41d139d09b8d800d87f008921ea496a4ac9f5597f8b1d75d0620d263d4c4d6564008249"+
+		"7f864d833505b11f00000a00000000000100000000030a0a0a0000000017000100000001"+
+		"0000140a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a")
+
+	// trailers only: grpc-status 5, grpc-message "feature not%20found"
+	parseGrpcHexPayload(t, grpc, &tcp, 1, "0000000400000000000000470105000000010085b8848d36a3821001008921ea496a4ac9"+
+		"f5597f8b1d75d0620d263d4c4d656400889acac8b21234da8f816f00899acac8b5254207"+
+		"317f8e94a34db6154a8e9544094f6d527f")
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	call := event.Grpc
+	if event.Status != ERROR_STATUS || call["status_code"] != 5 || call["status"] != "NOT_FOUND" ||
+		call["message"] != "feature not found" || call["method"] != "RecordRoute" {
+
+		t.Errorf("Wrong call: %v", call)
+	}
+	request := call["request"].(bson.M)
+	response := call["response"].(bson.M)
+	if request["messages"] != 2 || request["bytes"] != 23 || response["messages"] != 0 {
+		t.Errorf("Wrong message counts: %v %v", request, response)
+	}
+	if event.ResponseRaw != "NOT_FOUND: feature not found" {
+		t.Errorf("Wrong raw response: %q", event.ResponseRaw)
+	}
+}
+
+func TestGrpc_reset(t *testing.T) {
+
+	grpc, output := GrpcModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// the client cancels the call with RST_STREAM
+	parseGrpcHexPayload(t, grpc, &tcp, 0, "505249202a20485454502f322e300d0a0d0a534d0d0a0d0a00000004000000000000006b"+
+		"0104000000010085b9495339e484d7ab76ff0085b8824e5a4b839d29af0084b958d33f95"+
+		"6272d141fc1eca245f15852a4b631b87eb1968a0ff0088b83b5339ec327d7f8ba0e41d13"+
+		"9d09b8d800d87f008921ea496a4ac9f5597f8b1d75d0620d263d4c4d65640082497f864d"+
+		"833505b11f00000403000000000100000008")
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != ERROR_STATUS || event.Grpc["reset_code"] != uint32(8) {
+		t.Errorf("Wrong event: %v %v", event.Status, event.Grpc)
+	}
+	if _, exists := event.Grpc["status_code"]; exists {
+		t.Errorf("Unexpected status: %v", event.Grpc)
+	}
+}
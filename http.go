@@ -28,6 +28,7 @@ type HttpMessage struct {
 	version_major    uint8
 	version_minor    uint8
 	connection       string
+	upgrade          string
 	chunked_length   int
 	chunked_body     []byte
 
@@ -83,7 +84,12 @@ type HttpTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer     *time.Timer
+	timedOut  bool
+	lostInGap bool
+
+	// HTTP/2 stream reset by RST_STREAM
+	reset bool
 }
 
 type Http struct {
@@ -96,7 +102,9 @@ type Http struct {
 	Split_cookie      bool
 	Real_ip_header    string
 
-	transactionsMap map[HashableTcpTuple]*HttpTransaction
+	// pending transactions per connection, in the order of the
+	// requests. Pipelined responses come in the same order.
+	transactionsMap map[HashableTcpTuple][]*HttpTransaction
 
 	Publisher *PublisherType
 }
@@ -111,6 +119,10 @@ type tomlHttp struct {
 
 var HttpMod Http
 
+func init() {
+	RegisterProtocolPlugin("http", &HttpMod)
+}
+
 func (http *Http) InitDefaults() {
 	http.Send_request = true
 	http.Send_response = true
@@ -156,7 +168,7 @@ func (http *Http) Init(test_mode bool) error {
 		}
 	}
 
-	http.transactionsMap = make(map[HashableTcpTuple]*HttpTransaction, TransactionsHashSize)
+	http.transactionsMap = make(map[HashableTcpTuple][]*HttpTransaction, TransactionsHashSize)
 
 	if !test_mode {
 		http.Publisher = &Publisher
@@ -196,9 +208,6 @@ func parseResponseStatus(s []byte) (uint16, string, error) {
 }
 
 func (http *Http) parseHeader(m *HttpMessage, data []byte) (bool, bool, int) {
-	if m.Headers == nil {
-		m.Headers = make(map[string]string)
-	}
 	i := bytes.Index(data, []byte(":"))
 	if i == -1 {
 		// Expected \":\" in headers. Assuming incomplete"
@@ -224,33 +233,7 @@ func (http *Http) parseHeader(m *HttpMessage, data []byte) (bool, bool, int) {
 			headerVal := string(bytes.Trim(data[i+1:p], " \t"))
 			DEBUG("http", "Header: '%s' Value: '%s'\n", headerName, headerVal)
 
-			// Headers we need for parsing. Make sure we always
-			// capture their value
-			if headerName == "content-length" {
-				m.ContentLength, _ = strconv.Atoi(headerVal)
-				m.hasContentLength = true
-			} else if headerName == "transfer-encoding" {
-				m.TransferEncoding = headerVal
-			} else if headerName == "connection" {
-				m.connection = headerVal
-			}
-			if len(http.Real_ip_header) > 0 && headerName == http.Real_ip_header {
-				m.Real_ip = headerVal
-			}
-
-			if http.Send_headers {
-				if !http.Send_all_headers {
-					_, exists := http.Headers_whitelist[headerName]
-					if !exists {
-						return true, true, p + 2
-					}
-				}
-				if val, ok := m.Headers[headerName]; ok {
-					m.Headers[headerName] = val + ", " + headerVal
-				} else {
-					m.Headers[headerName] = headerVal
-				}
-			}
+			http.addHeader(m, headerName, headerVal)
 
 			return true, true, p + 2
 		}
@@ -259,6 +242,43 @@ func (http *Http) parseHeader(m *HttpMessage, data []byte) (bool, bool, int) {
 	return true, false, len(data)
 }
 
+// Records a header of the message. The header name is in lower case.
+func (http *Http) addHeader(m *HttpMessage, headerName string, headerVal string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+
+	// Headers we need for parsing. Make sure we always
+	// capture their value
+	if headerName == "content-length" {
+		m.ContentLength, _ = strconv.Atoi(headerVal)
+		m.hasContentLength = true
+	} else if headerName == "transfer-encoding" {
+		m.TransferEncoding = headerVal
+	} else if headerName == "connection" {
+		m.connection = headerVal
+	} else if headerName == "upgrade" {
+		m.upgrade = headerVal
+	}
+	if len(http.Real_ip_header) > 0 && headerName == http.Real_ip_header {
+		m.Real_ip = headerVal
+	}
+
+	if http.Send_headers {
+		if !http.Send_all_headers {
+			_, exists := http.Headers_whitelist[headerName]
+			if !exists {
+				return
+			}
+		}
+		if val, ok := m.Headers[headerName]; ok {
+			m.Headers[headerName] = val + ", " + headerVal
+		} else {
+			m.Headers[headerName] = headerVal
+		}
+	}
+}
+
 func (http *Http) messageParser(s *HttpStream) (bool, bool) {
 
 	var cont, ok, complete bool
@@ -496,23 +516,36 @@ func (http *Http) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
 
 	DEBUG("httpdetailed", "Payload received: [%s]", pkt.payload)
 
-	if tcp.httpData[dir] == nil {
-		tcp.httpData[dir] = &HttpStream{
+	if framer, ok := tcp.data[dir].(*Http2Framer); ok {
+		framer.parse(pkt.payload, pkt.ts)
+		return
+	}
+
+	stream, _ := tcp.data[dir].(*HttpStream)
+
+	if stream == nil {
+		if http2HasPreface(pkt.payload) {
+			// HTTP/2 with prior knowledge
+			conn := http.startHttp2(tcp, dir)
+			conn.framer(dir).parse(pkt.payload, pkt.ts)
+			conn.framer(1 - dir).parseFrames(pkt.ts)
+			return
+		}
+		stream = &HttpStream{
 			tcpStream: tcp,
 			data:      pkt.payload,
 			message:   &HttpMessage{Ts: pkt.ts},
 		}
-
+		tcp.data[dir] = stream
 	} else {
 		// concatenate bytes
-		tcp.httpData[dir].data = append(tcp.httpData[dir].data, pkt.payload...)
-		if len(tcp.httpData[dir].data) > TCP_MAX_DATA_IN_STREAM {
+		stream.data = append(stream.data, pkt.payload...)
+		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
 			DEBUG("http", "Stream data too large, dropping TCP stream")
-			tcp.httpData[dir] = nil
+			tcp.data[dir] = nil
 			return
 		}
 	}
-	stream := tcp.httpData[dir]
 	if stream.message == nil {
 		stream.message = &HttpMessage{Ts: pkt.ts}
 	}
@@ -521,11 +554,18 @@ func (http *Http) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
 	if !ok {
 		// drop this tcp stream. Will retry parsing with the next
 		// segment in it
-		tcp.httpData[dir] = nil
+		tcp.data[dir] = nil
 		return
 	}
 
 	if complete {
+		if !stream.message.IsRequest && stream.message.StatusCode == 101 &&
+			strings.ToLower(stream.message.upgrade) == "h2c" {
+
+			http.upgradeToHttp2(tcp, dir, stream)
+			return
+		}
+
 		// all ok, ship it
 		msg := stream.data[stream.message.start:stream.message.end]
 		censorPasswords(stream.message, msg)
@@ -538,12 +578,11 @@ func (http *Http) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
 }
 
 func (http *Http) ReceivedFin(tcp *TcpStream, dir uint8) {
-	if tcp.httpData[dir] == nil {
+	stream, _ := tcp.data[dir].(*HttpStream)
+	if stream == nil {
 		return
 	}
 
-	stream := tcp.httpData[dir]
-
 	// send whatever data we got so far as complete. This
 	// is needed for the HTTP/1.0 without Content-Length situation.
 	if stream.message != nil &&
@@ -561,6 +600,81 @@ func (http *Http) ReceivedFin(tcp *TcpStream, dir uint8) {
 	}
 }
 
+func (http *Http) GapInStream(tcp *TcpStream, dir uint8) {
+	// the HTTP/1 parser starts over after the gap, but HTTP/2 can't
+	// decode the headers anymore
+	if framer, ok := tcp.data[dir].(*Http2Framer); ok {
+		framer.conn.broken = true
+		return
+	}
+
+	// the responses are matched to the requests by their order, which
+	// is lost if one of them was in the gap
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	pending := http.transactionsMap[tuple.raw]
+	delete(http.transactionsMap, tuple.raw)
+	for _, trans := range pending {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		if len(trans.Http) != 0 {
+			trans.lostInGap = true
+			err := http.PublishTransaction(trans)
+			if err != nil {
+				WARN("Publish failure: %s", err)
+			}
+			DEBUG("http", "HTTP response lost in a gap: %s", trans.Http["request"])
+		}
+	}
+}
+
+func (http *Http) ConnectionExpired(tcp *TcpStream) {
+	// nothing to do, the pending transactions expire on their own
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("HEAD "), []byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "),
+	[]byte("CONNECT "),
+}
+
+// Recognizes the first line of an HTTP request or response, or the
+// HTTP/2 connection preface.
+func (http *Http) Detect(data []byte) int {
+
+	if http2HasPreface(data) {
+		if len(data) >= len(http2Preface) {
+			return DetectionScoreCertain
+		}
+		return 50
+	}
+
+	if bytes.HasPrefix(data, []byte("HTTP/1.")) {
+		if len(data) >= 13 && data[8] == ' ' &&
+			data[9] >= '1' && data[9] <= '5' {
+			return DetectionScoreCertain
+		}
+		return 50
+	}
+
+	for _, method := range httpMethods {
+		if !bytes.HasPrefix(data, method) {
+			continue
+		}
+		i := bytes.Index(data, []byte("\r\n"))
+		if i == -1 {
+			// first line not complete yet
+			return 50
+		}
+		if bytes.HasSuffix(data[:i], []byte(" HTTP/1.0")) ||
+			bytes.HasSuffix(data[:i], []byte(" HTTP/1.1")) {
+			return DetectionScoreCertain
+		}
+		return 0
+	}
+	return 0
+}
+
 func (http *Http) handleHttp(m *HttpMessage, tcp *TcpStream,
 	dir uint8, raw_msg []byte) {
 
@@ -578,17 +692,18 @@ func (http *Http) handleHttp(m *HttpMessage, tcp *TcpStream,
 
 func (http *Http) receivedHttpRequest(msg *HttpMessage) {
 
-	trans := http.transactionsMap[msg.TcpTuple.raw]
-	if trans != nil {
-		if len(trans.Http) != 0 {
-			WARN("Two requests without a response. Dropping old request")
-		}
-	} else {
-		trans = &HttpTransaction{Type: "http", tuple: msg.TcpTuple}
-		http.transactionsMap[msg.TcpTuple.raw] = trans
-	}
+	trans := http.newTransaction(msg)
+	http.transactionsMap[msg.TcpTuple.raw] = append(http.transactionsMap[msg.TcpTuple.raw], trans)
+
+	DEBUG("http", "Received request with tuple: %s (%d pending)", msg.TcpTuple,
+		len(http.transactionsMap[msg.TcpTuple.raw]))
+}
 
-	DEBUG("http", "Received request with tuple: %s", msg.TcpTuple)
+// Creates the transaction of a request, it expires if no response
+// completes it in time.
+func (http *Http) newTransaction(msg *HttpMessage) *HttpTransaction {
+
+	trans := &HttpTransaction{Type: "http", tuple: msg.TcpTuple}
 
 	trans.ts = msg.Ts
 	trans.Ts = int64(trans.ts.UnixNano() / 1000)
@@ -648,11 +763,44 @@ func (http *Http) receivedHttpRequest(msg *HttpMessage) {
 	}
 	trans.timer = time.AfterFunc(TransactionTimeout, func() { http.expireTransaction(trans) })
 
+	return trans
 }
 
 func (http *Http) expireTransaction(trans *HttpTransaction) {
+
+	if len(trans.Http) != 0 {
+		// the request never got a response
+		trans.timedOut = true
+		trans.ResponseTime = TimeoutResponseTime
+
+		err := http.PublishTransaction(trans)
+		if err != nil {
+			WARN("Publish failure: %s", err)
+		}
+		DEBUG("http", "HTTP transaction timed out: %s", trans.Http["request"])
+	}
+
 	// remove from map
-	delete(http.transactionsMap, trans.tuple.raw)
+	for i, t := range http.transactionsMap[trans.tuple.raw] {
+		if t == trans {
+			http.removeTransaction(trans.tuple, i)
+			break
+		}
+	}
+}
+
+func (http *Http) removeTransaction(tuple TcpTuple, index int) *HttpTransaction {
+
+	trans_list := http.transactionsMap[tuple.raw]
+	trans := trans_list[index]
+	trans_list = append(trans_list[:index], trans_list[index+1:]...)
+	if len(trans_list) == 0 {
+		delete(http.transactionsMap, tuple.raw)
+	} else {
+		http.transactionsMap[tuple.raw] = trans_list
+	}
+
+	return trans
 }
 
 func (http *Http) receivedHttpResponse(msg *HttpMessage) {
@@ -662,17 +810,25 @@ func (http *Http) receivedHttpResponse(msg *HttpMessage) {
 
 	DEBUG("http", "Received response with tuple: %s", tuple)
 
-	trans := http.transactionsMap[tuple.raw]
-	if trans == nil {
+	if len(http.transactionsMap[tuple.raw]) == 0 {
 		WARN("Response from unknown transaction. Ignoring: %v", tuple)
 		return
 	}
 
+	// the responses come in the order of the requests
+	trans := http.removeTransaction(tuple, 0)
+
 	if len(trans.Http) == 0 {
 		WARN("Response without a known request. Ignoring.")
 		return
 	}
 
+	http.completeTransaction(trans, msg)
+}
+
+// Adds the response to the transaction and publishes it.
+func (http *Http) completeTransaction(trans *HttpTransaction, msg *HttpMessage) {
+
 	response := bson.M{
 		"phrase": msg.StatusPhrase,
 		"code":   msg.StatusCode,
@@ -716,8 +872,6 @@ func (http *Http) receivedHttpResponse(msg *HttpMessage) {
 	DEBUG("http", "HTTP transaction completed: %s -> %s\n", trans.Http["request"],
 		trans.Http["response"])
 
-	// remove from map
-	delete(http.transactionsMap, trans.tuple.raw)
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
@@ -732,12 +886,20 @@ func (http *Http) PublishTransaction(t *HttpTransaction) error {
 	event := Event{}
 
 	event.Type = "http"
-	response := t.Http["response"].(bson.M)
-	code := response["code"].(uint16)
-	if code < 400 {
-		event.Status = OK_STATUS
-	} else {
+	if t.timedOut {
+		event.Status = TIMEOUT_STATUS
+	} else if t.lostInGap {
+		event.Status = GAP_STATUS
+	} else if t.reset {
 		event.Status = ERROR_STATUS
+	} else {
+		response := t.Http["response"].(bson.M)
+		code := response["code"].(uint16)
+		if code < 400 {
+			event.Status = OK_STATUS
+		} else {
+			event.Status = ERROR_STATUS
+		}
 	}
 	event.ResponseTime = t.ResponseTime
 	if http.Send_request {
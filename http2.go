@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Analysis of HTTP/2 over cleartext TCP, started either by the client
+// connection preface (prior knowledge) or by upgrading an HTTP/1.1
+// connection (h2c). Each HTTP/2 stream is published as an http
+// transaction, like a request and its response in HTTP/1.
+
+// Frame types
+const (
+	Http2FrameData         = 0x0
+	Http2FrameHeaders      = 0x1
+	Http2FramePriority     = 0x2
+	Http2FrameRstStream    = 0x3
+	Http2FrameSettings     = 0x4
+	Http2FramePushPromise  = 0x5
+	Http2FramePing         = 0x6
+	Http2FrameGoaway       = 0x7
+	Http2FrameWindowUpdate = 0x8
+	Http2FrameContinuation = 0x9
+)
+
+// Frame flags
+const (
+	Http2FlagEndStream  = 0x1
+	Http2FlagAck        = 0x1
+	Http2FlagEndHeaders = 0x4
+	Http2FlagPadded     = 0x8
+	Http2FlagPriority   = 0x20
+)
+
+const (
+	Http2FrameHeaderLength    = 9
+	Http2SettingsHeaderTable  = 0x1
+	Http2SettingsEntryLength  = 6
+	Http2PriorityFieldsLength = 5
+)
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// Receives the header blocks and data of the HTTP/2 streams. The
+// protocols carried over HTTP/2 implement it.
+type Http2Handler interface {
+	http2Headers(conn *Http2Connection, st *Http2Stream, fromClient bool,
+		fields []hpackField, endStream bool, ts time.Time)
+	http2Data(conn *Http2Connection, st *Http2Stream, fromClient bool,
+		data []byte, endStream bool, ts time.Time)
+	http2Reset(conn *Http2Connection, st *Http2Stream, errorCode uint32, ts time.Time)
+}
+
+// State of an HTTP/2 connection, shared by its two directions.
+type Http2Connection struct {
+	tcpStream *TcpStream
+	clientDir uint8
+	handler   Http2Handler
+
+	// header decoding of the blocks sent in each direction
+	decoders [2]*hpackDecoder
+
+	streams map[uint32]*Http2Stream
+
+	// set when the frames or the headers couldn't be decoded, the rest
+	// of the connection is ignored
+	broken bool
+}
+
+// One direction of an HTTP/2 connection, it is the protocol data of
+// the TCP stream once HTTP/2 is recognized.
+type Http2Framer struct {
+	conn *Http2Connection
+	dir  uint8
+
+	data []byte
+
+	// the client starts with the preface, before the frames
+	prefaceSeen bool
+
+	// header block split in CONTINUATION frames
+	headerBlock      []byte
+	headerFrameType  byte
+	headerStreamId   uint32
+	headerEndStream  bool
+	headerPromisedId uint32
+}
+
+// An HTTP/2 stream, carrying one request and its response.
+type Http2Stream struct {
+	id uint32
+
+	// state of the handler
+	data ProtocolData
+}
+
+// Returns true when the data starts with the connection preface, or
+// with the part of it received so far.
+func http2HasPreface(data []byte) bool {
+	if len(data) >= len(http2Preface) {
+		return bytes.HasPrefix(data, http2Preface)
+	}
+	return len(data) > 0 && bytes.HasPrefix(http2Preface, data)
+}
+
+// Switches the TCP stream to HTTP/2, the client being in the given
+// direction. Only the client sends the preface.
+func newHttp2Connection(tcp *TcpStream, clientDir uint8, handler Http2Handler) *Http2Connection {
+
+	DEBUG("http2", "HTTP/2 connection %s", tcp.tuple)
+
+	conn := &Http2Connection{
+		tcpStream: tcp,
+		clientDir: clientDir,
+		handler:   handler,
+		streams:   map[uint32]*Http2Stream{},
+	}
+	for dir := 0; dir < 2; dir++ {
+		conn.decoders[dir] = newHpackDecoder()
+		tcp.data[dir] = &Http2Framer{
+			conn:        conn,
+			dir:         uint8(dir),
+			prefaceSeen: uint8(dir) != clientDir,
+		}
+	}
+	return conn
+}
+
+func (conn *Http2Connection) framer(dir uint8) *Http2Framer {
+	framer, _ := conn.tcpStream.data[dir].(*Http2Framer)
+	return framer
+}
+
+// Adds the payload of a TCP segment and handles the complete frames.
+func (framer *Http2Framer) parse(payload []byte, ts time.Time) {
+
+	if framer.conn.broken {
+		return
+	}
+
+	framer.data = append(framer.data, payload...)
+	if len(framer.data) > TCP_MAX_DATA_IN_STREAM {
+		DEBUG("http2", "Stream data too large, ignoring the HTTP/2 connection")
+		framer.conn.broken = true
+		framer.data = nil
+		return
+	}
+
+	framer.parseFrames(ts)
+}
+
+func (framer *Http2Framer) parseFrames(ts time.Time) {
+
+	conn := framer.conn
+	if conn.broken {
+		return
+	}
+
+	if !framer.prefaceSeen {
+		if len(framer.data) < len(http2Preface) {
+			return
+		}
+		if !bytes.HasPrefix(framer.data, http2Preface) {
+			DEBUG("http2", "Invalid HTTP/2 connection preface")
+			conn.broken = true
+			return
+		}
+		framer.data = framer.data[len(http2Preface):]
+		framer.prefaceSeen = true
+	}
+
+	for len(framer.data) >= Http2FrameHeaderLength {
+		length := int(framer.data[0])<<16 | int(framer.data[1])<<8 | int(framer.data[2])
+		if len(framer.data) < Http2FrameHeaderLength+length {
+			// wait for the rest of the frame
+			return
+		}
+		frameType := framer.data[3]
+		flags := framer.data[4]
+		streamId := Bytes_Ntohl(framer.data[5:9]) & 0x7fffffff
+		payload := framer.data[Http2FrameHeaderLength : Http2FrameHeaderLength+length]
+
+		DEBUG("http2detailed", "HTTP/2 frame type=%d flags=%x stream=%d length=%d",
+			frameType, flags, streamId, length)
+
+		err := framer.frame(frameType, flags, streamId, payload, ts)
+		if err != nil {
+			DEBUG("http2", "Ignoring the HTTP/2 connection: %s", err)
+			conn.broken = true
+			framer.data = nil
+			return
+		}
+		framer.data = framer.data[Http2FrameHeaderLength+length:]
+	}
+}
+
+// Removes the padding of the DATA, HEADERS and PUSH_PROMISE frames.
+func http2Unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&Http2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) < 1 || int(payload[0]) > len(payload)-1 {
+		return nil, MsgError("Invalid HTTP/2 padding")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+func (framer *Http2Framer) frame(frameType byte, flags byte, streamId uint32,
+	payload []byte, ts time.Time) error {
+
+	conn := framer.conn
+	fromClient := framer.dir == conn.clientDir
+
+	if framer.headerStreamId != 0 {
+		// nothing can come between the frames of a header block
+		if frameType != Http2FrameContinuation || streamId != framer.headerStreamId {
+			return MsgError("Expected CONTINUATION of stream %d", framer.headerStreamId)
+		}
+		framer.headerBlock = append(framer.headerBlock, payload...)
+		if len(framer.headerBlock) > TCP_MAX_DATA_IN_STREAM {
+			framer.headerBlock = nil
+			return MsgError("HTTP/2 header block too large")
+		}
+		if flags&Http2FlagEndHeaders != 0 {
+			return framer.headerBlockDone(ts)
+		}
+		return nil
+	}
+
+	switch frameType {
+	case Http2FrameData:
+		data, err := http2Unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+		st := conn.streams[streamId]
+		if st == nil {
+			break
+		}
+		endStream := flags&Http2FlagEndStream != 0
+		conn.handler.http2Data(conn, st, fromClient, data, endStream, ts)
+		if endStream && !fromClient {
+			delete(conn.streams, streamId)
+		}
+
+	case Http2FrameHeaders, Http2FramePushPromise:
+		block, err := http2Unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+		framer.headerPromisedId = 0
+		if frameType == Http2FrameHeaders && flags&Http2FlagPriority != 0 {
+			if len(block) < Http2PriorityFieldsLength {
+				return MsgError("HTTP/2 HEADERS frame too short")
+			}
+			block = block[Http2PriorityFieldsLength:]
+		}
+		if frameType == Http2FramePushPromise {
+			if len(block) < 4 {
+				return MsgError("HTTP/2 PUSH_PROMISE frame too short")
+			}
+			framer.headerPromisedId = Bytes_Ntohl(block[0:4]) & 0x7fffffff
+			block = block[4:]
+		}
+		framer.headerBlock = append([]byte{}, block...)
+		framer.headerFrameType = frameType
+		framer.headerStreamId = streamId
+		framer.headerEndStream = frameType == Http2FrameHeaders && flags&Http2FlagEndStream != 0
+		if flags&Http2FlagEndHeaders != 0 {
+			return framer.headerBlockDone(ts)
+		}
+
+	case Http2FrameSettings:
+		if flags&Http2FlagAck != 0 {
+			break
+		}
+		for i := 0; i+Http2SettingsEntryLength <= len(payload); i += Http2SettingsEntryLength {
+			id := Bytes_Ntohs(payload[i : i+2])
+			value := Bytes_Ntohl(payload[i+2 : i+6])
+			if id == Http2SettingsHeaderTable {
+				// the sender of the settings decodes the other direction
+				conn.decoders[1-framer.dir].setAllowedMaxSize(int(value))
+			}
+		}
+
+	case Http2FrameRstStream:
+		st := conn.streams[streamId]
+		if st == nil || len(payload) < 4 {
+			break
+		}
+		delete(conn.streams, streamId)
+		DEBUG("http2", "HTTP/2 stream %d reset", streamId)
+		conn.handler.http2Reset(conn, st, Bytes_Ntohl(payload[0:4]), ts)
+
+	case Http2FrameContinuation:
+		return MsgError("Unexpected CONTINUATION frame")
+	}
+
+	return nil
+}
+
+func (framer *Http2Framer) headerBlockDone(ts time.Time) error {
+
+	conn := framer.conn
+	streamId := framer.headerStreamId
+	endStream := framer.headerEndStream
+	framer.headerStreamId = 0
+
+	fields, err := conn.decoders[framer.dir].decode(framer.headerBlock)
+	framer.headerBlock = nil
+	if err != nil {
+		return err
+	}
+
+	if framer.headerFrameType == Http2FramePushPromise {
+		// the request of a pushed response, sent by the server
+		st := &Http2Stream{id: framer.headerPromisedId}
+		conn.streams[st.id] = st
+		conn.handler.http2Headers(conn, st, true, fields, true, ts)
+		return nil
+	}
+
+	st := conn.streams[streamId]
+
+	if framer.dir == conn.clientDir {
+		if st == nil {
+			st = &Http2Stream{id: streamId}
+			conn.streams[streamId] = st
+		}
+		conn.handler.http2Headers(conn, st, true, fields, endStream, ts)
+		return nil
+	}
+
+	if st == nil {
+		DEBUG("http2", "HTTP/2 response on unknown stream %d", streamId)
+		return nil
+	}
+	conn.handler.http2Headers(conn, st, false, fields, endStream, ts)
+	if endStream {
+		delete(conn.streams, streamId)
+	}
+	return nil
+}
+
+func http2HeaderValue(fields []hpackField, name string) (string, bool) {
+	for _, field := range fields {
+		if field.name == name {
+			return field.value, true
+		}
+	}
+	return "", false
+}
+
+// The HTTP/2 streams analyzed by the http protocol. They are published
+// like the HTTP/1 transactions.
+
+type httpHttp2Stream struct {
+	request     *HttpMessage
+	requestDone bool
+	response    *HttpMessage
+
+	trans *HttpTransaction
+}
+
+func httpStreamOf(st *Http2Stream) *httpHttp2Stream {
+	hst, _ := st.data.(*httpHttp2Stream)
+	if hst == nil {
+		hst = &httpHttp2Stream{}
+		st.data = hst
+	}
+	return hst
+}
+
+// Switches the connection to HTTP/2, keeping the data already received.
+func (http *Http) startHttp2(tcp *TcpStream, clientDir uint8) *Http2Connection {
+	var pending [2][]byte
+	for dir := 0; dir < 2; dir++ {
+		if stream, ok := tcp.data[dir].(*HttpStream); ok && stream != nil {
+			pending[dir] = stream.data
+		}
+	}
+	conn := newHttp2Connection(tcp, clientDir, http)
+	for dir := uint8(0); dir < 2; dir++ {
+		conn.framer(dir).data = pending[dir]
+	}
+	return conn
+}
+
+// Called when a 101 response switches the connection to h2c. The
+// response to the upgrade request comes on the stream 1.
+func (http *Http) upgradeToHttp2(tcp *TcpStream, dir uint8, stream *HttpStream) {
+
+	// data following the 101 response is already HTTP/2
+	stream.data = stream.data[stream.message.end:]
+	conn := http.startHttp2(tcp, 1-dir)
+
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	if len(http.transactionsMap[tuple.raw]) > 0 {
+		trans := http.removeTransaction(tuple, 0)
+		conn.streams[1] = &Http2Stream{
+			id:   1,
+			data: &httpHttp2Stream{requestDone: true, trans: trans},
+		}
+	}
+
+	// requests first, the responses refer to them
+	conn.framer(1 - dir).parseFrames(stream.message.Ts)
+	conn.framer(dir).parseFrames(stream.message.Ts)
+}
+
+func (http *Http) http2Headers(conn *Http2Connection, st *Http2Stream, fromClient bool,
+	fields []hpackField, endStream bool, ts time.Time) {
+
+	hst := httpStreamOf(st)
+
+	if fromClient {
+		if hst.request == nil && !hst.requestDone {
+			hst.request = http.http2Message(fields, true, ts)
+		} else if hst.request != nil {
+			// trailers
+			http.http2AddHeaders(hst.request, fields)
+		}
+		if endStream {
+			http.http2RequestDone(conn, st)
+		}
+		return
+	}
+
+	if hst.response == nil {
+		response := http.http2Message(fields, false, ts)
+		if response.StatusCode >= 100 && response.StatusCode < 200 && !endStream {
+			// informational, the final response follows
+			return
+		}
+		hst.response = response
+	} else {
+		// trailers
+		http.http2AddHeaders(hst.response, fields)
+	}
+	if endStream {
+		http.http2ResponseDone(conn, st)
+	}
+}
+
+// Creates the message of a header block. The raw message looks like an
+// HTTP/1 one, the body is appended to it.
+func (http *Http) http2Message(fields []hpackField, isRequest bool, ts time.Time) *HttpMessage {
+
+	m := &HttpMessage{
+		Ts:            ts,
+		IsRequest:     isRequest,
+		version_major: 2,
+		version_minor: 0,
+	}
+
+	var raw bytes.Buffer
+	authority := ""
+	for _, field := range fields {
+		switch field.name {
+		case ":method":
+			m.Method = field.value
+		case ":path":
+			m.RequestUri = field.value
+		case ":authority":
+			authority = field.value
+		case ":status":
+			code, _ := strconv.Atoi(field.value)
+			m.StatusCode = uint16(code)
+		}
+	}
+	if isRequest {
+		m.FirstLine = m.Method + " " + m.RequestUri + " HTTP/2.0"
+		raw.WriteString(m.FirstLine + "\r\n")
+	} else {
+		raw.WriteString("HTTP/2.0 " + strconv.Itoa(int(m.StatusCode)) + "\r\n")
+	}
+
+	if _, exists := http2HeaderValue(fields, "host"); authority != "" && !exists {
+		// same as the Host header of HTTP/1
+		fields = append(fields, hpackField{"host", authority})
+	}
+	for _, field := range fields {
+		if !strings.HasPrefix(field.name, ":") {
+			raw.WriteString(field.name + ": " + field.value + "\r\n")
+		}
+	}
+	raw.WriteString("\r\n")
+
+	http.http2AddHeaders(m, fields)
+
+	m.Raw = raw.Bytes()
+	m.bodyOffset = len(m.Raw)
+	return m
+}
+
+// The cookies can be split in several fields, they are joined again
+// like in a single HTTP/1 header.
+func (http *Http) http2AddHeaders(m *HttpMessage, fields []hpackField) {
+	cookies := []string{}
+	for _, field := range fields {
+		if strings.HasPrefix(field.name, ":") {
+			continue
+		}
+		if field.name == "cookie" {
+			cookies = append(cookies, field.value)
+			continue
+		}
+		http.addHeader(m, field.name, field.value)
+	}
+	if len(cookies) > 0 {
+		http.addHeader(m, "cookie", strings.Join(cookies, "; "))
+	}
+}
+
+func (http *Http) http2Data(conn *Http2Connection, st *Http2Stream, fromClient bool,
+	data []byte, endStream bool, ts time.Time) {
+
+	hst := httpStreamOf(st)
+
+	m := hst.response
+	if fromClient {
+		m = hst.request
+	}
+	if m == nil {
+		return
+	}
+
+	if !m.hasContentLength {
+		m.ContentLength += len(data)
+	}
+	contentType, ok := m.Headers["content-type"]
+	if ok && (len(contentType) == 0 || shouldIncludeInBody(contentType)) &&
+		len(m.Raw)+len(data) <= TCP_MAX_DATA_IN_STREAM {
+
+		m.Raw = append(m.Raw, data...)
+	}
+
+	if endStream {
+		if fromClient {
+			http.http2RequestDone(conn, st)
+		} else {
+			http.http2ResponseDone(conn, st)
+		}
+	}
+}
+
+// Fills in the fields set by handleHttp for the HTTP/1 messages.
+func (http *Http) http2PrepareMessage(conn *Http2Connection, m *HttpMessage) {
+	tcp := conn.tcpStream
+	m.TcpTuple = TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	m.CmdlineTuple = procWatcher.FindProcessesTuple(tcp.tuple)
+	m.end = len(m.Raw)
+	censorPasswords(m, m.Raw)
+}
+
+func (http *Http) http2RequestDone(conn *Http2Connection, st *Http2Stream) {
+	hst := httpStreamOf(st)
+	if hst.requestDone {
+		return
+	}
+	hst.requestDone = true
+
+	m := hst.request
+	m.Direction = conn.clientDir
+	http.http2PrepareMessage(conn, m)
+	hst.trans = http.newTransaction(m)
+
+	DEBUG("http", "HTTP/2 request on stream %d: %s", st.id, m.FirstLine)
+}
+
+func (http *Http) http2ResponseDone(conn *Http2Connection, st *Http2Stream) {
+	hst := httpStreamOf(st)
+
+	if !hst.requestDone && hst.request != nil {
+		// the server can answer before the end of the request
+		http.http2RequestDone(conn, st)
+	}
+	if hst.trans == nil {
+		DEBUG("http", "HTTP/2 response without a known request on stream %d", st.id)
+		return
+	}
+	if hst.trans.timedOut || hst.response == nil {
+		return
+	}
+
+	m := hst.response
+	m.Direction = 1 - conn.clientDir
+	http.http2PrepareMessage(conn, m)
+	http.completeTransaction(hst.trans, m)
+}
+
+func (http *Http) http2Reset(conn *Http2Connection, st *Http2Stream, errorCode uint32,
+	ts time.Time) {
+
+	hst := httpStreamOf(st)
+	if !hst.requestDone && hst.request != nil {
+		http.http2RequestDone(conn, st)
+	}
+	trans := hst.trans
+	if trans == nil || trans.timedOut {
+		return
+	}
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+
+	// the stream ends without its response, or before its end
+	trans.reset = true
+	trans.Http["reset_code"] = errorCode
+	trans.ResponseTime = int32(ts.Sub(trans.ts).Nanoseconds() / 1e6)
+
+	err := http.PublishTransaction(trans)
+	if err != nil {
+		WARN("Publish failure: %s", err)
+	}
+	DEBUG("http", "HTTP/2 stream %d reset with code %d", st.id, errorCode)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Keeps the events published.
+type recordingOutput struct {
+	events []*Event
+}
+
+func (out *recordingOutput) PublishIPs(name string, localAddrs []string) error { return nil }
+func (out *recordingOutput) GetNameByIP(ip string) string                      { return "" }
+func (out *recordingOutput) PublishEvent(event *Event) error {
+	out.events = append(out.events, event)
+	return nil
+}
+
+func newRecordingPublisher() (*PublisherType, *recordingOutput) {
+	output := &recordingOutput{}
+	publisher := &PublisherType{name: "test", Output: []OutputInterface{output}}
+	return publisher, output
+}
+
+// Records what the analyzers publish through the global Publisher,
+// until the returned function restores it.
+func recordGlobalPublisher() (*recordingOutput, func()) {
+	saved := Publisher
+	publisher, output := newRecordingPublisher()
+	Publisher = *publisher
+	return output, func() { Publisher = saved }
+}
+
+func parseHexPayload(t *testing.T, http *Http, tcp *TcpStream, dir uint8, hexstr string) {
+	payload, err := hex.DecodeString(hexstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.Parse(&Packet{ts: time.Now(), payload: payload}, tcp, dir)
+}
+
+func TestHpack_decode(t *testing.T) {
+
+	// requests of the RFC 7541 appendix C.4, with Huffman coding and
+	// the dynamic table
+	decoder := newHpackDecoder()
+
+	block, _ := hex.DecodeString("828684418cf1e3c2e5f23a6ba0ab90f4ff")
+	fields, err := decoder.decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []hpackField{
+		{":method", "GET"}, {":scheme", "http"}, {":path", "/"},
+		{":authority", "www.example.com"},
+	}
+	if len(fields) != len(expected) {
+		t.Fatalf("Wrong fields: %v", fields)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], fields[i])
+		}
+	}
+
+	block, _ = hex.DecodeString("828684be5886a8eb10649cbf")
+	fields, err = decoder.decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 5 || fields[3] != (hpackField{":authority", "www.example.com"}) ||
+		fields[4] != (hpackField{"cache-control", "no-cache"}) {
+
+		t.Errorf("Wrong fields: %v", fields)
+	}
+	if decoder.size != 110 {
+		t.Errorf("Wrong dynamic table size: %d", decoder.size)
+	}
+
+	// index beyond the dynamic table
+	block, _ = hex.DecodeString("c5")
+	if _, err = decoder.decode(block); err == nil {
+		t.Errorf("Expected an error for an unknown index")
+	}
+}
+
+func TestHttp2_priorKnowledge(t *testing.T) {
+
+	http := HttpModForTests()
+	http.Send_headers = true
+	http.Send_all_headers = true
+	publisher, output := newRecordingPublisher()
+	http.Publisher = publisher
+
+	include_body_for := _Config.Http.Include_body_for
+	_Config.Http.Include_body_for = []string{"text/plain"}
+	defer func() { _Config.Http.Include_body_for = include_body_for }()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// GET /a on the stream 1, POST /a on the stream 3 with its header
+	// block split in a CONTINUATION frame
+	parseHexPayload(t, http, &tcp, 0, "505249202a20485454502f322e300d0a0d0a534d0d0a0d0a"+
+		"00000004000000000000002201050000000182864482607f41882f91d35d055c87a7"+
+		"4003782d61818f0f11821c010f11838e017f")
+	parseHexPayload(t, http, &tcp, 0, "0000030100000000038386c000000b090400000003bf0f10"+
+		"87497ca58ae819aa0000080009000000030268656c6c6f0000")
+
+	if _, ok := tcp.data[0].(*Http2Framer); !ok {
+		t.Fatalf("HTTP/2 not recognized")
+	}
+
+	// the response of the stream 3 comes first
+	parseHexPayload(t, http, &tcp, 1, "00000604000000000000010000100000000004010000000000"+
+		"000a010400000003885f87497ca58ae819aa000005000100000003776f726c640000010105000000018d")
+
+	if len(output.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(output.events))
+	}
+
+	post := output.events[0]
+	request := post.Http["request"].(bson.M)
+	response := post.Http["response"].(bson.M)
+	if request["method"] != "POST" || request["uri"] != "/a" ||
+		request["line"] != "POST /a HTTP/2.0" || response["code"] != uint16(200) {
+
+		t.Errorf("Wrong POST transaction: %v", post.Http)
+	}
+	if post.RequestRaw != "POST /a HTTP/2.0\r\ncontent-type: text/plain\r\nhost: example.com\r\n\r\nhello" {
+		t.Errorf("Wrong raw request: %q", post.RequestRaw)
+	}
+	if post.ResponseRaw != "HTTP/2.0 200\r\ncontent-type: text/plain\r\n\r\nworld" {
+		t.Errorf("Wrong raw response: %q", post.ResponseRaw)
+	}
+	if post.Http["content_length"] != 5 {
+		t.Errorf("Wrong POST event: %v", post)
+	}
+
+	get := output.events[1]
+	request = get.Http["request"].(bson.M)
+	response = get.Http["response"].(bson.M)
+	headers := request["headers"].(map[string]string)
+	if request["method"] != "GET" || request["uri"] != "/a" ||
+		response["code"] != uint16(404) || get.Status != ERROR_STATUS {
+
+		t.Errorf("Wrong GET transaction: %v", get.Http)
+	}
+	if headers["host"] != "example.com" || headers["x-a"] != "b" || headers["cookie"] != "a=1; b=2" {
+		t.Errorf("Wrong request headers: %v", headers)
+	}
+}
+
+func TestHttp2_upgrade(t *testing.T) {
+
+	http := HttpModForTests()
+	publisher, output := newRecordingPublisher()
+	http.Publisher = publisher
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	parseHexPayload(t, http, &tcp, 0, hex.EncodeToString([]byte("GET / HTTP/1.1\r\n"+
+		"Host: h\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n")))
+
+	// 101 response followed by the response on the stream 1
+	parseHexPayload(t, http, &tcp, 1, hex.EncodeToString([]byte("HTTP/1.1 101 Switching Protocols\r\n"+
+		"Connection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))+
+		"00000004000000000000000101050000000188")
+
+	parseHexPayload(t, http, &tcp, 0, "505249202a20485454502f322e300d0a0d0a534d0d0a0d0a"+
+		"000000040000000000")
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	request := output.events[0].Http["request"].(bson.M)
+	response := output.events[0].Http["response"].(bson.M)
+	if request["line"] != "GET / HTTP/1.1" || response["code"] != uint16(200) {
+		t.Errorf("Wrong transaction: %v", output.events[0].Http)
+	}
+	if _, ok := tcp.data[0].(*Http2Framer); !ok {
+		t.Errorf("Client direction not switched to HTTP/2")
+	}
+	if framer, _ := tcp.data[0].(*Http2Framer); framer != nil && framer.conn.broken {
+		t.Errorf("HTTP/2 connection not decoded")
+	}
+}
+
+func TestHttp2_detect(t *testing.T) {
+
+	if score := HttpMod.Detect([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")); score != DetectionScoreCertain {
+		t.Errorf("HTTP/2 preface scored %d", score)
+	}
+	if score := HttpMod.Detect([]byte("PRI * HT")); score != 50 {
+		t.Errorf("Partial HTTP/2 preface scored %d", score)
+	}
+}
+
+func http2TestFrame(frameType byte, flags byte, streamId uint32, payload []byte) []byte {
+	length := len(payload)
+	frame := []byte{byte(length >> 16), byte(length >> 8), byte(length), frameType, flags,
+		byte(streamId >> 24), byte(streamId >> 16), byte(streamId >> 8), byte(streamId)}
+	return append(frame, payload...)
+}
+
+func TestHttp2_reset(t *testing.T) {
+
+	http := HttpModForTests()
+	publisher, output := newRecordingPublisher()
+	http.Publisher = publisher
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// GET / on the stream 1, cancelled by the server
+	request := append([]byte{}, http2Preface...)
+	request = append(request, http2TestFrame(Http2FrameHeaders,
+		Http2FlagEndHeaders|Http2FlagEndStream, 1, []byte{0x82, 0x86, 0x84})...)
+	ts := time.Now()
+	http.Parse(&Packet{ts: ts, payload: request}, &tcp, 0)
+	http.Parse(&Packet{ts: ts.Add(5 * time.Millisecond),
+		payload: http2TestFrame(Http2FrameRstStream, 0, 1, []byte{0, 0, 0, 8})}, &tcp, 1)
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != ERROR_STATUS || event.ResponseTime != 5 ||
+		event.Http["reset_code"] != uint32(8) || event.Http["request"].(bson.M)["uri"] != "/" {
+
+		t.Errorf("Wrong event: %v %d %v", event.Status, event.ResponseTime, event.Http)
+	}
+	if _, exists := event.Http["response"]; exists {
+		t.Errorf("Unexpected response: %v", event.Http)
+	}
+}
+
+func TestHttp2_headerBlockTooLarge(t *testing.T) {
+
+	http := HttpModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	request := append([]byte{}, http2Preface...)
+	request = append(request, http2TestFrame(Http2FrameHeaders, 0, 1, []byte{0x82})...)
+	http.Parse(&Packet{ts: time.Now(), payload: request}, &tcp, 0)
+
+	// CONTINUATION frames that never end the header block
+	continuation := http2TestFrame(Http2FrameContinuation, 0, 1, make([]byte, 1<<20))
+	for i := 0; i <= TCP_MAX_DATA_IN_STREAM>>20; i++ {
+		http.Parse(&Packet{ts: time.Now(), payload: continuation}, &tcp, 0)
+	}
+
+	framer, ok := tcp.data[0].(*Http2Framer)
+	if !ok {
+		t.Fatalf("HTTP/2 not recognized")
+	}
+	if !framer.conn.broken || len(framer.headerBlock) > TCP_MAX_DATA_IN_STREAM {
+		t.Errorf("Header block kept growing: %d", len(framer.headerBlock))
+	}
+}
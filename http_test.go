@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 	//"fmt"
+
+	"labix.org/v2/mgo/bson"
 )
 
 func HttpModForTests() *Http {
@@ -783,3 +785,120 @@ func TestEatBodyChunkedWaitCRLF(t *testing.T) {
 		t.Error("Wrong message end", message.end)
 	}
 }
+
+func TestHttp_gapWithPipelinedRequests(t *testing.T) {
+
+	http := HttpModForTests()
+	publisher, output := newRecordingPublisher()
+	http.Publisher = publisher
+
+	tcp := &TcpStream{id: 1, tuple: testIpPortTuple(), protocol: http}
+
+	for _, uri := range []string{"/a", "/b"} {
+		http.Parse(&Packet{ts: time.Now(), payload: []byte("GET " + uri + " HTTP/1.1\r\n\r\n")},
+			tcp, TcpDirectionOriginal)
+	}
+
+	// the response to /a is lost, the one received after the gap can't
+	// be matched
+	tcp.GapInStream(TcpDirectionReverse)
+	http.Parse(&Packet{ts: time.Now(), payload: []byte("HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 0\r\n\r\n")}, tcp, TcpDirectionReverse)
+
+	if len(output.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(output.events))
+	}
+	for i, uri := range []string{"/a", "/b"} {
+		event := output.events[i]
+		if event.Status != GAP_STATUS || event.ResponseTime != 0 ||
+			event.Http["request"].(bson.M)["uri"] != uri {
+
+			t.Errorf("Wrong event: %v %d %v", event.Status, event.ResponseTime, event.Http)
+		}
+	}
+	if len(http.transactionsMap) != 0 {
+		t.Errorf("Transactions still pending")
+	}
+}
+
+func TestHttp_pipelinedRequests(t *testing.T) {
+
+	http := HttpModForTests()
+
+	tuple := TcpTupleFromIpPort(testIpPortTuple(), 1)
+	request := func(uri string) *HttpMessage {
+		return &HttpMessage{
+			Ts:           time.Now(),
+			TcpTuple:     tuple,
+			CmdlineTuple: &CmdlineTuple{},
+			IsRequest:    true,
+			Method:       "GET",
+			RequestUri:   uri,
+		}
+	}
+
+	http.receivedHttpRequest(request("/a"))
+	http.receivedHttpRequest(request("/b"))
+
+	if len(http.transactionsMap[tuple.raw]) != 2 {
+		t.Fatalf("Expected 2 pending transactions, got %d", len(http.transactionsMap[tuple.raw]))
+	}
+
+	http.receivedHttpResponse(&HttpMessage{
+		Ts:           time.Now(),
+		TcpTuple:     tuple,
+		CmdlineTuple: &CmdlineTuple{},
+		StatusCode:   200,
+	})
+
+	pending := http.transactionsMap[tuple.raw]
+	if len(pending) != 1 {
+		t.Fatalf("Expected 1 pending transaction, got %d", len(pending))
+	}
+	if uri := pending[0].Http["request"].(bson.M)["uri"]; uri != "/b" {
+		t.Errorf("Response not matched to the first request, %s still pending", uri)
+	}
+
+	http.receivedHttpResponse(&HttpMessage{
+		Ts:           time.Now(),
+		TcpTuple:     tuple,
+		CmdlineTuple: &CmdlineTuple{},
+		StatusCode:   200,
+	})
+
+	if _, exists := http.transactionsMap[tuple.raw]; exists {
+		t.Errorf("Transactions still pending")
+	}
+}
+
+func TestHttp_expireTransaction(t *testing.T) {
+
+	http := HttpModForTests()
+	publisher, output := newRecordingPublisher()
+	http.Publisher = publisher
+
+	tcp := &TcpStream{id: 1, tuple: testIpPortTuple(), protocol: http}
+	http.Parse(&Packet{ts: time.Now(), payload: []byte("GET /a HTTP/1.1\r\n\r\n")},
+		tcp, TcpDirectionOriginal)
+
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	if len(http.transactionsMap[tuple.raw]) != 1 {
+		t.Fatalf("No pending transaction")
+	}
+	trans := http.transactionsMap[tuple.raw][0]
+	trans.timer.Stop()
+	http.expireTransaction(trans)
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != TIMEOUT_STATUS || event.ResponseTime != TimeoutResponseTime ||
+		event.Http["request"].(bson.M)["uri"] != "/a" {
+
+		t.Errorf("Wrong event: %v %d %v", event.Status, event.ResponseTime, event.Http)
+	}
+	if _, exists := http.transactionsMap[tuple.raw]; exists {
+		t.Errorf("Expired transaction still in the map")
+	}
+}
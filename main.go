@@ -32,19 +32,6 @@ type PacketbeatStruct struct {
 // Global variable containing the main values
 var Packetbeat PacketbeatStruct
 
-type protocolType uint16
-
-const (
-	UnknownProtocol protocolType = iota
-	HttpProtocol
-	MysqlProtocol
-	RedisProtocol
-	PgsqlProtocol
-	ThriftProtocol
-)
-
-var protocolNames = []string{"unknown", "http", "mysql", "redis", "pgsql", "thrift"}
-
 type tomlConfig struct {
 	Interfaces tomlInterfaces
 	RunOptions tomlRunOptions
@@ -55,8 +42,11 @@ type tomlConfig struct {
 	Logging    tomlLogging
 	Passwords  tomlPasswords
 	Thrift     tomlThrift
+	Mongodb    tomlMongodb
 	Http       tomlHttp
 	Geoip      tomlGeoip
+
+	Protocol_detection tomlProtocolDetection
 }
 
 type tomlRunOptions struct {
@@ -229,16 +219,6 @@ func main() {
 		return
 	}
 
-	if err = ThriftMod.Init(false); err != nil {
-		CRIT(err.Error())
-		return
-	}
-
-	if err = HttpMod.Init(false); err != nil {
-		CRIT(err.Error())
-		return
-	}
-
 	if err = TcpInit(); err != nil {
 		CRIT(err.Error())
 		return
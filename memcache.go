@@ -0,0 +1,894 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	MemcacheBinaryHeaderLength = 24
+	MemcacheUdpHeaderLength    = 8
+
+	MemcacheMagicRequest  = 0x80
+	MemcacheMagicResponse = 0x81
+
+	// Maximum number of keys sent in the event
+	MemcacheMaxKeys = 10
+
+	// longest line accepted while waiting for its end
+	MemcacheMaxLineLength = 8192
+)
+
+// Binary protocol status codes
+const (
+	MemcacheStatusNoError       = 0x00
+	MemcacheStatusKeyNotFound   = 0x01
+	MemcacheStatusKeyExists     = 0x02
+	MemcacheStatusItemNotStored = 0x05
+)
+
+// Statistics are returned in one response each
+const MemcacheOpcodeStat = 0x10
+
+var MemcacheOpcodeNames = map[byte]string{
+	0x00: "get",
+	0x01: "set",
+	0x02: "add",
+	0x03: "replace",
+	0x04: "delete",
+	0x05: "increment",
+	0x06: "decrement",
+	0x07: "quit",
+	0x08: "flush",
+	0x09: "getq",
+	0x0a: "noop",
+	0x0b: "version",
+	0x0c: "getk",
+	0x0d: "getkq",
+	0x0e: "append",
+	0x0f: "prepend",
+	0x10: "stat",
+	0x11: "setq",
+	0x12: "addq",
+	0x13: "replaceq",
+	0x14: "deleteq",
+	0x15: "incrementq",
+	0x16: "decrementq",
+	0x17: "quitq",
+	0x18: "flushq",
+	0x19: "appendq",
+	0x1a: "prependq",
+	0x1c: "touch",
+	0x1d: "gat",
+	0x1e: "gatq",
+	0x20: "sasl_list_mechs",
+	0x21: "sasl_auth",
+	0x22: "sasl_step",
+	0x23: "gatk",
+	0x24: "gatkq",
+}
+
+var MemcacheStatusNames = map[uint16]string{
+	0x00: "NO_ERROR",
+	0x01: "KEY_NOT_FOUND",
+	0x02: "KEY_EXISTS",
+	0x03: "VALUE_TOO_LARGE",
+	0x04: "INVALID_ARGUMENTS",
+	0x05: "ITEM_NOT_STORED",
+	0x06: "NON_NUMERIC_VALUE",
+	0x20: "AUTH_ERROR",
+	0x21: "AUTH_CONTINUE",
+	0x81: "UNKNOWN_COMMAND",
+	0x82: "OUT_OF_MEMORY",
+}
+
+// Text commands followed by a data block
+var memcacheStorageCommands = map[string]bool{
+	"set": true, "add": true, "replace": true, "append": true, "prepend": true, "cas": true,
+}
+
+// Commands returning values, in both protocols
+var memcacheRetrievalCommands = map[string]bool{
+	"get": true, "gets": true, "gat": true, "gats": true,
+	"getq": true, "getk": true, "getkq": true, "gatq": true, "gatk": true, "gatkq": true,
+}
+
+// Binary commands that only get a response in some cases: a hit for
+// the gets, an error for the others
+var memcacheQuietOpcodes = map[byte]bool{
+	0x09: true, 0x0d: true, 0x11: true, 0x12: true, 0x13: true, 0x14: true,
+	0x15: true, 0x16: true, 0x17: true, 0x18: true, 0x19: true, 0x1a: true,
+	0x1e: true, 0x24: true,
+}
+
+// First words of the text responses
+var memcacheTextResponses = map[string]bool{
+	"VALUE": true, "END": true, "STORED": true, "NOT_STORED": true, "EXISTS": true,
+	"NOT_FOUND": true, "DELETED": true, "TOUCHED": true, "OK": true, "ERROR": true,
+	"CLIENT_ERROR": true, "SERVER_ERROR": true, "VERSION": true, "STAT": true,
+}
+
+type MemcacheMessage struct {
+	Ts        time.Time
+	IsRequest bool
+	Binary    bool
+	Direction uint8
+
+	Command string
+	Keys    []string
+
+	// size of the values sent or returned, and number of values returned
+	ValueBytes int
+	Values     int
+
+	// text protocol
+	Line    string
+	NoReply bool
+
+	// binary protocol
+	Opcode byte
+	Opaque uint32
+	Status uint16
+	Quiet  bool
+
+	// response status, the first word of the text ones
+	StatusText string
+	IsError    bool
+	Error      string
+}
+
+type MemcacheStream struct {
+	tcpStream *TcpStream
+
+	data []byte
+
+	parseOffset int
+
+	message *MemcacheMessage
+}
+
+type MemcacheTransaction struct {
+	tuple        TcpTuple
+	Src          Endpoint
+	Dst          Endpoint
+	ResponseTime int32
+	ts           time.Time
+	transport    string
+
+	Request  *MemcacheMessage
+	Response *MemcacheMessage
+
+	timer    *time.Timer
+	timedOut bool
+	done     bool
+}
+
+type Memcache struct {
+	// config
+	Send_request        bool
+	Send_response       bool
+	Transaction_timeout time.Duration
+
+	// requests waiting for their response, in the order they were sent
+	transactionsMap map[HashableTcpTuple][]*MemcacheTransaction
+
+	udpTransactions *IdTransactions
+
+	// messages spanning several datagrams, until all of them arrived
+	udpMessages map[memcacheUdpMessageKey]*memcacheUdpMessage
+
+	Publisher *PublisherType
+}
+
+type memcacheUdpMessageKey struct {
+	tuple     HashableIpPortTuple
+	requestId uint16
+}
+
+// The datagrams of a message received so far, by sequence number.
+type memcacheUdpMessage struct {
+	ts        time.Time
+	datagrams [][]byte
+	received  int
+	size      int
+}
+
+var MemcacheMod Memcache
+
+func init() {
+	RegisterProtocolPlugin("memcache", &MemcacheMod)
+}
+
+func (memcache *Memcache) InitDefaults() {
+	memcache.Send_request = true
+	memcache.Send_response = true
+	memcache.Transaction_timeout = TransactionTimeout
+}
+
+func (memcache *Memcache) setFromConfig() error {
+	if _ConfigMeta.IsDefined("protocols", "memcache", "send_request") {
+		memcache.Send_request = _Config.Protocols["memcache"].Send_request
+	}
+	if _ConfigMeta.IsDefined("protocols", "memcache", "send_response") {
+		memcache.Send_response = _Config.Protocols["memcache"].Send_response
+	}
+	timeout, err := configTransactionTimeout("memcache")
+	if err != nil {
+		return err
+	}
+	memcache.Transaction_timeout = timeout
+	return nil
+}
+
+func (memcache *Memcache) Init(test_mode bool) error {
+
+	memcache.InitDefaults()
+
+	if !test_mode {
+		err := memcache.setFromConfig()
+		if err != nil {
+			return err
+		}
+		memcache.Publisher = &Publisher
+	}
+
+	memcache.transactionsMap = make(map[HashableTcpTuple][]*MemcacheTransaction, TransactionsHashSize)
+	memcache.udpTransactions = NewIdTransactions(memcache.expireUdpTransaction)
+	memcache.udpTransactions.Timeout = memcache.Transaction_timeout
+	memcache.udpMessages = make(map[memcacheUdpMessageKey]*memcacheUdpMessage)
+
+	return nil
+}
+
+func (stream *MemcacheStream) PrepareForNewMessage() {
+	stream.data = stream.data[stream.parseOffset:]
+	stream.parseOffset = 0
+	stream.message = nil
+}
+
+// Returns true when the word is a number, as the replies to incr and
+// decr are.
+func memcacheIsNumber(word string) bool {
+	_, err := strconv.ParseUint(word, 10, 64)
+	return err == nil
+}
+
+func memcacheMessageParser(s *MemcacheStream) (bool, bool) {
+
+	if len(s.data) == 0 {
+		return true, false
+	}
+
+	switch s.data[0] {
+	case MemcacheMagicRequest, MemcacheMagicResponse:
+		return memcacheBinaryParser(s)
+	}
+	return memcacheTextParser(s)
+}
+
+func memcacheBinaryParser(s *MemcacheStream) (bool, bool) {
+
+	m := s.message
+	data := s.data
+
+	if len(data) < MemcacheBinaryHeaderLength {
+		return true, false
+	}
+
+	keyLength := int(Bytes_Ntohs(data[2:4]))
+	extrasLength := int(data[4])
+	bodyLength := int(Bytes_Ntohl(data[8:12]))
+	if extrasLength+keyLength > bodyLength {
+		DEBUG("memcache", "Invalid binary message lengths")
+		return false, false
+	}
+	if len(data) < MemcacheBinaryHeaderLength+bodyLength {
+		DEBUG("memcache", "Waiting for more data")
+		return true, false
+	}
+
+	m.Binary = true
+	m.IsRequest = data[0] == MemcacheMagicRequest
+	m.Opcode = data[1]
+	m.Opaque = Bytes_Ntohl(data[12:16])
+	if name, exists := MemcacheOpcodeNames[m.Opcode]; exists {
+		m.Command = name
+	} else {
+		m.Command = strconv.Itoa(int(m.Opcode))
+	}
+
+	body := data[MemcacheBinaryHeaderLength : MemcacheBinaryHeaderLength+bodyLength]
+	if keyLength > 0 {
+		m.Keys = []string{string(body[extrasLength : extrasLength+keyLength])}
+	}
+	m.ValueBytes = bodyLength - extrasLength - keyLength
+
+	if m.IsRequest {
+		m.Quiet = memcacheQuietOpcodes[m.Opcode]
+	} else {
+		m.Status = Bytes_Ntohs(data[6:8])
+		if name, exists := MemcacheStatusNames[m.Status]; exists {
+			m.StatusText = name
+		} else {
+			m.StatusText = strconv.Itoa(int(m.Status))
+		}
+		switch m.Status {
+		case MemcacheStatusNoError:
+			if memcacheRetrievalCommands[m.Command] {
+				m.Values = 1
+			}
+		case MemcacheStatusKeyNotFound, MemcacheStatusKeyExists, MemcacheStatusItemNotStored:
+			// answers, not failures
+		default:
+			m.IsError = true
+			// the body of the errors is a message
+			m.Error = string(body[extrasLength+keyLength:])
+		}
+		if m.IsError || !memcacheRetrievalCommands[m.Command] {
+			m.ValueBytes = 0
+		}
+	}
+
+	s.parseOffset = MemcacheBinaryHeaderLength + bodyLength
+	return true, true
+}
+
+func memcacheTextParser(s *MemcacheStream) (bool, bool) {
+
+	m := s.message
+
+	for s.parseOffset < len(s.data) {
+
+		found, line, off := readLine(s.data, s.parseOffset)
+		if !found {
+			if len(s.data)-s.parseOffset > MemcacheMaxLineLength {
+				DEBUG("memcache", "Line too long")
+				return false, false
+			}
+			DEBUG("memcache", "End of line not found, waiting for more data")
+			return true, false
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			DEBUG("memcache", "Empty line")
+			return false, false
+		}
+		word := fields[0]
+
+		if m.Line == "" {
+			m.Line = line
+			m.IsRequest = !memcacheTextResponses[word] && !memcacheIsNumber(word)
+		}
+
+		if m.IsRequest {
+			return memcacheTextRequest(s, fields, off)
+		}
+
+		switch word {
+		case "VALUE":
+			// VALUE <key> <flags> <bytes> [<cas unique>]
+			if len(fields) < 4 {
+				DEBUG("memcache", "Invalid VALUE line: %s", line)
+				return false, false
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil || size < 0 {
+				DEBUG("memcache", "Invalid value size: %s", line)
+				return false, false
+			}
+			if len(s.data) < off+size+2 {
+				DEBUG("memcache", "Waiting for the rest of the value")
+				return true, false
+			}
+			m.Keys = append(m.Keys, fields[1])
+			m.Values += 1
+			m.ValueBytes += size
+			s.parseOffset = off + size + 2
+
+		case "STAT":
+			m.Values += 1
+			s.parseOffset = off
+
+		default:
+			// the last line of the response
+			m.StatusText = word
+			if memcacheIsNumber(word) {
+				m.StatusText = ""
+			}
+			if word == "ERROR" || word == "CLIENT_ERROR" || word == "SERVER_ERROR" {
+				m.IsError = true
+				m.Error = strings.TrimSpace(strings.TrimPrefix(line, word))
+			}
+			m.Line = line
+			s.parseOffset = off
+			return true, true
+		}
+	}
+
+	return true, false
+}
+
+func memcacheTextRequest(s *MemcacheStream, fields []string, off int) (bool, bool) {
+
+	m := s.message
+	m.Command = strings.ToLower(fields[0])
+	args := fields[1:]
+
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		m.NoReply = true
+		args = args[:len(args)-1]
+	}
+
+	switch {
+	case memcacheStorageCommands[m.Command]:
+		// <command> <key> <flags> <exptime> <bytes> [<cas unique>]
+		if len(args) < 4 {
+			DEBUG("memcache", "Invalid storage command: %s", m.Line)
+			return false, false
+		}
+		size, err := strconv.Atoi(args[3])
+		if err != nil || size < 0 {
+			DEBUG("memcache", "Invalid value size: %s", m.Line)
+			return false, false
+		}
+		if len(s.data) < off+size+2 {
+			DEBUG("memcache", "Waiting for the rest of the value")
+			return true, false
+		}
+		m.Keys = args[:1]
+		m.ValueBytes = size
+		off += size + 2
+
+	case m.Command == "gat" || m.Command == "gats":
+		// the expiration time comes first
+		if len(args) > 1 {
+			m.Keys = args[1:]
+		}
+
+	case m.Command == "get" || m.Command == "gets":
+		m.Keys = args
+
+	case m.Command == "delete" || m.Command == "incr" || m.Command == "decr" ||
+		m.Command == "touch":
+
+		if len(args) > 0 {
+			m.Keys = args[:1]
+		}
+
+	case m.Command == "quit":
+		// the server closes the connection
+		m.NoReply = true
+	}
+
+	s.parseOffset = off
+	return true, true
+}
+
+func (memcache *Memcache) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	defer RECOVER("ParseMemcache exception")
+
+	stream, _ := tcp.data[dir].(*MemcacheStream)
+
+	if stream == nil {
+		stream = &MemcacheStream{
+			tcpStream: tcp,
+			data:      pkt.payload,
+			message:   &MemcacheMessage{Ts: pkt.ts},
+		}
+		tcp.data[dir] = stream
+	} else {
+		// concatenate bytes
+		stream.data = append(stream.data, pkt.payload...)
+		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
+			DEBUG("memcache", "Stream data too large, dropping TCP stream")
+			tcp.data[dir] = nil
+			return
+		}
+	}
+
+	for len(stream.data) > 0 {
+		if stream.message == nil {
+			stream.message = &MemcacheMessage{Ts: pkt.ts}
+		}
+
+		ok, complete := memcacheMessageParser(stream)
+
+		if !ok {
+			// drop this tcp stream. Will retry parsing with the next
+			// segment in it
+			tcp.data[dir] = nil
+			DEBUG("memcache", "Ignore Memcache message. Drop tcp stream. Try parsing with the next segment")
+			return
+		}
+
+		if complete {
+			stream.message.Direction = dir
+			memcache.handleMemcache(stream.message, tcp)
+
+			// and reset message
+			stream.PrepareForNewMessage()
+		} else {
+			// wait for more data
+			break
+		}
+	}
+}
+
+func (memcache *Memcache) ReceivedFin(tcp *TcpStream, dir uint8) {
+	// nothing to do, the pending requests expire on their own
+}
+
+func (memcache *Memcache) GapInStream(tcp *TcpStream, dir uint8) {
+	// nothing to do, the parser starts over after the gap
+}
+
+func (memcache *Memcache) ConnectionExpired(tcp *TcpStream) {
+	// the pending requests are published when they expire
+	delete(memcache.transactionsMap, TcpTupleFromIpPort(tcp.tuple, tcp.id).raw)
+}
+
+func (memcache *Memcache) handleMemcache(m *MemcacheMessage, tcp *TcpStream) {
+
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+
+	if m.IsRequest {
+		DEBUG("memcache", "Memcache request: %s", m.Command)
+		trans := memcache.newTransaction(tcp.tuple, tcp.id, "tcp", m)
+		if m.NoReply {
+			memcache.publishTransaction(trans)
+			return
+		}
+		memcache.transactionsMap[tuple.raw] = append(memcache.transactionsMap[tuple.raw], trans)
+		trans.timer = time.AfterFunc(memcache.Transaction_timeout,
+			func() { memcache.expireTransaction(trans) })
+		return
+	}
+
+	DEBUG("memcache", "Memcache response: %s", m.StatusText)
+
+	pending := memcache.transactionsMap[tuple.raw]
+	index := -1
+	for i, trans := range pending {
+		if !m.Binary {
+			// the replies come in the order of the commands
+			index = i
+			break
+		}
+		if trans.Request.Binary && trans.Request.Opaque == m.Opaque {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		DEBUG("memcache", "Response from unknown transaction. Ignoring.")
+		return
+	}
+	trans := pending[index]
+
+	if m.Binary && trans.Request.Opcode == MemcacheOpcodeStat && len(m.Keys) > 0 {
+		// one response per statistic, the last one has no key
+		if trans.Response == nil {
+			trans.Response = m
+		}
+		trans.Response.Values += 1
+		return
+	}
+
+	// the quiet requests sent before got no response, which is their
+	// answer: a miss or a success
+	remaining := []*MemcacheTransaction{}
+	for i, previous := range pending {
+		if i < index && previous.Request.Quiet {
+			memcache.completeTransaction(previous, nil, m.Ts)
+			continue
+		}
+		if i != index {
+			remaining = append(remaining, previous)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(memcache.transactionsMap, tuple.raw)
+	} else {
+		memcache.transactionsMap[tuple.raw] = remaining
+	}
+
+	if trans.Response != nil {
+		// statistics
+		m.Values = trans.Response.Values
+	}
+	memcache.completeTransaction(trans, m, m.Ts)
+}
+
+func (memcache *Memcache) newTransaction(ipPortTuple *IpPortTuple, id uint32, transport string,
+	m *MemcacheMessage) *MemcacheTransaction {
+
+	tuple := TcpTupleFromIpPort(ipPortTuple, id)
+	trans := &MemcacheTransaction{tuple: tuple, transport: transport, Request: m, ts: m.Ts}
+
+	cmdline := procWatcher.FindProcessesTuple(ipPortTuple)
+	trans.Src = Endpoint{
+		Ip:   tuple.Src_ip.String(),
+		Port: tuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	trans.Dst = Endpoint{
+		Ip:   tuple.Dst_ip.String(),
+		Port: tuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+	if m.Direction == TcpDirectionReverse {
+		trans.Src, trans.Dst = trans.Dst, trans.Src
+	}
+
+	return trans
+}
+
+func (memcache *Memcache) completeTransaction(trans *MemcacheTransaction, m *MemcacheMessage,
+	ts time.Time) {
+
+	if trans.done {
+		return
+	}
+	trans.done = true
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+
+	trans.Response = m
+	trans.ResponseTime = int32(ts.Sub(trans.ts).Nanoseconds() / 1e6)
+
+	memcache.publishTransaction(trans)
+}
+
+func (memcache *Memcache) expireTransaction(trans *MemcacheTransaction) {
+
+	if trans.done {
+		return
+	}
+	trans.done = true
+	trans.timedOut = true
+	trans.ResponseTime = int32(memcache.Transaction_timeout / time.Millisecond)
+	memcache.publishTransaction(trans)
+
+	// remove from map
+	pending := memcache.transactionsMap[trans.tuple.raw]
+	for i, t := range pending {
+		if t == trans {
+			pending = append(pending[:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(memcache.transactionsMap, trans.tuple.raw)
+	} else {
+		memcache.transactionsMap[trans.tuple.raw] = pending
+	}
+}
+
+// Over UDP each message is prefixed by a frame header carrying the
+// request ID, and the sequence number and count of its datagrams. The
+// messages spanning several datagrams are decoded once all of them
+// arrived.
+func (memcache *Memcache) ParseUdp(pkt *Packet) {
+	defer RECOVER("ParseMemcacheUdp exception")
+
+	if len(pkt.payload) <= MemcacheUdpHeaderLength {
+		DEBUG("memcache", "Datagram too short")
+		return
+	}
+	requestId := Bytes_Ntohs(pkt.payload[0:2])
+	sequence := Bytes_Ntohs(pkt.payload[2:4])
+	datagrams := Bytes_Ntohs(pkt.payload[4:6])
+
+	data := pkt.payload[MemcacheUdpHeaderLength:]
+	ts := pkt.ts
+	if datagrams > 1 {
+		data, ts = memcache.reassembleUdp(pkt, requestId, sequence, datagrams)
+		if data == nil {
+			// wait for the other datagrams
+			return
+		}
+	} else if sequence != 0 {
+		return
+	}
+
+	stream := &MemcacheStream{
+		data:    data,
+		message: &MemcacheMessage{Ts: ts, Direction: TcpDirectionOriginal},
+	}
+	ok, complete := memcacheMessageParser(stream)
+	if !ok || !complete {
+		DEBUG("memcache", "Ignoring Memcache datagram")
+		return
+	}
+	m := stream.message
+
+	if m.IsRequest {
+		if m.NoReply {
+			memcache.publishTransaction(memcache.newTransaction(&pkt.tuple, 0, "udp", m))
+			return
+		}
+		memcache.udpTransactions.AddRequest(&pkt.tuple, TcpDirectionOriginal,
+			uint32(requestId), m.Ts, m)
+		return
+	}
+
+	udpTrans := memcache.udpTransactions.MatchResponse(&pkt.tuple, TcpDirectionOriginal,
+		uint32(requestId), m.Ts)
+	if udpTrans == nil {
+		return
+	}
+	memcache.publishTransaction(memcacheUdpTransaction(udpTrans, m))
+}
+
+// Keeps the datagram and returns the whole message once all its datagrams
+// were received, with the time of the first one.
+func (memcache *Memcache) reassembleUdp(pkt *Packet, requestId uint16, sequence uint16,
+	datagrams uint16) ([]byte, time.Time) {
+
+	if sequence >= datagrams {
+		DEBUG("memcache", "Invalid datagram sequence number %d of %d", sequence, datagrams)
+		return nil, pkt.ts
+	}
+
+	key := memcacheUdpMessageKey{tuple: pkt.tuple.raw, requestId: requestId}
+	msg, exists := memcache.udpMessages[key]
+	if !exists || len(msg.datagrams) != int(datagrams) {
+		memcache.expireUdpMessages(pkt.ts)
+		msg = &memcacheUdpMessage{ts: pkt.ts, datagrams: make([][]byte, datagrams)}
+		memcache.udpMessages[key] = msg
+	}
+	if msg.datagrams[sequence] != nil {
+		// retransmitted
+		return nil, pkt.ts
+	}
+
+	// the capture buffer can be reused by the sniffer
+	data := make([]byte, len(pkt.payload)-MemcacheUdpHeaderLength)
+	copy(data, pkt.payload[MemcacheUdpHeaderLength:])
+	msg.datagrams[sequence] = data
+	msg.received++
+	msg.size += len(data)
+	if msg.ts.After(pkt.ts) {
+		msg.ts = pkt.ts
+	}
+
+	if msg.size > TCP_MAX_DATA_IN_STREAM {
+		DEBUG("memcache", "Message too large, dropping its datagrams")
+		delete(memcache.udpMessages, key)
+		return nil, pkt.ts
+	}
+	if msg.received < len(msg.datagrams) {
+		return nil, pkt.ts
+	}
+
+	delete(memcache.udpMessages, key)
+	whole := make([]byte, 0, msg.size)
+	for _, datagram := range msg.datagrams {
+		whole = append(whole, datagram...)
+	}
+	return whole, msg.ts
+}
+
+// Drops the messages that still miss datagrams after the transaction
+// timeout, their request is reported as timed out.
+func (memcache *Memcache) expireUdpMessages(ts time.Time) {
+	for key, msg := range memcache.udpMessages {
+		if ts.Sub(msg.ts) > memcache.Transaction_timeout {
+			delete(memcache.udpMessages, key)
+		}
+	}
+}
+
+func memcacheUdpTransaction(udpTrans *IdTransaction, response *MemcacheMessage) *MemcacheTransaction {
+	return &MemcacheTransaction{
+		Src:          udpTrans.Src,
+		Dst:          udpTrans.Dst,
+		ResponseTime: udpTrans.ResponseTime,
+		ts:           udpTrans.Ts,
+		transport:    "udp",
+		Request:      udpTrans.Data.(*MemcacheMessage),
+		Response:     response,
+	}
+}
+
+func (memcache *Memcache) expireUdpTransaction(udpTrans *IdTransaction) {
+	trans := memcacheUdpTransaction(udpTrans, nil)
+	trans.timedOut = true
+	memcache.publishTransaction(trans)
+}
+
+func (memcache *Memcache) publishTransaction(t *MemcacheTransaction) {
+
+	if memcache.Publisher == nil {
+		return
+	}
+
+	event := Event{}
+
+	event.Type = "memcache"
+	if t.timedOut {
+		event.Status = TIMEOUT_STATUS
+	} else if t.Response != nil && t.Response.IsError {
+		event.Status = ERROR_STATUS
+	} else {
+		event.Status = OK_STATUS
+	}
+	event.ResponseTime = t.ResponseTime
+
+	request := t.Request
+	keys := request.Keys
+	if len(keys) > MemcacheMaxKeys {
+		keys = keys[:MemcacheMaxKeys]
+	}
+	protocol := "text"
+	if request.Binary {
+		protocol = "binary"
+	}
+	event.Memcache = bson.M{
+		"protocol":   protocol,
+		"transport":  t.transport,
+		"command":    request.Command,
+		"keys":       keys,
+		"keys_count": len(request.Keys),
+		"request": bson.M{
+			"value_bytes": request.ValueBytes,
+		},
+	}
+	if request.Binary {
+		event.Memcache["request"].(bson.M)["opaque"] = request.Opaque
+		event.Memcache["request"].(bson.M)["quiet"] = request.Quiet
+	} else {
+		event.Memcache["request"].(bson.M)["noreply"] = request.NoReply
+	}
+
+	if memcache.Send_request {
+		if request.Binary {
+			event.RequestRaw = strings.TrimSpace(request.Command + " " + strings.Join(keys, " "))
+		} else {
+			event.RequestRaw = request.Line
+		}
+	}
+
+	response := t.Response
+	if response != nil {
+		r := bson.M{
+			"status":      response.StatusText,
+			"value_bytes": response.ValueBytes,
+			"values":      response.Values,
+		}
+		if response.IsError {
+			r["error"] = response.Error
+		}
+		event.Memcache["response"] = r
+
+		if memcache.Send_response {
+			if response.Binary {
+				event.ResponseRaw = response.StatusText
+			} else {
+				event.ResponseRaw = response.Line
+			}
+		}
+	}
+
+	if memcacheRetrievalCommands[request.Command] && !t.timedOut &&
+		(response == nil || !response.IsError) {
+
+		// a quiet get without response is a miss
+		hits := 0
+		if response != nil {
+			hits = response.Values
+		}
+		event.Memcache["hits"] = hits
+		event.Memcache["misses"] = len(request.Keys) - hits
+	}
+
+	err := memcache.Publisher.PublishEvent(t.ts, &t.Src, &t.Dst, &event)
+	if err != nil {
+		WARN("Publish failure: %s", err)
+	}
+}
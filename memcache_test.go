@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func MemcacheModForTests() (*Memcache, *recordingOutput) {
+	var memcache Memcache
+	memcache.Init(true)
+	publisher, output := newRecordingPublisher()
+	memcache.Publisher = publisher
+	return &memcache, output
+}
+
+func parseMemcache(memcache *Memcache, tcp *TcpStream, dir uint8, payload string) {
+	memcache.Parse(&Packet{ts: time.Now(), payload: []byte(payload)}, tcp, dir)
+}
+
+func parseMemcacheHex(t *testing.T, memcache *Memcache, tcp *TcpStream, dir uint8, hexstr string) {
+	payload, err := hex.DecodeString(hexstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memcache.Parse(&Packet{ts: time.Now(), payload: payload}, tcp, dir)
+}
+
+func TestMemcache_textGet(t *testing.T) {
+
+	memcache, output := MemcacheModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	parseMemcache(memcache, &tcp, 0, "get a b c\r\n")
+	// the second value is split over two segments
+	parseMemcache(memcache, &tcp, 1, "VALUE a 0 5\r\nhello\r\nVALUE c 0 3\r\nab")
+	parseMemcache(memcache, &tcp, 1, "c\r\nEND\r\n")
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Type != "memcache" || event.Status != OK_STATUS {
+		t.Errorf("Wrong event: %v", event)
+	}
+	if event.Memcache["command"] != "get" || event.Memcache["protocol"] != "text" ||
+		event.Memcache["keys_count"] != 3 || event.Memcache["hits"] != 2 ||
+		event.Memcache["misses"] != 1 {
+
+		t.Errorf("Wrong memcache fields: %v", event.Memcache)
+	}
+	response := event.Memcache["response"].(bson.M)
+	if response["value_bytes"] != 8 || response["status"] != "END" {
+		t.Errorf("Wrong response: %v", response)
+	}
+	if event.RequestRaw != "get a b c" {
+		t.Errorf("Wrong raw request: %q", event.RequestRaw)
+	}
+}
+
+func TestMemcache_textStorage(t *testing.T) {
+
+	memcache, output := MemcacheModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// the data block comes in its own segment, the delete gets no reply
+	parseMemcache(memcache, &tcp, 0, "set key 0 0 10\r\n")
+	parseMemcache(memcache, &tcp, 0, "0123456789\r\ndelete old noreply\r\nincr n x\r\n")
+
+	if len(output.events) != 1 || output.events[0].Memcache["command"] != "delete" {
+		t.Fatalf("Expected the delete event: %v", output.events)
+	}
+
+	parseMemcache(memcache, &tcp, 1, "STORED\r\nCLIENT_ERROR invalid numeric delta argument\r\n")
+
+	if len(output.events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(output.events))
+	}
+	set := output.events[1]
+	request := set.Memcache["request"].(bson.M)
+	if set.Status != OK_STATUS || set.Memcache["command"] != "set" ||
+		request["value_bytes"] != 10 || set.ResponseRaw != "STORED" {
+
+		t.Errorf("Wrong set event: %v", set.Memcache)
+	}
+	if _, exists := set.Memcache["hits"]; exists {
+		t.Errorf("Hits set for a storage command")
+	}
+
+	incr := output.events[2]
+	response := incr.Memcache["response"].(bson.M)
+	if incr.Status != ERROR_STATUS || response["error"] != "invalid numeric delta argument" {
+		t.Errorf("Wrong incr event: %v", incr.Memcache)
+	}
+}
+
+func TestMemcache_binaryQuietGets(t *testing.T) {
+
+	memcache, output := MemcacheModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// getq a (opaque 1), getq b (opaque 2) and noop (opaque 3)
+	parseMemcacheHex(t, memcache, &tcp, 0, "800900010000000000000001000000010000000000000000"+
+		"61800900010000000000000001000000020000000000000000"+
+		"62800a00000000000000000000000000030000000000000000")
+
+	// only b is found, then the noop response
+	parseMemcacheHex(t, memcache, &tcp, 1, "810900000400000000000009000000020000000000000000"+
+		"0000000068656c6c6f810a0000000000000000000000000003"+
+		"0000000000000000")
+
+	if len(output.events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(output.events))
+	}
+	miss := output.events[0]
+	if miss.Memcache["command"] != "getq" || miss.Memcache["misses"] != 1 ||
+		miss.Memcache["hits"] != 0 || miss.Memcache["keys"].([]string)[0] != "a" {
+
+		t.Errorf("Wrong miss event: %v", miss.Memcache)
+	}
+	hit := output.events[1]
+	response := hit.Memcache["response"].(bson.M)
+	if hit.Memcache["hits"] != 1 || hit.Memcache["protocol"] != "binary" ||
+		response["value_bytes"] != 5 || response["status"] != "NO_ERROR" {
+
+		t.Errorf("Wrong hit event: %v", hit.Memcache)
+	}
+	if output.events[2].Memcache["command"] != "noop" {
+		t.Errorf("Wrong noop event: %v", output.events[2].Memcache)
+	}
+	if len(memcache.transactionsMap) != 0 {
+		t.Errorf("Transactions left: %v", memcache.transactionsMap)
+	}
+}
+
+func TestMemcache_binaryError(t *testing.T) {
+
+	memcache, output := MemcacheModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// set k with a 3 bytes value, refused as too large
+	parseMemcacheHex(t, memcache, &tcp, 0, "80010001080000000000000c00000007000000000000000000"+
+		"000000000000006b78797a")
+	parseMemcacheHex(t, memcache, &tcp, 1, "810100000000000300000009000000070000000000000000"+
+		"546f6f206c61726765")
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	request := event.Memcache["request"].(bson.M)
+	response := event.Memcache["response"].(bson.M)
+	if event.Status != ERROR_STATUS || request["value_bytes"] != 3 || request["opaque"] != uint32(7) ||
+		response["status"] != "VALUE_TOO_LARGE" || response["error"] != "Too large" {
+
+		t.Errorf("Wrong event: %v", event.Memcache)
+	}
+}
+
+func TestMemcache_udp(t *testing.T) {
+
+	memcache, output := MemcacheModForTests()
+
+	request := NewIpPortTuple(4, net.IPv4(192, 168, 0, 1), 34567, net.IPv4(192, 168, 0, 2), 11211)
+	response := NewIpPortTuple(4, net.IPv4(192, 168, 0, 2), 11211, net.IPv4(192, 168, 0, 1), 34567)
+	ts := time.Now()
+
+	// frame header with the request ID 5
+	memcache.ParseUdp(&Packet{ts: ts, tuple: request,
+		payload: []byte("\x00\x05\x00\x00\x00\x01\x00\x00get k\r\n")})
+	memcache.ParseUdp(&Packet{ts: ts.Add(2 * time.Millisecond), tuple: response,
+		payload: []byte("\x00\x05\x00\x00\x00\x01\x00\x00END\r\n")})
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Memcache["transport"] != "udp" || event.Memcache["misses"] != 1 ||
+		event.ResponseTime != 2 || event.Src_port != 34567 {
+
+		t.Errorf("Wrong event: %v %v", event, event.Memcache)
+	}
+}
+
+func TestMemcache_udpMultipleDatagrams(t *testing.T) {
+
+	memcache, output := MemcacheModForTests()
+
+	request := NewIpPortTuple(4, net.IPv4(192, 168, 0, 1), 34567, net.IPv4(192, 168, 0, 2), 11211)
+	response := NewIpPortTuple(4, net.IPv4(192, 168, 0, 2), 11211, net.IPv4(192, 168, 0, 1), 34567)
+	ts := time.Now()
+
+	memcache.ParseUdp(&Packet{ts: ts, tuple: request,
+		payload: []byte("\x00\x06\x00\x00\x00\x01\x00\x00get k\r\n")})
+
+	// a value of 3000 bytes in three datagrams, the last one first
+	reply := []byte("VALUE k 0 3000\r\n" + strings.Repeat("v", 3000) + "\r\nEND\r\n")
+	parts := [][]byte{reply[:1400], reply[1400:2800], reply[2800:]}
+	for i, sequence := range []int{2, 0, 1} {
+		payload := append([]byte{0, 6, 0, byte(sequence), 0, 3, 0, 0}, parts[sequence]...)
+		memcache.ParseUdp(&Packet{ts: ts.Add(time.Duration(i+2) * time.Millisecond),
+			tuple: response, payload: payload})
+	}
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Memcache["hits"] != 1 || event.Memcache["misses"] != 0 ||
+		event.Memcache["response"].(bson.M)["value_bytes"] != 3000 || event.ResponseTime != 2 {
+
+		t.Errorf("Wrong event: %d %v", event.ResponseTime, event.Memcache)
+	}
+	if len(memcache.udpMessages) != 0 {
+		t.Errorf("Datagrams still kept")
+	}
+}
@@ -0,0 +1,760 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	MongodbHeaderLength = 16
+
+	// largest message accepted by the servers
+	MongodbMaxMessageSize = 48 * 1000 * 1000
+)
+
+// Opcodes
+const (
+	MongodbOpReply       = 1
+	MongodbOpUpdate      = 2001
+	MongodbOpInsert      = 2002
+	MongodbOpQuery       = 2004
+	MongodbOpGetMore     = 2005
+	MongodbOpDelete      = 2006
+	MongodbOpKillCursors = 2007
+	MongodbOpCompressed  = 2012
+	MongodbOpMsg         = 2013
+)
+
+var MongodbOpcodeNames = map[int32]string{
+	MongodbOpReply:       "OP_REPLY",
+	MongodbOpUpdate:      "OP_UPDATE",
+	MongodbOpInsert:      "OP_INSERT",
+	MongodbOpQuery:       "OP_QUERY",
+	MongodbOpGetMore:     "OP_GET_MORE",
+	MongodbOpDelete:      "OP_DELETE",
+	MongodbOpKillCursors: "OP_KILL_CURSORS",
+	MongodbOpCompressed:  "OP_COMPRESSED",
+	MongodbOpMsg:         "OP_MSG",
+}
+
+// OP_REPLY response flags
+const (
+	MongodbReplyCursorNotFound = 1 << 0
+	MongodbReplyQueryFailure   = 1 << 1
+)
+
+// OP_MSG flags
+const (
+	MongodbMsgChecksumPresent = 1 << 0
+	MongodbMsgMoreToCome      = 1 << 1
+)
+
+type MongodbMessage struct {
+	Ts         time.Time
+	Direction  uint8
+	Size       int
+	RequestId  int32
+	ResponseTo int32
+	Opcode     int32
+
+	IsRequest    bool
+	ExpectsReply bool
+
+	// request
+	Method         string
+	Database       string
+	Collection     string
+	Query          bson.D
+	NumberToSkip   int32
+	NumberToReturn int32
+	Documents      int
+	IsCommand      bool
+
+	// response
+	Flags          uint32
+	CursorId       int64
+	StartingFrom   int32
+	NumberReturned int
+	Reply          bson.D
+}
+
+type MongodbStream struct {
+	tcpStream *TcpStream
+
+	data []byte
+}
+
+type Mongodb struct {
+	// config
+	MaxDocLength        int
+	Send_request        bool
+	Send_response       bool
+	Transaction_timeout time.Duration
+
+	transactions *IdTransactions
+
+	Publisher *PublisherType
+}
+
+type tomlMongodb struct {
+	Max_doc_length int
+}
+
+var MongodbMod Mongodb
+
+func init() {
+	RegisterProtocolPlugin("mongodb", &MongodbMod)
+}
+
+func (mongodb *Mongodb) InitDefaults() {
+	mongodb.MaxDocLength = 1000
+	mongodb.Send_request = true
+	mongodb.Send_response = true
+	mongodb.Transaction_timeout = TransactionTimeout
+}
+
+func (mongodb *Mongodb) setFromConfig() error {
+	if _ConfigMeta.IsDefined("mongodb", "max_doc_length") {
+		if _Config.Mongodb.Max_doc_length <= 0 {
+			return MsgError("Invalid mongodb.max_doc_length: %d", _Config.Mongodb.Max_doc_length)
+		}
+		mongodb.MaxDocLength = _Config.Mongodb.Max_doc_length
+	}
+	if _ConfigMeta.IsDefined("protocols", "mongodb", "send_request") {
+		mongodb.Send_request = _Config.Protocols["mongodb"].Send_request
+	}
+	if _ConfigMeta.IsDefined("protocols", "mongodb", "send_response") {
+		mongodb.Send_response = _Config.Protocols["mongodb"].Send_response
+	}
+	timeout, err := configTransactionTimeout("mongodb")
+	if err != nil {
+		return err
+	}
+	mongodb.Transaction_timeout = timeout
+	return nil
+}
+
+func (mongodb *Mongodb) Init(test_mode bool) error {
+
+	mongodb.InitDefaults()
+
+	if !test_mode {
+		err := mongodb.setFromConfig()
+		if err != nil {
+			return err
+		}
+		mongodb.Publisher = &Publisher
+	}
+
+	// the replies refer to the ID of their request
+	mongodb.transactions = NewIdTransactions(mongodb.expireTransaction)
+	mongodb.transactions.Timeout = mongodb.Transaction_timeout
+
+	return nil
+}
+
+func mongodbInt32(data []byte) int32 {
+	return int32(binary.LittleEndian.Uint32(data))
+}
+
+func mongodbReadCString(data []byte, offset int) (string, int, error) {
+	for i := offset; i < len(data); i++ {
+		if data[i] == 0 {
+			return string(data[offset:i]), i + 1, nil
+		}
+	}
+	return "", 0, MsgError("Unterminated string")
+}
+
+func mongodbReadDocument(data []byte, offset int) (bson.D, int, error) {
+	if offset+4 > len(data) {
+		return nil, 0, MsgError("Document out of the message")
+	}
+	length := int(mongodbInt32(data[offset:]))
+	if length < 5 || offset+length > len(data) {
+		return nil, 0, MsgError("Invalid document length: %d", length)
+	}
+	doc, err := mongodbUnmarshal(data[offset : offset+length])
+	if err != nil {
+		return nil, 0, err
+	}
+	return doc, offset + length, nil
+}
+
+// The bson package re-raises the runtime errors it hits on malformed
+// documents, they are turned into errors here.
+func mongodbUnmarshal(data []byte) (doc bson.D, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			doc = nil
+			err = MsgError("Malformed document: %v", r)
+		}
+	}()
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// Splits a full collection name of the form db.collection.
+func mongodbSplitCollection(name string) (database string, collection string) {
+	dot := strings.IndexByte(name, '.')
+	if dot < 0 {
+		return name, ""
+	}
+	return name[:dot], name[dot+1:]
+}
+
+func mongodbField(doc bson.D, name string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Name == name {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Numbers can be encoded as doubles, int32 or int64.
+func mongodbNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// The commands are documents whose first key is the command name, its
+// value is the collection for most of them.
+func (m *MongodbMessage) setCommand(body bson.D) {
+	m.IsCommand = true
+	if len(body) == 0 {
+		return
+	}
+	m.Method = body[0].Name
+	if collection, ok := body[0].Value.(string); ok {
+		m.Collection = collection
+	}
+	if m.Method == "getMore" {
+		if collection, ok := mongodbField(body, "collection"); ok {
+			m.Collection, _ = collection.(string)
+		}
+	}
+	if db, ok := mongodbField(body, "$db"); ok {
+		m.Database, _ = db.(string)
+	}
+}
+
+func mongodbParseMessage(data []byte) (*MongodbMessage, error) {
+
+	m := &MongodbMessage{Size: len(data)}
+	m.RequestId = mongodbInt32(data[4:8])
+	m.ResponseTo = mongodbInt32(data[8:12])
+	m.Opcode = mongodbInt32(data[12:16])
+
+	body := data[MongodbHeaderLength:]
+	var err error
+
+	switch m.Opcode {
+	case MongodbOpReply:
+		if len(body) < 20 {
+			return nil, MsgError("OP_REPLY too short")
+		}
+		m.Flags = binary.LittleEndian.Uint32(body[0:4])
+		m.CursorId = int64(binary.LittleEndian.Uint64(body[4:12]))
+		m.StartingFrom = mongodbInt32(body[12:16])
+		m.NumberReturned = int(mongodbInt32(body[16:20]))
+		if m.NumberReturned > 0 {
+			// the first document tells about the errors
+			m.Reply, _, err = mongodbReadDocument(body, 20)
+		}
+
+	case MongodbOpQuery:
+		m.IsRequest = true
+		m.ExpectsReply = true
+		if len(body) < 4 {
+			return nil, MsgError("OP_QUERY too short")
+		}
+		var name string
+		var off int
+		name, off, err = mongodbReadCString(body, 4)
+		if err != nil {
+			return nil, err
+		}
+		if off+8 > len(body) {
+			return nil, MsgError("OP_QUERY too short")
+		}
+		m.NumberToSkip = mongodbInt32(body[off : off+4])
+		m.NumberToReturn = mongodbInt32(body[off+4 : off+8])
+		m.Query, _, err = mongodbReadDocument(body, off+8)
+		if err != nil {
+			return nil, err
+		}
+		m.Database, m.Collection = mongodbSplitCollection(name)
+		if m.Collection == "$cmd" {
+			m.Collection = ""
+			command := m.Query
+			if len(command) > 0 && (command[0].Name == "$query" || command[0].Name == "query") {
+				// with read preference, the command is wrapped
+				if wrapped, ok := command[0].Value.(bson.D); ok {
+					command = wrapped
+				}
+			}
+			database := m.Database
+			m.setCommand(command)
+			m.Database = database
+		} else {
+			m.Method = "find"
+		}
+
+	case MongodbOpGetMore:
+		m.IsRequest = true
+		m.ExpectsReply = true
+		m.Method = "getMore"
+		var name string
+		var off int
+		name, off, err = mongodbReadCString(body, 4)
+		if err != nil {
+			return nil, err
+		}
+		if off+12 > len(body) {
+			return nil, MsgError("OP_GET_MORE too short")
+		}
+		m.NumberToReturn = mongodbInt32(body[off : off+4])
+		m.CursorId = int64(binary.LittleEndian.Uint64(body[off+4 : off+12]))
+		m.Database, m.Collection = mongodbSplitCollection(name)
+
+	case MongodbOpInsert:
+		m.IsRequest = true
+		m.Method = "insert"
+		var name string
+		var off int
+		name, off, err = mongodbReadCString(body, 4)
+		if err != nil {
+			return nil, err
+		}
+		m.Database, m.Collection = mongodbSplitCollection(name)
+		for off < len(body) {
+			var doc bson.D
+			doc, off, err = mongodbReadDocument(body, off)
+			if err != nil {
+				return nil, err
+			}
+			if m.Documents == 0 {
+				m.Query = doc
+			}
+			m.Documents += 1
+		}
+
+	case MongodbOpUpdate, MongodbOpDelete:
+		m.IsRequest = true
+		m.Method = "update"
+		if m.Opcode == MongodbOpDelete {
+			m.Method = "delete"
+		}
+		var name string
+		var off int
+		name, off, err = mongodbReadCString(body, 4)
+		if err != nil {
+			return nil, err
+		}
+		m.Database, m.Collection = mongodbSplitCollection(name)
+		// the flags come before the selector
+		m.Query, _, err = mongodbReadDocument(body, off+4)
+
+	case MongodbOpKillCursors:
+		m.IsRequest = true
+		m.Method = "killCursors"
+
+	case MongodbOpMsg:
+		err = m.parseMsg(body)
+
+	case MongodbOpCompressed:
+		// the content can't be looked at, only the header
+		m.IsRequest = m.ResponseTo == 0
+		m.ExpectsReply = m.IsRequest
+
+	default:
+		return nil, MsgError("Unknown opcode: %d", m.Opcode)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OP_MSG carries a body document and optional sequences of documents,
+// such as the documents of an insert.
+func (m *MongodbMessage) parseMsg(body []byte) error {
+
+	if len(body) < 5 {
+		return MsgError("OP_MSG too short")
+	}
+	flags := binary.LittleEndian.Uint32(body[0:4])
+	if flags&MongodbMsgChecksumPresent != 0 {
+		body = body[:len(body)-4]
+	}
+	m.Flags = flags
+
+	m.IsRequest = m.ResponseTo == 0
+	m.ExpectsReply = m.IsRequest && flags&MongodbMsgMoreToCome == 0
+
+	var doc bson.D
+	var err error
+	off := 4
+	for off < len(body) {
+		kind := body[off]
+		off += 1
+		switch kind {
+		case 0:
+			doc, off, err = mongodbReadDocument(body, off)
+			if err != nil {
+				return err
+			}
+			if m.IsRequest {
+				m.Query = doc
+				m.setCommand(doc)
+			} else {
+				m.Reply = doc
+			}
+
+		case 1:
+			if off+4 > len(body) {
+				return MsgError("OP_MSG section out of the message")
+			}
+			end := off + int(mongodbInt32(body[off:off+4]))
+			if end > len(body) || end < off+4 {
+				return MsgError("Invalid OP_MSG section size")
+			}
+			_, off, err = mongodbReadCString(body[:end], off+4)
+			if err != nil {
+				return err
+			}
+			for off < end {
+				_, off, err = mongodbReadDocument(body[:end], off)
+				if err != nil {
+					return err
+				}
+				m.Documents += 1
+			}
+
+		default:
+			return MsgError("Unknown OP_MSG section kind: %d", kind)
+		}
+	}
+
+	if !m.IsRequest && m.Reply != nil {
+		if cursor, ok := mongodbField(m.Reply, "cursor"); ok {
+			if cursor, ok := cursor.(bson.D); ok {
+				if id, ok := mongodbField(cursor, "id"); ok {
+					m.CursorId, _ = id.(int64)
+				}
+				for _, batch := range []string{"firstBatch", "nextBatch"} {
+					if docs, ok := mongodbField(cursor, batch); ok {
+						if docs, ok := docs.([]interface{}); ok {
+							m.NumberReturned = len(docs)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (mongodb *Mongodb) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	defer RECOVER("ParseMongodb exception")
+
+	stream, _ := tcp.data[dir].(*MongodbStream)
+
+	if stream == nil {
+		stream = &MongodbStream{tcpStream: tcp, data: pkt.payload}
+		tcp.data[dir] = stream
+	} else {
+		// concatenate bytes
+		stream.data = append(stream.data, pkt.payload...)
+		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
+			DEBUG("mongodb", "Stream data too large, dropping TCP stream")
+			tcp.data[dir] = nil
+			return
+		}
+	}
+
+	for len(stream.data) >= MongodbHeaderLength {
+		length := int(mongodbInt32(stream.data[0:4]))
+		if length < MongodbHeaderLength || length > MongodbMaxMessageSize {
+			DEBUG("mongodb", "Invalid message length %d. Drop tcp stream.", length)
+			tcp.data[dir] = nil
+			return
+		}
+		if len(stream.data) < length {
+			// wait for more data
+			break
+		}
+
+		m, err := mongodbParseMessage(stream.data[:length])
+		stream.data = stream.data[length:]
+		if err != nil {
+			DEBUG("mongodb", "Ignoring MongoDB message: %s", err)
+			continue
+		}
+
+		m.Ts = pkt.ts
+		m.Direction = dir
+		mongodb.handleMongodb(m, tcp)
+	}
+}
+
+func (mongodb *Mongodb) ReceivedFin(tcp *TcpStream, dir uint8) {
+	// nothing to do, the messages are length delimited
+}
+
+func (mongodb *Mongodb) GapInStream(tcp *TcpStream, dir uint8) {
+	// nothing to do, the parser starts over after the gap
+}
+
+func (mongodb *Mongodb) ConnectionExpired(tcp *TcpStream) {
+	// nothing to do, the pending requests expire on their own
+}
+
+// Recognizes the requests by their header and first document.
+func (mongodb *Mongodb) Detect(data []byte) int {
+
+	if len(data) < MongodbHeaderLength {
+		return 0
+	}
+	length := int(mongodbInt32(data[0:4]))
+	opcode := mongodbInt32(data[12:16])
+	if length < MongodbHeaderLength || length > MongodbMaxMessageSize ||
+		mongodbInt32(data[8:12]) != 0 {
+
+		return 0
+	}
+	if opcode != MongodbOpQuery && opcode != MongodbOpMsg {
+		return 0
+	}
+	if len(data) < length {
+		// incomplete, but looks good so far
+		return 50
+	}
+	m, err := mongodbParseMessage(data[:length])
+	if err != nil || !m.IsRequest {
+		return 0
+	}
+	return DetectionScoreCertain
+}
+
+func (mongodb *Mongodb) handleMongodb(m *MongodbMessage, tcp *TcpStream) {
+
+	if m.IsRequest {
+		DEBUG("mongodb", "MongoDB request %d: %s", m.RequestId, m.Method)
+		if !m.ExpectsReply {
+			// the writes of the legacy opcodes get no reply
+			trans := &IdTransaction{Ts: m.Ts, Data: m}
+			trans.Src, trans.Dst = mongodbEndpoints(tcp, m.Direction)
+			mongodb.publishTransaction(trans, nil, false)
+			return
+		}
+		mongodb.transactions.AddRequest(tcp.tuple, m.Direction, uint32(m.RequestId), m.Ts, m)
+		return
+	}
+
+	DEBUG("mongodb", "MongoDB response to %d", m.ResponseTo)
+	trans := mongodb.transactions.MatchResponse(tcp.tuple, m.Direction, uint32(m.ResponseTo), m.Ts)
+	if trans == nil {
+		return
+	}
+	mongodb.publishTransaction(trans, m, false)
+}
+
+func mongodbEndpoints(tcp *TcpStream, dir uint8) (src Endpoint, dst Endpoint) {
+	cmdline := procWatcher.FindProcessesTuple(tcp.tuple)
+	src = Endpoint{
+		Ip:   tcp.tuple.Src_ip.String(),
+		Port: tcp.tuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	dst = Endpoint{
+		Ip:   tcp.tuple.Dst_ip.String(),
+		Port: tcp.tuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+	if dir == TcpDirectionReverse {
+		src, dst = dst, src
+	}
+	return src, dst
+}
+
+func (mongodb *Mongodb) expireTransaction(trans *IdTransaction) {
+	mongodb.publishTransaction(trans, nil, true)
+}
+
+// Returns the error reported by a reply, or "" if it succeeded.
+func mongodbReplyError(request *MongodbMessage, response *MongodbMessage) string {
+
+	if response.Opcode == MongodbOpReply {
+		if response.Flags&MongodbReplyCursorNotFound != 0 {
+			return "cursor not found"
+		}
+		if msg, ok := mongodbField(response.Reply, "$err"); ok {
+			return fmt.Sprintf("%v", msg)
+		}
+		if response.Flags&MongodbReplyQueryFailure != 0 {
+			return "query failure"
+		}
+		if !request.IsCommand {
+			// documents of a collection, the fields are not ours
+			return ""
+		}
+	}
+
+	if ok, exists := mongodbField(response.Reply, "ok"); exists {
+		if value, isNumber := mongodbNumber(ok); isNumber && value == 0 {
+			if msg, exists := mongodbField(response.Reply, "errmsg"); exists {
+				return fmt.Sprintf("%v", msg)
+			}
+			return "ok: 0"
+		}
+	}
+	if errors, exists := mongodbField(response.Reply, "writeErrors"); exists {
+		if errors, ok := errors.([]interface{}); ok && len(errors) > 0 {
+			if first, ok := errors[0].(bson.D); ok {
+				if msg, exists := mongodbField(first, "errmsg"); exists {
+					return fmt.Sprintf("%v", msg)
+				}
+			}
+			return "write error"
+		}
+	}
+	return ""
+}
+
+// Formats a document in the shell syntax, cut at MaxDocLength.
+func (mongodb *Mongodb) formatDocument(doc bson.D) string {
+	str := mongodbFormatValue(doc)
+	if len(str) > mongodb.MaxDocLength {
+		return str[:mongodb.MaxDocLength] + "..."
+	}
+	return str
+}
+
+func mongodbFormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case bson.D:
+		fields := []string{}
+		for _, elem := range v {
+			fields = append(fields, strconv.Quote(elem.Name)+": "+mongodbFormatValue(elem.Value))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case []interface{}:
+		values := []string{}
+		for _, elem := range v {
+			values = append(values, mongodbFormatValue(elem))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case string:
+		return strconv.Quote(v)
+	case nil:
+		return "null"
+	case bson.ObjectId:
+		return fmt.Sprintf("ObjectId(%q)", v.Hex())
+	case time.Time:
+		return fmt.Sprintf("ISODate(%q)", v.UTC().Format(time.RFC3339Nano))
+	case []byte:
+		return fmt.Sprintf("BinData(%d bytes)", len(v))
+	case bson.Binary:
+		return fmt.Sprintf("BinData(%d bytes)", len(v.Data))
+	case bson.RegEx:
+		return fmt.Sprintf("/%s/%s", v.Pattern, v.Options)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func (mongodb *Mongodb) publishTransaction(t *IdTransaction, response *MongodbMessage, timedOut bool) {
+
+	if mongodb.Publisher == nil {
+		return
+	}
+
+	request := t.Data.(*MongodbMessage)
+
+	event := Event{}
+	event.Type = "mongodb"
+	event.ResponseTime = t.ResponseTime
+
+	event.Mongodb = bson.M{
+		"opcode":     MongodbOpcodeNames[request.Opcode],
+		"request_id": request.RequestId,
+		"method":     request.Method,
+		"database":   request.Database,
+		"collection": request.Collection,
+	}
+	if request.Query != nil {
+		event.Mongodb["query"] = mongodb.formatDocument(request.Query)
+	}
+	switch request.Opcode {
+	case MongodbOpQuery:
+		event.Mongodb["number_to_skip"] = request.NumberToSkip
+		event.Mongodb["number_to_return"] = request.NumberToReturn
+	case MongodbOpGetMore:
+		event.Mongodb["number_to_return"] = request.NumberToReturn
+		event.Mongodb["cursor_id"] = request.CursorId
+	}
+	if request.Documents > 0 {
+		event.Mongodb["documents"] = request.Documents
+	}
+
+	if mongodb.Send_request {
+		query := ""
+		if request.Query != nil {
+			query = mongodb.formatDocument(request.Query)
+		}
+		name := request.Database
+		if request.Collection != "" {
+			name += "." + request.Collection
+		}
+		event.RequestRaw = fmt.Sprintf("%s.%s(%s)", name, request.Method, query)
+	}
+
+	errorMessage := ""
+	if response != nil {
+		errorMessage = mongodbReplyError(request, response)
+		event.Mongodb["number_returned"] = response.NumberReturned
+		event.Mongodb["cursor_id"] = response.CursorId
+		if response.Opcode == MongodbOpReply {
+			event.Mongodb["starting_from"] = response.StartingFrom
+		}
+		if errorMessage != "" {
+			event.Mongodb["error"] = errorMessage
+		}
+		if mongodb.Send_response && response.Reply != nil {
+			event.ResponseRaw = mongodb.formatDocument(response.Reply)
+		}
+	}
+
+	if timedOut {
+		event.Status = TIMEOUT_STATUS
+	} else if errorMessage != "" {
+		event.Status = ERROR_STATUS
+	} else {
+		event.Status = OK_STATUS
+	}
+
+	err := mongodb.Publisher.PublishEvent(t.Ts, &t.Src, &t.Dst, &event)
+	if err != nil {
+		WARN("Publish failure: %s", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func MongodbModForTests() (*Mongodb, *recordingOutput) {
+	var mongodb Mongodb
+	mongodb.Init(true)
+	publisher, output := newRecordingPublisher()
+	mongodb.Publisher = publisher
+	return &mongodb, output
+}
+
+func mongodbInt32Bytes(v int32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return b
+}
+
+func mongodbInt64Bytes(v int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func mongodbCString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// Builds an ordered document from its keys and values.
+func mongodbDoc(pairs ...interface{}) bson.D {
+	doc := bson.D{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func mongodbDocBytes(t *testing.T, doc interface{}) []byte {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Builds a message from its header fields and its body parts.
+func mongodbTestMessage(requestId int32, responseTo int32, opcode int32, parts ...[]byte) []byte {
+	body := []byte{}
+	for _, part := range parts {
+		body = append(body, part...)
+	}
+	msg := mongodbInt32Bytes(int32(MongodbHeaderLength + len(body)))
+	msg = append(msg, mongodbInt32Bytes(requestId)...)
+	msg = append(msg, mongodbInt32Bytes(responseTo)...)
+	msg = append(msg, mongodbInt32Bytes(opcode)...)
+	return append(msg, body...)
+}
+
+func parseMongodb(mongodb *Mongodb, tcp *TcpStream, dir uint8, payload []byte) {
+	mongodb.Parse(&Packet{ts: time.Now(), payload: payload}, tcp, dir)
+}
+
+func TestMongodb_opMsgFind(t *testing.T) {
+
+	mongodb, output := MongodbModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	request := mongodbTestMessage(7, 0, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0},
+		mongodbDocBytes(t, mongodbDoc(
+			"find", "users",
+			"filter", mongodbDoc("age", mongodbDoc("$gt", 30)),
+			"$db", "test",
+		)))
+	reply := mongodbTestMessage(8, 7, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0},
+		mongodbDocBytes(t, mongodbDoc(
+			"cursor", mongodbDoc(
+				"firstBatch", []interface{}{mongodbDoc("name", "a"), mongodbDoc("name", "b")},
+				"id", int64(12),
+				"ns", "test.users",
+			),
+			"ok", 1.0,
+		)))
+
+	// the request is split over two segments
+	parseMongodb(mongodb, &tcp, 0, request[:20])
+	parseMongodb(mongodb, &tcp, 0, request[20:])
+	parseMongodb(mongodb, &tcp, 1, reply)
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Type != "mongodb" || event.Status != OK_STATUS {
+		t.Errorf("Wrong event: %v", event)
+	}
+	fields := event.Mongodb
+	if fields["opcode"] != "OP_MSG" || fields["method"] != "find" || fields["database"] != "test" ||
+		fields["collection"] != "users" || fields["number_returned"] != 2 ||
+		fields["cursor_id"] != int64(12) {
+
+		t.Errorf("Wrong mongodb fields: %v", fields)
+	}
+	if fields["query"] != `{"find": "users", "filter": {"age": {"$gt": 30}}, "$db": "test"}` {
+		t.Errorf("Wrong query: %s", fields["query"])
+	}
+	if event.RequestRaw != `test.users.find({"find": "users", "filter": {"age": {"$gt": 30}}, "$db": "test"})` {
+		t.Errorf("Wrong raw request: %s", event.RequestRaw)
+	}
+}
+
+func TestMongodb_opMsgWriteError(t *testing.T) {
+
+	mongodb, output := MongodbModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// the documents to insert are in a sequence section
+	docs := append(mongodbDocBytes(t, mongodbDoc("_id", 1)), mongodbDocBytes(t, mongodbDoc("_id", 1))...)
+	sequence := append(mongodbCString("documents"), docs...)
+	request := mongodbTestMessage(9, 0, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0},
+		mongodbDocBytes(t, mongodbDoc("insert", "users", "$db", "test")),
+		[]byte{1}, mongodbInt32Bytes(int32(4+len(sequence))), sequence)
+	reply := mongodbTestMessage(10, 9, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0},
+		mongodbDocBytes(t, mongodbDoc(
+			"n", 1,
+			"writeErrors", []interface{}{mongodbDoc(
+				"index", 1,
+				"code", 11000,
+				"errmsg", "E11000 duplicate key error",
+			)},
+			"ok", 1.0,
+		)))
+
+	parseMongodb(mongodb, &tcp, 0, request)
+	parseMongodb(mongodb, &tcp, 1, reply)
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != ERROR_STATUS || event.Mongodb["method"] != "insert" ||
+		event.Mongodb["documents"] != 2 || event.Mongodb["error"] != "E11000 duplicate key error" {
+
+		t.Errorf("Wrong event: %v %v", event.Status, event.Mongodb)
+	}
+}
+
+func TestMongodb_legacyQuery(t *testing.T) {
+
+	mongodb, output := MongodbModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// a query on a collection, a failed command and an insert
+	query := mongodbTestMessage(1, 0, MongodbOpQuery, mongodbInt32Bytes(0),
+		mongodbCString("test.users"), mongodbInt32Bytes(5), mongodbInt32Bytes(10),
+		mongodbDocBytes(t, mongodbDoc("ok", 0)))
+	command := mongodbTestMessage(2, 0, MongodbOpQuery, mongodbInt32Bytes(0),
+		mongodbCString("admin.$cmd"), mongodbInt32Bytes(0), mongodbInt32Bytes(-1),
+		mongodbDocBytes(t, mongodbDoc("$query", mongodbDoc("count", "users"))))
+	insert := mongodbTestMessage(3, 0, MongodbOpInsert, mongodbInt32Bytes(0),
+		mongodbCString("test.users"), mongodbDocBytes(t, mongodbDoc("a", 1)),
+		mongodbDocBytes(t, mongodbDoc("a", 2)))
+	parseMongodb(mongodb, &tcp, 0, append(append(query, command...), insert...))
+
+	if len(output.events) != 1 || output.events[0].Mongodb["method"] != "insert" ||
+		output.events[0].Mongodb["documents"] != 2 {
+
+		t.Fatalf("Expected the insert event: %v", output.events)
+	}
+
+	// the documents of the collection can have an ok field
+	replyQuery := mongodbTestMessage(4, 1, MongodbOpReply, mongodbInt32Bytes(0),
+		mongodbInt64Bytes(42), mongodbInt32Bytes(0), mongodbInt32Bytes(2),
+		mongodbDocBytes(t, mongodbDoc("ok", 0)), mongodbDocBytes(t, mongodbDoc("ok", 0)))
+	replyCommand := mongodbTestMessage(5, 2, MongodbOpReply, mongodbInt32Bytes(0),
+		mongodbInt64Bytes(0), mongodbInt32Bytes(0), mongodbInt32Bytes(1),
+		mongodbDocBytes(t, mongodbDoc("ok", 0.0, "errmsg", "not authorized")))
+	parseMongodb(mongodb, &tcp, 1, append(replyCommand, replyQuery...))
+
+	if len(output.events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(output.events))
+	}
+
+	count := output.events[1]
+	if count.Status != ERROR_STATUS || count.Mongodb["method"] != "count" ||
+		count.Mongodb["database"] != "admin" || count.Mongodb["collection"] != "users" ||
+		count.Mongodb["error"] != "not authorized" {
+
+		t.Errorf("Wrong command event: %v %v", count.Status, count.Mongodb)
+	}
+
+	find := output.events[2]
+	if find.Status != OK_STATUS || find.Mongodb["method"] != "find" ||
+		find.Mongodb["number_to_skip"] != int32(5) || find.Mongodb["number_to_return"] != int32(10) ||
+		find.Mongodb["number_returned"] != 2 || find.Mongodb["cursor_id"] != int64(42) {
+
+		t.Errorf("Wrong query event: %v %v", find.Status, find.Mongodb)
+	}
+	if mongodb.transactions.Pending() != 0 {
+		t.Errorf("Transactions left")
+	}
+}
+
+func TestMongodb_queryFailure(t *testing.T) {
+
+	mongodb, output := MongodbModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	parseMongodb(mongodb, &tcp, 0, mongodbTestMessage(1, 0, MongodbOpQuery, mongodbInt32Bytes(0),
+		mongodbCString("test.users"), mongodbInt32Bytes(0), mongodbInt32Bytes(0),
+		mongodbDocBytes(t, mongodbDoc("$where", "bad"))))
+	parseMongodb(mongodb, &tcp, 1, mongodbTestMessage(2, 1, MongodbOpReply,
+		mongodbInt32Bytes(MongodbReplyQueryFailure), mongodbInt64Bytes(0),
+		mongodbInt32Bytes(0), mongodbInt32Bytes(1),
+		mongodbDocBytes(t, mongodbDoc("$err", "invalid query", "code", 16722))))
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	if output.events[0].Status != ERROR_STATUS || output.events[0].Mongodb["error"] != "invalid query" {
+		t.Errorf("Wrong event: %v", output.events[0].Mongodb)
+	}
+}
+
+func TestMongodb_formatDocument(t *testing.T) {
+
+	mongodb, _ := MongodbModForTests()
+	mongodb.MaxDocLength = 20
+
+	doc := mongodbDoc("name", "a very long name", "tags", []interface{}{"x", nil, true})
+	if str := mongodb.formatDocument(doc); str != `{"name": "a very lon...` {
+		t.Errorf("Wrong document: %s", str)
+	}
+}
+
+func TestMongodb_detect(t *testing.T) {
+
+	mongodb, _ := MongodbModForTests()
+
+	request := mongodbTestMessage(7, 0, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0},
+		mongodbDocBytes(t, mongodbDoc("ping", 1, "$db", "admin")))
+
+	if score := mongodb.Detect(request); score != DetectionScoreCertain {
+		t.Errorf("OP_MSG request scored %d", score)
+	}
+	if score := mongodb.Detect(request[:20]); score != 50 {
+		t.Errorf("Partial OP_MSG request scored %d", score)
+	}
+	if score := mongodb.Detect([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")); score != 0 {
+		t.Errorf("HTTP request scored %d", score)
+	}
+
+	// a string element with a length of 0 and one with a negative length
+	for _, strLength := range []int32{0, -1308622833} {
+		doc := []byte{2, 'a', 0}
+		doc = append(doc, mongodbInt32Bytes(strLength)...)
+		doc = append(doc, 0)
+		doc = append(mongodbInt32Bytes(int32(4+len(doc))), doc...)
+		malformed := mongodbTestMessage(7, 0, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0}, doc)
+
+		if score := mongodb.Detect(malformed); score != 0 {
+			t.Errorf("Malformed document with string length %d scored %d", strLength, score)
+		}
+	}
+}
+
+func TestMongodb_malformedDocument(t *testing.T) {
+
+	mongodb, output := MongodbModForTests()
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	doc := []byte{2, 'a', 0}
+	doc = append(doc, mongodbInt32Bytes(0)...)
+	doc = append(doc, 0)
+	doc = append(mongodbInt32Bytes(int32(4+len(doc))), doc...)
+	malformed := mongodbTestMessage(1, 0, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0}, doc)
+
+	// the malformed message is skipped and the next one is parsed
+	parseMongodb(mongodb, &tcp, 0, malformed)
+	parseMongodb(mongodb, &tcp, 0, mongodbTestMessage(2, 0, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0},
+		mongodbDocBytes(t, mongodbDoc("ping", 1, "$db", "admin"))))
+	parseMongodb(mongodb, &tcp, 1, mongodbTestMessage(3, 2, MongodbOpMsg, mongodbInt32Bytes(0), []byte{0},
+		mongodbDocBytes(t, mongodbDoc("ok", 1.0))))
+
+	if len(output.events) != 1 || output.events[0].Mongodb["method"] != "ping" {
+		t.Errorf("Expected the ping event: %v", output.events)
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/csv"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -12,11 +14,58 @@ import (
 
 // Packet types
 const (
-	MYSQL_CMD_QUERY = 3
+	MYSQL_CMD_INIT_DB      = 2
+	MYSQL_CMD_QUERY        = 3
+	MYSQL_CMD_STMT_PREPARE = 22
+	MYSQL_CMD_STMT_EXECUTE = 23
+	MYSQL_CMD_STMT_CLOSE   = 25
+)
+
+// Column types, as used by the binary protocol
+const (
+	MYSQL_TYPE_TINY      = 1
+	MYSQL_TYPE_SHORT     = 2
+	MYSQL_TYPE_LONG      = 3
+	MYSQL_TYPE_FLOAT     = 4
+	MYSQL_TYPE_DOUBLE    = 5
+	MYSQL_TYPE_NULL      = 6
+	MYSQL_TYPE_TIMESTAMP = 7
+	MYSQL_TYPE_LONGLONG  = 8
+	MYSQL_TYPE_INT24     = 9
+	MYSQL_TYPE_DATE      = 10
+	MYSQL_TYPE_TIME      = 11
+	MYSQL_TYPE_DATETIME  = 12
+	MYSQL_TYPE_YEAR      = 13
+)
+
+const MYSQL_UNSIGNED_FLAG = 0x20
+
+// Version of the protocol, first byte of the initial handshake
+const MYSQL_PROTOCOL_VERSION = 10
+
+// Capability flags
+const (
+	MYSQL_CLIENT_CONNECT_WITH_DB                = 0x00000008
+	MYSQL_CLIENT_PROTOCOL_41                    = 0x00000200
+	MYSQL_CLIENT_SSL                            = 0x00000800
+	MYSQL_CLIENT_SECURE_CONNECTION              = 0x00008000
+	MYSQL_CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA = 0x00200000
+)
+
+// Status flags, sent in the OK and EOF packets
+const (
+	MYSQL_SERVER_MORE_RESULTS_EXISTS = 0x0008
 )
 
 const MAX_PAYLOAD_SIZE = 100 * 1024
 
+// Counters of one of the result sets of a response. CALL statements
+// and multi-statement queries get more than one.
+type MysqlResultSet struct {
+	NumberOfFields int
+	NumberOfRows   int
+}
+
 type MysqlMessage struct {
 	start int
 	end   int
@@ -33,13 +82,25 @@ type MysqlMessage struct {
 	Rows           [][]string
 	Tables         string
 	IsOK           bool
-	AffectedRows   int
-	InsertId       int
+	AffectedRows   uint64
+	InsertId       uint64
+	StatusFlags    uint16
+	Warnings       uint16
 	IsError        bool
 	ErrorCode      int
+	SqlState       string
 	ErrorInfo      string
 	Query          string
 	IgnoreMessage  bool
+	ResultSets     []MysqlResultSet
+
+	// connection phase
+	IsGreeting    bool
+	IsLogin       bool
+	ServerVersion string
+	Capabilities  uint32
+	User          string
+	Database      string
 
 	Direction    uint8
 	IsTruncated  bool
@@ -63,11 +124,13 @@ type MysqlTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer    *time.Timer
+	timedOut bool
 }
 
 type MysqlStream struct {
 	tcpStream *TcpStream
+	dir       uint8
 
 	data []byte
 
@@ -88,10 +151,58 @@ const (
 	MysqlStateEatMessage
 	MysqlStateEatFields
 	MysqlStateEatRows
+	MysqlStateNextResult
 )
 
 var mysqlTransactionsMap = make(map[HashableTcpTuple]*MysqlTransaction, TransactionsHashSize)
 
+// A statement prepared on the server with COM_STMT_PREPARE.
+type mysqlStatement struct {
+	query     string
+	numParams int
+
+	// type and flags of each parameter, sent by the client only with
+	// the first execution
+	paramTypes []byte
+}
+
+// What is known about a connection from its handshake and from the
+// commands sent on it.
+type mysqlConnection struct {
+	serverVersion string
+	capabilities  uint32
+	user          string
+	database      string
+
+	// set from the handshake response until the OK or ERR packet that
+	// ends the authentication, which can take more packets in between
+	authenticating bool
+	clientDir      uint8
+
+	// prepared statements, by id
+	statements map[uint32]*mysqlStatement
+}
+
+var mysqlConnectionsMap = make(map[HashableTcpTuple]*mysqlConnection)
+
+func getMysqlConnection(tuple TcpTuple) *mysqlConnection {
+	conn := mysqlConnectionsMap[tuple.raw]
+	if conn == nil {
+		conn = &mysqlConnection{statements: make(map[uint32]*mysqlStatement)}
+		mysqlConnectionsMap[tuple.raw] = conn
+	}
+	return conn
+}
+
+type Mysql struct {
+}
+
+var MysqlMod Mysql
+
+func init() {
+	RegisterProtocolPlugin("mysql", &MysqlMod)
+}
+
 func (stream *MysqlStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.message.end:]
 	stream.parseState = MysqlStateStart
@@ -100,6 +211,50 @@ func (stream *MysqlStream) PrepareForNewMessage() {
 	stream.message = nil
 }
 
+// The connection of the stream, nil when the parser runs without one.
+func (s *MysqlStream) connection() *mysqlConnection {
+	if s.tcpStream == nil || s.tcpStream.tuple == nil {
+		return nil
+	}
+	return getMysqlConnection(TcpTupleFromIpPort(s.tcpStream.tuple, s.tcpStream.id))
+}
+
+// The packets exchanged during the authentication, after the handshake
+// response: auth switch requests and more auth data from the server,
+// the client answers to them. They are neither commands nor responses
+// to commands. Returns true when the packet is one of them.
+func (s *MysqlStream) isAuthPacket(m *MysqlMessage) bool {
+	conn := s.connection()
+	if conn == nil || !conn.authenticating {
+		return false
+	}
+	if s.dir == conn.clientDir {
+		if m.Seq != 0 {
+			return true
+		}
+		// a command, the end of the authentication was missed
+		conn.authenticating = false
+		return false
+	}
+	if m.Typ != 0x00 && m.Typ != 0xff {
+		return true
+	}
+	// the OK or ERR packet answering the login
+	conn.authenticating = false
+	return false
+}
+
+// The COM_STMT_PREPARE response starts with an OK packet that has its
+// own layout, so the parser needs to know which command it answers.
+func (s *MysqlStream) answersPrepare() bool {
+	if s.tcpStream == nil || s.tcpStream.tuple == nil {
+		return false
+	}
+	tuple := TcpTupleFromIpPort(s.tcpStream.tuple, s.tcpStream.id)
+	trans := mysqlTransactionsMap[tuple.raw]
+	return trans != nil && trans.Mysql["command"] == "prepare"
+}
+
 func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 
 	DEBUG("mysqldetailed", "MySQL parser called. parseState = %d", s.parseState)
@@ -120,10 +275,42 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 
 			DEBUG("mysqldetailed", "MySQL Header: Packet length %d, Seq %d, Type=%d", m.PacketLength, m.Seq, m.Typ)
 
-			if m.Seq == 0 {
+			if s.isAuthPacket(m) {
+				DEBUG("mysqldetailed", "Received authentication data")
+				m.IgnoreMessage = true
+				s.parseState = MysqlStateEatMessage
+				break
+			}
+
+			if m.Seq == 1 && m.PacketLength >= 32 && len(s.data[s.parseOffset:]) < 4+32 {
+				// can't tell yet if it's a handshake response
+				return true, false
+			}
+
+			if m.Seq == 0 && m.Typ == MYSQL_PROTOCOL_VERSION && m.PacketLength > 1 {
+				// starts Connection Phase
+				DEBUG("mysqldetailed", "Received initial handshake")
+				m.IsGreeting = true
+				s.parseState = MysqlStateEatMessage
+
+			} else if m.Seq == 1 && isMysqlHandshakeResponse(s.data[s.parseOffset:]) {
+				DEBUG("mysqldetailed", "Received handshake response")
+				m.IsLogin = true
+				m.IsRequest = true
+				s.parseState = MysqlStateEatMessage
+				if conn := s.connection(); conn != nil {
+					conn.authenticating = true
+					conn.clientDir = s.dir
+				}
+
+			} else if m.Seq == 0 {
 				// starts Command Phase
 
-				if m.Typ == MYSQL_CMD_QUERY {
+				if m.Typ == MYSQL_CMD_QUERY ||
+					m.Typ == MYSQL_CMD_INIT_DB ||
+					m.Typ == MYSQL_CMD_STMT_PREPARE ||
+					m.Typ == MYSQL_CMD_STMT_EXECUTE ||
+					m.Typ == MYSQL_CMD_STMT_CLOSE {
 					// parse request
 					m.IsRequest = true
 					m.start = s.parseOffset
@@ -177,14 +364,31 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 				s.parseOffset += 4 //header
 				s.parseOffset += int(m.PacketLength)
 				m.end = s.parseOffset
-				if m.IsRequest {
-					m.Query = string(s.data[m.start+5 : m.end])
-				} else if m.IsOK {
-					m.AffectedRows = int(s.data[m.start+5])
-					m.InsertId = int(s.data[m.start+6])
+				if m.IsOK && !m.IsRequest && !s.answersPrepare() {
+					if !parseMysqlOK(m, s.data[m.start+4:m.end]) {
+						return false, false
+					}
+					if m.StatusFlags&MYSQL_SERVER_MORE_RESULTS_EXISTS != 0 {
+						// multi-statement query, the results of the
+						// next statements follow
+						DEBUG("mysqldetailed", "More results follow the OK packet")
+						m.ResultSets = append(m.ResultSets, MysqlResultSet{})
+						m.end = 0
+						s.parseState = MysqlStateNextResult
+						break
+					}
+				}
+				if m.IsGreeting {
+					parseMysqlGreeting(m, s.data[m.start+4:m.end])
+				} else if m.IsLogin {
+					parseMysqlLogin(m, s.data[m.start+4:m.end])
+				} else if m.IsRequest {
+					if m.Typ == MYSQL_CMD_QUERY || m.Typ == MYSQL_CMD_STMT_PREPARE ||
+						m.Typ == MYSQL_CMD_INIT_DB {
+						m.Query = string(s.data[m.start+5 : m.end])
+					}
 				} else if m.IsError {
-					m.ErrorCode = int(uint16(s.data[m.start+6])<<8 | uint16(s.data[m.start+7]))
-					m.ErrorInfo = string(s.data[m.start+9:m.start+14]) + ": " + string(s.data[m.start+15:])
+					parseMysqlError(m, s.data[m.start+4:m.end])
 				}
 				DEBUG("mysqldetailed", "Message complete. remaining=%d", len(s.data[s.parseOffset:]))
 				return true, true
@@ -272,8 +476,20 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 				if uint8(s.data[s.parseOffset]) == 0xfe {
 					DEBUG("mysqldetailed", "Received EOF packet")
 					// EOF marker
+					status := mysqlEofStatus(s.data[s.parseOffset : s.parseOffset+int(m.PacketLength)])
 					s.parseOffset += int(m.PacketLength)
 
+					m.ResultSets = append(m.ResultSets, MysqlResultSet{
+						NumberOfFields: m.NumberOfFields,
+						NumberOfRows:   m.NumberOfRows,
+					})
+					if status&MYSQL_SERVER_MORE_RESULTS_EXISTS != 0 {
+						DEBUG("mysqldetailed", "More results follow the EOF packet")
+						s.parseState = MysqlStateNextResult
+						break
+					}
+
+					m.NumberOfFields, m.NumberOfRows = sumMysqlResultSets(m.ResultSets)
 					if m.end == 0 {
 						m.end = s.parseOffset
 					} else {
@@ -300,43 +516,342 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 			}
 
 			break
+
+		case MysqlStateNextResult:
+			if len(s.data[s.parseOffset:]) < 5 {
+				// wait for more
+				return true, false
+			}
+			hdr := s.data[s.parseOffset : s.parseOffset+5]
+			m.PacketLength = uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16
+			m.Seq = uint8(hdr[3])
+
+			DEBUG("mysqldetailed", "Next result: packet length %d, packet number %d", m.PacketLength, m.Seq)
+
+			if uint8(hdr[4]) != 0x00 && uint8(hdr[4]) != 0xff {
+				// starts another result set
+				DEBUG("mysqldetailed", "Query response. Number of fields %d", uint8(hdr[4]))
+				m.NumberOfFields = int(hdr[4])
+				m.NumberOfRows = 0
+				s.parseOffset += 5
+				s.parseState = MysqlStateEatFields
+				break
+			}
+
+			if len(s.data[s.parseOffset:]) < int(m.PacketLength)+4 {
+				// wait for more
+				return true, false
+			}
+			body := s.data[s.parseOffset+4 : s.parseOffset+4+int(m.PacketLength)]
+			s.parseOffset += 4 + int(m.PacketLength)
+
+			if uint8(hdr[4]) == 0xff {
+				DEBUG("mysqldetailed", "Received ERR response")
+				m.IsOK = false
+				m.IsError = true
+				parseMysqlError(m, body)
+			} else {
+				// the status of a statement that returned no result
+				// set, or the final status of a CALL
+				if !parseMysqlOK(m, body) {
+					return false, false
+				}
+				if m.StatusFlags&MYSQL_SERVER_MORE_RESULTS_EXISTS != 0 {
+					DEBUG("mysqldetailed", "More results follow the OK packet")
+					m.ResultSets = append(m.ResultSets, MysqlResultSet{})
+					break
+				}
+				m.IsOK = true
+			}
+
+			// last packet of the response
+			m.NumberOfFields, m.NumberOfRows = sumMysqlResultSets(m.ResultSets)
+			if m.end == 0 {
+				m.end = s.parseOffset
+			} else {
+				m.IsTruncated = true
+			}
+			m.Size = uint64(s.parseOffset - m.start)
+			return true, true
 		}
 	}
 
 	return true, false
 }
 
+// Returns the status flags of an EOF packet, sent after its header
+// byte and the number of warnings.
+func mysqlEofStatus(body []byte) uint16 {
+	if len(body) < 5 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(body[3:5])
+}
+
+// Returns the number of fields of the first result set and the total
+// number of rows of a response.
+func sumMysqlResultSets(results []MysqlResultSet) (int, int) {
+	if len(results) == 0 {
+		return 0, 0
+	}
+	rows := 0
+	for _, result := range results {
+		rows += result.NumberOfRows
+	}
+	return results[0].NumberOfFields, rows
+}
+
+// Reads the fields of an OK packet: the header byte, the affected rows
+// and last insert id as length encoded integers, the status flags and
+// the number of warnings.
+func parseMysqlOK(m *MysqlMessage, body []byte) bool {
+
+	var complete bool
+	var err error
+	off := 1
+
+	m.AffectedRows, off, complete, err = read_linteger(body, off)
+	if err != nil || !complete {
+		DEBUG("mysql", "Failed to read the affected rows: %s", err)
+		return false
+	}
+	m.InsertId, off, complete, err = read_linteger(body, off)
+	if err != nil || !complete {
+		DEBUG("mysql", "Failed to read the last insert id: %s", err)
+		return false
+	}
+
+	if len(body) >= off+4 {
+		m.StatusFlags = binary.LittleEndian.Uint16(body[off : off+2])
+		m.Warnings = binary.LittleEndian.Uint16(body[off+2 : off+4])
+	}
+
+	DEBUG("mysqldetailed", "OK: affected_rows=%d, insert_id=%d, status=%x, warnings=%d",
+		m.AffectedRows, m.InsertId, m.StatusFlags, m.Warnings)
+	return true
+}
+
+// Reads the fields of an ERR packet: the header byte, the error code
+// and, with the 4.1 protocol, the SQL state marker and the SQL state,
+// followed by the error message.
+func parseMysqlError(m *MysqlMessage, body []byte) {
+
+	if len(body) < 3 {
+		return
+	}
+	m.ErrorCode = int(binary.LittleEndian.Uint16(body[1:3]))
+
+	message := body[3:]
+	if len(message) >= 6 && message[0] == '#' {
+		m.SqlState = string(message[1:6])
+		message = message[6:]
+	}
+
+	if len(m.SqlState) > 0 {
+		m.ErrorInfo = m.SqlState + ": " + string(message)
+	} else {
+		m.ErrorInfo = string(message)
+	}
+}
+
+// The handshake response starts with the capability flags, the
+// maximum packet size, the character set and 23 zero bytes.
+func isMysqlHandshakeResponse(data []byte) bool {
+
+	if len(data) < 4+32 {
+		return false
+	}
+	body := data[4:]
+	if body[0] == 0x00 || body[0] >= 0xfe {
+		// OK, EOF or ERR packets
+		return false
+	}
+	capabilities := binary.LittleEndian.Uint32(body[0:4])
+	if capabilities&MYSQL_CLIENT_PROTOCOL_41 == 0 {
+		return false
+	}
+	for _, b := range body[9:32] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func parseMysqlGreeting(m *MysqlMessage, body []byte) {
+
+	// protocol version, then the null terminated server version
+	i := bytes.IndexByte(body[1:], 0)
+	if i == -1 {
+		return
+	}
+	m.ServerVersion = string(body[1 : 1+i])
+
+	// connection id, auth plugin data, filler
+	off := 1 + i + 1 + 4 + 8 + 1
+	if len(body) >= off+2 {
+		m.Capabilities = uint32(binary.LittleEndian.Uint16(body[off : off+2]))
+	}
+	// character set, status flags
+	off += 2 + 1 + 2
+	if len(body) >= off+2 {
+		m.Capabilities |= uint32(binary.LittleEndian.Uint16(body[off:off+2])) << 16
+	}
+
+	DEBUG("mysqldetailed", "Server version %s, capabilities %x", m.ServerVersion, m.Capabilities)
+}
+
+func parseMysqlLogin(m *MysqlMessage, body []byte) {
+
+	m.Capabilities = binary.LittleEndian.Uint32(body[0:4])
+	if len(body) == 32 && m.Capabilities&MYSQL_CLIENT_SSL != 0 {
+		// SSL request, the real handshake response is encrypted
+		DEBUG("mysql", "Connection switches to SSL")
+		m.IgnoreMessage = true
+		return
+	}
+
+	// capabilities, max packet size, character set, reserved
+	off := 32
+	i := bytes.IndexByte(body[off:], 0)
+	if i == -1 {
+		return
+	}
+	m.User = string(body[off : off+i])
+	off += i + 1
+
+	// skip the auth response
+	if m.Capabilities&MYSQL_CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA != 0 {
+		_, next, complete, err := read_lstring(body, off)
+		if err != nil || !complete {
+			return
+		}
+		off = next
+	} else if m.Capabilities&MYSQL_CLIENT_SECURE_CONNECTION != 0 {
+		if off >= len(body) {
+			return
+		}
+		off += 1 + int(body[off])
+	} else {
+		i = bytes.IndexByte(body[off:], 0)
+		if i == -1 {
+			return
+		}
+		off += i + 1
+	}
+
+	if m.Capabilities&MYSQL_CLIENT_CONNECT_WITH_DB != 0 && off < len(body) {
+		i = bytes.IndexByte(body[off:], 0)
+		if i == -1 {
+			i = len(body) - off
+		}
+		m.Database = string(body[off : off+i])
+	}
+
+	DEBUG("mysqldetailed", "Login user=%s, database=%s", m.User, m.Database)
+}
+
+func (mysql *Mysql) Init(test_mode bool) error {
+	return nil
+}
+
+func (mysql *Mysql) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	ParseMysql(pkt, tcp, dir)
+}
+
+func (mysql *Mysql) ReceivedFin(tcp *TcpStream, dir uint8) {
+	// nothing to do, the responses are length delimited
+}
+
+func (mysql *Mysql) GapInStream(tcp *TcpStream, dir uint8) {
+	// nothing to do, the parser starts over after the gap
+}
+
+func (mysql *Mysql) ConnectionExpired(tcp *TcpStream) {
+	// the pending transactions expire on their own, but the prepared
+	// statements are only valid during the connection
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	delete(mysqlConnectionsMap, tuple.raw)
+}
+
+var mysqlQueryVerbs = []string{
+	"SELECT", "INSERT", "UPDATE", "DELETE", "SET", "SHOW", "USE", "CREATE",
+	"DROP", "ALTER", "BEGIN", "COMMIT", "ROLLBACK", "REPLACE", "CALL",
+}
+
+// Recognizes the greeting sent by the server when the connection opens
+// or a COM_QUERY with a known SQL verb.
+func (mysql *Mysql) Detect(data []byte) int {
+
+	if len(data) < 5 {
+		return 0
+	}
+
+	length := int(uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16)
+	seq := data[3]
+	if seq != 0 {
+		return 0
+	}
+
+	switch data[4] {
+	case 0x0a:
+		// protocol version 10, followed by the null terminated
+		// server version
+		if length > 1024 || len(data) < 6 || data[5] < '0' || data[5] > '9' {
+			return 0
+		}
+		if bytes.IndexByte(data[5:], 0) == -1 {
+			return 50
+		}
+		return DetectionScoreCertain
+	case MYSQL_CMD_QUERY:
+		if length != len(data)-4 {
+			return 0
+		}
+		query := strings.ToUpper(strings.TrimSpace(string(data[5:])))
+		for _, verb := range mysqlQueryVerbs {
+			if strings.HasPrefix(query, verb) {
+				return DetectionScoreCertain
+			}
+		}
+	}
+	return 0
+}
+
 func ParseMysql(pkt *Packet, tcp *TcpStream, dir uint8) {
 
 	defer RECOVER("ParseMysql exception")
 
-	if tcp.mysqlData[dir] == nil {
-		tcp.mysqlData[dir] = &MysqlStream{
+	stream, _ := tcp.data[dir].(*MysqlStream)
+
+	if stream == nil {
+		stream = &MysqlStream{
 			tcpStream: tcp,
+			dir:       dir,
 			data:      pkt.payload,
 			message:   &MysqlMessage{Ts: pkt.ts},
 		}
+		tcp.data[dir] = stream
 	} else {
 		// concatenate bytes
-		tcp.mysqlData[dir].data = append(tcp.mysqlData[dir].data, pkt.payload...)
-		if len(tcp.mysqlData[dir].data) > TCP_MAX_DATA_IN_STREAM {
+		stream.data = append(stream.data, pkt.payload...)
+		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
 			DEBUG("mysql", "Stream data too large, dropping TCP stream")
-			tcp.mysqlData[dir] = nil
+			tcp.data[dir] = nil
 			return
 		}
 	}
 
-	stream := tcp.mysqlData[dir]
 	for len(stream.data) > 0 {
 		if stream.message == nil {
 			stream.message = &MysqlMessage{Ts: pkt.ts}
 		}
 
-		ok, complete := mysqlMessageParser(tcp.mysqlData[dir])
+		ok, complete := mysqlMessageParser(stream)
 		if !ok {
 			// drop this tcp stream. Will retry parsing with the next
 			// segment in it
-			tcp.mysqlData[dir] = nil
+			tcp.data[dir] = nil
 			DEBUG("mysql", "Ignore MySQL message. Drop tcp stream. Try parsing with the next segment")
 			return
 		}
@@ -366,18 +881,32 @@ var handleMysql = func(m *MysqlMessage, tcp *TcpStream,
 	m.CmdlineTuple = procWatcher.FindProcessesTuple(tcp.tuple)
 	m.Raw = raw_msg
 
-	if m.IsRequest {
+	if m.IsGreeting {
+		receivedMysqlGreeting(m)
+	} else if m.IsRequest {
 		receivedMysqlRequest(m)
 	} else {
 		receivedMysqlResponse(m)
 	}
 }
 
+func receivedMysqlGreeting(msg *MysqlMessage) {
+	conn := getMysqlConnection(msg.TcpTuple)
+	conn.serverVersion = msg.ServerVersion
+	conn.capabilities = msg.Capabilities
+}
+
 func receivedMysqlRequest(msg *MysqlMessage) {
 
 	// Add it to the HT
 	tuple := msg.TcpTuple
 
+	if msg.Typ == MYSQL_CMD_STMT_CLOSE {
+		// no response is sent for it
+		closeMysqlStatement(tuple, msg.Raw)
+		return
+	}
+
 	trans := mysqlTransactionsMap[tuple.raw]
 	if trans != nil {
 		if len(trans.Mysql) != 0 {
@@ -405,9 +934,37 @@ func receivedMysqlRequest(msg *MysqlMessage) {
 		trans.Src, trans.Dst = trans.Dst, trans.Src
 	}
 
+	conn := getMysqlConnection(tuple)
+
+	raw_query := msg.Query
+	command := "query"
+	var params []string
+	var stmt_id uint32
+	switch {
+	case msg.IsLogin:
+		command = "login"
+		conn.user = msg.User
+		conn.database = msg.Database
+		if conn.capabilities == 0 {
+			// the initial handshake wasn't seen
+			conn.capabilities = msg.Capabilities
+		} else {
+			conn.capabilities &= msg.Capabilities
+		}
+	case msg.Typ == MYSQL_CMD_INIT_DB:
+		command = "init_db"
+		conn.database = msg.Query
+		raw_query = "USE " + msg.Query
+	case msg.Typ == MYSQL_CMD_STMT_PREPARE:
+		command = "prepare"
+	case msg.Typ == MYSQL_CMD_STMT_EXECUTE:
+		command = "execute"
+		stmt_id, raw_query, params = executedMysqlStatement(tuple, msg.Raw)
+	}
+
 	// Extract the method, by simply taking the first word and
 	// making it upper case.
-	query := strings.Trim(msg.Query, " \n\t")
+	query := strings.Trim(raw_query, " \n\t")
 	index := strings.IndexAny(query, " \n\t")
 	var method string
 	if index > 0 {
@@ -415,15 +972,39 @@ func receivedMysqlRequest(msg *MysqlMessage) {
 	} else {
 		method = strings.ToUpper(query)
 	}
+	if len(method) == 0 && command == "execute" {
+		// the statement was prepared before the capture started
+		method = "EXECUTE"
+	}
+	if command == "login" {
+		method = "LOGIN"
+	}
+	if command == "query" && method == "USE" && len(query) > 4 {
+		conn.database = strings.Trim(query[4:], " `;")
+	}
 
 	trans.Mysql = bson.M{
 		"query":     query,
-		"query.raw": msg.Query,
+		"query.raw": raw_query,
 		"method":    method,
+		"command":   command,
+		"user":      conn.user,
+		"database":  conn.database,
+		"tables":    "",
+	}
+	if len(query) > 0 {
+		fingerprint, hash, tables := analyzeSql(query, false)
+		trans.Mysql["query_fingerprint"] = fingerprint
+		trans.Mysql["query_hash"] = hash
+		trans.Mysql["tables"] = strings.Join(tables, ", ")
+	}
+	if command == "execute" {
+		trans.Mysql["statement_id"] = stmt_id
+		trans.Mysql["params"] = params
 	}
 
 	// save Raw message
-	trans.Request_raw = msg.Query
+	trans.Request_raw = raw_query
 
 	if trans.timer != nil {
 		trans.timer.Stop()
@@ -449,20 +1030,66 @@ func receivedMysqlResponse(msg *MysqlMessage) {
 		"isok":          msg.IsOK,
 		"affected_rows": msg.AffectedRows,
 		"insert_id":     msg.InsertId,
-		"tables":        msg.Tables,
+		"status_flags":  msg.StatusFlags,
+		"warnings":      msg.Warnings,
 		"num_rows":      msg.NumberOfRows,
 		"size":          msg.Size,
 		"num_fields":    msg.NumberOfFields,
 		"iserror":       msg.IsError,
 		"error_code":    msg.ErrorCode,
+		"sql_state":     msg.SqlState,
 		"error_message": msg.ErrorInfo,
 	})
 
+	if len(msg.ResultSets) > 1 {
+		result_sets := []bson.M{}
+		for _, result := range msg.ResultSets {
+			result_sets = append(result_sets, bson.M{
+				"num_fields": result.NumberOfFields,
+				"num_rows":   result.NumberOfRows,
+			})
+		}
+		trans.Mysql["result_sets"] = result_sets
+	}
+
+	if len(msg.Tables) > 0 {
+		// the tables of the result set are more precise than the
+		// ones found in the query
+		trans.Mysql["tables"] = msg.Tables
+	}
+
 	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
 
+	if trans.Mysql["command"] == "prepare" && msg.IsOK {
+		stmt_id, stmt := preparedMysqlStatement(tuple, trans.Mysql["query.raw"].(string), msg.Raw)
+		if stmt != nil {
+			trans.Mysql["statement_id"] = stmt_id
+			trans.Mysql["num_params"] = stmt.numParams
+		}
+	}
+
+	if trans.Mysql["command"] == "login" {
+		if !msg.IsError {
+			// only the failed logins are published
+			DEBUG("mysql", "User %s logged in", trans.Mysql["user"])
+			delete(mysqlTransactionsMap, trans.tuple.raw)
+			if trans.timer != nil {
+				trans.timer.Stop()
+			}
+			return
+		}
+		trans.Mysql["server_version"] = getMysqlConnection(tuple).serverVersion
+	}
+
 	// save Raw message
 	if len(msg.Raw) > 0 {
-		fields, rows := parseMysqlResponse(msg.Raw)
+		var fields []string
+		var rows [][]string
+		if trans.Mysql["command"] == "execute" {
+			fields, rows = parseMysqlBinaryResponse(msg.Raw)
+		} else {
+			fields, rows = parseMysqlResponse(msg.Raw)
+		}
 
 		trans.Response_raw = dumpInCSVFormat(fields, rows)
 	}
@@ -483,11 +1110,126 @@ func receivedMysqlResponse(msg *MysqlMessage) {
 }
 
 func (trans *MysqlTransaction) Expire() {
-	// TODO: Here we need to PUBLISH an incomplete/timeout transaction
+
+	if len(trans.Mysql) != 0 {
+		// the query never got a response
+		trans.timedOut = true
+		trans.ResponseTime = TimeoutResponseTime
+
+		err := Publisher.PublishMysqlTransaction(trans)
+		if err != nil {
+			WARN("Publish failure: %s", err)
+		}
+		DEBUG("mysql", "Mysql transaction timed out: %s", trans.Mysql)
+	}
+
 	// remove from map
 	delete(mysqlTransactionsMap, trans.tuple.raw)
 }
 
+// Saves the statement from a COM_STMT_PREPARE_OK response and returns
+// it with its id, or nil if the response is too short.
+func preparedMysqlStatement(tuple TcpTuple, query string, raw []byte) (uint32, *mysqlStatement) {
+
+	// header, status, statement id, columns, params
+	if len(raw) < 4+1+4+2+2 {
+		DEBUG("mysql", "COM_STMT_PREPARE response too short")
+		return 0, nil
+	}
+	stmt_id := binary.LittleEndian.Uint32(raw[5:9])
+	numParams := int(binary.LittleEndian.Uint16(raw[11:13]))
+
+	conn := getMysqlConnection(tuple)
+	stmt := &mysqlStatement{query: query, numParams: numParams}
+	conn.statements[stmt_id] = stmt
+
+	DEBUG("mysqldetailed", "Prepared statement %d with %d params: %s", stmt_id, numParams, query)
+	return stmt_id, stmt
+}
+
+func closeMysqlStatement(tuple TcpTuple, raw []byte) {
+
+	if len(raw) < 4+1+4 {
+		return
+	}
+	stmt_id := binary.LittleEndian.Uint32(raw[5:9])
+
+	conn := mysqlConnectionsMap[tuple.raw]
+	if conn != nil {
+		delete(conn.statements, stmt_id)
+	}
+}
+
+// Returns the statement id, the prepared query and the parameters of
+// a COM_STMT_EXECUTE request. The query is empty if the statement was
+// not prepared on this connection while capturing.
+func executedMysqlStatement(tuple TcpTuple, raw []byte) (uint32, string, []string) {
+
+	// header, command, statement id, flags, iteration count
+	if len(raw) < 4+1+4+1+4 {
+		DEBUG("mysql", "COM_STMT_EXECUTE request too short")
+		return 0, "", nil
+	}
+	stmt_id := binary.LittleEndian.Uint32(raw[5:9])
+
+	var stmt *mysqlStatement
+	if conn := mysqlConnectionsMap[tuple.raw]; conn != nil {
+		stmt = conn.statements[stmt_id]
+	}
+	if stmt == nil {
+		DEBUG("mysql", "Unknown prepared statement %d", stmt_id)
+		return stmt_id, "", nil
+	}
+	if stmt.numParams == 0 {
+		return stmt_id, stmt.query, nil
+	}
+
+	off := 14
+	nullBitmap := raw[off:]
+	bitmapLen := (stmt.numParams + 7) / 8
+	if len(nullBitmap) < bitmapLen+1 {
+		return stmt_id, stmt.query, nil
+	}
+	nullBitmap = nullBitmap[:bitmapLen]
+	off += bitmapLen
+
+	newParamsBound := raw[off]
+	off++
+	if newParamsBound == 1 {
+		if len(raw) < off+2*stmt.numParams {
+			return stmt_id, stmt.query, nil
+		}
+		stmt.paramTypes = make([]byte, 2*stmt.numParams)
+		copy(stmt.paramTypes, raw[off:off+2*stmt.numParams])
+		off += 2 * stmt.numParams
+	}
+	if len(stmt.paramTypes) != 2*stmt.numParams {
+		DEBUG("mysql", "Types of the parameters of statement %d not known", stmt_id)
+		return stmt_id, stmt.query, nil
+	}
+
+	params := []string{}
+	for i := 0; i < stmt.numParams; i++ {
+		if nullBitmap[i/8]&(1<<uint(i%8)) != 0 {
+			params = append(params, "NULL")
+			continue
+		}
+		typ := stmt.paramTypes[2*i]
+		unsigned := stmt.paramTypes[2*i+1]&0x80 != 0
+
+		var value string
+		var ok bool
+		value, off, ok = read_binary_value(raw, off, typ, unsigned)
+		if !ok {
+			DEBUG("mysql", "Failed to read parameter %d of statement %d", i, stmt_id)
+			break
+		}
+		params = append(params, value)
+	}
+
+	return stmt_id, stmt.query, params
+}
+
 func dumpInCSVFormat(fields []string, rows [][]string) string {
 
 	var buf bytes.Buffer
@@ -515,6 +1257,16 @@ func dumpInCSVFormat(fields []string, rows [][]string) string {
 }
 
 func parseMysqlResponse(data []byte) ([]string, [][]string) {
+	return parseMysqlResultSet(data, false)
+}
+
+// Parses the result set sent in response to COM_STMT_EXECUTE, which
+// has its rows in the binary protocol.
+func parseMysqlBinaryResponse(data []byte) ([]string, [][]string) {
+	return parseMysqlResultSet(data, true)
+}
+
+func parseMysqlResultSet(data []byte, binary_rows bool) ([]string, [][]string) {
 
 	length := read_length(data, 0)
 	if length < 1 {
@@ -525,6 +1277,10 @@ func parseMysqlResponse(data []byte) ([]string, [][]string) {
 	fields := []string{}
 	rows := [][]string{}
 
+	// column type and flags, needed for the binary rows
+	types := []uint8{}
+	flags := []uint16{}
+
 	if uint8(data[4]) == 0x00 {
 		// OK response
 	} else if uint8(data[4]) == 0xff {
@@ -573,6 +1329,15 @@ func parseMysqlResponse(data []byte) ([]string, [][]string) {
 				return fields, rows
 			}
 
+			// length of the fixed fields, charset, column length,
+			// type, flags
+			if len(data) < off+10 {
+				DEBUG("mysql", "Reading field: too short")
+				return fields, rows
+			}
+			types = append(types, uint8(data[off+7]))
+			flags = append(flags, binary.LittleEndian.Uint16(data[off+8:off+10]))
+
 			fields = append(fields, string(name))
 
 			offset += length + 4
@@ -591,6 +1356,18 @@ func parseMysqlResponse(data []byte) ([]string, [][]string) {
 			length = read_length(data, offset)
 			off := offset + 4 // skip length + packet number
 			start := off
+
+			if binary_rows {
+				row = read_binary_row(data[:start+length], off, types, flags)
+				if row == nil {
+					// nevertheless, return what we have so far
+					return fields, rows
+				}
+				rows = append(rows, row)
+				offset += length + 4
+				continue
+			}
+
 			for off < start+length {
 				var text []byte
 
@@ -619,12 +1396,195 @@ func parseMysqlResponse(data []byte) ([]string, [][]string) {
 	return fields, rows
 }
 
+// Reads a row of a binary result set: a 0x00 header, the NULL bitmap
+// and then the values of the non NULL columns.
+func read_binary_row(data []byte, offset int, types []uint8, flags []uint16) []string {
+
+	// the first two bits of the NULL bitmap are not used
+	bitmapLen := (len(types) + 7 + 2) / 8
+	if len(data) < offset+1+bitmapLen {
+		DEBUG("mysql", "Binary row too short")
+		return nil
+	}
+	nullBitmap := data[offset+1 : offset+1+bitmapLen]
+	off := offset + 1 + bitmapLen
+
+	row := []string{}
+	for i, typ := range types {
+		bit := i + 2
+		if nullBitmap[bit/8]&(1<<uint(bit%8)) != 0 {
+			row = append(row, "NULL")
+			continue
+		}
+
+		var value string
+		var ok bool
+		value, off, ok = read_binary_value(data, off, typ, flags[i]&MYSQL_UNSIGNED_FLAG != 0)
+		if !ok {
+			DEBUG("mysql", "Error parsing binary row")
+			return nil
+		}
+		row = append(row, value)
+	}
+	return row
+}
+
+// Reads a value encoded as in the binary protocol of the prepared
+// statements and returns its text representation and the offset after
+// it.
+func read_binary_value(data []byte, offset int, typ uint8, unsigned bool) (string, int, bool) {
+
+	fixed := func(size int) []byte {
+		if len(data) < offset+size {
+			return nil
+		}
+		return data[offset : offset+size]
+	}
+
+	switch typ {
+	case MYSQL_TYPE_NULL:
+		return "NULL", offset, true
+
+	case MYSQL_TYPE_TINY:
+		b := fixed(1)
+		if b == nil {
+			return "", 0, false
+		}
+		if unsigned {
+			return fmt.Sprintf("%d", b[0]), offset + 1, true
+		}
+		return fmt.Sprintf("%d", int8(b[0])), offset + 1, true
+
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		b := fixed(2)
+		if b == nil {
+			return "", 0, false
+		}
+		v := binary.LittleEndian.Uint16(b)
+		if unsigned || typ == MYSQL_TYPE_YEAR {
+			return fmt.Sprintf("%d", v), offset + 2, true
+		}
+		return fmt.Sprintf("%d", int16(v)), offset + 2, true
+
+	case MYSQL_TYPE_LONG, MYSQL_TYPE_INT24:
+		b := fixed(4)
+		if b == nil {
+			return "", 0, false
+		}
+		v := binary.LittleEndian.Uint32(b)
+		if unsigned {
+			return fmt.Sprintf("%d", v), offset + 4, true
+		}
+		return fmt.Sprintf("%d", int32(v)), offset + 4, true
+
+	case MYSQL_TYPE_LONGLONG:
+		b := fixed(8)
+		if b == nil {
+			return "", 0, false
+		}
+		v := binary.LittleEndian.Uint64(b)
+		if unsigned {
+			return fmt.Sprintf("%d", v), offset + 8, true
+		}
+		return fmt.Sprintf("%d", int64(v)), offset + 8, true
+
+	case MYSQL_TYPE_FLOAT:
+		b := fixed(4)
+		if b == nil {
+			return "", 0, false
+		}
+		v := math.Float32frombits(binary.LittleEndian.Uint32(b))
+		return fmt.Sprintf("%g", v), offset + 4, true
+
+	case MYSQL_TYPE_DOUBLE:
+		b := fixed(8)
+		if b == nil {
+			return "", 0, false
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(b))
+		return fmt.Sprintf("%g", v), offset + 8, true
+
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_DATETIME, MYSQL_TYPE_TIMESTAMP:
+		if len(data) < offset+1 {
+			return "", 0, false
+		}
+		length := int(data[offset])
+		if len(data) < offset+1+length {
+			return "", 0, false
+		}
+		b := data[offset+1 : offset+1+length]
+
+		var year uint16
+		var month, day, hour, minute, second uint8
+		var micro uint32
+		if length >= 4 {
+			year = binary.LittleEndian.Uint16(b[0:2])
+			month, day = b[2], b[3]
+		}
+		if length >= 7 {
+			hour, minute, second = b[4], b[5], b[6]
+		}
+		if length >= 11 {
+			micro = binary.LittleEndian.Uint32(b[7:11])
+		}
+
+		value := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+		if typ != MYSQL_TYPE_DATE {
+			value += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+			if micro != 0 {
+				value += fmt.Sprintf(".%06d", micro)
+			}
+		}
+		return value, offset + 1 + length, true
+
+	case MYSQL_TYPE_TIME:
+		if len(data) < offset+1 {
+			return "", 0, false
+		}
+		length := int(data[offset])
+		if len(data) < offset+1+length {
+			return "", 0, false
+		}
+		b := data[offset+1 : offset+1+length]
+
+		sign := ""
+		var hours uint32
+		var minute, second uint8
+		var micro uint32
+		if length >= 8 {
+			if b[0] == 1 {
+				sign = "-"
+			}
+			hours = binary.LittleEndian.Uint32(b[1:5])*24 + uint32(b[5])
+			minute, second = b[6], b[7]
+		}
+		if length >= 12 {
+			micro = binary.LittleEndian.Uint32(b[8:12])
+		}
+
+		value := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, minute, second)
+		if micro != 0 {
+			value += fmt.Sprintf(".%06d", micro)
+		}
+		return value, offset + 1 + length, true
+	}
+
+	// strings, blobs, decimals and the like are length encoded
+	text, off, complete, err := read_lstring(data, offset)
+	if err != nil || !complete {
+		return "", 0, false
+	}
+	return string(text), off, true
+}
+
 func (publisher *PublisherType) PublishMysqlTransaction(t *MysqlTransaction) error {
 
 	event := Event{}
 	event.Type = "mysql"
 
-	if t.Mysql["iserror"].(bool) {
+	if t.timedOut {
+		event.Status = TIMEOUT_STATUS
+	} else if t.Mysql["iserror"].(bool) {
 		event.Status = ERROR_STATUS
 	} else {
 		event.Status = OK_STATUS
@@ -650,7 +1610,7 @@ func read_lstring(data []byte, offset int) ([]byte, int, bool, error) {
 	return data[off : off+int(length)], off + int(length), true, nil
 }
 func read_linteger(data []byte, offset int) (uint64, int, bool, error) {
-	if len(data) == 0 {
+	if len(data) <= offset {
 		return 0, 0, false, nil
 	}
 	switch uint8(data[offset]) {
@@ -658,11 +1618,7 @@ func read_linteger(data []byte, offset int) (uint64, int, bool, error) {
 		if len(data[offset+1:]) < 8 {
 			return 0, 0, false, nil
 		}
-		return uint64(data[offset+1]) | uint64(data[offset+2])<<8 |
-				uint64(data[offset+2])<<16 | uint64(data[offset+3])<<24 |
-				uint64(data[offset+4])<<32 | uint64(data[offset+5])<<40 |
-				uint64(data[offset+6])<<48 | uint64(data[offset+7])<<56,
-			offset + 9, true, nil
+		return binary.LittleEndian.Uint64(data[offset+1 : offset+9]), offset + 9, true, nil
 	case 0xfd:
 		if len(data[offset+1:]) < 3 {
 			return 0, 0, false, nil
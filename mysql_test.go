@@ -100,7 +100,53 @@ func TestMySQLParser_errorResponse(t *testing.T) {
 	if stream.message.IsOK {
 		t.Errorf("Failed to parse MySQL error esponse")
 	}
+	if stream.message.ErrorCode != 1146 || stream.message.SqlState != "42S02" {
+		t.Errorf("Wrong error code or SQL state: %d %s", stream.message.ErrorCode,
+			stream.message.SqlState)
+	}
+	if stream.message.ErrorInfo != "42S02: Table 'minitwit.possst' doesn't exist" {
+		t.Errorf("Wrong error message: %s", stream.message.ErrorInfo)
+	}
+}
+
+func TestMySQLParser_OKResponseLargeValues(t *testing.T) {
+
+	// 70000 affected rows, last insert id 16909060, status 0x0002,
+	// 3 warnings
+	data := []byte(
+		"0c00000100fd701101fc040302000300")
+
+	message, err := hex.DecodeString(string(data))
+	if err != nil {
+		t.Errorf("Failed to decode hex string")
+	}
 
+	stream := &MysqlStream{tcpStream: nil, data: message, message: new(MysqlMessage)}
+
+	ok, complete := mysqlMessageParser(stream)
+
+	if !ok || !complete {
+		t.Errorf("Failed to parse MySQL OK response")
+	}
+	if stream.message.AffectedRows != 70000 {
+		t.Errorf("Wrong number of affected rows: %d", stream.message.AffectedRows)
+	}
+	if stream.message.InsertId != 772 {
+		t.Errorf("Wrong last insert id: %d", stream.message.InsertId)
+	}
+	if stream.message.StatusFlags != 2 || stream.message.Warnings != 3 {
+		t.Errorf("Wrong status flags or warnings: %x %d", stream.message.StatusFlags,
+			stream.message.Warnings)
+	}
+}
+
+func TestMySQL_read_linteger(t *testing.T) {
+
+	data, _ := hex.DecodeString("fe0807060504030201")
+	value, off, complete, err := read_linteger(data, 0)
+	if err != nil || !complete || off != 9 || value != 0x0102030405060708 {
+		t.Errorf("Wrong 8 bytes integer: %x", value)
+	}
 }
 
 func TestMySQLParser_dataResponse(t *testing.T) {
@@ -285,12 +331,14 @@ func TestParseMySQL_simpleUpdateResponse(t *testing.T) {
 		payload: data,
 		ts:      ts,
 	}
-	tcp := TcpStream{
-		mysqlData: [2]*MysqlStream{nil, nil},
-	}
+	tcp := TcpStream{}
 
 	var count_handleMysql = 0
 
+	old_handleMysql := handleMysql
+	defer func() {
+		handleMysql = old_handleMysql
+	}()
 	handleMysql = func(m *MysqlMessage, tcp *TcpStream,
 		dir uint8, raw_msg []byte) {
 
@@ -327,9 +375,7 @@ func TestParseMySQL_threeResponses(t *testing.T) {
 		payload: data,
 		ts:      ts,
 	}
-	tcp := TcpStream{
-		mysqlData: [2]*MysqlStream{nil, nil},
-	}
+	tcp := TcpStream{}
 
 	var count_handleMysql = 0
 
@@ -374,9 +420,7 @@ func TestParseMySQL_splitResponse(t *testing.T) {
 		payload: data,
 		ts:      ts,
 	}
-	tcp := TcpStream{
-		mysqlData: [2]*MysqlStream{nil, nil},
-	}
+	tcp := TcpStream{}
 
 	var count_handleMysql = 0
 
@@ -416,3 +460,373 @@ func TestParseMySQL_splitResponse(t *testing.T) {
 		t.Errorf("handleMysql not called on the second run")
 	}
 }
+
+func TestMySQL_preparedStatement(t *testing.T) {
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"mysql", "mysqldetailed"})
+	}
+
+	output, restore := recordGlobalPublisher()
+	defer restore()
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(mysqlTransactionsMap, tuple.raw)
+	defer delete(mysqlConnectionsMap, tuple.raw)
+
+	parse := func(hexdata string, dir uint8) {
+		data, err := hex.DecodeString(hexdata)
+		if err != nil {
+			t.Fatalf("Failed to decode hex string")
+		}
+		ParseMysql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+
+	// COM_STMT_PREPARE and its response, the statement id 1 with 1
+	// column and 2 params is not an affected rows count
+	parse("340000001653454c454354206e616d652046524f4d20706f737420574845"+
+		"5245206964203d203f20414e4420757365726e616d65203d203f", 0)
+	trans := mysqlTransactionsMap[tuple.raw]
+	if trans == nil || trans.Mysql["query"] != "SELECT name FROM post WHERE id = ? AND username = ?" {
+		t.Fatalf("Failed to parse COM_STMT_PREPARE")
+	}
+	parse("0c000001000100000001000200000000", 1)
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	prepared := output.events[0].Mysql
+	if prepared["command"] != "prepare" || prepared["isok"] != true ||
+		prepared["statement_id"] != uint32(1) || prepared["num_params"] != 2 ||
+		prepared["affected_rows"] != uint64(0) {
+
+		t.Errorf("Wrong prepare event: %v", prepared)
+	}
+
+	stmt := mysqlConnectionsMap[tuple.raw].statements[1]
+	if stmt == nil || stmt.numParams != 2 {
+		t.Fatalf("Prepared statement not saved")
+	}
+
+	// first execution, with the types of the parameters
+	parse("1c0000001701000000000100000000010800fd002a00000000000000036a6f65", 0)
+	trans = mysqlTransactionsMap[tuple.raw]
+	if trans.Mysql["query"] != stmt.query || trans.Mysql["method"] != "SELECT" ||
+		trans.Mysql["command"] != "execute" {
+		t.Errorf("Wrong execute transaction: %v", trans.Mysql)
+	}
+	params := trans.Mysql["params"].([]string)
+	if len(params) != 2 || params[0] != "42" || params[1] != "joe" {
+		t.Errorf("Wrong parameters: %v", params)
+	}
+	if trans.Mysql["query_fingerprint"] != "select name from post where id = ? and username = ?" ||
+		trans.Mysql["tables"] != "post" {
+		t.Errorf("Wrong fingerprint or tables: %v", trans.Mysql)
+	}
+	parse("0700000100000002000000", 1)
+
+	// second execution, reusing the types
+	parse("140000001701000000000100000002000700000000000000", 0)
+	params = mysqlTransactionsMap[tuple.raw].Mysql["params"].([]string)
+	if len(params) != 2 || params[0] != "7" || params[1] != "NULL" {
+		t.Errorf("Wrong parameters: %v", params)
+	}
+	parse("0700000100000002000000", 1)
+
+	if len(output.events) != 3 || output.events[2].Mysql["statement_id"] != uint32(1) {
+		t.Errorf("Executions not published: %v", output.events)
+	}
+
+	// COM_STMT_CLOSE
+	parse("050000001901000000", 0)
+	if _, exists := mysqlConnectionsMap[tuple.raw].statements[1]; exists {
+		t.Errorf("Statement not closed")
+	}
+}
+
+func TestMySQL_binaryResultSet(t *testing.T) {
+
+	raw, err := hex.DecodeString("0100000103" +
+		"240000020364656602646204706f737404706f73740269640269640c3f0014000000080000000000" +
+		"280000030364656602646204706f737404706f7374046e616d65046e616d650c3f0014000000fd0000000000" +
+		"2e0000040364656602646204706f737404706f7374076372656174656407637265617465640c3f00140000000c0000000000" +
+		"05000005fe00000200" +
+		"1200000600082a0000000000000007dd070716122c11" +
+		"05000007fe00000200")
+	if err != nil {
+		t.Fatalf("Failed to decode hex string")
+	}
+
+	fields, rows := parseMysqlBinaryResponse(raw)
+
+	if len(fields) != 3 || fields[0] != "id" || fields[1] != "name" || fields[2] != "created" {
+		t.Errorf("Wrong fields: %v", fields)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("Expected one row, got %d", len(rows))
+	}
+	if rows[0][0] != "42" || rows[0][1] != "NULL" || rows[0][2] != "2013-07-22 18:44:17" {
+		t.Errorf("Wrong row: %v", rows[0])
+	}
+}
+
+func TestParseMySQL_connectionPhase(t *testing.T) {
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"mysql", "mysqldetailed"})
+	}
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(mysqlTransactionsMap, tuple.raw)
+	defer delete(mysqlConnectionsMap, tuple.raw)
+
+	parse := func(hexdata string, dir uint8) {
+		data, err := hex.DecodeString(hexdata)
+		if err != nil {
+			t.Fatalf("Failed to decode hex string")
+		}
+		ParseMysql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+
+	// initial handshake
+	parse("5b0000000a352e352e33382d307562756e7475302e31342e30342e31002a0000006162636465666768"+
+		"00ffa70802000f001500000000000000000000696a6b6c6d6e6f7071727374006d7973716c5f6e61"+
+		"746976655f70617373776f726400", 1)
+
+	conn := mysqlConnectionsMap[tuple.raw]
+	if conn == nil || conn.serverVersion != "5.5.38-0ubuntu0.14.04.1" {
+		t.Fatalf("Initial handshake not decoded")
+	}
+	if conn.capabilities != 0x000fa7ff {
+		t.Errorf("Wrong server capabilities: %x", conn.capabilities)
+	}
+
+	// handshake response
+	parse("430000018da2080000000001080000000000000000000000000000000000000000000000726f6f7400"+
+		"1478787878787878787878787878787878787878786d696e697477697400", 0)
+
+	if conn.user != "root" || conn.database != "minitwit" {
+		t.Errorf("Handshake response not decoded: user=%s, database=%s", conn.user, conn.database)
+	}
+	trans := mysqlTransactionsMap[tuple.raw]
+	if trans == nil || trans.Mysql["command"] != "login" {
+		t.Fatalf("No login transaction")
+	}
+
+	// login succeeded, nothing is published
+	parse("0700000200000002000000", 1)
+	if _, exists := mysqlTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Login transaction still pending")
+	}
+
+	// the queries carry the user and the database
+	parse("0f0000000373656c656374202a2066726f6d2074", 0)
+	trans = mysqlTransactionsMap[tuple.raw]
+	if trans == nil || trans.Mysql["user"] != "root" || trans.Mysql["database"] != "minitwit" {
+		t.Errorf("Query without user and database")
+	}
+}
+
+func TestParseMySQL_failedLogin(t *testing.T) {
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(mysqlConnectionsMap, tuple.raw)
+
+	login, _ := hex.DecodeString("430000018da208000000000108000000000000000000000000000000000000" +
+		"0000000000726f6f74001478787878787878787878787878787878787878786d696e697477697400")
+	ParseMysql(&Packet{payload: login, ts: time.Now()}, &tcp, 0)
+
+	trans := mysqlTransactionsMap[tuple.raw]
+	if trans == nil || trans.Mysql["method"] != "LOGIN" {
+		t.Fatalf("No login transaction")
+	}
+
+	access_denied, _ := hex.DecodeString("48000002ff15042332383030304163636573732064656e69656420666f" +
+		"7220757365722027726f6f742740276c6f63616c686f73742720287573696e672070617373776f72643a2059455329")
+	ParseMysql(&Packet{payload: access_denied, ts: time.Now()}, &tcp, 1)
+
+	if trans.Mysql["iserror"] != true || trans.Mysql["user"] != "root" {
+		t.Errorf("Failed login not reported: %v", trans.Mysql)
+	}
+	if _, exists := mysqlTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Login transaction still pending")
+	}
+}
+
+func TestMySQLParser_callResponse(t *testing.T) {
+
+	// two result sets with the more results flag in their EOF packets,
+	// the final OK of the CALL, then the OK of the next query
+	data := []byte(
+		"01000001011e00000203646566047465737401740174016101610c3f000b" +
+			"00000003000000000005000003fe0000020002000004013105000005fe00" +
+			"000a0001000006011e00000703646566047465737401740174016201620c" +
+			"3f000b00000003000000000005000008fe00000a00020000090132020000" +
+			"0a01330500000bfe00000a000700000c00000002000000" +
+			"0700000100000000000000")
+
+	message, err := hex.DecodeString(string(data))
+	if err != nil {
+		t.Errorf("Failed to decode hex string")
+	}
+
+	stream := &MysqlStream{tcpStream: nil, data: message, message: new(MysqlMessage)}
+
+	ok, complete := mysqlMessageParser(stream)
+
+	if !ok || !complete {
+		t.Fatalf("Failed to parse the CALL response")
+	}
+	if !stream.message.IsOK || stream.message.IsTruncated {
+		t.Errorf("Wrong response status")
+	}
+	if len(stream.message.ResultSets) != 2 {
+		t.Fatalf("Expected 2 result sets, got %d", len(stream.message.ResultSets))
+	}
+	if stream.message.ResultSets[0].NumberOfRows != 1 ||
+		stream.message.ResultSets[1].NumberOfRows != 2 {
+		t.Errorf("Wrong number of rows per result set: %v", stream.message.ResultSets)
+	}
+	if stream.message.NumberOfRows != 3 {
+		t.Errorf("Wrong total number of rows: %d", stream.message.NumberOfRows)
+	}
+	if stream.message.Size != 143 {
+		t.Errorf("Wrong response size: %d", stream.message.Size)
+	}
+
+	// the next response is parsed from its start
+	stream.PrepareForNewMessage()
+	stream.message = new(MysqlMessage)
+
+	ok, complete = mysqlMessageParser(stream)
+	if !ok || !complete || !stream.message.IsOK {
+		t.Errorf("Failed to parse the response following the CALL")
+	}
+	if len(stream.data) != 11 {
+		t.Errorf("Wrong remaining data: %d bytes", len(stream.data))
+	}
+}
+
+func TestMySQLParser_multiStatementResponse(t *testing.T) {
+
+	// OK of an INSERT with the more results flag, then a result set
+	data := []byte(
+		"070000010001050a00000001000002011e00000303646566047465737401" +
+			"740174016101610c3f000b00000003000000000005000004fe0000020002" +
+			"000005013105000006fe00000200")
+
+	message, err := hex.DecodeString(string(data))
+	if err != nil {
+		t.Errorf("Failed to decode hex string")
+	}
+
+	stream := &MysqlStream{tcpStream: nil, data: message, message: new(MysqlMessage)}
+
+	ok, complete := mysqlMessageParser(stream)
+
+	if !ok || !complete {
+		t.Fatalf("Failed to parse the multi-statement response")
+	}
+	if stream.message.end != len(message) {
+		t.Errorf("Response not parsed to its end: %d", stream.message.end)
+	}
+	if stream.message.AffectedRows != 1 || stream.message.InsertId != 5 {
+		t.Errorf("Wrong OK fields: %d %d", stream.message.AffectedRows, stream.message.InsertId)
+	}
+	if len(stream.message.ResultSets) != 2 || stream.message.NumberOfRows != 1 {
+		t.Errorf("Wrong result sets: %v", stream.message.ResultSets)
+	}
+}
+
+func TestMySQL_expireTransaction(t *testing.T) {
+
+	output, restore := recordGlobalPublisher()
+	defer restore()
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(mysqlTransactionsMap, tuple.raw)
+	defer delete(mysqlConnectionsMap, tuple.raw)
+
+	// COM_QUERY SELECT 1
+	query, _ := hex.DecodeString("090000000353454c4543542031")
+	ParseMysql(&Packet{payload: query, ts: time.Now()}, &tcp, 0)
+
+	trans := mysqlTransactionsMap[tuple.raw]
+	if trans == nil {
+		t.Fatalf("No pending transaction")
+	}
+	trans.timer.Stop()
+	trans.Expire()
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != TIMEOUT_STATUS || event.ResponseTime != TimeoutResponseTime ||
+		event.Mysql["query"] != "SELECT 1" {
+
+		t.Errorf("Wrong event: %v %d %v", event.Status, event.ResponseTime, event.Mysql)
+	}
+	if _, exists := mysqlTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Expired transaction still in the map")
+	}
+}
+
+func mysqlTestPacket(seq byte, payload []byte) []byte {
+	length := len(payload)
+	return append([]byte{byte(length), byte(length >> 8), byte(length >> 16), seq}, payload...)
+}
+
+func TestParseMySQL_authSwitch(t *testing.T) {
+
+	output, restore := recordGlobalPublisher()
+	defer restore()
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(mysqlTransactionsMap, tuple.raw)
+	defer delete(mysqlConnectionsMap, tuple.raw)
+
+	parse := func(data []byte, dir uint8) {
+		ParseMysql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+
+	login, _ := hex.DecodeString("430000018da208000000000108000000000000000000000000000000000000" +
+		"0000000000726f6f74001478787878787878787878787878787878787878786d696e697477697400")
+	parse(login, 0)
+
+	// the server switches to caching_sha2_password, which asks for the
+	// full authentication, the client requests the public key and
+	// sends the encrypted password
+	switchRequest := append([]byte{0xfe}, []byte("caching_sha2_password\x00")...)
+	switchRequest = append(switchRequest, make([]byte, 21)...)
+	parse(mysqlTestPacket(2, switchRequest), 1)
+	parse(mysqlTestPacket(3, make([]byte, 32)), 0)
+	parse(mysqlTestPacket(4, []byte{0x01, 0x04}), 1)
+	parse(mysqlTestPacket(5, []byte{0x02}), 0)
+	parse(mysqlTestPacket(6, append([]byte{0x01}, []byte("-----BEGIN PUBLIC KEY-----")...)), 1)
+	parse(mysqlTestPacket(7, make([]byte, 256)), 0)
+
+	trans := mysqlTransactionsMap[tuple.raw]
+	if trans == nil || trans.Mysql["command"] != "login" {
+		t.Fatalf("Login transaction answered by the authentication data")
+	}
+
+	// login succeeded, nothing is published
+	parse(mysqlTestPacket(8, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), 1)
+	if _, exists := mysqlTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Login transaction still pending")
+	}
+
+	// the commands are decoded again
+	parse(mysqlTestPacket(0, append([]byte{MYSQL_CMD_QUERY}, []byte("SELECT 1")...)), 0)
+	parse(mysqlTestPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), 1)
+
+	if len(output.events) != 1 || output.events[0].Mysql["query"] != "SELECT 1" ||
+		output.events[0].Status != OK_STATUS {
+
+		t.Errorf("Query after the authentication not published: %v", output.events)
+	}
+}
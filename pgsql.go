@@ -1,11 +1,30 @@
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
 	"labix.org/v2/mgo/bson"
+	"math"
 	"strings"
 	"time"
 )
 
+// Type OIDs of the parameters decoded from the binary format
+const (
+	PGSQL_TYPE_BOOL    = 16
+	PGSQL_TYPE_BYTEA   = 17
+	PGSQL_TYPE_NAME    = 19
+	PGSQL_TYPE_INT8    = 20
+	PGSQL_TYPE_INT2    = 21
+	PGSQL_TYPE_INT4    = 23
+	PGSQL_TYPE_TEXT    = 25
+	PGSQL_TYPE_OID     = 26
+	PGSQL_TYPE_FLOAT4  = 700
+	PGSQL_TYPE_FLOAT8  = 701
+	PGSQL_TYPE_BPCHAR  = 1042
+	PGSQL_TYPE_VARCHAR = 1043
+)
+
 type PgsqlMessage struct {
 	start         int
 	end           int
@@ -27,6 +46,36 @@ type PgsqlMessage struct {
 	ErrorInfo      string
 	ErrorCode      string
 	ErrorSeverity  string
+	AffectedRows   int
+
+	// extended query protocol
+	Typ           byte
+	StatementName string
+	PortalName    string
+	ClosedObject  byte
+	ParamTypes    []uint32
+	ParamFormats  []uint16
+	ParamValues   [][]byte
+
+	// startup
+	IsStartup       bool
+	User            string
+	Database        string
+	ApplicationName string
+
+	// COPY
+	CopyBytes  int
+	CopyFailed bool
+
+	Notices []PgsqlNotice
+
+	IsReadyForQuery bool
+
+	// asynchronous notification
+	IsNotification  bool
+	NotificationPid uint32
+	Channel         string
+	Payload         string
 
 	Direction    uint8
 	Incomplete   bool
@@ -34,6 +83,13 @@ type PgsqlMessage struct {
 	CmdlineTuple *CmdlineTuple
 }
 
+// A NoticeResponse, sent by the server while running a query.
+type PgsqlNotice struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
 type PgsqlTransaction struct {
 	Type         string
 	tuple        TcpTuple
@@ -49,7 +105,11 @@ type PgsqlTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer    *time.Timer
+	timedOut bool
+
+	// the batch of messages the request was sent in
+	batch int
 }
 
 type PgsqlStream struct {
@@ -59,6 +119,7 @@ type PgsqlStream struct {
 
 	parseOffset       int
 	parseState        int
+	isClient          bool
 	seenSSLRequest    bool
 	expectSSLResponse bool
 
@@ -68,6 +129,7 @@ type PgsqlStream struct {
 const (
 	PgsqlStartState = iota
 	PgsqlGetDataState
+	PgsqlCopyState
 )
 
 const (
@@ -78,6 +140,63 @@ const (
 
 var pgsqlTransactionsMap = make(map[HashableTcpTuple][]*PgsqlTransaction, TransactionsHashSize)
 
+// A statement created with a Parse message. The unnamed statement has
+// an empty name.
+type pgsqlStatement struct {
+	query      string
+	paramTypes []uint32
+}
+
+// A statement bound to its parameters with a Bind message.
+type pgsqlPortal struct {
+	statementName string
+	statement     *pgsqlStatement
+	params        []string
+}
+
+// What is known about a connection from its StartupMessage and the
+// prepared statements and portals, used to find the query run by an
+// Execute message.
+type pgsqlConnection struct {
+	user            string
+	database        string
+	applicationName string
+
+	statements map[string]*pgsqlStatement
+	portals    map[string]*pgsqlPortal
+
+	// The client ends the batches of extended query messages with a
+	// Sync, a simple query or the startup is a batch on its own. The
+	// server answers each batch with a ReadyForQuery.
+	batchesSent  int
+	batchesReady int
+	batchFailed  bool
+	failedBatch  int
+}
+
+var pgsqlConnectionsMap = make(map[HashableTcpTuple]*pgsqlConnection)
+
+func getPgsqlConnection(tuple TcpTuple) *pgsqlConnection {
+	conn := pgsqlConnectionsMap[tuple.raw]
+	if conn == nil {
+		conn = &pgsqlConnection{
+			statements: make(map[string]*pgsqlStatement),
+			portals:    make(map[string]*pgsqlPortal),
+		}
+		pgsqlConnectionsMap[tuple.raw] = conn
+	}
+	return conn
+}
+
+type Pgsql struct {
+}
+
+var PgsqlMod Pgsql
+
+func init() {
+	RegisterProtocolPlugin("pgsql", &PgsqlMod)
+}
+
 func (stream *PgsqlStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.message.end:]
 	stream.parseState = PgsqlStartState
@@ -182,7 +301,7 @@ func pgsqlRowsParser(s *PgsqlStream) {
 		// read column value (byten)
 		column_value := []byte{}
 
-		if m.FieldsFormat[i] == 0 {
+		if i < len(m.FieldsFormat) && m.FieldsFormat[i] == 0 {
 			// field value in text format
 			if column_length > 0 {
 				column_value = s.data[s.parseOffset : s.parseOffset+int(column_length)]
@@ -208,32 +327,256 @@ func pgsqlErrorParser(s *PgsqlStream) {
 
 	m := s.message
 
-	for len(s.data[s.parseOffset:]) > 0 {
+	var off int
+	m.ErrorSeverity, m.ErrorCode, m.ErrorInfo, off = readPgsqlErrorFields(s.data[s.parseOffset:])
+	s.parseOffset += off
+
+	DEBUG("pgsqldetailed", "%s %s %s", m.ErrorSeverity, m.ErrorCode, m.ErrorInfo)
+}
+
+// Reads the fields of an ErrorResponse or a NoticeResponse. Returns the
+// severity, the code, the message and the number of bytes read.
+func readPgsqlErrorFields(data []byte) (string, string, string, int) {
+
+	var severity, code, message string
+	off := 0
+
+	for len(data[off:]) > 0 {
 		// read field type(byte1)
-		field_type := s.data[s.parseOffset]
-		s.parseOffset += 1
+		field_type := data[off]
+		off += 1
 
 		if field_type == 0 {
 			break
 		}
 
 		// read field value(string)
-		field_value, err := readString(s.data[s.parseOffset:])
+		field_value, err := readString(data[off:])
 		if err != nil {
 			ERR("Fail to read the column field")
 		}
-		s.parseOffset += len(field_value) + 1
+		off += len(field_value) + 1
 
 		if field_type == 'M' {
-			m.ErrorInfo = field_value
+			message = field_value
 		} else if field_type == 'C' {
-			m.ErrorCode = field_value
+			code = field_value
 		} else if field_type == 'S' {
-			m.ErrorSeverity = field_value
+			severity = field_value
 		}
 
 	}
-	DEBUG("pgsqldetailed", "%s %s %s", m.ErrorSeverity, m.ErrorCode, m.ErrorInfo)
+	return severity, code, message, off
+}
+
+// Adds a NoticeResponse to the message being parsed, notices are
+// reported with the response of the query.
+func pgsqlNoticeParser(s *PgsqlStream, length int) {
+
+	m := s.message
+
+	body := s.data[s.parseOffset+5 : s.parseOffset+1+length]
+	severity, code, message, _ := readPgsqlErrorFields(body)
+	m.Notices = append(m.Notices, PgsqlNotice{
+		Severity: severity,
+		Code:     code,
+		Message:  message,
+	})
+	DEBUG("pgsqldetailed", "Notice %s %s %s", severity, code, message)
+
+	s.parseOffset += 1 + length
+}
+
+// Reads a NotificationResponse: the process id of the notifying
+// backend, the channel and the payload.
+func pgsqlNotificationParser(m *PgsqlMessage, body []byte) bool {
+
+	if len(body) < 4 {
+		return false
+	}
+	m.NotificationPid = Bytes_Ntohl(body[0:4])
+
+	channel, err := readString(body[4:])
+	if err != nil {
+		return false
+	}
+	m.Channel = channel
+
+	payload, err := readString(body[4+len(channel)+1:])
+	if err != nil {
+		return false
+	}
+	m.Payload = payload
+
+	DEBUG("pgsqldetailed", "Notification pid=%d, channel=%s, payload=%s",
+		m.NotificationPid, m.Channel, m.Payload)
+	return true
+}
+
+// Returns the number of rows from the tag of a CommandComplete, like
+// "INSERT 0 1" or "SELECT 3".
+func pgsqlCommandRows(tag string) int {
+	words := strings.Fields(tag)
+	if len(words) < 2 {
+		return 0
+	}
+	var rows int
+	_, err := fmt.Sscanf(words[len(words)-1], "%d", &rows)
+	if err != nil {
+		return 0
+	}
+	return rows
+}
+
+// Reads the Parse, Bind, Execute and Close messages of the extended
+// query protocol. The body starts after the type and length.
+func pgsqlExtendedQueryParser(m *PgsqlMessage, body []byte) bool {
+
+	off := 0
+	readName := func() (string, bool) {
+		name, err := readString(body[off:])
+		if err != nil {
+			return "", false
+		}
+		off += len(name) + 1
+		return name, true
+	}
+	readInt16 := func() (uint16, bool) {
+		if len(body) < off+2 {
+			return 0, false
+		}
+		v := Bytes_Ntohs(body[off : off+2])
+		off += 2
+		return v, true
+	}
+	readInt32 := func() (uint32, bool) {
+		if len(body) < off+4 {
+			return 0, false
+		}
+		v := Bytes_Ntohl(body[off : off+4])
+		off += 4
+		return v, true
+	}
+
+	var ok bool
+	switch m.Typ {
+	case 'P':
+		if m.StatementName, ok = readName(); !ok {
+			return false
+		}
+		if m.Query, ok = readName(); !ok {
+			return false
+		}
+		count, ok := readInt16()
+		if !ok {
+			return false
+		}
+		for i := 0; i < int(count); i++ {
+			typ, ok := readInt32()
+			if !ok {
+				return false
+			}
+			m.ParamTypes = append(m.ParamTypes, typ)
+		}
+		DEBUG("pgsqldetailed", "Parse statement=%s, query=%s", m.StatementName, m.Query)
+
+	case 'B':
+		if m.PortalName, ok = readName(); !ok {
+			return false
+		}
+		if m.StatementName, ok = readName(); !ok {
+			return false
+		}
+		count, ok := readInt16()
+		if !ok {
+			return false
+		}
+		for i := 0; i < int(count); i++ {
+			format, ok := readInt16()
+			if !ok {
+				return false
+			}
+			m.ParamFormats = append(m.ParamFormats, format)
+		}
+		count, ok = readInt16()
+		if !ok {
+			return false
+		}
+		for i := 0; i < int(count); i++ {
+			length, ok := readInt32()
+			if !ok {
+				return false
+			}
+			if int32(length) == -1 {
+				m.ParamValues = append(m.ParamValues, nil)
+				continue
+			}
+			if len(body) < off+int(length) {
+				return false
+			}
+			m.ParamValues = append(m.ParamValues, body[off:off+int(length)])
+			off += int(length)
+		}
+		DEBUG("pgsqldetailed", "Bind portal=%s, statement=%s, %d params",
+			m.PortalName, m.StatementName, len(m.ParamValues))
+
+	case 'E':
+		if m.PortalName, ok = readName(); !ok {
+			return false
+		}
+		DEBUG("pgsqldetailed", "Execute portal=%s", m.PortalName)
+
+	case 'C':
+		if len(body) < 1 {
+			return false
+		}
+		m.ClosedObject = body[0]
+		off += 1
+		name, ok := readName()
+		if !ok {
+			return false
+		}
+		if m.ClosedObject == 'S' {
+			m.StatementName = name
+		} else {
+			m.PortalName = name
+		}
+	}
+	return true
+}
+
+// Reads the parameters of a StartupMessage, pairs of null terminated
+// names and values after the length and the protocol version.
+func pgsqlStartupParser(m *PgsqlMessage, body []byte) {
+
+	off := 0
+	for off < len(body) {
+		name, err := readString(body[off:])
+		if err != nil || len(name) == 0 {
+			break
+		}
+		off += len(name) + 1
+		value, err := readString(body[off:])
+		if err != nil {
+			break
+		}
+		off += len(value) + 1
+
+		switch name {
+		case "user":
+			m.User = value
+		case "database":
+			m.Database = value
+		case "application_name":
+			m.ApplicationName = value
+		}
+	}
+	if len(m.Database) == 0 {
+		// defaults to the user name
+		m.Database = m.User
+	}
+	DEBUG("pgsqldetailed", "Startup user=%s, database=%s, application=%s",
+		m.User, m.Database, m.ApplicationName)
 }
 
 func isSpecialPgsqlCommand(data []byte) (bool, int) {
@@ -282,8 +625,14 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 				// In case of Commands: StartupMessage, SSLRequest, CancelRequest that don't have
 				// their type in the first byte
 
+				s.isClient = true
+
 				// read length
 				length := int(Bytes_Ntohl(s.data[s.parseOffset : s.parseOffset+4]))
+				if length < 8 {
+					DEBUG("pgsql", "Invalid length %d of special command", length)
+					return false, false
+				}
 
 				// ignore command
 				if len(s.data[s.parseOffset:]) >= length {
@@ -296,6 +645,16 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 						m.isSSLRequest = true
 						return true, true
 					}
+					if command == StartupMessage {
+						m.start = s.parseOffset
+						s.parseOffset += length
+						m.end = s.parseOffset
+						m.IsRequest = true
+						m.IsStartup = true
+						m.toExport = true
+						pgsqlStartupParser(m, s.data[m.start+8:m.end])
+						return true, true
+					}
 					s.parseOffset += length
 				} else {
 					// wait for more
@@ -327,10 +686,22 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 
 				DEBUG("pgsqldetailed", "Pgsql type %c, length=%d", typ, length)
 
+				if length < 4 {
+					DEBUG("pgsql", "Invalid length %d of message type %c", length, typ)
+					return false, false
+				}
+
 				if typ == 'Q' {
 					// SimpleQuery
+					if length < 5 {
+						DEBUG("pgsql", "SimpleQuery without a query")
+						return false, false
+					}
+
 					m.start = s.parseOffset
 					m.IsRequest = true
+					m.Typ = typ
+					s.isClient = true
 
 					if len(s.data[s.parseOffset:]) >= length+1 {
 						s.parseOffset += 1 //type
@@ -345,9 +716,138 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 						DEBUG("pgsqldetailed", "Wait for more data 2")
 						return true, false
 					}
+				} else if s.isClient && typ == 'S' {
+					// Sync, ends a batch of extended query messages
+					if len(s.data[s.parseOffset:]) >= length+1 {
+						m.start = s.parseOffset
+						m.IsRequest = true
+						m.Typ = typ
+						m.toExport = true
+						s.parseOffset += 1 + length
+						m.end = s.parseOffset
+						return true, true
+					} else {
+						// wait for more
+						DEBUG("pgsqldetailed", "Wait for more data 2a")
+						return true, false
+					}
+				} else if typ == 'P' || typ == 'B' || (s.isClient && (typ == 'E' || typ == 'C')) {
+					// Parse, Bind, Execute or Close of the extended
+					// query protocol. Describe and Flush are ignored
+					m.start = s.parseOffset
+					m.IsRequest = true
+					m.Typ = typ
+					s.isClient = true
+
+					if len(s.data[s.parseOffset:]) >= length+1 {
+						s.parseOffset += 1 //type
+						s.parseOffset += length
+						m.end = s.parseOffset
+						if !pgsqlExtendedQueryParser(m, s.data[m.start+5:m.end]) {
+							DEBUG("pgsql", "Failed to parse message of type %c", typ)
+							return false, false
+						}
+						m.toExport = true
+						return true, true
+					} else {
+						// wait for more
+						DEBUG("pgsqldetailed", "Wait for more data 2b")
+						return true, false
+					}
+				} else if typ == 'R' && !s.isClient {
+					// Authentication request. Only AuthenticationOk is
+					// a response, the others continue the exchange
+
+					if len(s.data[s.parseOffset:]) >= length+1 {
+						if length >= 8 && Bytes_Ntohl(s.data[s.parseOffset+5:s.parseOffset+9]) == 0 {
+							DEBUG("pgsqldetailed", "AuthenticationOk")
+							m.start = s.parseOffset
+							m.IsRequest = false
+							m.IsOK = true
+							m.toExport = true
+							s.parseOffset += 1 + length
+							m.end = s.parseOffset
+							m.Size = uint64(m.end - m.start)
+							return true, true
+						}
+						s.parseOffset += 1 + length
+					} else {
+						// wait for more
+						DEBUG("pgsqldetailed", "Wait for more data 2c")
+						return true, false
+					}
+				} else if typ == 'N' && !s.isClient {
+					// NoticeResponse
+
+					if len(s.data[s.parseOffset:]) >= length+1 {
+						pgsqlNoticeParser(s, length)
+					} else {
+						// wait for more
+						DEBUG("pgsqldetailed", "Wait for more data 2d")
+						return true, false
+					}
+				} else if typ == 'A' && !s.isClient {
+					// NotificationResponse, sent asynchronously to the
+					// clients that run LISTEN
+
+					if len(s.data[s.parseOffset:]) >= length+1 {
+						m.start = s.parseOffset
+						s.parseOffset += 1 + length
+						m.end = s.parseOffset
+						if !pgsqlNotificationParser(m, s.data[m.start+5:m.end]) {
+							DEBUG("pgsql", "Failed to parse NotificationResponse")
+							return false, false
+						}
+						m.IsNotification = true
+						m.toExport = true
+						return true, true
+					} else {
+						// wait for more
+						DEBUG("pgsqldetailed", "Wait for more data 2e")
+						return true, false
+					}
+				} else if typ == 'H' && !s.isClient {
+					// CopyOutResponse, the rows follow in CopyData
+					// messages
+
+					if len(s.data[s.parseOffset:]) >= length+1 {
+						m.start = s.parseOffset
+						m.IsRequest = false
+						m.IsOK = true
+						m.toExport = true
+						s.parseOffset += 1 + length
+						m.Size = uint64(1 + length)
+						s.parseState = PgsqlCopyState
+					} else {
+						// wait for more
+						DEBUG("pgsqldetailed", "Wait for more data 2f")
+						return true, false
+					}
+				} else if typ == 'd' && s.isClient {
+					// CopyData of a COPY FROM STDIN
+					m.start = s.parseOffset
+					m.IsRequest = true
+					m.Typ = typ
+					m.toExport = true
+					s.parseState = PgsqlCopyState
+
+				} else if typ == 'D' && !s.isClient {
+					// DataRow without RowDescription, the statement
+					// was described before it was executed
+					m.start = s.parseOffset
+					m.IsRequest = false
+					m.IsOK = true
+					m.toExport = true
+					s.parseState = PgsqlGetDataState
+
 				} else if typ == 'T' {
 					// RowDescription
 
+					if length < 6 {
+						DEBUG("pgsql", "RowDescription without a fields count")
+						return false, false
+					}
+
 					m.start = s.parseOffset
 					m.IsRequest = false
 					m.IsOK = true
@@ -388,6 +888,7 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 					DEBUG("pgsqldetailed", "ErrorResponse")
 					m.start = s.parseOffset
 					m.IsRequest = false
+					m.IsOK = false
 					m.IsError = true
 					m.toExport = true
 
@@ -409,6 +910,11 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 				} else if typ == 'C' {
 					// CommandComplete -> Successful response
 
+					if length < 5 {
+						DEBUG("pgsql", "CommandComplete without a tag")
+						return false, false
+					}
+
 					m.start = s.parseOffset
 					m.IsRequest = false
 					m.IsOK = true
@@ -419,6 +925,7 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 
 						name := string(s.data[s.parseOffset+4 : s.parseOffset+length-1]) //without \0
 						DEBUG("pgsqldetailed", "CommandComplete length=%d, tag=%s", length, name)
+						m.AffectedRows = pgsqlCommandRows(name)
 
 						s.parseOffset += length
 						m.end = s.parseOffset
@@ -437,6 +944,8 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 						s.parseOffset += 1 // type
 						s.parseOffset += length
 						m.end = s.parseOffset
+						m.IsReadyForQuery = true
+						m.toExport = true
 
 						return true, true
 					} else {
@@ -478,10 +987,19 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 
 			// read message length
 			length := int(Bytes_Ntohl(s.data[s.parseOffset+1 : s.parseOffset+5]))
+			if length < 4 {
+				DEBUG("pgsql", "Invalid length %d of message type %c", length, typ)
+				return false, false
+			}
 
 			if typ == 'D' {
 				// DataRow
 
+				if length < 6 {
+					DEBUG("pgsql", "DataRow without a columns count")
+					return false, false
+				}
+
 				if len(s.data[s.parseOffset:]) >= length+1 {
 					// skip type
 					s.parseOffset += 1
@@ -499,6 +1017,11 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 			} else if typ == 'C' {
 				// CommandComplete
 
+				if length < 5 {
+					DEBUG("pgsql", "CommandComplete without a tag")
+					return false, false
+				}
+
 				if len(s.data[s.parseOffset:]) >= length+1 {
 
 					// skip type
@@ -506,6 +1029,7 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 
 					name := string(s.data[s.parseOffset+4 : s.parseOffset+length-1]) //without \0
 					DEBUG("pgsqldetailed", "CommandComplete length=%d, tag=%s", length, name)
+					m.AffectedRows = pgsqlCommandRows(name)
 
 					s.parseOffset += length
 					m.end = s.parseOffset
@@ -522,43 +1046,205 @@ func pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 					DEBUG("pgsqldetailed", "Wait for more data 8")
 					return true, false
 				}
+			} else if typ == 's' {
+				// PortalSuspended, the Execute reached its row limit
+
+				if len(s.data[s.parseOffset:]) >= length+1 {
+					s.parseOffset += 1 //type
+					s.parseOffset += length
+					m.end = s.parseOffset
+					m.Size = uint64(m.end - m.start)
+
+					s.parseState = PgsqlStartState
+					return true, true
+				} else {
+					// wait for more
+					DEBUG("pgsqldetailed", "Wait for more data 9")
+					return true, false
+				}
+			} else if typ == 'N' {
+				// NoticeResponse
+
+				if len(s.data[s.parseOffset:]) >= length+1 {
+					pgsqlNoticeParser(s, length)
+				} else {
+					// wait for more
+					DEBUG("pgsqldetailed", "Wait for more data 10")
+					return true, false
+				}
+			} else if m.NumberOfRows == 0 {
+				// the RowDescription answered a Describe, the rows
+				// will follow the Execute
+				DEBUG("pgsqldetailed", "RowDescription not followed by rows")
+				m = &PgsqlMessage{Ts: m.Ts, Notices: m.Notices}
+				s.message = m
+				s.parseState = PgsqlStartState
 			} else {
 				// shouldn't happen
 				DEBUG("pgsqldetailed", "Skip command of type %c", typ)
 				s.parseState = PgsqlStartState
 			}
 			break
+
+		case PgsqlCopyState:
+
+			// COPY TO STDOUT, the server sends:
+			// CopyOutResponse
+			// zero or more CopyData
+			// CopyDone
+			// CommandComplete
+			//
+			// COPY FROM STDIN, the client sends zero or more CopyData
+			// followed by CopyDone or CopyFail
+
+			if len(s.data[s.parseOffset:]) < 5 {
+				// wait for more
+				return true, false
+			}
+
+			// read type
+			typ := byte(s.data[s.parseOffset])
+
+			// read message length
+			length := int(Bytes_Ntohl(s.data[s.parseOffset+1 : s.parseOffset+5]))
+			if length < 4 {
+				DEBUG("pgsql", "Invalid length %d of message type %c", length, typ)
+				return false, false
+			}
+
+			if len(s.data[s.parseOffset:]) < length+1 {
+				// wait for more
+				DEBUG("pgsqldetailed", "Wait for more data 11")
+				return true, false
+			}
+
+			if typ == 'd' {
+				// CopyData
+				m.CopyBytes += length - 4
+			} else if (typ == 'c' || typ == 'f') && s.isClient {
+				// CopyDone or CopyFail
+				DEBUG("pgsqldetailed", "COPY done, %d bytes", m.CopyBytes)
+				m.CopyFailed = typ == 'f'
+				s.parseOffset += 1 + length
+				m.end = s.parseOffset
+				s.parseState = PgsqlStartState
+				return true, true
+			} else if typ == 'c' {
+				// CopyDone, CommandComplete follows
+			} else if typ == 'C' {
+				// CommandComplete
+				if length < 5 {
+					DEBUG("pgsql", "CommandComplete without a tag")
+					return false, false
+				}
+				name := string(s.data[s.parseOffset+5 : s.parseOffset+length]) //without \0
+				DEBUG("pgsqldetailed", "COPY done, %d bytes, tag=%s", m.CopyBytes, name)
+				m.AffectedRows = pgsqlCommandRows(name)
+
+				s.parseOffset += 1 + length
+				m.end = s.parseOffset
+				m.Size += uint64(1 + length)
+				s.parseState = PgsqlStartState
+				return true, true
+			} else if typ == 'N' {
+				// NoticeResponse
+				pgsqlNoticeParser(s, length)
+				break
+			} else {
+				// the COPY failed
+				DEBUG("pgsqldetailed", "COPY interrupted by message of type %c", typ)
+				s.parseState = PgsqlStartState
+				break
+			}
+
+			// the copied data is not kept
+			s.parseOffset += 1 + length
+			m.Size += uint64(1 + length)
+			s.data = s.data[s.parseOffset:]
+			s.parseOffset = 0
+			m.start = 0
+			break
 		}
 	}
 
 	return true, false
 }
 
+func (pgsql *Pgsql) Init(test_mode bool) error {
+	return nil
+}
+
+func (pgsql *Pgsql) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	ParsePgsql(pkt, tcp, dir)
+}
+
+func (pgsql *Pgsql) ReceivedFin(tcp *TcpStream, dir uint8) {
+	// nothing to do, the responses are length delimited
+}
+
+func (pgsql *Pgsql) GapInStream(tcp *TcpStream, dir uint8) {
+	GapInPgsqlStream(tcp, dir)
+}
+
+func (pgsql *Pgsql) ConnectionExpired(tcp *TcpStream) {
+	// the pending transactions expire on their own, but the prepared
+	// statements are only valid during the connection
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	delete(pgsqlConnectionsMap, tuple.raw)
+}
+
+// Recognizes the messages starting a connection (startup, SSL or cancel
+// request) and simple queries.
+func (pgsql *Pgsql) Detect(data []byte) int {
+
+	if len(data) < 8 {
+		return 0
+	}
+
+	if special, _ := isSpecialPgsqlCommand(data); special {
+		length := int(Bytes_Ntohl(data[0:4]))
+		if length >= 8 && length <= 10000 {
+			return DetectionScoreCertain
+		}
+		return 0
+	}
+
+	if data[0] == 'Q' {
+		length := int(Bytes_Ntohl(data[1:5]))
+		if length == len(data)-1 && data[len(data)-1] == 0 {
+			return DetectionScoreCertain
+		}
+	}
+	return 0
+}
+
 func ParsePgsql(pkt *Packet, tcp *TcpStream, dir uint8) {
 
 	defer RECOVER("ParsePgsql exception")
 
-	if tcp.pgsqlData[dir] == nil {
-		tcp.pgsqlData[dir] = &PgsqlStream{
+	stream, _ := tcp.data[dir].(*PgsqlStream)
+
+	if stream == nil {
+		stream = &PgsqlStream{
 			tcpStream: tcp,
 			data:      pkt.payload,
 			message:   &PgsqlMessage{Ts: pkt.ts},
 		}
+		tcp.data[dir] = stream
 		DEBUG("pgsqldetailed", "New stream created")
 	} else {
 		// concatenate bytes
-		tcp.pgsqlData[dir].data = append(tcp.pgsqlData[dir].data, pkt.payload...)
-		DEBUG("pgsqldetailed", "Len data: %d cap data: %d", len(tcp.pgsqlData[dir].data), cap(tcp.pgsqlData[dir].data))
-		if len(tcp.pgsqlData[dir].data) > TCP_MAX_DATA_IN_STREAM {
+		stream.data = append(stream.data, pkt.payload...)
+		DEBUG("pgsqldetailed", "Len data: %d cap data: %d", len(stream.data), cap(stream.data))
+		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
 			DEBUG("pgsql", "Stream data too large, dropping TCP stream")
-			tcp.pgsqlData[dir] = nil
+			tcp.data[dir] = nil
 			return
 		}
 	}
 
-	stream := tcp.pgsqlData[dir]
-
-	if tcp.pgsqlData[1-dir] != nil && tcp.pgsqlData[1-dir].seenSSLRequest {
+	stream_rev, _ := tcp.data[1-dir].(*PgsqlStream)
+	if stream_rev != nil && stream_rev.seenSSLRequest {
 		stream.expectSSLResponse = true
 	}
 
@@ -568,11 +1254,11 @@ func ParsePgsql(pkt *Packet, tcp *TcpStream, dir uint8) {
 			stream.message = &PgsqlMessage{Ts: pkt.ts}
 		}
 
-		ok, complete := pgsqlMessageParser(tcp.pgsqlData[dir])
+		ok, complete := pgsqlMessageParser(stream)
 		if !ok {
 			// drop this tcp stream. Will retry parsing with the next
 			// segment in it
-			tcp.pgsqlData[dir] = nil
+			tcp.data[dir] = nil
 			DEBUG("pgsql", "Ignore Postgresql message. Drop tcp stream. Try parsing with the next segment")
 			return
 		}
@@ -587,7 +1273,7 @@ func ParsePgsql(pkt *Packet, tcp *TcpStream, dir uint8) {
 			} else if stream.message.isSSLResponse {
 				// SSL request answered
 				stream.expectSSLResponse = false
-				tcp.pgsqlData[1-dir].seenSSLRequest = false
+				stream_rev.seenSSLRequest = false
 			} else {
 				if stream.message.toExport {
 					handlePgsql(stream.message, tcp, dir, msg)
@@ -625,7 +1311,10 @@ func GapInPgsqlStream(tcp *TcpStream, dir uint8) {
 
 	// If enough data was received, send it to the
 	// next layer but mark it as incomplete.
-	stream := tcp.pgsqlData[dir]
+	stream, _ := tcp.data[dir].(*PgsqlStream)
+	if stream == nil {
+		return
+	}
 	if PgsqlMessageHasEnoughData(stream.message) {
 		DEBUG("pgsql", "Message not complete, but sending to the next layer")
 		stream.message.toExport = true
@@ -655,63 +1344,341 @@ var handlePgsql = func(m *PgsqlMessage, tcp *TcpStream,
 	m.Direction = dir
 	m.CmdlineTuple = procWatcher.FindProcessesTuple(tcp.tuple)
 
-	if m.IsRequest {
-		receivedPgsqlRequest(m)
+	if m.IsNotification {
+		receivedPgsqlNotification(m)
+	} else if m.IsReadyForQuery {
+		readyPgsqlConnection(m)
+	} else if m.IsStartup {
+		receivedPgsqlStartup(m)
+	} else if m.IsRequest {
+		switch m.Typ {
+		case 'P':
+			parsedPgsqlStatement(m)
+		case 'B':
+			boundPgsqlPortal(m)
+		case 'E':
+			executedPgsqlPortal(m)
+		case 'C':
+			closedPgsqlObject(m)
+		case 'd':
+			copiedPgsqlData(m)
+		case 'S':
+			syncedPgsqlConnection(m)
+		default:
+			receivedPgsqlRequest(m)
+		}
 	} else {
 		receivedPgsqlResponse(m)
 	}
 }
 
-func receivedPgsqlRequest(msg *PgsqlMessage) {
+// Creates the transaction of a query and queues it until its response
+// is received.
+func newPgsqlTransaction(msg *PgsqlMessage, query string) *PgsqlTransaction {
 
 	tuple := msg.TcpTuple
 
+	trans := newPgsqlEvent(msg, query)
+	trans.batch = getPgsqlConnection(tuple).batchesSent
+
+	trans.timer = time.AfterFunc(TransactionTimeout, func() { trans.Expire() })
+
+	pgsqlTransactionsMap[tuple.raw] = append(pgsqlTransactionsMap[tuple.raw], trans)
+
+	return trans
+}
+
+// Creates a transaction with the endpoints of the message and the
+// connection details.
+func newPgsqlEvent(msg *PgsqlMessage, query string) *PgsqlTransaction {
+
+	tuple := msg.TcpTuple
+
+	trans := &PgsqlTransaction{Type: "pgsql", tuple: tuple}
+
+	trans.ts = msg.Ts
+	trans.Ts = int64(trans.ts.UnixNano() / 1000) // transactions have microseconds resolution
+	trans.JsTs = msg.Ts
+	trans.Src = Endpoint{
+		Ip:   msg.TcpTuple.Src_ip.String(),
+		Port: msg.TcpTuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	trans.Dst = Endpoint{
+		Ip:   msg.TcpTuple.Dst_ip.String(),
+		Port: msg.TcpTuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+	if msg.Direction == TcpDirectionReverse {
+		trans.Src, trans.Dst = trans.Dst, trans.Src
+	}
+
+	conn := getPgsqlConnection(tuple)
+
+	trans.Pgsql = bson.M{
+		"query":            query,
+		"query.raw":        query,
+		"method":           getQueryMethod(query),
+		"user":             conn.user,
+		"database":         conn.database,
+		"application_name": conn.applicationName,
+		"tables":           "",
+	}
+	if len(query) > 0 {
+		fingerprint, hash, tables := analyzeSql(query, true)
+		trans.Pgsql["query_fingerprint"] = fingerprint
+		trans.Pgsql["query_hash"] = hash
+		trans.Pgsql["tables"] = strings.Join(tables, ", ")
+	}
+
+	trans.Request_raw = query
+
+	return trans
+}
+
+func receivedPgsqlRequest(msg *PgsqlMessage) {
+
 	// parse the query, as it might contain a list of pgsql command
 	// separated by ';'
 	queries := pgsqlQueryParser(msg.Query)
 
 	DEBUG("pgsqldetailed", "Queries (%d) :%s", len(queries), queries)
 
-	if pgsqlTransactionsMap[tuple.raw] == nil {
-		pgsqlTransactionsMap[tuple.raw] = []*PgsqlTransaction{}
+	for _, query := range queries {
+		trans := newPgsqlTransaction(msg, query)
+		trans.Pgsql["command"] = "query"
+	}
+
+	getPgsqlConnection(msg.TcpTuple).batchesSent++
+}
+
+// The login is tracked as a transaction, answered by AuthenticationOk
+// or by an ErrorResponse.
+func receivedPgsqlStartup(msg *PgsqlMessage) {
+
+	conn := getPgsqlConnection(msg.TcpTuple)
+	conn.user = msg.User
+	conn.database = msg.Database
+	conn.applicationName = msg.ApplicationName
+
+	trans := newPgsqlTransaction(msg, "")
+	trans.Pgsql["method"] = "LOGIN"
+	trans.Pgsql["command"] = "login"
+
+	conn.batchesSent++
+}
+
+func parsedPgsqlStatement(msg *PgsqlMessage) {
+
+	conn := getPgsqlConnection(msg.TcpTuple)
+	conn.statements[msg.StatementName] = &pgsqlStatement{
+		query:      msg.Query,
+		paramTypes: msg.ParamTypes,
 	}
+}
 
-	for _, query := range queries {
+func boundPgsqlPortal(msg *PgsqlMessage) {
 
-		trans := &PgsqlTransaction{Type: "pgsql", tuple: tuple}
+	conn := getPgsqlConnection(msg.TcpTuple)
+	stmt := conn.statements[msg.StatementName]
 
-		trans.ts = msg.Ts
-		trans.Ts = int64(trans.ts.UnixNano() / 1000) // transactions have microseconds resolution
-		trans.JsTs = msg.Ts
-		trans.Src = Endpoint{
-			Ip:   msg.TcpTuple.Src_ip.String(),
-			Port: msg.TcpTuple.Src_port,
-			Proc: string(msg.CmdlineTuple.Src),
-		}
-		trans.Dst = Endpoint{
-			Ip:   msg.TcpTuple.Dst_ip.String(),
-			Port: msg.TcpTuple.Dst_port,
-			Proc: string(msg.CmdlineTuple.Dst),
+	params := []string{}
+	for i, value := range msg.ParamValues {
+		var format uint16
+		if len(msg.ParamFormats) == 1 {
+			format = msg.ParamFormats[0]
+		} else if i < len(msg.ParamFormats) {
+			format = msg.ParamFormats[i]
 		}
-		if msg.Direction == TcpDirectionReverse {
-			trans.Src, trans.Dst = trans.Dst, trans.Src
+		var typ uint32
+		if stmt != nil && i < len(stmt.paramTypes) {
+			typ = stmt.paramTypes[i]
 		}
+		params = append(params, pgsqlParamValue(value, format, typ))
+	}
+
+	conn.portals[msg.PortalName] = &pgsqlPortal{
+		statementName: msg.StatementName,
+		statement:     stmt,
+		params:        params,
+	}
+}
+
+func executedPgsqlPortal(msg *PgsqlMessage) {
+
+	conn := getPgsqlConnection(msg.TcpTuple)
+	portal := conn.portals[msg.PortalName]
 
-		trans.Pgsql = bson.M{
-			"query":     query,
-			"query.raw": query,
-			"method":    getQueryMethod(query),
+	var query, statementName string
+	var params []string
+	if portal != nil {
+		statementName = portal.statementName
+		params = portal.params
+		if portal.statement != nil {
+			query = strings.TrimSpace(portal.statement.query)
 		}
+	}
+
+	trans := newPgsqlTransaction(msg, query)
+	if len(query) == 0 {
+		// the statement was prepared before the capture started
+		trans.Pgsql["method"] = "EXECUTE"
+	}
+	trans.Pgsql["command"] = "execute"
+	trans.Pgsql["statement"] = statementName
+	trans.Pgsql["params"] = params
+}
+
+func syncedPgsqlConnection(msg *PgsqlMessage) {
+	getPgsqlConnection(msg.TcpTuple).batchesSent++
+}
 
-		trans.Request_raw = query
+// The server answered the batch sent first. After an error it skips the
+// messages up to the Sync, so the Executes that followed the failed one
+// get no response.
+func readyPgsqlConnection(msg *PgsqlMessage) {
 
+	conn := pgsqlConnectionsMap[msg.TcpTuple.raw]
+	if conn == nil || conn.batchesReady >= conn.batchesSent {
+		// the batch was sent before the capture started
+		return
+	}
+	batch := conn.batchesReady
+	conn.batchesReady++
+
+	if !conn.batchFailed || conn.failedBatch != batch {
+		return
+	}
+	conn.batchFailed = false
+
+	for len(pgsqlTransactionsMap[msg.TcpTuple.raw]) > 0 {
+		trans := pgsqlTransactionsMap[msg.TcpTuple.raw][0]
+		if trans.batch > batch {
+			break
+		}
+		removePgsqlTransaction(msg.TcpTuple, 0)
 		if trans.timer != nil {
 			trans.timer.Stop()
 		}
-		trans.timer = time.AfterFunc(TransactionTimeout, func() { trans.Expire() })
 
-		pgsqlTransactionsMap[tuple.raw] = append(pgsqlTransactionsMap[tuple.raw], trans)
+		trans.Pgsql = bson_concat(trans.Pgsql, bson.M{
+			"isOK":          false,
+			"iserror":       true,
+			"error_message": "skipped after error",
+		})
+		trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6)
+
+		err := Publisher.PublishPgsqlTransaction(trans)
+		if err != nil {
+			WARN("Publish failure: %s", err)
+		}
+		DEBUG("pgsql", "Postgres transaction skipped after error: %s", trans.Pgsql)
+	}
+}
+
+// Counts the bytes sent by the client for the pending COPY FROM STDIN.
+func copiedPgsqlData(msg *PgsqlMessage) {
+
+	trans_list := pgsqlTransactionsMap[msg.TcpTuple.raw]
+	if len(trans_list) == 0 {
+		DEBUG("pgsql", "COPY data without a COPY query")
+		return
+	}
+	trans := trans_list[len(trans_list)-1]
+	trans.Pgsql["copy_bytes"] = msg.CopyBytes
+	if msg.CopyFailed {
+		trans.Pgsql["copy_failed"] = true
+	}
+}
+
+// Notifications are published on their own, they don't answer a
+// query of the client.
+func receivedPgsqlNotification(msg *PgsqlMessage) {
+
+	trans := newPgsqlEvent(msg, "")
+
+	// sent by the server to the listening client
+	trans.Src, trans.Dst = trans.Dst, trans.Src
+
+	trans.Pgsql = bson_concat(trans.Pgsql, bson.M{
+		"method":        "NOTIFY",
+		"command":       "notification",
+		"channel":       msg.Channel,
+		"payload":       msg.Payload,
+		"notifying_pid": msg.NotificationPid,
+		"isOK":          true,
+		"iserror":       false,
+	})
+
+	err := Publisher.PublishPgsqlTransaction(trans)
+	if err != nil {
+		WARN("Publish failure: %s", err)
 	}
+
+	DEBUG("pgsql", "Postgres notification: %s", trans.Pgsql)
+}
+
+func closedPgsqlObject(msg *PgsqlMessage) {
+
+	conn := pgsqlConnectionsMap[msg.TcpTuple.raw]
+	if conn == nil {
+		return
+	}
+	if msg.ClosedObject == 'S' {
+		delete(conn.statements, msg.StatementName)
+	} else {
+		delete(conn.portals, msg.PortalName)
+	}
+}
+
+// Formats the value of a parameter sent in a Bind message. The binary
+// format is decoded for the common types, other values are shown in
+// hex.
+func pgsqlParamValue(value []byte, format uint16, typ uint32) string {
+
+	if value == nil {
+		return "NULL"
+	}
+	if format == 0 {
+		return string(value)
+	}
+
+	switch typ {
+	case PGSQL_TYPE_BOOL:
+		if len(value) == 1 {
+			if value[0] != 0 {
+				return "true"
+			}
+			return "false"
+		}
+	case PGSQL_TYPE_INT2:
+		if len(value) == 2 {
+			return fmt.Sprintf("%d", int16(Bytes_Ntohs(value)))
+		}
+	case PGSQL_TYPE_INT4:
+		if len(value) == 4 {
+			return fmt.Sprintf("%d", int32(Bytes_Ntohl(value)))
+		}
+	case PGSQL_TYPE_OID:
+		if len(value) == 4 {
+			return fmt.Sprintf("%d", Bytes_Ntohl(value))
+		}
+	case PGSQL_TYPE_INT8:
+		if len(value) == 8 {
+			return fmt.Sprintf("%d", int64(Bytes_Ntohll(value)))
+		}
+	case PGSQL_TYPE_FLOAT4:
+		if len(value) == 4 {
+			return fmt.Sprintf("%g", math.Float32frombits(Bytes_Ntohl(value)))
+		}
+	case PGSQL_TYPE_FLOAT8:
+		if len(value) == 8 {
+			return fmt.Sprintf("%g", math.Float64frombits(Bytes_Ntohll(value)))
+		}
+	case PGSQL_TYPE_TEXT, PGSQL_TYPE_VARCHAR, PGSQL_TYPE_BPCHAR, PGSQL_TYPE_NAME:
+		return string(value)
+	}
+	return "\\x" + hex.EncodeToString(value)
 }
 
 func receivedPgsqlResponse(msg *PgsqlMessage) {
@@ -727,6 +1694,13 @@ func receivedPgsqlResponse(msg *PgsqlMessage) {
 	// extract the first transaction from the array
 	trans := removePgsqlTransaction(tuple, 0)
 
+	if msg.IsError {
+		// the server skips what follows in the batch
+		conn := getPgsqlConnection(tuple)
+		conn.batchFailed = true
+		conn.failedBatch = trans.batch
+	}
+
 	// check if the request was received
 	if len(trans.Pgsql) == 0 {
 		WARN("Response from unknown transaction. Ignoring.")
@@ -742,8 +1716,40 @@ func receivedPgsqlResponse(msg *PgsqlMessage) {
 		"error_code":     msg.ErrorCode,
 		"error_message":  msg.ErrorInfo,
 		"error_severity": msg.ErrorSeverity,
+		"affected_rows":  msg.AffectedRows,
 	})
 
+	if len(msg.Notices) > 0 {
+		notices := []bson.M{}
+		for _, notice := range msg.Notices {
+			notices = append(notices, bson.M{
+				"severity": notice.Severity,
+				"code":     notice.Code,
+				"message":  notice.Message,
+			})
+		}
+		trans.Pgsql["notices"] = notices
+	}
+
+	if trans.Pgsql["method"] == "COPY" {
+		if msg.CopyBytes > 0 {
+			// COPY TO STDOUT
+			trans.Pgsql["copy_bytes"] = msg.CopyBytes
+		} else if _, exists := trans.Pgsql["copy_bytes"]; !exists {
+			trans.Pgsql["copy_bytes"] = 0
+		}
+		trans.Pgsql["copy_rows"] = msg.AffectedRows
+	}
+
+	if trans.Pgsql["command"] == "login" && !msg.IsError {
+		// only the failed logins are published
+		DEBUG("pgsql", "User %s logged in", trans.Pgsql["user"])
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		return
+	}
+
 	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
 	trans.Response_raw = dumpInCSVFormat(msg.Fields, msg.Rows)
 
@@ -760,7 +1766,19 @@ func receivedPgsqlResponse(msg *PgsqlMessage) {
 }
 
 func (trans *PgsqlTransaction) Expire() {
-	// TODO: Here we need to PUBLISH an incomplete/timeout transaction
+
+	if len(trans.Pgsql) != 0 {
+		// the query never got a response
+		trans.timedOut = true
+		trans.ResponseTime = TimeoutResponseTime
+
+		err := Publisher.PublishPgsqlTransaction(trans)
+		if err != nil {
+			WARN("Publish failure: %s", err)
+		}
+		DEBUG("pgsql", "Postgres transaction timed out: %s", trans.Pgsql)
+	}
+
 	// remove from map
 	for i, t := range pgsqlTransactionsMap[trans.tuple.raw] {
 		if t == trans {
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/hex"
+	"labix.org/v2/mgo/bson"
+	"strings"
 	"testing"
 	"time"
 )
@@ -166,9 +169,7 @@ func TestPgsqlParser_threeResponses(t *testing.T) {
 		payload: data,
 		ts:      ts,
 	}
-	tcp := TcpStream{
-		pgsqlData: [2]*PgsqlStream{nil, nil},
-	}
+	tcp := TcpStream{}
 
 	var count_handlePgsql = 0
 
@@ -184,8 +185,9 @@ func TestPgsqlParser_threeResponses(t *testing.T) {
 
 	ParsePgsql(&pkt, &tcp, 1)
 
-	if count_handlePgsql != 3 {
-		t.Error("handlePgsql not called three times")
+	// the ReadyForQuery that follows is passed on as well
+	if count_handlePgsql != 4 {
+		t.Error("handlePgsql not called for the three responses and the ReadyForQuery")
 	}
 
 }
@@ -227,3 +229,413 @@ func TestPgsqlParser_errorResponse(t *testing.T) {
 		t.Error("Failed to parse error message")
 	}
 }
+
+// Test a query run with Parse, Bind, Describe, Execute and Sync
+func TestParsePgsql_extendedQuery(t *testing.T) {
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"pgsql", "pgsqldetailed"})
+	}
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(pgsqlTransactionsMap, tuple.raw)
+	defer delete(pgsqlConnectionsMap, tuple.raw)
+
+	parse := func(hexdata string, dir uint8) {
+		data, err := hex.DecodeString(hexdata)
+		if err != nil {
+			t.Fatalf("Failed to decode hex string")
+		}
+		ParsePgsql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+
+	// one int4 and one bool parameter, both in binary format
+	parse("50000000440053454c454354206e616d652046524f4d2075736572732057"+
+		"48455245206964203d20243120414e4420616374697665203d2024320000"+
+		"020000001700000010420000001b0000000100010002000000040000002a"+
+		"0000000101000044000000065000450000000900000000005300000004", 0)
+
+	trans_list := pgsqlTransactionsMap[tuple.raw]
+	if len(trans_list) != 1 {
+		t.Fatalf("Expected one transaction, got %d", len(trans_list))
+	}
+	trans := trans_list[0]
+	if trans.Pgsql["query"] != "SELECT name FROM users WHERE id = $1 AND active = $2" ||
+		trans.Pgsql["method"] != "SELECT" || trans.Pgsql["command"] != "execute" {
+		t.Errorf("Wrong execute transaction: %v", trans.Pgsql)
+	}
+	params := trans.Pgsql["params"].([]string)
+	if len(params) != 2 || params[0] != "42" || params[1] != "true" {
+		t.Errorf("Wrong parameters: %v", params)
+	}
+	if trans.Pgsql["query_fingerprint"] != "select name from users where id = ? and active = ?" ||
+		trans.Pgsql["tables"] != "users" {
+		t.Errorf("Wrong fingerprint or tables: %v", trans.Pgsql)
+	}
+
+	// ParseComplete, BindComplete, RowDescription, DataRow,
+	// CommandComplete and ReadyForQuery
+	parse("31000000043200000004540000001d00016e616d65000000000000000000"+
+		"0019ffffffffffff0000440000000d0001000000036a6f65430000000d53"+
+		"454c4543542031005a0000000549", 1)
+
+	if _, exists := pgsqlTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Transaction still pending")
+	}
+	if trans.Pgsql["num_rows"] != 1 || trans.Pgsql["affected_rows"] != 1 ||
+		trans.Pgsql["iserror"] != false {
+		t.Errorf("Wrong response: %v", trans.Pgsql)
+	}
+	if trans.Response_raw != "name\njoe\n" {
+		t.Errorf("Wrong rows: %s", trans.Response_raw)
+	}
+
+	// Close of a named statement
+	conn := pgsqlConnectionsMap[tuple.raw]
+	conn.statements["stmt1"] = &pgsqlStatement{query: "SELECT 1"}
+	parse("430000000b5373746d7431005300000004", 0)
+	if _, exists := conn.statements["stmt1"]; exists {
+		t.Errorf("Statement not closed")
+	}
+	if len(pgsqlTransactionsMap[tuple.raw]) != 0 {
+		t.Errorf("Close shouldn't create a transaction")
+	}
+}
+
+// Builds a message of the given type from its body parts.
+func pgsqlTestMessage(typ byte, parts ...string) []byte {
+	body := strings.Join(parts, "")
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// Test that the Executes skipped after an error don't take the
+// responses of the next batch
+func TestParsePgsql_errorInBatch(t *testing.T) {
+
+	output, restore := recordGlobalPublisher()
+	defer restore()
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(pgsqlTransactionsMap, tuple.raw)
+	defer delete(pgsqlConnectionsMap, tuple.raw)
+
+	parse := func(dir uint8, messages ...[]byte) {
+		data := []byte{}
+		for _, msg := range messages {
+			data = append(data, msg...)
+		}
+		ParsePgsql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+	execute := func(query string) []byte {
+		msg := pgsqlTestMessage('P', "\x00", query, "\x00", "\x00\x00")
+		msg = append(msg, pgsqlTestMessage('B', "\x00\x00", "\x00\x00\x00\x00\x00\x00")...)
+		return append(msg, pgsqlTestMessage('E', "\x00", "\x00\x00\x00\x00")...)
+	}
+	sync := pgsqlTestMessage('S')
+	ready := pgsqlTestMessage('Z', "I")
+	parseComplete := pgsqlTestMessage('1')
+	bindComplete := pgsqlTestMessage('2')
+
+	parse(0, execute("UPDATE missing SET a = 1"), execute("UPDATE t SET a = 2"), sync,
+		execute("UPDATE t SET a = 3"), sync)
+
+	if len(pgsqlTransactionsMap[tuple.raw]) != 3 {
+		t.Fatalf("Expected 3 transactions, got %d", len(pgsqlTransactionsMap[tuple.raw]))
+	}
+
+	// the server skips the second Execute after the error
+	parse(1, parseComplete, bindComplete,
+		pgsqlTestMessage('E', "SERROR\x00", "C42P01\x00", "Mrelation does not exist\x00", "\x00"),
+		ready)
+	parse(1, parseComplete, bindComplete, pgsqlTestMessage('C', "UPDATE 1\x00"), ready)
+
+	if len(output.events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(output.events))
+	}
+	expected := []struct {
+		query  string
+		status string
+		error  string
+	}{
+		{"UPDATE missing SET a = 1", ERROR_STATUS, "relation does not exist"},
+		{"UPDATE t SET a = 2", ERROR_STATUS, "skipped after error"},
+		{"UPDATE t SET a = 3", OK_STATUS, ""},
+	}
+	for i, exp := range expected {
+		event := output.events[i]
+		if event.Pgsql["query"] != exp.query || event.Status != exp.status ||
+			event.Pgsql["error_message"] != exp.error {
+
+			t.Errorf("Wrong event %d: %s %v", i, event.Status, event.Pgsql)
+		}
+	}
+	if _, exists := pgsqlTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Transactions still pending")
+	}
+}
+
+// Test that the messages too short for their length field are refused
+// instead of read out of bounds
+func TestPgsqlParser_invalidLength(t *testing.T) {
+
+	parse := func(data []byte, isClient bool, state int) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Errorf("Panic parsing %X (client=%v, state=%d): %v", data, isClient, state, r)
+			}
+		}()
+		stream := &PgsqlStream{data: data, message: new(PgsqlMessage),
+			isClient: isClient, parseState: state}
+		pgsqlMessageParser(stream)
+	}
+
+	for _, state := range []int{PgsqlStartState, PgsqlGetDataState, PgsqlCopyState} {
+		for typ := 0; typ < 256; typ++ {
+			for length := 0; length <= 4; length++ {
+				data := []byte{byte(typ), 0, 0, 0, byte(length)}
+				parse(data, false, state)
+				parse(data, true, state)
+			}
+		}
+	}
+
+	// StartupMessage
+	for length := 0; length < 8; length++ {
+		parse([]byte{0, 0, 0, byte(length), 0, 3, 0, 0}, false, PgsqlStartState)
+	}
+}
+
+func TestPgsql_paramValue(t *testing.T) {
+
+	tests := []struct {
+		value    []byte
+		format   uint16
+		typ      uint32
+		expected string
+	}{
+		{[]byte("abc"), 0, PGSQL_TYPE_INT4, "abc"},
+		{nil, 1, PGSQL_TYPE_INT4, "NULL"},
+		{[]byte{0xff, 0xfe}, 1, PGSQL_TYPE_INT2, "-2"},
+		{[]byte{0, 0, 0, 0, 0, 0, 1, 0}, 1, PGSQL_TYPE_INT8, "256"},
+		{[]byte{0x3f, 0xc0, 0, 0}, 1, PGSQL_TYPE_FLOAT4, "1.5"},
+		{[]byte("joe"), 1, PGSQL_TYPE_VARCHAR, "joe"},
+		{[]byte{0xde, 0xad}, 1, PGSQL_TYPE_BYTEA, "\\xdead"},
+	}
+
+	for _, test := range tests {
+		value := pgsqlParamValue(test.value, test.format, test.typ)
+		if value != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, value)
+		}
+	}
+}
+
+// Test a successful startup followed by a query
+func TestParsePgsql_startup(t *testing.T) {
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(pgsqlTransactionsMap, tuple.raw)
+	defer delete(pgsqlConnectionsMap, tuple.raw)
+
+	parse := func(hexdata string, dir uint8) {
+		data, err := hex.DecodeString(hexdata)
+		if err != nil {
+			t.Fatalf("Failed to decode hex string")
+		}
+		ParsePgsql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+
+	// StartupMessage
+	parse("0000003b000300007573657200706f737467726573006461746162617365"+
+		"0074657374006170706c69636174696f6e5f6e616d65007073716c0000", 0)
+
+	conn := pgsqlConnectionsMap[tuple.raw]
+	if conn == nil || conn.user != "postgres" || conn.database != "test" ||
+		conn.applicationName != "psql" {
+		t.Fatalf("StartupMessage not decoded")
+	}
+	if len(pgsqlTransactionsMap[tuple.raw]) != 1 {
+		t.Fatalf("No login transaction")
+	}
+
+	// AuthenticationOk, ParameterStatus, BackendKeyData, ReadyForQuery
+	parse("52000000080000000053000000197365727665725f76657273696f6e0039"+
+		"2e332e35004b0000000c00000001000000025a0000000549", 1)
+
+	if len(pgsqlTransactionsMap[tuple.raw]) != 0 {
+		t.Errorf("Login transaction still pending")
+	}
+
+	// the queries carry the user and the database
+	parse("510000000d53454c454354203100", 0)
+	trans_list := pgsqlTransactionsMap[tuple.raw]
+	if len(trans_list) != 1 || trans_list[0].Pgsql["user"] != "postgres" ||
+		trans_list[0].Pgsql["database"] != "test" ||
+		trans_list[0].Pgsql["application_name"] != "psql" {
+		t.Errorf("Query without user and database")
+	}
+	trans_list[0].timer.Stop()
+}
+
+// Test a login refused after the password exchange
+func TestParsePgsql_failedLogin(t *testing.T) {
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(pgsqlTransactionsMap, tuple.raw)
+	defer delete(pgsqlConnectionsMap, tuple.raw)
+
+	parse := func(hexdata string, dir uint8) {
+		data, err := hex.DecodeString(hexdata)
+		if err != nil {
+			t.Fatalf("Failed to decode hex string")
+		}
+		ParsePgsql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+
+	parse("0000003b000300007573657200706f737467726573006461746162617365"+
+		"0074657374006170706c69636174696f6e5f6e616d65007073716c0000", 0)
+	trans_list := pgsqlTransactionsMap[tuple.raw]
+	if len(trans_list) != 1 || trans_list[0].Pgsql["method"] != "LOGIN" {
+		t.Fatalf("No login transaction")
+	}
+	trans := trans_list[0]
+
+	// AuthenticationMD5Password, PasswordMessage
+	parse("520000000c0000000561626364", 1)
+	parse("70000000286d643530303030303030303030303030303030303030303030"+
+		"3030303030303030303000", 0)
+	if len(pgsqlTransactionsMap[tuple.raw]) != 1 {
+		t.Fatalf("Login transaction not pending during the password exchange")
+	}
+
+	// ErrorResponse
+	parse("450000004753464154414c00433238503031004d70617373776f72642061"+
+		"757468656e7469636174696f6e206661696c656420666f72207573657220"+
+		"22706f737467726573220000", 1)
+
+	if len(pgsqlTransactionsMap[tuple.raw]) != 0 {
+		t.Errorf("Login transaction still pending")
+	}
+	if trans.Pgsql["iserror"] != true || trans.Pgsql["error_code"] != "28P01" ||
+		trans.Pgsql["user"] != "postgres" {
+		t.Errorf("Failed login not reported: %v", trans.Pgsql)
+	}
+}
+
+// Test COPY in both directions, a notice and a notification
+func TestParsePgsql_copyNoticeNotify(t *testing.T) {
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(pgsqlTransactionsMap, tuple.raw)
+	defer delete(pgsqlConnectionsMap, tuple.raw)
+
+	parse := func(hexdata string, dir uint8) {
+		data, err := hex.DecodeString(hexdata)
+		if err != nil {
+			t.Fatalf("Failed to decode hex string")
+		}
+		ParsePgsql(&Packet{payload: data, ts: time.Now()}, &tcp, dir)
+	}
+	pending := func() *PgsqlTransaction {
+		trans_list := pgsqlTransactionsMap[tuple.raw]
+		if len(trans_list) != 1 {
+			t.Fatalf("Expected one pending transaction, got %d", len(trans_list))
+		}
+		return trans_list[0]
+	}
+
+	// COPY TO STDOUT
+	parse("5100000019434f505920757365727320544f205354444f555400", 0)
+	trans := pending()
+	parse("480000000b00000200000000640000000a31096a6f650a640000000a3209"+
+		"616e6e0a6300000004430000000b434f50592032005a0000000549", 1)
+	if trans.Pgsql["copy_bytes"] != 12 || trans.Pgsql["copy_rows"] != 2 {
+		t.Errorf("Wrong COPY TO STDOUT: %v", trans.Pgsql)
+	}
+
+	// COPY FROM STDIN
+	parse("510000001a434f50592075736572732046524f4d20535444494e00", 0)
+	trans = pending()
+	parse("470000000b00000200000000", 1)
+	parse("64000000153309626f620a34097375650a3509616c0a6300000004", 0)
+	pending()
+	parse("430000000b434f50592033005a0000000549", 1)
+	if trans.Pgsql["copy_bytes"] != 17 || trans.Pgsql["copy_rows"] != 3 {
+		t.Errorf("Wrong COPY FROM STDIN: %v", trans.Pgsql)
+	}
+
+	// a query answered with a notice, and a notification received
+	// while it was pending
+	parse("510000001d44524f50205441424c452049462045584953545320666f6f00", 0)
+	trans = pending()
+	parse("4100000015000010926576656e74730068656c6c6f00", 1)
+	pending()
+	parse("4e0000003a534e4f5449434500433030303030004d7461626c652022666f"+
+		"6f2220646f6573206e6f742065786973742c20736b697070696e67000043"+
+		"0000000f44524f50205441424c45005a0000000549", 1)
+
+	if len(pgsqlTransactionsMap[tuple.raw]) != 0 {
+		t.Errorf("Transaction still pending")
+	}
+	notices, _ := trans.Pgsql["notices"].([]bson.M)
+	if len(notices) != 1 || notices[0]["severity"] != "NOTICE" ||
+		notices[0]["message"] != "table \"foo\" does not exist, skipping" {
+		t.Errorf("Wrong notices: %v", trans.Pgsql["notices"])
+	}
+}
+
+func TestPgsqlParser_notification(t *testing.T) {
+
+	data, _ := hex.DecodeString("4100000015000010926576656e74730068656c6c6f00")
+	stream := &PgsqlStream{tcpStream: nil, data: data, message: new(PgsqlMessage)}
+
+	ok, complete := pgsqlMessageParser(stream)
+
+	if !ok || !complete || !stream.message.IsNotification {
+		t.Fatalf("Failed to parse NotificationResponse")
+	}
+	if stream.message.NotificationPid != 4242 || stream.message.Channel != "events" ||
+		stream.message.Payload != "hello" {
+		t.Errorf("Wrong notification: %d %s %s", stream.message.NotificationPid,
+			stream.message.Channel, stream.message.Payload)
+	}
+}
+
+func TestPgsql_expireTransaction(t *testing.T) {
+
+	output, restore := recordGlobalPublisher()
+	defer restore()
+
+	tcp := TcpStream{tuple: testIpPortTuple(), id: GetId()}
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(pgsqlTransactionsMap, tuple.raw)
+	defer delete(pgsqlConnectionsMap, tuple.raw)
+
+	ParsePgsql(&Packet{payload: pgsqlTestMessage('Q', "SELECT 1\x00"), ts: time.Now()}, &tcp, 0)
+
+	if len(pgsqlTransactionsMap[tuple.raw]) != 1 {
+		t.Fatalf("No pending transaction")
+	}
+	trans := pgsqlTransactionsMap[tuple.raw][0]
+	trans.timer.Stop()
+	trans.Expire()
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != TIMEOUT_STATUS || event.ResponseTime != TimeoutResponseTime ||
+		event.Pgsql["query"] != "SELECT 1" {
+
+		t.Errorf("Wrong event: %v %d %v", event.Status, event.ResponseTime, event.Pgsql)
+	}
+	if _, exists := pgsqlTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Expired transaction still in the map")
+	}
+}
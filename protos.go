@@ -0,0 +1,65 @@
+package main
+
+// Per connection state that a protocol analyzer keeps on the
+// TcpStream, one for each direction. The TCP layer doesn't look inside
+// it, it only drops it when the stream expires.
+type ProtocolData interface{}
+
+// Interface implemented by the protocol analyzers. The TCP layer binds
+// every followed stream to one of them and forwards it the stream
+// events.
+type ProtocolPlugin interface {
+	// Called once at startup for the protocols present in the
+	// configuration file. In test mode the configuration is not read.
+	Init(test_mode bool) error
+
+	// Called for every TCP segment that carries data.
+	Parse(pkt *Packet, tcp *TcpStream, dir uint8)
+
+	// Called when a FIN flag is seen in the given direction.
+	ReceivedFin(tcp *TcpStream, dir uint8)
+
+	// Called when the TCP layer gives up on missing data, either after
+	// waiting for it or because too much data was received after it.
+	// The parsing of that direction then resumes with the data
+	// following the gap, from an empty per direction state.
+	GapInStream(tcp *TcpStream, dir uint8)
+
+	// Called when the TCP stream expires or is dropped. The per
+	// connection data is released after this returns.
+	ConnectionExpired(tcp *TcpStream)
+}
+
+// Registry of the protocol analyzers, keyed by the name used in the
+// [protocols] section of the configuration file.
+var protocolPlugins = map[string]ProtocolPlugin{}
+
+// Makes a protocol analyzer available under the given name. Meant to be
+// called from the init() function of the file implementing it.
+func RegisterProtocolPlugin(name string, plugin ProtocolPlugin) {
+	if _, exists := protocolPlugins[name]; exists {
+		panic("Protocol plugin registered twice: " + name)
+	}
+	protocolPlugins[name] = plugin
+}
+
+// Initializes the protocol analyzers enabled in the configuration file.
+func ProtocolsInit() error {
+	for name, plugin := range protocolPlugins {
+		if _, exists := _Config.Protocols[name]; !exists {
+			continue
+		}
+		err := plugin.Init(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range _Config.Protocols {
+		if _, exists := protocolPlugins[name]; !exists {
+			WARN("Protocol %s is configured but not supported. Ignoring it.", name)
+		}
+	}
+
+	return nil
+}
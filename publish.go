@@ -86,11 +86,15 @@ type Event struct {
 	ResponseRaw  string    `json:"response_raw"`
 	Tags         string    `json:"tags"`
 
-	Mysql  bson.M `json:"mysql"`
-	Http   bson.M `json:"http"`
-	Redis  bson.M `json:"redis"`
-	Pgsql  bson.M `json:"pgsql"`
-	Thrift bson.M `json:"thrift"`
+	Mysql    bson.M `json:"mysql"`
+	Http     bson.M `json:"http"`
+	Redis    bson.M `json:"redis"`
+	Pgsql    bson.M `json:"pgsql"`
+	Thrift   bson.M `json:"thrift"`
+	Grpc     bson.M `json:"grpc"`
+	Dns      bson.M `json:"dns"`
+	Memcache bson.M `json:"memcache"`
+	Mongodb  bson.M `json:"mongodb"`
 }
 
 type Topology struct {
@@ -108,10 +112,20 @@ func PrintPublishEvent(event *Event) {
 }
 
 const (
-	OK_STATUS    = "OK"
-	ERROR_STATUS = "Error"
+	OK_STATUS      = "OK"
+	ERROR_STATUS   = "Error"
+	TIMEOUT_STATUS = "Timeout"
+
+	// The request was sent but its response, if any, was lost in a
+	// gap of the TCP stream. No response time is known.
+	GAP_STATUS = "Gap"
 )
 
+// Response time of the transactions that expired without a response,
+// in milliseconds. The expiration timer starts when the request is
+// received, so this is how long the request waited.
+const TimeoutResponseTime = int32(TransactionTimeout / 1e6)
+
 func (publisher *PublisherType) GetServerName(ip string) string {
 	// in case the IP is localhost, return current agent name
 	islocal, err := IsLoopback(ip)
@@ -135,7 +149,15 @@ func (publisher *PublisherType) PublishRedisTransaction(t *RedisTransaction) err
 
 	event := Event{}
 	event.Type = "redis"
-	event.Status = OK_STATUS
+	if t.timedOut {
+		event.Status = TIMEOUT_STATUS
+	} else if t.lostInGap {
+		event.Status = GAP_STATUS
+	} else if t.Redis["iserror"].(bool) {
+		event.Status = ERROR_STATUS
+	} else {
+		event.Status = OK_STATUS
+	}
 	event.ResponseTime = t.ResponseTime
 	event.RequestRaw = t.Request_raw
 	event.ResponseRaw = t.Response_raw
@@ -211,7 +233,9 @@ func (publisher *PublisherType) PublishPgsqlTransaction(t *PgsqlTransaction) err
 	event := Event{}
 
 	event.Type = "pgsql"
-	if t.Pgsql["iserror"].(bool) {
+	if t.timedOut {
+		event.Status = TIMEOUT_STATUS
+	} else if t.Pgsql["iserror"].(bool) {
 		event.Status = ERROR_STATUS
 	} else {
 		event.Status = OK_STATUS
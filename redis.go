@@ -19,9 +19,23 @@ type RedisMessage struct {
 	Direction    uint8
 
 	IsRequest bool
+	IsError   bool
+	Type      string
 	Message   string
 }
 
+// Types of the Redis replies
+const (
+	RedisStatusReply    = "status"
+	RedisErrorReply     = "error"
+	RedisIntegerReply   = "integer"
+	RedisBulkReply      = "bulk"
+	RedisMultiBulkReply = "multi-bulk"
+)
+
+// Maximum number of command arguments sent in the event
+const RedisMaxArgs = 10
+
 type RedisStream struct {
 	tcpStream *TcpStream
 
@@ -49,7 +63,9 @@ type RedisTransaction struct {
 	Request_raw  string
 	Response_raw string
 
-	timer *time.Timer
+	timer     *time.Timer
+	timedOut  bool
+	lostInGap bool
 }
 
 // Keep sorted for future command addition
@@ -214,14 +230,60 @@ var RedisCommands = map[string]struct{}{
 	"ZUNIONSTORE":      struct{}{},
 }
 
-var redisTransactionsMap = make(map[HashableTcpTuple]*RedisTransaction, TransactionsHashSize)
+// Commands for which the first argument is not a key
+var redisKeylessCommands = map[string]struct{}{
+	"AUTH":         struct{}{},
+	"BGREWRITEAOF": struct{}{},
+	"BGSAVE":       struct{}{},
+	"DBSIZE":       struct{}{},
+	"DISCARD":      struct{}{},
+	"ECHO":         struct{}{},
+	"EVAL":         struct{}{},
+	"EVALSHA":      struct{}{},
+	"EXEC":         struct{}{},
+	"FLUSHALL":     struct{}{},
+	"FLUSHDB":      struct{}{},
+	"INFO":         struct{}{},
+	"LASTSAVE":     struct{}{},
+	"MONITOR":      struct{}{},
+	"MULTI":        struct{}{},
+	"PING":         struct{}{},
+	"PSUBSCRIBE":   struct{}{},
+	"PUBLISH":      struct{}{},
+	"PUNSUBSCRIBE": struct{}{},
+	"QUIT":         struct{}{},
+	"RANDOMKEY":    struct{}{},
+	"SAVE":         struct{}{},
+	"SCAN":         struct{}{},
+	"SELECT":       struct{}{},
+	"SHUTDOWN":     struct{}{},
+	"SLAVEOF":      struct{}{},
+	"SLOWLOG":      struct{}{},
+	"SUBSCRIBE":    struct{}{},
+	"SYNC":         struct{}{},
+	"TIME":         struct{}{},
+	"UNSUBSCRIBE":  struct{}{},
+	"UNWATCH":      struct{}{},
+}
+
+// pending transactions per connection, in the order of the commands.
+// The replies to pipelined commands come in the same order.
+var redisTransactionsMap = make(map[HashableTcpTuple][]*RedisTransaction, TransactionsHashSize)
+
+type Redis struct {
+}
+
+var RedisMod Redis
+
+func init() {
+	RegisterProtocolPlugin("redis", &RedisMod)
+}
 
 func (stream *RedisStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.parseOffset:]
 	stream.parseOffset = 0
-	stream.message.NumberOfBulks = 0
-	stream.message.Bulks = []string{}
-	stream.message.IsRequest = false
+	// the next message gets the timestamp of the segment it starts in
+	stream.message = nil
 }
 
 func redisMessageParser(s *RedisStream) (bool, bool) {
@@ -232,6 +294,23 @@ func redisMessageParser(s *RedisStream) (bool, bool) {
 
 	for s.parseOffset < len(s.data) {
 
+		if m.Type == "" {
+			// the first byte of the message gives the type
+			switch s.data[s.parseOffset] {
+			case '*':
+				m.Type = RedisMultiBulkReply
+			case '$':
+				m.Type = RedisBulkReply
+			case ':':
+				m.Type = RedisIntegerReply
+			case '+':
+				m.Type = RedisStatusReply
+			case '-':
+				m.Type = RedisErrorReply
+				m.IsError = true
+			}
+		}
+
 		if s.data[s.parseOffset] == '*' {
 			//Multi Bulk Message
 
@@ -341,11 +420,12 @@ func redisMessageParser(s *RedisStream) (bool, bool) {
 			m.NumberOfBulks = m.NumberOfBulks - 1
 			m.Bulks = append(m.Bulks, value)
 
-			if len(m.Bulks) == 1 {
-				// check if it's a command
-				if isRedisCommand(value) {
-					m.IsRequest = true
-				}
+			// check if it's a command, some of them have a sub-command
+			if len(m.Bulks) == 1 && isRedisCommand(strings.ToUpper(value)) {
+				m.IsRequest = true
+			}
+			if len(m.Bulks) == 2 && isRedisCommand(strings.ToUpper(m.Bulks[0]+" "+value)) {
+				m.IsRequest = true
 			}
 
 			if m.NumberOfBulks == 0 {
@@ -371,37 +451,119 @@ func readLine(data []byte, offset int) (bool, string, int) {
 	return true, string(data[offset : offset+q]), offset + q + 2
 }
 
+func (redis *Redis) Init(test_mode bool) error {
+	return nil
+}
+
+func (redis *Redis) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	ParseRedis(pkt, tcp, dir)
+}
+
+func (redis *Redis) ReceivedFin(tcp *TcpStream, dir uint8) {
+	// nothing to do, the replies are length delimited
+}
+
+func (redis *Redis) GapInStream(tcp *TcpStream, dir uint8) {
+	// the parser starts over after the gap, but the replies are matched
+	// to the commands by their order, which is lost if one of them was
+	// in the gap
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	pending := redisTransactionsMap[tuple.raw]
+	delete(redisTransactionsMap, tuple.raw)
+	for _, trans := range pending {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		if len(trans.Redis) != 0 {
+			trans.lostInGap = true
+			err := Publisher.PublishRedisTransaction(trans)
+			if err != nil {
+				WARN("Publish failure: %s", err)
+			}
+			DEBUG("redis", "Redis reply lost in a gap: %s", trans.Redis)
+		}
+	}
+}
+
+func (redis *Redis) ConnectionExpired(tcp *TcpStream) {
+	// nothing to do, the pending transactions expire on their own
+}
+
+// Recognizes a request sent in the unified protocol, that is a
+// multibulk starting with a known command. The simple replies are
+// too short to be anything more than a hint.
+func (redis *Redis) Detect(data []byte) int {
+
+	if len(data) == 0 {
+		return 0
+	}
+
+	switch data[0] {
+	case '*':
+		lines := strings.SplitN(string(data), "\r\n", 4)
+		if len(lines) < 2 {
+			return 0
+		}
+		count, err := strconv.Atoi(lines[0][1:])
+		if err != nil || count <= 0 {
+			return 0
+		}
+		if len(lines) < 4 {
+			// incomplete, but looks good so far
+			return 50
+		}
+		if len(lines[1]) < 2 || lines[1][0] != '$' {
+			return 0
+		}
+		length, err := strconv.Atoi(lines[1][1:])
+		if err != nil || length != len(lines[2]) {
+			return 0
+		}
+		if isRedisCommand(strings.ToUpper(lines[2])) {
+			return DetectionScoreCertain
+		}
+		return 0
+	case '+', '-', ':':
+		if bytes.HasSuffix(data, []byte("\r\n")) {
+			return 30
+		}
+	}
+	return 0
+}
+
 func ParseRedis(pkt *Packet, tcp *TcpStream, dir uint8) {
 	defer RECOVER("ParseRedis exception")
 
-	if tcp.redisData[dir] == nil {
-		tcp.redisData[dir] = &RedisStream{
+	stream, _ := tcp.data[dir].(*RedisStream)
+
+	if stream == nil {
+		stream = &RedisStream{
 			tcpStream: tcp,
 			data:      pkt.payload,
 			message:   &RedisMessage{Ts: pkt.ts},
 		}
+		tcp.data[dir] = stream
 	} else {
 		// concatenate bytes
-		tcp.redisData[dir].data = append(tcp.redisData[dir].data, pkt.payload...)
-		if len(tcp.redisData[dir].data) > TCP_MAX_DATA_IN_STREAM {
+		stream.data = append(stream.data, pkt.payload...)
+		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
 			DEBUG("redis", "Stream data too large, dropping TCP stream")
-			tcp.redisData[dir] = nil
+			tcp.data[dir] = nil
 			return
 		}
 	}
 
-	stream := tcp.redisData[dir]
 	for len(stream.data) > 0 {
 		if stream.message == nil {
 			stream.message = &RedisMessage{Ts: pkt.ts}
 		}
 
-		ok, complete := redisMessageParser(tcp.redisData[dir])
+		ok, complete := redisMessageParser(stream)
 
 		if !ok {
 			// drop this tcp stream. Will retry parsing with the next
 			// segment in it
-			tcp.redisData[dir] = nil
+			tcp.data[dir] = nil
 			DEBUG("redis", "Ignore Redis message. Drop tcp stream. Try parsing with the next segment")
 			return
 		}
@@ -432,6 +594,36 @@ func isRedisCommand(key string) bool {
 	return exists
 }
 
+// Splits the bulks of a request in the command name, the key it
+// applies to and at most RedisMaxArgs other arguments.
+func redisCommandArgs(bulks []string) (method string, key string, args []string) {
+
+	if len(bulks) == 0 {
+		return "", "", nil
+	}
+
+	method = strings.ToUpper(bulks[0])
+	rest := bulks[1:]
+	if len(rest) > 0 && isRedisCommand(method+" "+strings.ToUpper(rest[0])) {
+		method = method + " " + strings.ToUpper(rest[0])
+		rest = rest[1:]
+	}
+
+	if _, keyless := redisKeylessCommands[method]; !keyless &&
+		!strings.Contains(method, " ") && len(rest) > 0 {
+
+		key = rest[0]
+		rest = rest[1:]
+	}
+
+	if len(rest) > RedisMaxArgs {
+		rest = rest[:RedisMaxArgs]
+	}
+	args = rest
+
+	return method, key, args
+}
+
 func handleRedis(m *RedisMessage, tcp *TcpStream,
 	dir uint8) {
 
@@ -450,18 +642,15 @@ func receivedRedisRequest(msg *RedisMessage) {
 	// Add it to the HT
 	tuple := msg.TcpTuple
 
-	trans := redisTransactionsMap[tuple.raw]
-	if trans != nil {
-		if len(trans.Redis) != 0 {
-			WARN("Two requests without a Response. Dropping old request")
-		}
-	} else {
-		trans = &RedisTransaction{Type: "redis", tuple: tuple}
-		redisTransactionsMap[tuple.raw] = trans
-	}
+	trans := &RedisTransaction{Type: "redis", tuple: tuple}
+	redisTransactionsMap[tuple.raw] = append(redisTransactionsMap[tuple.raw], trans)
 
+	method, key, args := redisCommandArgs(msg.Bulks)
 	trans.Redis = bson.M{
 		"request": msg.Message,
+		"method":  method,
+		"key":     key,
+		"args":    args,
 	}
 	trans.Request_raw = msg.Message
 
@@ -483,27 +672,56 @@ func receivedRedisRequest(msg *RedisMessage) {
 		trans.Src, trans.Dst = trans.Dst, trans.Src
 	}
 
-	if trans.timer != nil {
-		trans.timer.Stop()
-	}
 	trans.timer = time.AfterFunc(TransactionTimeout, func() { trans.Expire() })
-
 }
 
 func (trans *RedisTransaction) Expire() {
 
+	if len(trans.Redis) != 0 {
+		// the command never got a response
+		trans.timedOut = true
+		trans.ResponseTime = TimeoutResponseTime
+
+		err := Publisher.PublishRedisTransaction(trans)
+		if err != nil {
+			WARN("Publish failure: %s", err)
+		}
+		DEBUG("redis", "Redis transaction timed out: %s", trans.Redis)
+	}
+
 	// remove from map
-	delete(redisTransactionsMap, trans.tuple.raw)
+	for i, t := range redisTransactionsMap[trans.tuple.raw] {
+		if t == trans {
+			removeRedisTransaction(trans.tuple, i)
+			break
+		}
+	}
+}
+
+func removeRedisTransaction(tuple TcpTuple, index int) *RedisTransaction {
+
+	trans_list := redisTransactionsMap[tuple.raw]
+	trans := trans_list[index]
+	trans_list = append(trans_list[:index], trans_list[index+1:]...)
+	if len(trans_list) == 0 {
+		delete(redisTransactionsMap, tuple.raw)
+	} else {
+		redisTransactionsMap[tuple.raw] = trans_list
+	}
+
+	return trans
 }
 
 func receivedRedisResponse(msg *RedisMessage) {
 
 	tuple := msg.TcpTuple
-	trans := redisTransactionsMap[tuple.raw]
-	if trans == nil {
+	if len(redisTransactionsMap[tuple.raw]) == 0 {
 		WARN("Response from unknown transaction. Ignoring.")
 		return
 	}
+
+	// the replies come in the order of the commands
+	trans := removeRedisTransaction(tuple, 0)
 	// check if the request was received
 	if len(trans.Redis) == 0 {
 		WARN("Response from unknown transaction. Ignoring.")
@@ -512,6 +730,11 @@ func receivedRedisResponse(msg *RedisMessage) {
 	}
 
 	trans.Redis["response"] = msg.Message
+	trans.Redis["response_type"] = msg.Type
+	trans.Redis["iserror"] = msg.IsError
+	if msg.IsError {
+		trans.Redis["error_message"] = msg.Message
+	}
 
 	trans.Response_raw = msg.Message
 
@@ -524,10 +747,7 @@ func receivedRedisResponse(msg *RedisMessage) {
 
 	DEBUG("redis", "Redis transaction completed: %s", trans.Redis)
 
-	// remove from map
-	delete(redisTransactionsMap, trans.tuple.raw)
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
-
 }
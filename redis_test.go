@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/hex"
 	"testing"
+	"time"
 	//"fmt"
 	//"log/syslog"
 )
@@ -90,3 +91,172 @@ func TestRedisParser_NilResult(t *testing.T) {
 		t.Errorf("Failed to parse Redis response: %s", stream.message.Message)
 	}
 }
+
+func TestParseRedis_pipelinedCommands(t *testing.T) {
+
+	tcp := TcpStream{tuple: testIpPortTuple()}
+	tcp.tuple.Dst_port = 6379
+	tcp.tuple.ComputeHashebles()
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(redisTransactionsMap, tuple.raw)
+
+	ts := time.Now()
+	requests := &Packet{
+		ts: ts,
+		payload: []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n" +
+			"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"),
+	}
+	ParseRedis(requests, &tcp, 0)
+
+	pending := redisTransactionsMap[tuple.raw]
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 pending transactions, got %d", len(pending))
+	}
+	if pending[0].Request_raw != "GET a" || pending[1].Request_raw != "GET b" {
+		t.Errorf("Wrong requests: %s, %s", pending[0].Request_raw, pending[1].Request_raw)
+	}
+
+	reply := &Packet{ts: ts.Add(5 * time.Millisecond), payload: []byte("$1\r\n1\r\n")}
+	ParseRedis(reply, &tcp, 1)
+
+	pending = redisTransactionsMap[tuple.raw]
+	if len(pending) != 1 || pending[0].Request_raw != "GET b" {
+		t.Fatalf("Reply not matched to the first command")
+	}
+
+	reply = &Packet{ts: ts.Add(10 * time.Millisecond), payload: []byte("$1\r\n2\r\n")}
+	ParseRedis(reply, &tcp, 1)
+
+	if _, exists := redisTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Transactions still pending")
+	}
+}
+
+func TestParseRedis_gapWithPipelinedCommands(t *testing.T) {
+
+	output, restore := recordGlobalPublisher()
+	defer restore()
+
+	tcp := TcpStream{tuple: testIpPortTuple(), protocol: &RedisMod}
+	tcp.tuple.Dst_port = 6379
+	tcp.tuple.ComputeHashebles()
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(redisTransactionsMap, tuple.raw)
+
+	ParseRedis(&Packet{ts: time.Now(), payload: []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n" +
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n")}, &tcp, 0)
+
+	// the reply to GET a is lost, the one received after the gap can't
+	// be matched
+	tcp.GapInStream(1)
+	ParseRedis(&Packet{ts: time.Now(), payload: []byte("$1\r\n2\r\n")}, &tcp, 1)
+
+	if len(output.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(output.events))
+	}
+	for i, request := range []string{"GET a", "GET b"} {
+		event := output.events[i]
+		if event.Status != GAP_STATUS || event.ResponseTime != 0 || event.Redis["request"] != request {
+			t.Errorf("Wrong event: %v %d %v", event.Status, event.ResponseTime, event.Redis)
+		}
+	}
+	if _, exists := redisTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Transactions still pending")
+	}
+}
+
+func TestRedisParser_ErrorResult(t *testing.T) {
+
+	stream := &RedisStream{tcpStream: nil,
+		data:    []byte("-ERR unknown command 'foo'\r\n"),
+		message: new(RedisMessage)}
+
+	ok, complete := redisMessageParser(stream)
+
+	if !ok || !complete {
+		t.Errorf("Parsing failed")
+	}
+	if !stream.message.IsError || stream.message.Type != RedisErrorReply {
+		t.Errorf("Error reply not recognized")
+	}
+	if stream.message.Message != "ERR unknown command 'foo'" {
+		t.Errorf("Failed to parse Redis error: %s", stream.message.Message)
+	}
+}
+
+func TestRedisParser_subCommandRequest(t *testing.T) {
+
+	stream := &RedisStream{tcpStream: nil,
+		data:    []byte("*3\r\n$6\r\nconfig\r\n$3\r\nget\r\n$7\r\ntimeout\r\n"),
+		message: new(RedisMessage)}
+
+	ok, complete := redisMessageParser(stream)
+
+	if !ok || !complete {
+		t.Errorf("Parsing failed")
+	}
+	if !stream.message.IsRequest || stream.message.Type != RedisMultiBulkReply {
+		t.Errorf("Request not recognized")
+	}
+}
+
+func TestRedis_commandArgs(t *testing.T) {
+
+	method, key, args := redisCommandArgs([]string{"hmset", "user:1", "name", "joe"})
+	if method != "HMSET" || key != "user:1" || len(args) != 2 {
+		t.Errorf("Wrong split: %s %s %v", method, key, args)
+	}
+
+	method, key, args = redisCommandArgs([]string{"CONFIG", "GET", "timeout"})
+	if method != "CONFIG GET" || key != "" || len(args) != 1 || args[0] != "timeout" {
+		t.Errorf("Wrong split: %s %s %v", method, key, args)
+	}
+
+	method, key, _ = redisCommandArgs([]string{"PING"})
+	if method != "PING" || key != "" {
+		t.Errorf("Wrong split: %s %s", method, key)
+	}
+
+	bulks := []string{"RPUSH", "list"}
+	for i := 0; i < 2*RedisMaxArgs; i++ {
+		bulks = append(bulks, "x")
+	}
+	_, _, args = redisCommandArgs(bulks)
+	if len(args) != RedisMaxArgs {
+		t.Errorf("Arguments not bounded: %d", len(args))
+	}
+}
+
+func TestRedis_expireTransaction(t *testing.T) {
+
+	output, restore := recordGlobalPublisher()
+	defer restore()
+
+	tcp := TcpStream{tuple: testIpPortTuple()}
+	tcp.tuple.Dst_port = 6379
+	tcp.tuple.ComputeHashebles()
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	defer delete(redisTransactionsMap, tuple.raw)
+
+	ParseRedis(&Packet{ts: time.Now(), payload: []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n")}, &tcp, 0)
+
+	if len(redisTransactionsMap[tuple.raw]) != 1 {
+		t.Fatalf("No pending transaction")
+	}
+	trans := redisTransactionsMap[tuple.raw][0]
+	trans.timer.Stop()
+	trans.Expire()
+
+	if len(output.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(output.events))
+	}
+	event := output.events[0]
+	if event.Status != TIMEOUT_STATUS || event.ResponseTime != TimeoutResponseTime ||
+		event.Redis["request"] != "GET a" {
+
+		t.Errorf("Wrong event: %v %d %v", event.Status, event.ResponseTime, event.Redis)
+	}
+	if _, exists := redisTransactionsMap[tuple.raw]; exists {
+		t.Errorf("Expired transaction still in the map")
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Kinds of the tokens of a SQL query
+const (
+	sqlTokenWord = iota
+	sqlTokenIdent
+	sqlTokenLiteral
+	sqlTokenParam
+	sqlTokenOp
+)
+
+type sqlToken struct {
+	kind int
+	text string
+}
+
+// Words that can't be table names or aliases. They also keep a space
+// before the parenthesis that follows them, other words are functions.
+var sqlKeywords = map[string]bool{
+	"all": true, "and": true, "as": true, "by": true, "case": true,
+	"cross": true, "delete": true, "distinct": true, "else": true,
+	"end": true, "exists": true, "for": true, "from": true,
+	"full": true, "group": true, "having": true, "if": true, "in": true,
+	"inner": true, "insert": true, "into": true, "is": true,
+	"join": true, "left": true, "like": true, "limit": true,
+	"natural": true, "not": true, "null": true, "offset": true,
+	"on": true, "or": true, "order": true, "outer": true,
+	"replace": true, "returning": true, "right": true, "select": true,
+	"set": true, "straight_join": true, "table": true, "then": true,
+	"union": true, "update": true, "using": true, "value": true,
+	"values": true, "when": true, "where": true, "with": true,
+}
+
+// Modifiers that can come between a keyword and the table name.
+var sqlTableModifiers = map[string]bool{
+	"delayed": true, "exists": true, "high_priority": true, "if": true,
+	"ignore": true, "low_priority": true, "not": true, "only": true,
+	"quick": true, "temporary": true,
+}
+
+// Keywords followed by a table name.
+var sqlTableKeywords = map[string]bool{
+	"from": true, "join": true, "update": true, "into": true,
+	"table": true, "straight_join": true,
+}
+
+// Splits a query in tokens, leaving out the comments and the
+// whitespace. With ansi_quotes, the double quotes delimit identifiers
+// as in PostgreSQL, otherwise they delimit strings as in MySQL.
+func tokenizeSql(query string, ansi_quotes bool) []sqlToken {
+
+	tokens := []sqlToken{}
+	i := 0
+	n := len(query)
+
+	isWordChar := func(c byte) bool {
+		return c == '_' || c == '$' || c == '@' || c >= 0x80 ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+	}
+	isDigit := func(c byte) bool {
+		return c >= '0' && c <= '9'
+	}
+
+	// returns the end of the string or identifier starting at start
+	quoted := func(start int) int {
+		quote := query[start]
+		j := start + 1
+		for j < n {
+			if query[j] == '\\' && quote == '\'' && !ansi_quotes {
+				j += 2
+				continue
+			}
+			if query[j] == quote {
+				if j+1 < n && query[j+1] == quote {
+					// doubled quote
+					j += 2
+					continue
+				}
+				return j + 1
+			}
+			j++
+		}
+		return n
+	}
+
+	for i < n {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '-' && i+1 < n && query[i+1] == '-', c == '#' && !ansi_quotes:
+			// comment until the end of the line
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = n
+			} else {
+				i += end + 1
+			}
+
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = n
+			} else {
+				i += 2 + end + 2
+			}
+
+		case c == '\'' || (c == '"' && !ansi_quotes):
+			end := quoted(i)
+			tokens = append(tokens, sqlToken{sqlTokenLiteral, query[i:end]})
+			i = end
+
+		case c == '`' || (c == '"' && ansi_quotes):
+			end := quoted(i)
+			name := query[i+1 : end]
+			if len(name) > 0 && name[len(name)-1] == c {
+				name = name[:len(name)-1]
+			}
+			tokens = append(tokens, sqlToken{sqlTokenIdent, name})
+			i = end
+
+		case c == '?':
+			tokens = append(tokens, sqlToken{sqlTokenParam, "?"})
+			i++
+
+		case c == '$' && i+1 < n && isDigit(query[i+1]):
+			// positional parameter of PostgreSQL
+			j := i + 1
+			for j < n && isDigit(query[j]) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenParam, query[i:j]})
+			i = j
+
+		case c == '$' && ansi_quotes:
+			// dollar quoted string of PostgreSQL, $tag$...$tag$
+			j := i + 1
+			for j < n && isWordChar(query[j]) && query[j] != '$' {
+				j++
+			}
+			if j >= n || query[j] != '$' {
+				tokens = append(tokens, sqlToken{sqlTokenOp, "$"})
+				i++
+				break
+			}
+			tag := query[i : j+1]
+			end := strings.Index(query[j+1:], tag)
+			if end < 0 {
+				i = n
+			} else {
+				i = j + 1 + end + len(tag)
+			}
+			tokens = append(tokens, sqlToken{sqlTokenLiteral, tag})
+
+		case isDigit(c) || (c == '.' && i+1 < n && isDigit(query[i+1])):
+			j := i
+			if c == '0' && i+1 < n && (query[i+1] == 'x' || query[i+1] == 'X') {
+				j += 2
+			}
+			for j < n && (isWordChar(query[j]) || query[j] == '.') {
+				if (query[j] == 'e' || query[j] == 'E') && j+1 < n &&
+					(query[j+1] == '-' || query[j+1] == '+') {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenLiteral, query[i:j]})
+			i = j
+
+		case isWordChar(c):
+			j := i
+			for j < n && isWordChar(query[j]) {
+				j++
+			}
+			word := query[i:j]
+			if j < n && query[j] == '\'' && isSqlStringPrefix(word) {
+				// x'..', b'..', N'..', E'..' or a charset introducer
+				end := quoted(j)
+				tokens = append(tokens, sqlToken{sqlTokenLiteral, query[i:end]})
+				i = end
+				break
+			}
+			tokens = append(tokens, sqlToken{sqlTokenWord, word})
+			i = j
+
+		default:
+			op := string(c)
+			if i+1 < n {
+				switch query[i : i+2] {
+				case "<=", ">=", "<>", "!=", "||", "&&", "::", ":=", "<<", ">>":
+					op = query[i : i+2]
+				}
+			}
+			tokens = append(tokens, sqlToken{sqlTokenOp, op})
+			i += len(op)
+		}
+	}
+
+	return mergeSqlSigns(tokens)
+}
+
+func isSqlStringPrefix(word string) bool {
+	switch strings.ToLower(word) {
+	case "x", "b", "n", "e":
+		return true
+	}
+	return strings.HasPrefix(word, "_")
+}
+
+// Merges the signs of the negative and positive numbers into the
+// numbers, unless the sign is a binary operator.
+func mergeSqlSigns(tokens []sqlToken) []sqlToken {
+
+	merged := []sqlToken{}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.kind == sqlTokenOp && (token.text == "-" || token.text == "+") &&
+			i+1 < len(tokens) && tokens[i+1].kind == sqlTokenLiteral {
+
+			unary := true
+			if len(merged) > 0 {
+				prev := merged[len(merged)-1]
+				switch prev.kind {
+				case sqlTokenLiteral, sqlTokenParam, sqlTokenIdent:
+					unary = false
+				case sqlTokenWord:
+					unary = sqlKeywords[strings.ToLower(prev.text)]
+				case sqlTokenOp:
+					unary = prev.text != ")"
+				}
+			}
+			if unary {
+				merged = append(merged, sqlToken{sqlTokenLiteral, token.text + tokens[i+1].text})
+				i++
+				continue
+			}
+		}
+		merged = append(merged, token)
+	}
+	return merged
+}
+
+func isSqlValue(token sqlToken) bool {
+	return token.kind == sqlTokenLiteral || token.kind == sqlTokenParam
+}
+
+// Returns the index after the parenthesis closing the one at start.
+func skipSqlParens(tokens []sqlToken, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		if tokens[i].kind != sqlTokenOp {
+			continue
+		}
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// Returns the query with its literals and parameters replaced by '?',
+// the lists of values in IN collapsed to (?+), the rows after the
+// first one of VALUES removed, the comments removed and the words in
+// lower case, separated by single spaces.
+func sqlFingerprint(tokens []sqlToken) string {
+
+	// the rows of VALUES are removed from a copy
+	tokens = append([]sqlToken{}, tokens...)
+
+	parts := []string{}
+	noSpace := true
+
+	add := func(text string, spaceBefore bool) {
+		if spaceBefore && !noSpace {
+			parts = append(parts, " ")
+		}
+		parts = append(parts, text)
+		noSpace = false
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+
+		switch token.kind {
+		case sqlTokenLiteral, sqlTokenParam:
+			add("?", true)
+
+		case sqlTokenWord, sqlTokenIdent:
+			word := strings.ToLower(token.text)
+			add(word, true)
+
+			if token.kind != sqlTokenWord || i+1 >= len(tokens) || tokens[i+1].text != "(" {
+				break
+			}
+			if word == "in" {
+				// list of values
+				end := skipSqlParens(tokens, i+1)
+				values := true
+				for j := i + 2; j < end-1; j++ {
+					if !isSqlValue(tokens[j]) && tokens[j].text != "," {
+						values = false
+						break
+					}
+				}
+				if values && end-1 > i+2 {
+					add("(?+)", true)
+					i = end - 1
+				}
+			} else if word == "values" || word == "value" {
+				// keep the first row only
+				end := skipSqlParens(tokens, i+1)
+				for end+1 < len(tokens) && tokens[end].text == "," && tokens[end+1].text == "(" {
+					next := skipSqlParens(tokens, end+1)
+					tokens = append(tokens[:end], tokens[next:]...)
+				}
+			}
+
+		case sqlTokenOp:
+			switch token.text {
+			case ";":
+				// statements are separated by ';', trailing ones are
+				// left out
+				if i+1 < len(tokens) {
+					add(";", false)
+				}
+			case ",", ")":
+				add(token.text, false)
+			case ".", "::":
+				add(token.text, false)
+				noSpace = true
+			case "(":
+				spaced := true
+				if i > 0 && tokens[i-1].kind == sqlTokenWord &&
+					!sqlKeywords[strings.ToLower(tokens[i-1].text)] {
+					// function call
+					spaced = false
+				}
+				add("(", spaced)
+				noSpace = true
+			default:
+				add(token.text, true)
+			}
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+// Returns a short and stable hash of a fingerprint, to group the
+// queries that have the same fingerprint.
+func sqlFingerprintHash(fingerprint string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(fingerprint))
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// Returns the names of the tables used by the query, in the order they
+// appear.
+func sqlTables(tokens []sqlToken) []string {
+
+	tables := []string{}
+	seen := map[string]bool{}
+
+	isName := func(i int) bool {
+		if i >= len(tokens) {
+			return false
+		}
+		if tokens[i].kind == sqlTokenIdent {
+			return true
+		}
+		return tokens[i].kind == sqlTokenWord &&
+			!sqlKeywords[strings.ToLower(tokens[i].text)] &&
+			!strings.HasPrefix(tokens[i].text, "@")
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind != sqlTokenWord {
+			continue
+		}
+		keyword := strings.ToLower(tokens[i].text)
+		if !sqlTableKeywords[keyword] {
+			continue
+		}
+
+		j := i + 1
+		for {
+			for j < len(tokens) && tokens[j].kind == sqlTokenWord &&
+				sqlTableModifiers[strings.ToLower(tokens[j].text)] {
+				j++
+			}
+			if !isName(j) {
+				break
+			}
+
+			// dotted names, like database.table
+			name := tokens[j].text
+			j++
+			for j+1 < len(tokens) && tokens[j].text == "." && isName(j+1) {
+				name += "." + tokens[j+1].text
+				j += 2
+			}
+			if !seen[name] {
+				seen[name] = true
+				tables = append(tables, name)
+			}
+
+			// alias
+			if j < len(tokens) && strings.ToLower(tokens[j].text) == "as" {
+				j += 2
+			} else if isName(j) {
+				j++
+			}
+
+			// more tables in the list
+			if keyword != "from" || j >= len(tokens) || tokens[j].text != "," {
+				break
+			}
+			j++
+		}
+	}
+
+	return tables
+}
+
+// Returns the fingerprint of the query, its hash and the tables used.
+func analyzeSql(query string, ansi_quotes bool) (string, string, []string) {
+
+	tokens := tokenizeSql(query, ansi_quotes)
+	tables := sqlTables(tokens)
+	fingerprint := sqlFingerprint(tokens)
+
+	return fingerprint, sqlFingerprintHash(fingerprint), tables
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSql_fingerprint(t *testing.T) {
+
+	tests := []struct {
+		query       string
+		ansi_quotes bool
+		expected    string
+	}{
+		{"SELECT * FROM users WHERE id=1", false,
+			"select * from users where id = ?"},
+		{"select *\n  from users  where id = 2 -- by id", false,
+			"select * from users where id = ?"},
+		{"SELECT name FROM `users` WHERE name = 'O\\'Brien' AND x = \"y\"", false,
+			"select name from users where name = ? and x = ?"},
+		{"SELECT count(*) FROM t WHERE id IN (1, 2, 3) AND v > -1.5e-3", false,
+			"select count(*) from t where id in (?+) and v > ?"},
+		{"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y'), (3, 'z');", false,
+			"insert into t(a, b) values (?, ?)"},
+		{"SELECT a - 1 FROM t /* comment */ WHERE b = x'ff'", false,
+			"select a - ? from t where b = ?"},
+		{"SELECT \"Name\" FROM public.users WHERE id = $1 AND t = $$it's$$::text", true,
+			"select name from public.users where id = ? and t = ?::text"},
+	}
+
+	for _, test := range tests {
+		fingerprint := sqlFingerprint(tokenizeSql(test.query, test.ansi_quotes))
+		if fingerprint != test.expected {
+			t.Errorf("Wrong fingerprint of %s: %s", test.query, fingerprint)
+		}
+	}
+}
+
+func TestSql_fingerprintHash(t *testing.T) {
+
+	_, hash1, _ := analyzeSql("SELECT * FROM users WHERE id=1", false)
+	_, hash2, _ := analyzeSql("select * from users where id = 42", false)
+	_, hash3, _ := analyzeSql("select * from posts where id = 42", false)
+
+	if hash1 != hash2 {
+		t.Errorf("Same queries with different hashes: %s %s", hash1, hash2)
+	}
+	if hash1 == hash3 {
+		t.Errorf("Different queries with the same hash: %s", hash1)
+	}
+	if len(hash1) != 16 {
+		t.Errorf("Wrong hash: %s", hash1)
+	}
+}
+
+func TestSql_tables(t *testing.T) {
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT * FROM users", "users"},
+		{"SELECT * FROM users u, db.posts AS p WHERE u.id = p.user_id", "users, db.posts"},
+		{"SELECT * FROM a JOIN b ON a.id = b.id LEFT JOIN `c` USING (id)", "a, b, c"},
+		{"INSERT IGNORE INTO log (msg) VALUES ('x')", "log"},
+		{"UPDATE LOW_PRIORITY users SET name = 'x'", "users"},
+		{"DELETE FROM sessions WHERE expires < NOW()", "sessions"},
+		{"CREATE TABLE IF NOT EXISTS foo (id int)", "foo"},
+		{"SELECT * FROM (SELECT id FROM inner_t) AS sub", "inner_t"},
+		{"SELECT 1", ""},
+	}
+
+	for _, test := range tests {
+		tables := strings.Join(sqlTables(tokenizeSql(test.query, false)), ", ")
+		if tables != test.expected {
+			t.Errorf("Wrong tables of %s: %s", test.query, tables)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,6 +14,13 @@ const TCP_STREAM_EXPIRY = 10 * 1e9
 const TCP_STREAM_HASH_SIZE = 2 ^ 16
 const TCP_MAX_DATA_IN_STREAM = 10 * 1e6
 
+// Out of order segments are kept until the missing data arrives, but
+// not longer than TCP_GAP_TIMEOUT and not more than
+// TCP_MAX_PENDING_DATA bytes per direction. The timeout is measured on
+// the packet timestamps and checked when the stream receives a segment.
+const TCP_GAP_TIMEOUT = 2 * 1e9
+const TCP_MAX_PENDING_DATA = 1 * 1e6
+
 type CmdlineTuple struct {
 	Src, Dst []byte
 }
@@ -32,15 +40,27 @@ type TcpStream struct {
 	id       uint32
 	tuple    *IpPortTuple
 	timer    *time.Timer
-	protocol protocolType
+	protocol ProtocolPlugin
 
 	lastSeq [2]uint32
 
-	httpData   [2]*HttpStream
-	mysqlData  [2]*MysqlStream
-	redisData  [2]*RedisStream
-	pgsqlData  [2]*PgsqlStream
-	thriftData [2]*ThriftStream
+	// per direction out of order segments, sorted by sequence number
+	pending      [2][]tcpSegment
+	pendingBytes [2]int
+	gapDeadline  [2]time.Time
+
+	// timestamp of the last packet received, in either direction
+	lastTs time.Time
+
+	// per direction state of the protocol analyzer
+	data [2]ProtocolData
+}
+
+// A segment received ahead of the expected sequence number.
+type tcpSegment struct {
+	seq uint32
+	fin bool
+	pkt *Packet
 }
 
 type Endpoint struct {
@@ -60,15 +80,17 @@ func GetId() uint32 {
 
 // Config
 type tomlProtocol struct {
-	Ports         []int
-	Send_request  bool
-	Send_response bool
+	Ports               []int
+	Udp_ports           []int
+	Send_request        bool
+	Send_response       bool
+	Transaction_timeout int
 }
 
 var tcpStreamsMap = make(map[HashableIpPortTuple]*TcpStream, TCP_STREAM_HASH_SIZE)
-var tcpPortMap map[uint16]protocolType
+var tcpPortMap map[uint16]ProtocolPlugin
 
-func decideProtocol(tuple *IpPortTuple) protocolType {
+func decideProtocol(tuple *IpPortTuple) ProtocolPlugin {
 	protocol, exists := tcpPortMap[tuple.Src_port]
 	if exists {
 		return protocol
@@ -79,59 +101,186 @@ func decideProtocol(tuple *IpPortTuple) protocolType {
 		return protocol
 	}
 
-	return UnknownProtocol
+	return nil
 }
 
-func (stream *TcpStream) AddPacket(pkt *Packet, tcphdr *layers.TCP, original_dir uint8) {
-
-	// create/reset timer
+func (stream *TcpStream) resetTimer() {
 	if stream.timer != nil {
 		stream.timer.Stop()
 	}
 	stream.timer = time.AfterFunc(TCP_STREAM_EXPIRY, func() { stream.Expire() })
+}
 
-	switch stream.protocol {
-	case HttpProtocol:
-		if len(pkt.payload) > 0 {
-			HttpMod.Parse(pkt, stream, original_dir)
-		}
+func (stream *TcpStream) AddPacket(pkt *Packet, tcphdr *layers.TCP, original_dir uint8) {
 
-		if tcphdr.FIN {
-			HttpMod.ReceivedFin(stream, original_dir)
-		}
+	// create/reset timer
+	stream.resetTimer()
 
-	case MysqlProtocol:
-		if len(pkt.payload) > 0 {
-			ParseMysql(pkt, stream, original_dir)
-		}
+	if len(pkt.payload) > 0 {
+		stream.protocol.Parse(pkt, stream, original_dir)
+	}
 
-	case RedisProtocol:
+	if tcphdr.FIN {
+		stream.protocol.ReceivedFin(stream, original_dir)
+	}
+}
+
+func (stream *TcpStream) GapInStream(original_dir uint8) {
+	stream.protocol.GapInStream(stream, original_dir)
+
+	// what follows the gap can't be appended to what was received
+	// before it, so the protocol parser starts over
+	stream.data[original_dir] = nil
+}
+
+// Passes the segment to the protocol parser and advances the expected
+// sequence number.
+func (stream *TcpStream) deliver(seq uint32, fin bool, pkt *Packet, original_dir uint8) {
+	stream.lastSeq[original_dir] = seq + uint32(len(pkt.payload))
+	stream.AddPacket(pkt, &layers.TCP{Seq: seq, FIN: fin}, original_dir)
+}
+
+// Orders the segment relative to what was already delivered in this
+// direction. Retransmitted data is dropped, segments received ahead of
+// time are kept until the hole before them is filled.
+func (stream *TcpStream) addSegment(seq uint32, fin bool, pkt *Packet, original_dir uint8) {
+
+	stream.lastTs = pkt.ts
+	stream.checkGapDeadlines(pkt.ts)
+
+	next := stream.lastSeq[original_dir]
+	if next == 0 {
+		// first segment in this direction
+		stream.deliver(seq, fin, pkt, original_dir)
+		return
+	}
+
+	end := seq + uint32(len(pkt.payload))
+	if len(pkt.payload) > 0 && TcpSeqBeforeEq(end, next) {
+		DEBUG("tcp", "Ignoring retransmitted segment. pkt.seq=%v len=%v stream.seq=%v",
+			seq, len(pkt.payload), next)
+		return
+	}
+
+	if TcpSeqBefore(seq, next) {
+		// partially retransmitted, keep only the new data
 		if len(pkt.payload) > 0 {
-			ParseRedis(pkt, stream, original_dir)
+			pkt.payload = pkt.payload[next-seq:]
 		}
+		seq = next
+	}
 
-	case PgsqlProtocol:
-		if len(pkt.payload) > 0 {
-			ParsePgsql(pkt, stream, original_dir)
+	if seq != next {
+		DEBUG("tcp", "Out of order segment. last_seq: %d, seq: %d", next, seq)
+		stream.queueSegment(seq, fin, pkt, original_dir)
+		return
+	}
+
+	stream.deliver(seq, fin, pkt, original_dir)
+	stream.deliverPending(original_dir, pkt.ts)
+}
+
+// Gives up on the holes that waited longer than TCP_GAP_TIMEOUT, in
+// both directions.
+func (stream *TcpStream) checkGapDeadlines(ts time.Time) {
+	for dir := uint8(0); dir < 2; dir++ {
+		if len(stream.pending[dir]) > 0 && ts.After(stream.gapDeadline[dir]) {
+			DEBUG("tcp", "Timeout waiting for the missing segments")
+			stream.skipGap(dir, ts)
 		}
+	}
+}
 
-	case ThriftProtocol:
-		if len(pkt.payload) > 0 {
-			ThriftMod.Parse(pkt, stream, original_dir)
+func (stream *TcpStream) queueSegment(seq uint32, fin bool, pkt *Packet, original_dir uint8) {
+
+	stream.resetTimer()
+
+	// the capture buffer can be reused by the sniffer
+	payload := make([]byte, len(pkt.payload))
+	copy(payload, pkt.payload)
+	segment := tcpSegment{
+		seq: seq,
+		fin: fin,
+		pkt: &Packet{ts: pkt.ts, tuple: pkt.tuple, payload: payload},
+	}
+
+	pending := stream.pending[original_dir]
+	i := 0
+	for i < len(pending) && TcpSeqBefore(pending[i].seq, seq) {
+		i++
+	}
+	if i < len(pending) && pending[i].seq == seq &&
+		len(pending[i].pkt.payload) >= len(payload) {
+		// already have it
+		return
+	}
+	pending = append(pending, tcpSegment{})
+	copy(pending[i+1:], pending[i:])
+	pending[i] = segment
+	stream.pending[original_dir] = pending
+	stream.pendingBytes[original_dir] += len(payload)
+
+	if stream.pendingBytes[original_dir] > TCP_MAX_PENDING_DATA {
+		DEBUG("tcp", "Too much out of order data, giving up on the missing segments")
+		stream.skipGap(original_dir, pkt.ts)
+		return
+	}
+
+	if stream.gapDeadline[original_dir].IsZero() {
+		stream.gapDeadline[original_dir] = pkt.ts.Add(TCP_GAP_TIMEOUT)
+	}
+}
+
+// Delivers the pending segments that became in order. If it stops on
+// another hole, the wait for that one starts at ts.
+func (stream *TcpStream) deliverPending(original_dir uint8, ts time.Time) {
+
+	for len(stream.pending[original_dir]) > 0 {
+		segment := stream.pending[original_dir][0]
+		next := stream.lastSeq[original_dir]
+		if TcpSeqBefore(next, segment.seq) {
+			// still missing data
+			if stream.gapDeadline[original_dir].IsZero() {
+				stream.gapDeadline[original_dir] = ts.Add(TCP_GAP_TIMEOUT)
+			}
+			return
 		}
 
-		if tcphdr.FIN {
-			ThriftMod.ReceivedFin(stream, original_dir)
+		stream.pending[original_dir] = stream.pending[original_dir][1:]
+		stream.pendingBytes[original_dir] -= len(segment.pkt.payload)
+
+		end := segment.seq + uint32(len(segment.pkt.payload))
+		if len(segment.pkt.payload) > 0 && TcpSeqBeforeEq(end, next) {
+			// overlaps what was already delivered
+			continue
+		}
+		if len(segment.pkt.payload) > 0 {
+			segment.pkt.payload = segment.pkt.payload[next-segment.seq:]
 		}
+		stream.deliver(next, segment.fin, segment.pkt, original_dir)
 	}
+
+	stream.pending[original_dir] = nil
+	stream.pendingBytes[original_dir] = 0
+	stream.gapDeadline[original_dir] = time.Time{}
 }
 
-func (stream *TcpStream) GapInStream(original_dir uint8) {
-	switch stream.protocol {
-	case PgsqlProtocol:
-		GapInPgsqlStream(stream, original_dir)
-		break
+// The missing data is considered lost. Tells the protocol about the gap
+// and continues with the segments received after it.
+func (stream *TcpStream) skipGap(original_dir uint8, ts time.Time) {
+
+	if len(stream.pending[original_dir]) == 0 {
+		return
 	}
+
+	DEBUG("tcp", "Gap in tcp stream. last_seq: %d, seq: %d",
+		stream.lastSeq[original_dir], stream.pending[original_dir][0].seq)
+
+	stream.GapInStream(original_dir)
+
+	stream.lastSeq[original_dir] = stream.pending[original_dir][0].seq
+	stream.gapDeadline[original_dir] = time.Time{}
+	stream.deliverPending(original_dir, ts)
 }
 
 func (stream *TcpStream) Expire() {
@@ -141,11 +290,22 @@ func (stream *TcpStream) Expire() {
 	// de-register from dict
 	delete(tcpStreamsMap, stream.tuple.raw)
 
+	// the data received after the holes is still delivered
+	for dir := uint8(0); dir < 2; dir++ {
+		for len(stream.pending[dir]) > 0 {
+			stream.skipGap(dir, stream.lastTs)
+		}
+	}
+
+	// delivering re-armed the timer of a stream that is already gone
+	if stream.timer != nil {
+		stream.timer.Stop()
+	}
+
+	stream.protocol.ConnectionExpired(stream)
+
 	// nullify to help the GC
-	stream.httpData = [2]*HttpStream{nil, nil}
-	stream.mysqlData = [2]*MysqlStream{nil, nil}
-	stream.redisData = [2]*RedisStream{nil, nil}
-	stream.pgsqlData = [2]*PgsqlStream{nil, nil}
+	stream.data = [2]ProtocolData{nil, nil}
 }
 
 func TcpSeqBefore(seq1 uint32, seq2 uint32) bool {
@@ -159,12 +319,14 @@ func TcpSeqBeforeEq(seq1 uint32, seq2 uint32) bool {
 func FollowTcp(tcphdr *layers.TCP, pkt *Packet) {
 	stream, exists := tcpStreamsMap[pkt.tuple.raw]
 	var original_dir uint8 = TcpDirectionOriginal
-	created := false
 	if !exists {
 		stream, exists = tcpStreamsMap[pkt.tuple.revRaw]
 		if !exists {
 			protocol := decideProtocol(&pkt.tuple)
-			if protocol == UnknownProtocol {
+			if protocol == nil {
+				if protocolDetection.Enabled {
+					protocolDetection.AddPacket(tcphdr, pkt)
+				}
 				// don't follow
 				return
 			}
@@ -173,40 +335,15 @@ func FollowTcp(tcphdr *layers.TCP, pkt *Packet) {
 			// create
 			stream = &TcpStream{id: GetId(), tuple: &pkt.tuple, protocol: protocol}
 			tcpStreamsMap[pkt.tuple.raw] = stream
-			created = true
 		} else {
 			original_dir = TcpDirectionReverse
 		}
 	}
-	tcp_start_seq := tcphdr.Seq
-	tcp_seq := tcp_start_seq + uint32(len(pkt.payload))
-
 	DEBUG("tcp", "pkt.start_seq=%v pkt.last_seq=%v stream.last_seq=%v (len=%d)",
-		tcp_start_seq, tcp_seq, stream.lastSeq[original_dir], len(pkt.payload))
-
-	if len(pkt.payload) > 0 &&
-		stream.lastSeq[original_dir] != 0 {
-
-		if TcpSeqBeforeEq(tcp_seq, stream.lastSeq[original_dir]) {
-
-			DEBUG("tcp", "Ignoring what looks like a retrasmitted segment. pkt.seq=%v len=%v stream.seq=%v",
-				tcphdr.Seq, len(pkt.payload), stream.lastSeq[original_dir])
-			return
-		}
+		tcphdr.Seq, tcphdr.Seq+uint32(len(pkt.payload)),
+		stream.lastSeq[original_dir], len(pkt.payload))
 
-		if TcpSeqBefore(stream.lastSeq[original_dir], tcp_start_seq) {
-			DEBUG("tcp", "Gap in tcp stream. last_seq: %d, seq: %d", stream.lastSeq[original_dir], tcp_start_seq)
-			if !created {
-				stream.GapInStream(original_dir)
-				// drop stream
-				stream.Expire()
-				return
-			}
-		}
-	}
-	stream.lastSeq[original_dir] = tcp_seq
-
-	stream.AddPacket(pkt, tcphdr, original_dir)
+	stream.addSegment(tcphdr.Seq, tcphdr.FIN, pkt, original_dir)
 }
 
 func PrintTcpMap() {
@@ -219,41 +356,113 @@ func PrintTcpMap() {
 	fmt.Printf("Streams dict: %v", tcpStreamsMap)
 }
 
-func configToPortsMap(config *tomlConfig) map[uint16]protocolType {
-	var res = map[uint16]protocolType{}
+// A port can only be configured for one protocol, as the streams are
+// dispatched by port.
+func configToPortsMap(config *tomlConfig) (map[uint16]ProtocolPlugin, error) {
+	var res = map[uint16]ProtocolPlugin{}
+	var names = map[uint16]string{}
 
-	var proto protocolType
-	for proto = UnknownProtocol + 1; int(proto) < len(protocolNames); proto++ {
+	for name, plugin := range protocolPlugins {
 
-		protoConfig, exists := config.Protocols[protocolNames[proto]]
+		protoConfig, exists := config.Protocols[name]
 		if !exists {
 			// skip
 			continue
 		}
 
 		for _, port := range protoConfig.Ports {
-			res[uint16(port)] = proto
+			if other, exists := names[uint16(port)]; exists {
+				first, second := other, name
+				if second < first {
+					first, second = second, first
+				}
+				return nil, MsgError("Port %d is configured for both %s and %s",
+					port, first, second)
+			}
+			res[uint16(port)] = plugin
+			names[uint16(port)] = name
 		}
 	}
 
-	return res
+	return res, nil
 }
 
 func configToFilter(config *tomlConfig) string {
 
+	if config.Protocol_detection.Enabled {
+		// the protocols can be on any port, the datagrams are only
+		// decoded on the configured ones
+		tcp := "tcp"
+		for _, output := range configToOutputsFilter(config) {
+			tcp += fmt.Sprintf(" and not (%s)", output)
+		}
+
+		// a port configured twice is reported by TcpInit
+		udpPorts, _ := configToUdpPortsMap(config)
+		ports := []int{}
+		for port := range udpPorts {
+			ports = append(ports, int(port))
+		}
+		if len(ports) == 0 {
+			return tcp
+		}
+		sort.Ints(ports)
+		udp := []string{}
+		for _, port := range ports {
+			udp = append(udp, fmt.Sprintf("port %d", port))
+		}
+		return fmt.Sprintf("(%s) or (udp and (%s))", tcp, strings.Join(udp, " or "))
+	}
+
 	res := []string{}
 
 	for _, protoConfig := range config.Protocols {
 		for _, port := range protoConfig.Ports {
 			res = append(res, fmt.Sprintf("port %d", port))
 		}
+		for _, port := range protoConfig.Udp_ports {
+			res = append(res, fmt.Sprintf("udp port %d", port))
+		}
 	}
 
 	return strings.Join(res, " or ")
 }
 
+// The traffic sent to the enabled outputs. When all ports are captured,
+// it would be detected and published, which would send more of it.
+func configToOutputsFilter(config *tomlConfig) []string {
+	res := []string{}
+
+	for _, name := range outputTypes {
+		output, exists := config.Output[name]
+		if !exists || !output.Enabled || output.Host == "" || output.Port == 0 {
+			continue
+		}
+		res = append(res, fmt.Sprintf("host %s and port %d", output.Host, output.Port))
+	}
+
+	return res
+}
+
 func TcpInit() error {
-	tcpPortMap = configToPortsMap(&_Config)
+	err := ProtocolsInit()
+	if err != nil {
+		return err
+	}
+
+	tcpPortMap, err = configToPortsMap(&_Config)
+	if err != nil {
+		return err
+	}
+	udpPortMap, err = configToUdpPortsMap(&_Config)
+	if err != nil {
+		return err
+	}
+
+	err = protocolDetection.Init(false)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -267,6 +476,7 @@ type DecoderStruct struct {
 	ip4     layers.IPv4
 	ip6     layers.IPv6
 	tcp     layers.TCP
+	udp     layers.UDP
 	payload gopacket.Payload
 	decoded []gopacket.LayerType
 }
@@ -281,17 +491,17 @@ func CreateDecoder(datalink layers.LinkType) (*DecoderStruct, error) {
 	case layers.LinkTypeLinuxSLL:
 		d.Parser = gopacket.NewDecodingLayerParser(
 			layers.LayerTypeLinuxSLL,
-			&d.sll, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+			&d.sll, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
 
 	case layers.LinkTypeEthernet:
 		d.Parser = gopacket.NewDecodingLayerParser(
 			layers.LayerTypeEthernet,
-			&d.eth, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+			&d.eth, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
 
 	case layers.LinkTypeNull: // loopback on OSx
 		d.Parser = gopacket.NewDecodingLayerParser(
 			layers.LayerTypeLoopback,
-			&d.lo, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+			&d.lo, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
 
 	default:
 		return nil, fmt.Errorf("Unsuported link type: %s", datalink.String())
@@ -310,11 +520,16 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 
 	err = decoder.Parser.DecodeLayers(data, &decoder.decoded)
 	if err != nil {
-		DEBUG("pcapread", "Decoding error: %s", err)
-		return
+		// gopacket guesses the layer following TCP or UDP from the
+		// ports, the analyzers decode the payload themselves
+		if _, unsupported := err.(gopacket.UnsupportedLayerType); !unsupported {
+			DEBUG("pcapread", "Decoding error: %s", err)
+			return
+		}
 	}
 
 	has_tcp := false
+	has_udp := false
 
 	for _, layerType := range decoder.decoded {
 		switch layerType {
@@ -337,16 +552,38 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 
 			packet.tuple.Src_port = uint16(decoder.tcp.SrcPort)
 			packet.tuple.Dst_port = uint16(decoder.tcp.DstPort)
+			packet.payload = decoder.tcp.Payload
 
 			has_tcp = true
 
+		case layers.LayerTypeUDP:
+			DEBUG("ip", "UDP packet")
+
+			packet.tuple.Src_port = uint16(decoder.udp.SrcPort)
+			packet.tuple.Dst_port = uint16(decoder.udp.DstPort)
+			packet.payload = decoder.udp.Payload
+
+			has_udp = true
+
 		case gopacket.LayerTypePayload:
 			packet.payload = decoder.payload
 		}
 	}
 
-	if !has_tcp {
-		DEBUG("pcapread", "No TCP header found in message")
+	if !has_tcp && !has_udp {
+		DEBUG("pcapread", "No TCP or UDP header found in message")
+		return
+	}
+
+	packet.ts = ci.Timestamp
+
+	if has_udp {
+		if len(packet.payload) == 0 {
+			DEBUG("pcapread", "Ignore empty UDP packet")
+			return
+		}
+		packet.tuple.ComputeHashebles()
+		FollowUdp(&packet)
 		return
 	}
 
@@ -356,8 +593,6 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 		return
 	}
 
-	packet.ts = ci.Timestamp
-
 	packet.tuple.ComputeHashebles()
 	FollowTcp(&decoder.tcp, &packet)
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/packetbeat/gopacket"
+	"github.com/packetbeat/gopacket/layers"
+)
+
+func TestTcp_configToPortsMap(t *testing.T) {
+
+	config := tomlConfig{
+		Protocols: map[string]tomlProtocol{
+			"http":    tomlProtocol{Ports: []int{80, 8080}},
+			"mysql":   tomlProtocol{Ports: []int{3306}},
+			"unknown": tomlProtocol{Ports: []int{1234}},
+		},
+	}
+
+	portsMap, err := configToPortsMap(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(portsMap) != 3 {
+		t.Errorf("Expected 3 ports, got %d", len(portsMap))
+	}
+	if portsMap[80] != ProtocolPlugin(&HttpMod) || portsMap[8080] != ProtocolPlugin(&HttpMod) {
+		t.Errorf("HTTP ports not mapped to the HTTP plugin")
+	}
+	if portsMap[3306] != ProtocolPlugin(&MysqlMod) {
+		t.Errorf("MySQL port not mapped to the MySQL plugin")
+	}
+	if _, exists := portsMap[1234]; exists {
+		t.Errorf("Port of unknown protocol shouldn't be mapped")
+	}
+
+	config.Protocols["grpc"] = tomlProtocol{Ports: []int{8080}}
+	_, err = configToPortsMap(&config)
+	if err == nil || err.Error() != "Port 8080 is configured for both grpc and http" {
+		t.Errorf("Expected an error for the port of two protocols, got %v", err)
+	}
+}
+
+// Records what the TCP layer passes to the protocol parser.
+type recordingPlugin struct {
+	data [2][]byte
+	fins int
+	gaps int
+}
+
+func (p *recordingPlugin) Init(test_mode bool) error { return nil }
+func (p *recordingPlugin) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
+	p.data[dir] = append(p.data[dir], pkt.payload...)
+}
+func (p *recordingPlugin) ReceivedFin(tcp *TcpStream, dir uint8) { p.fins++ }
+func (p *recordingPlugin) GapInStream(tcp *TcpStream, dir uint8) { p.gaps++ }
+func (p *recordingPlugin) ConnectionExpired(tcp *TcpStream)      {}
+
+func newRecordingStream() (*TcpStream, *recordingPlugin) {
+	plugin := &recordingPlugin{}
+	stream := &TcpStream{id: GetId(), tuple: testIpPortTuple(), protocol: plugin}
+	return stream, plugin
+}
+
+func addTestSegment(stream *TcpStream, seq uint32, fin bool, payload string) {
+	pkt := &Packet{payload: []byte(payload)}
+	stream.addSegment(seq, fin, pkt, TcpDirectionOriginal)
+}
+
+func TestTcp_outOfOrderSegments(t *testing.T) {
+
+	stream, plugin := newRecordingStream()
+	defer stream.Expire()
+
+	addTestSegment(stream, 100, false, "abc")
+	addTestSegment(stream, 106, false, "ghi")
+	addTestSegment(stream, 109, true, "")
+	addTestSegment(stream, 103, false, "def")
+
+	if string(plugin.data[TcpDirectionOriginal]) != "abcdefghi" {
+		t.Errorf("Wrong data delivered: %s", plugin.data[TcpDirectionOriginal])
+	}
+	if plugin.fins != 1 || plugin.gaps != 0 {
+		t.Errorf("Expected one FIN and no gaps, got %d and %d", plugin.fins, plugin.gaps)
+	}
+	if len(stream.pending[TcpDirectionOriginal]) != 0 {
+		t.Errorf("Segments still pending")
+	}
+}
+
+func TestTcp_retransmittedSegments(t *testing.T) {
+
+	stream, plugin := newRecordingStream()
+	defer stream.Expire()
+
+	addTestSegment(stream, 100, false, "abc")
+	addTestSegment(stream, 100, false, "abc")
+	addTestSegment(stream, 101, false, "bcdef")
+	addTestSegment(stream, 106, false, "g")
+
+	if string(plugin.data[TcpDirectionOriginal]) != "abcdefg" {
+		t.Errorf("Wrong data delivered: %s", plugin.data[TcpDirectionOriginal])
+	}
+}
+
+func TestTcp_gapInStream(t *testing.T) {
+
+	stream, plugin := newRecordingStream()
+	defer stream.Expire()
+
+	addTestSegment(stream, 100, false, "abc")
+	addTestSegment(stream, 110, false, "xyz")
+
+	if plugin.gaps != 0 {
+		t.Errorf("Gap reported before giving up on the missing data")
+	}
+
+	stream.skipGap(TcpDirectionOriginal, time.Time{})
+
+	if plugin.gaps != 1 {
+		t.Errorf("Expected one gap, got %d", plugin.gaps)
+	}
+	if string(plugin.data[TcpDirectionOriginal]) != "abcxyz" {
+		t.Errorf("Wrong data delivered: %s", plugin.data[TcpDirectionOriginal])
+	}
+	if stream.lastSeq[TcpDirectionOriginal] != 113 {
+		t.Errorf("Wrong next sequence number: %d", stream.lastSeq[TcpDirectionOriginal])
+	}
+}
+
+func TestTcp_gapTimeout(t *testing.T) {
+
+	stream, plugin := newRecordingStream()
+	defer stream.Expire()
+
+	ts := time.Now()
+	addSegment := func(seq uint32, payload string, elapsed time.Duration) {
+		pkt := &Packet{ts: ts.Add(elapsed), payload: []byte(payload)}
+		stream.addSegment(seq, false, pkt, TcpDirectionOriginal)
+	}
+
+	// two holes, at 103 and 109
+	addSegment(100, "abc", 0)
+	addSegment(106, "ghi", 0)
+	addSegment(112, "mno", 0)
+	addSegment(115, "p", time.Second)
+
+	if plugin.gaps != 0 {
+		t.Errorf("Gap reported before the timeout")
+	}
+
+	// a segment in the other direction after the timeout
+	stream.addSegment(500, false, &Packet{ts: ts.Add(3 * time.Second), payload: []byte("r")},
+		TcpDirectionReverse)
+
+	if plugin.gaps != 1 || string(plugin.data[TcpDirectionOriginal]) != "abcghi" {
+		t.Errorf("Expected the first gap to be skipped: %d %s", plugin.gaps,
+			plugin.data[TcpDirectionOriginal])
+	}
+
+	// the second hole waits from the moment the first one was skipped
+	addSegment(116, "q", 4*time.Second)
+	if plugin.gaps != 1 {
+		t.Errorf("Second gap skipped too early")
+	}
+	addSegment(117, "s", 6*time.Second)
+
+	if plugin.gaps != 2 || string(plugin.data[TcpDirectionOriginal]) != "abcghimnopqs" {
+		t.Errorf("Expected the second gap to be skipped: %d %s", plugin.gaps,
+			plugin.data[TcpDirectionOriginal])
+	}
+	if len(stream.pending[TcpDirectionOriginal]) != 0 {
+		t.Errorf("Segments still pending")
+	}
+}
+
+func TestTcp_expireWithPendingData(t *testing.T) {
+
+	stream, plugin := newRecordingStream()
+
+	addTestSegment(stream, 100, false, "abc")
+	addTestSegment(stream, 106, false, "ghi")
+	addTestSegment(stream, 112, false, "mno")
+
+	stream.Expire()
+
+	if plugin.gaps != 2 || string(plugin.data[TcpDirectionOriginal]) != "abcghimno" {
+		t.Errorf("Pending data not delivered on expiry: %d %s", plugin.gaps,
+			plugin.data[TcpDirectionOriginal])
+	}
+	if stream.timer.Stop() {
+		t.Errorf("Timer of the expired stream still armed")
+	}
+}
+
+func TestTcp_tooMuchPendingData(t *testing.T) {
+
+	stream, plugin := newRecordingStream()
+	defer stream.Expire()
+
+	addTestSegment(stream, 100, false, "a")
+	big := make([]byte, TCP_MAX_PENDING_DATA+1)
+	stream.addSegment(200, false, &Packet{payload: big}, TcpDirectionOriginal)
+
+	if plugin.gaps != 1 {
+		t.Errorf("Expected one gap, got %d", plugin.gaps)
+	}
+	if len(plugin.data[TcpDirectionOriginal]) != len(big)+1 {
+		t.Errorf("Wrong amount of data delivered: %d", len(plugin.data[TcpDirectionOriginal]))
+	}
+}
+
+func TestTcp_configToFilterWithDetection(t *testing.T) {
+
+	config := tomlConfig{
+		Protocols: map[string]tomlProtocol{
+			"http": tomlProtocol{Ports: []int{80}},
+			"dns":  tomlProtocol{Ports: []int{53}},
+		},
+		Output: map[string]tomlMothership{
+			"elasticsearch": tomlMothership{Enabled: true, Host: "localhost", Port: 9200},
+			"redis":         tomlMothership{Enabled: true, Host: "10.0.0.1", Port: 6379},
+			"file":          tomlMothership{Enabled: true, Path: "/tmp/packetbeat"},
+		},
+		Protocol_detection: tomlProtocolDetection{Enabled: true},
+	}
+
+	// the traffic to the outputs is not captured
+	filter := configToFilter(&config)
+	expected := "(tcp and not (host localhost and port 9200) and not (host 10.0.0.1 and port 6379))" +
+		" or (udp and (port 53))"
+	if filter != expected {
+		t.Errorf("Wrong filter: %s", filter)
+	}
+
+	config.Output["redis"] = tomlMothership{Enabled: false, Host: "10.0.0.1", Port: 6379}
+	delete(config.Protocols, "dns")
+	filter = configToFilter(&config)
+	if filter != "tcp and not (host localhost and port 9200)" {
+		t.Errorf("Wrong filter: %s", filter)
+	}
+}
+
+func TestTcp_decodeDnsPort(t *testing.T) {
+
+	savedPortMap := tcpPortMap
+	defer func() {
+		tcpPortMap = savedPortMap
+	}()
+
+	plugin := &recordingPlugin{}
+	tcpPortMap = map[uint16]ProtocolPlugin{53: plugin}
+
+	// Ethernet, IPv4 and TCP 192.168.0.1:40000 -> 192.168.0.53:53
+	// carrying a DNS query, which gopacket decodes as a DNS layer
+	frame, _ := hex.DecodeString("00000000000200000000000108004500004c000040004006000" +
+		"0c0a80001c0a800359c4000350000000100000000501800ff00000000" +
+		"0022beef01000001000000000000046e6f7065076578616d706c6503636f6d00000f0001")
+
+	decoder, err := CreateDecoder(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder.DecodePacketData(frame, &gopacket.CaptureInfo{Timestamp: time.Now()})
+
+	tuple := NewIpPortTuple(4, net.IPv4(192, 168, 0, 1), 40000, net.IPv4(192, 168, 0, 53), 53)
+	if stream, exists := tcpStreamsMap[tuple.raw]; exists {
+		stream.Expire()
+	}
+
+	if len(plugin.data[TcpDirectionOriginal]) != 36 {
+		t.Errorf("Expected the 36 bytes of the query, got %d", len(plugin.data[TcpDirectionOriginal]))
+	}
+}
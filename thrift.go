@@ -24,6 +24,10 @@ type ThriftMessage struct {
 
 	fields []ThriftField
 
+	// id of the last field read, the compact protocol sends the
+	// difference with it
+	lastFieldId uint16
+
 	IsRequest    bool
 	HasException bool
 	Version      uint32
@@ -31,6 +35,7 @@ type ThriftMessage struct {
 	Method       string
 	SeqId        uint32
 	Params       string
+	ParamsObj    bson.M
 	ReturnValue  string
 	Exceptions   string
 	FrameSize    uint32
@@ -42,6 +47,7 @@ type ThriftField struct {
 	Id   uint16
 
 	Value string
+	Obj   interface{}
 }
 
 type ThriftStream struct {
@@ -56,6 +62,11 @@ type ThriftStream struct {
 	// traffic in this direction. Used to skip large responses.
 	skipInput bool
 
+	// transport and protocol used in this direction, either configured
+	// for the port or detected from the first message
+	transportType byte
+	protocolType  byte
+
 	message *ThriftMessage
 }
 
@@ -73,7 +84,8 @@ type ThriftTransaction struct {
 	Request *ThriftMessage
 	Reply   *ThriftMessage
 
-	timer *time.Timer
+	timer    *time.Timer
+	timedOut bool
 }
 
 const (
@@ -115,6 +127,10 @@ const (
 	ThriftMsgTypeOneway
 )
 
+// Transport or protocol type that is detected from the first message
+// of each stream
+const ThriftAutoDetect = 0
+
 // Thrift protocol types
 const (
 	ThriftTBinary  = 1
@@ -135,11 +151,13 @@ type Thrift struct {
 	DropAfterNStructFields int
 	CaptureReply           bool
 	ObfuscateStrings       bool
+	StructuredParams       bool
 	Send_request           bool
 	Send_response          bool
 
 	TransportType byte
 	ProtocolType  byte
+	PortSettings  map[uint16]ThriftPortSettings
 
 	transMap map[HashableTcpTuple]*ThriftTransaction
 
@@ -148,8 +166,18 @@ type Thrift struct {
 	Idl          *ThriftIdl
 }
 
+// Transport and protocol used by the services on a given port.
+type ThriftPortSettings struct {
+	TransportType byte
+	ProtocolType  byte
+}
+
 var ThriftMod Thrift
 
+func init() {
+	RegisterProtocolPlugin("thrift", &ThriftMod)
+}
+
 type tomlThrift struct {
 	String_max_size            int
 	Collection_max_size        int
@@ -158,7 +186,15 @@ type tomlThrift struct {
 	Protocol_type              string
 	Capture_reply              bool
 	Obfuscate_strings          bool
+	Structured_params          bool
 	Idl_files                  []string
+	Port_settings              []tomlThriftPortSettings
+}
+
+type tomlThriftPortSettings struct {
+	Ports          []int
+	Transport_type string
+	Protocol_type  string
 }
 
 func (thrift *Thrift) InitDefaults() {
@@ -168,8 +204,10 @@ func (thrift *Thrift) InitDefaults() {
 	thrift.DropAfterNStructFields = 500
 	thrift.TransportType = ThriftTSocket
 	thrift.ProtocolType = ThriftTBinary
+	thrift.PortSettings = map[uint16]ThriftPortSettings{}
 	thrift.CaptureReply = true
 	thrift.ObfuscateStrings = false
+	thrift.StructuredParams = false
 	thrift.Send_request = true
 	thrift.Send_response = true
 }
@@ -187,21 +225,37 @@ func (thrift *Thrift) readConfig() error {
 		thrift.DropAfterNStructFields = _Config.Thrift.Drop_after_n_struct_fields
 	}
 	if _ConfigMeta.IsDefined("thrift", "transport_type") {
-		switch _Config.Thrift.Transport_type {
-		case "socket":
-			thrift.TransportType = ThriftTSocket
-		case "framed":
-			thrift.TransportType = ThriftTFramed
-		default:
-			return fmt.Errorf("Transport type `%s` not known", _Config.Thrift.Transport_type)
+		thrift.TransportType, err = thriftTransportType(_Config.Thrift.Transport_type)
+		if err != nil {
+			return err
 		}
 	}
 	if _ConfigMeta.IsDefined("thrift", "protocol_type") {
-		switch _Config.Thrift.Transport_type {
-		case "binary":
-			thrift.TransportType = ThriftTBinary
-		default:
-			return fmt.Errorf("Protocol type `%s` not known", _Config.Thrift.Protocol_type)
+		thrift.ProtocolType, err = thriftProtocolType(_Config.Thrift.Protocol_type)
+		if err != nil {
+			return err
+		}
+	}
+	for _, config := range _Config.Thrift.Port_settings {
+		// the types not set for the ports are the global ones
+		settings := ThriftPortSettings{thrift.TransportType, thrift.ProtocolType}
+		if config.Transport_type != "" {
+			settings.TransportType, err = thriftTransportType(config.Transport_type)
+			if err != nil {
+				return err
+			}
+		}
+		if config.Protocol_type != "" {
+			settings.ProtocolType, err = thriftProtocolType(config.Protocol_type)
+			if err != nil {
+				return err
+			}
+		}
+		for _, port := range config.Ports {
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("Invalid port in thrift.port_settings: %d", port)
+			}
+			thrift.PortSettings[uint16(port)] = settings
 		}
 	}
 	if _ConfigMeta.IsDefined("thrift", "capture_reply") {
@@ -210,6 +264,9 @@ func (thrift *Thrift) readConfig() error {
 	if _ConfigMeta.IsDefined("thrift", "obfuscate_strings") {
 		thrift.ObfuscateStrings = _Config.Thrift.Obfuscate_strings
 	}
+	if _ConfigMeta.IsDefined("thrift", "structured_params") {
+		thrift.StructuredParams = _Config.Thrift.Structured_params
+	}
 	if _ConfigMeta.IsDefined("thrift", "idl_files") {
 		thrift.Idl, err = NewThriftIdl(_Config.Thrift.Idl_files)
 		if err != nil {
@@ -227,6 +284,30 @@ func (thrift *Thrift) readConfig() error {
 	return nil
 }
 
+func thriftTransportType(name string) (byte, error) {
+	switch name {
+	case "socket":
+		return ThriftTSocket, nil
+	case "framed":
+		return ThriftTFramed, nil
+	case "auto":
+		return ThriftAutoDetect, nil
+	}
+	return 0, fmt.Errorf("Transport type `%s` not known", name)
+}
+
+func thriftProtocolType(name string) (byte, error) {
+	switch name {
+	case "binary":
+		return ThriftTBinary, nil
+	case "compact":
+		return ThriftTCompact, nil
+	case "auto":
+		return ThriftAutoDetect, nil
+	}
+	return 0, fmt.Errorf("Protocol type `%s` not known", name)
+}
+
 func (thrift *Thrift) Init(test_mode bool) error {
 
 	thrift.InitDefaults()
@@ -335,7 +416,9 @@ func (thrift *Thrift) readMessageBegin(s *ThriftStream) (bool, bool) {
 // Functions to decode simple types
 // They all have the same signature, returning the string value and the
 // number of bytes consumed (off).
-type ThriftFieldReader func(data []byte) (value string, ok bool, complete bool, off int)
+// The readers return the value formatted as a string and as an object
+// for the structured params.
+type ThriftFieldReader func(data []byte) (value string, obj interface{}, ok bool, complete bool, off int)
 
 // thriftReadString caps the returned value to ThriftStringMaxSize but returns the
 // off to the end of it.
@@ -362,8 +445,12 @@ func (thrift *Thrift) readString(data []byte) (value string, ok bool, complete b
 	return value, true, true, off // all good
 }
 
-func (thrift *Thrift) readAndQuoteString(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readAndQuoteString(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	value, ok, complete, off = thrift.readString(data)
+	return thrift.quoteString(value), thrift.stringObject(value), ok, complete, off
+}
+
+func (thrift *Thrift) quoteString(value string) string {
 	if value == "" {
 		value = `""`
 	} else if thrift.ObfuscateStrings {
@@ -375,13 +462,23 @@ func (thrift *Thrift) readAndQuoteString(data []byte) (value string, ok bool, co
 			value = hex.EncodeToString([]byte(value))
 		}
 	}
+	return value
+}
 
-	return value, ok, complete, off
+// Same as quoteString, for the structured params.
+func (thrift *Thrift) stringObject(value string) string {
+	if value != "" && thrift.ObfuscateStrings {
+		return "*"
+	}
+	if !utf8.ValidString(value) {
+		return hex.EncodeToString([]byte(value))
+	}
+	return value
 }
 
-func (thrift *Thrift) readBool(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readBool(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 1 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
 	if data[0] == byte(0) {
 		value = "false"
@@ -389,121 +486,124 @@ func (thrift *Thrift) readBool(data []byte) (value string, ok bool, complete boo
 		value = "true"
 	}
 
-	return value, true, true, 1
+	return value, data[0] != byte(0), true, true, 1
 }
 
-func (thrift *Thrift) readByte(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readByte(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 1 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
-	value = strconv.Itoa(int(data[0]))
+	// the Thrift byte is signed
+	value = strconv.Itoa(int(int8(data[0])))
 
-	return value, true, true, 1
+	return value, int8(data[0]), true, true, 1
 }
 
-func (thrift *Thrift) readDouble(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readDouble(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 8 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
 
 	bits := binary.BigEndian.Uint64(data[:8])
 	double := math.Float64frombits(bits)
 	value = strconv.FormatFloat(double, 'f', -1, 64)
 
-	return value, true, true, 8
+	return value, double, true, true, 8
 }
 
-func (thrift *Thrift) readI16(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readI16(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 2 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
 	i16 := Bytes_Ntohs(data[:2])
 	value = strconv.Itoa(int(i16))
 
-	return value, true, true, 2
+	return value, int16(i16), true, true, 2
 }
 
-func (thrift *Thrift) readI32(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readI32(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 4 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
 	i32 := Bytes_Ntohl(data[:4])
 	value = strconv.Itoa(int(i32))
 
-	return value, true, true, 4
+	return value, int32(i32), true, true, 4
 }
 
-func (thrift *Thrift) readI64(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readI64(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 8 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
 	i64 := Bytes_Ntohll(data[:8])
 	value = strconv.FormatInt(int64(i64), 10)
 
-	return value, true, true, 8
+	return value, int64(i64), true, true, 8
 }
 
 // Common implementation for lists and sets (they share the same binary repr).
-func (thrift *Thrift) readListOrSet(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readListOrSet(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 5 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
 	type_ := data[0]
 
 	funcReader, typeFound := thrift.funcReadersByType(type_)
 	if !typeFound {
 		DEBUG("thrift", "Field type %d not known", type_)
-		return "", false, false, 0
+		return "", nil, false, false, 0
 	}
 
 	sz := int(Bytes_Ntohl(data[1:5]))
 	if sz < 0 {
 		DEBUG("thrift", "List/Set too big: %d", sz)
-		return "", false, false, 0
+		return "", nil, false, false, 0
 	}
 
 	fields := []string{}
+	objs := []interface{}{}
 	offset := 5
 
 	for i := 0; i < sz; i++ {
-		value, ok, complete, bytesRead := funcReader(data[offset:])
+		value, obj, ok, complete, bytesRead := funcReader(data[offset:])
 		if !ok {
-			return "", false, false, 0
+			return "", nil, false, false, 0
 		}
 		if !complete {
-			return "", true, false, 0
+			return "", nil, true, false, 0
 		}
 
 		if i < thrift.CollectionMaxSize {
 			fields = append(fields, value)
+			objs = append(objs, obj)
 		} else if i == thrift.CollectionMaxSize {
 			fields = append(fields, "...")
 		}
 		offset += bytesRead
 	}
 
-	return strings.Join(fields, ", "), true, true, offset
+	return strings.Join(fields, ", "), objs, true, true, offset
 }
 
-func (thrift *Thrift) readSet(data []byte) (value string, ok bool, complete bool, off int) {
-	value, ok, complete, off = thrift.readListOrSet(data)
+func (thrift *Thrift) readSet(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	value, obj, ok, complete, off = thrift.readListOrSet(data)
 	if value != "" {
 		value = "{" + value + "}"
 	}
-	return value, ok, complete, off
+	return value, obj, ok, complete, off
 }
 
-func (thrift *Thrift) readList(data []byte) (value string, ok bool, complete bool, off int) {
-	value, ok, complete, off = thrift.readListOrSet(data)
+func (thrift *Thrift) readList(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	value, obj, ok, complete, off = thrift.readListOrSet(data)
 	if value != "" {
 		value = "[" + value + "]"
 	}
-	return value, ok, complete, off
+	return value, obj, ok, complete, off
 }
 
-func (thrift *Thrift) readMap(data []byte) (value string, ok bool, complete bool, off int) {
+func (thrift *Thrift) readMap(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 	if len(data) < 6 {
-		return "", true, false, 0
+		return "", nil, true, false, 0
 	}
 	type_key := data[0]
 	type_value := data[1]
@@ -511,54 +611,65 @@ func (thrift *Thrift) readMap(data []byte) (value string, ok bool, complete bool
 	funcReaderKey, typeFound := thrift.funcReadersByType(type_key)
 	if !typeFound {
 		DEBUG("thrift", "Field type %d not known", type_key)
-		return "", false, false, 0
+		return "", nil, false, false, 0
 	}
 
 	funcReaderValue, typeFound := thrift.funcReadersByType(type_value)
 	if !typeFound {
 		DEBUG("thrift", "Field type %d not known", type_value)
-		return "", false, false, 0
+		return "", nil, false, false, 0
 	}
 
 	sz := int(Bytes_Ntohl(data[2:6]))
 	if sz < 0 {
 		DEBUG("thrift", "Map too big: %d", sz)
-		return "", false, false, 0
+		return "", nil, false, false, 0
 	}
 
 	fields := []string{}
+	objs := bson.M{}
 	offset := 6
 
 	for i := 0; i < sz; i++ {
-		key, ok, complete, bytesRead := funcReaderKey(data[offset:])
+		key, key_obj, ok, complete, bytesRead := funcReaderKey(data[offset:])
 		if !ok {
-			return "", false, false, 0
+			return "", nil, false, false, 0
 		}
 		if !complete {
-			return "", true, false, 0
+			return "", nil, true, false, 0
 		}
 		offset += bytesRead
 
-		value, ok, complete, bytesRead := funcReaderValue(data[offset:])
+		value, obj, ok, complete, bytesRead := funcReaderValue(data[offset:])
 		if !ok {
-			return "", false, false, 0
+			return "", nil, false, false, 0
 		}
 		if !complete {
-			return "", true, false, 0
+			return "", nil, true, false, 0
 		}
 		offset += bytesRead
 
 		if i < thrift.CollectionMaxSize {
 			fields = append(fields, key+": "+value)
+			objs[thriftMapKey(key, key_obj)] = obj
 		} else if i == thrift.CollectionMaxSize {
 			fields = append(fields, "...")
 		}
 	}
 
-	return "{" + strings.Join(fields, ", ") + "}", true, true, offset
+	return "{" + strings.Join(fields, ", ") + "}", objs, true, true, offset
 }
 
-func (thrift *Thrift) readStruct(data []byte) (value string, ok bool, complete bool, off int) {
+// The keys of the structured maps are the keys themselves when they are
+// strings, and their formatted values otherwise.
+func thriftMapKey(key string, key_obj interface{}) string {
+	if str, ok := key_obj.(string); ok {
+		return str
+	}
+	return key
+}
+
+func (thrift *Thrift) readStruct(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
 
 	var bytesRead int
 	offset := 0
@@ -572,21 +683,22 @@ func (thrift *Thrift) readStruct(data []byte) (value string, ok bool, complete b
 
 		if i >= thrift.DropAfterNStructFields {
 			DEBUG("thrift", "Too many fields in struct. Dropping as error")
-			return "", false, false, 0
+			return "", nil, false, false, 0
 		}
 
 		if len(data) < 1 {
-			return "", true, false, 0
+			return "", nil, true, false, 0
 		}
 
 		field.Type = byte(data[offset])
 		offset += 1
 		if field.Type == ThriftTypeStop {
-			return thrift.formatStruct(fields, false, []*string{}), true, true, offset
+			return thrift.formatStruct(fields, false, []*string{}), thrift.structObject(fields),
+				true, true, offset
 		}
 
 		if len(data[offset:]) < 2 {
-			return "", true, false, 0 // not complete
+			return "", nil, true, false, 0 // not complete
 		}
 
 		field.Id = Bytes_Ntohs(data[offset : offset+2])
@@ -595,16 +707,16 @@ func (thrift *Thrift) readStruct(data []byte) (value string, ok bool, complete b
 		funcReader, typeFound := thrift.funcReadersByType(field.Type)
 		if !typeFound {
 			DEBUG("thrift", "Field type %d not known", field.Type)
-			return "", false, false, 0
+			return "", nil, false, false, 0
 		}
 
-		field.Value, ok, complete, bytesRead = funcReader(data[offset:])
+		field.Value, field.Obj, ok, complete, bytesRead = funcReader(data[offset:])
 
 		if !ok {
-			return "", false, false, 0
+			return "", nil, false, false, 0
 		}
 		if !complete {
-			return "", true, false, 0
+			return "", nil, true, false, 0
 		}
 		fields = append(fields, field)
 		offset += bytesRead
@@ -629,6 +741,16 @@ func (thrift *Thrift) formatStruct(fields []ThriftField, resolve_names bool,
 	return "(" + strings.Join(toJoin, ", ") + ")"
 }
 
+// The struct for the structured params, the fields are keyed by their
+// ids.
+func (thrift *Thrift) structObject(fields []ThriftField) bson.M {
+	obj := bson.M{}
+	for _, field := range fields {
+		obj[strconv.Itoa(int(field.Id))] = field.Obj
+	}
+	return obj
+}
+
 // Dictionary wrapped in a function to avoid "initialization loop"
 func (thrift *Thrift) funcReadersByType(type_ byte) (func_ ThriftFieldReader, exists bool) {
 	switch type_ {
@@ -687,7 +809,7 @@ func (thrift *Thrift) readField(s *ThriftStream) (ok bool, complete bool, field
 		return false, false, nil
 	}
 
-	field.Value, ok, complete, off = funcReader(s.data[offset:])
+	field.Value, field.Obj, ok, complete, off = funcReader(s.data[offset:])
 
 	if !ok {
 		return false, false, nil
@@ -709,7 +831,16 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 		switch s.parseState {
 		case ThriftStartState:
 			m.start = s.parseOffset
-			if thrift.TransportType == ThriftTFramed {
+			if s.transportType == ThriftAutoDetect || s.protocolType == ThriftAutoDetect {
+				ok, complete = s.detectTypes()
+				if !ok {
+					return false, false
+				}
+				if !complete {
+					return true, false
+				}
+			}
+			if s.transportType == ThriftTFramed {
 				// read I32
 				if len(s.data) < 4 {
 					return true, false
@@ -718,7 +849,11 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 				s.parseOffset = 4
 			}
 
-			ok, complete = thrift.readMessageBegin(s)
+			if s.protocolType == ThriftTCompact {
+				ok, complete = thrift.readCompactMessageBegin(s)
+			} else {
+				ok, complete = thrift.readMessageBegin(s)
+			}
 			if !ok {
 				return false, false
 			}
@@ -726,6 +861,13 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 				return true, false
 			}
 
+			// the multiplexed protocol prefixes the method with the
+			// service name
+			if i := strings.Index(m.Method, ":"); i >= 0 {
+				m.Service = m.Method[:i]
+				m.Method = m.Method[i+1:]
+			}
+
 			if !m.IsRequest && !thrift.CaptureReply {
 				// don't actually read the result
 				DEBUG("thrift", "Don't capture reply")
@@ -735,7 +877,12 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 			}
 			s.parseState = ThriftFieldState
 		case ThriftFieldState:
-			ok, complete, field := thrift.readField(s)
+			var field *ThriftField
+			if s.protocolType == ThriftTCompact {
+				ok, complete, field = thrift.readCompactField(s)
+			} else {
+				ok, complete, field = thrift.readField(s)
+			}
 			if !ok {
 				return false, false
 			}
@@ -743,13 +890,25 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 				// done
 				var method *ThriftIdlMethod = nil
 				if thrift.Idl != nil {
-					method = thrift.Idl.FindMethod(m.Method)
+					if !m.IsRequest && m.Service == "" {
+						// replies don't repeat the service name
+						m.Service = thrift.requestService(s, m.Method)
+					}
+					method = thrift.Idl.FindMethod(m.Service, m.Method)
 				}
 				if m.IsRequest {
+					if thrift.StructuredParams {
+						m.ParamsObj = thrift.structObject(m.fields)
+						if method != nil {
+							m.ParamsObj = thrift.Idl.NameFields(m.ParamsObj, method.Method.Arguments)
+						}
+					}
 					if method != nil {
 						m.Params = thrift.formatStruct(m.fields, true, method.Params)
 
-						m.Service = method.Service.Name
+						if m.Service == "" {
+							m.Service = method.Service.Name
+						}
 					} else {
 						m.Params = thrift.formatStruct(m.fields, false, nil)
 					}
@@ -786,6 +945,20 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 	return true, false
 }
 
+// Returns the service of the request waiting for a reply on the stream,
+// if it is for the same method.
+func (thrift *Thrift) requestService(s *ThriftStream, method string) string {
+	if s.tcpStream == nil || s.tcpStream.tuple == nil {
+		return ""
+	}
+	tuple := TcpTupleFromIpPort(s.tcpStream.tuple, s.tcpStream.id)
+	trans := thrift.transMap[tuple.raw]
+	if trans == nil || trans.Request == nil || trans.Request.Method != method {
+		return ""
+	}
+	return trans.Request.Service
+}
+
 func (stream *ThriftStream) PrepareForNewMessage(flush bool) {
 	if flush {
 		stream.data = []byte{}
@@ -798,19 +971,97 @@ func (stream *ThriftStream) PrepareForNewMessage(flush bool) {
 	stream.parseState = ThriftStartState
 }
 
+// Returns the transport and protocol configured for the port of the
+// service, or the global ones.
+func (thrift *Thrift) portSettings(tuple *IpPortTuple) ThriftPortSettings {
+	if settings, exists := thrift.PortSettings[tuple.Src_port]; exists {
+		return settings
+	}
+	if settings, exists := thrift.PortSettings[tuple.Dst_port]; exists {
+		return settings
+	}
+	return ThriftPortSettings{thrift.TransportType, thrift.ProtocolType}
+}
+
+// Decides the transport and protocol types left to auto-detection from
+// the beginning of the first message. A frame size is recognized by the
+// protocol header that follows it, the first byte of the headers being
+// too large for a plausible frame.
+func (stream *ThriftStream) detectTypes() (ok bool, complete bool) {
+	data := stream.data[stream.parseOffset:]
+
+	transport := stream.transportType
+	if transport == ThriftAutoDetect {
+		if len(data) < 1 {
+			return true, false
+		}
+		if thriftProtocolOf(data[0]) != ThriftAutoDetect {
+			transport = ThriftTSocket
+		} else {
+			if len(data) < 5 {
+				return true, false
+			}
+			size := Bytes_Ntohl(data[:4])
+			if size == 0 || size > TCP_MAX_DATA_IN_STREAM ||
+				thriftProtocolOf(data[4]) == ThriftAutoDetect {
+
+				DEBUG("thrift", "Can't detect the Thrift transport")
+				return false, false
+			}
+			transport = ThriftTFramed
+		}
+	}
+
+	protocol := stream.protocolType
+	if protocol == ThriftAutoDetect {
+		offset := 0
+		if transport == ThriftTFramed {
+			offset = 4
+		}
+		if len(data) <= offset {
+			return true, false
+		}
+		protocol = thriftProtocolOf(data[offset])
+		if protocol == ThriftAutoDetect {
+			DEBUG("thrift", "Can't detect the Thrift protocol")
+			return false, false
+		}
+	}
+
+	DEBUG("thrift", "Detected transport %d and protocol %d", transport, protocol)
+	stream.transportType = transport
+	stream.protocolType = protocol
+	return true, true
+}
+
+// Returns the protocol starting with the given byte, or
+// ThriftAutoDetect if none does.
+func thriftProtocolOf(b byte) byte {
+	switch b {
+	case byte(ThriftVersion1 >> 24):
+		return ThriftTBinary
+	case ThriftCompactProtocolId:
+		return ThriftTCompact
+	}
+	return ThriftAutoDetect
+}
+
 func (thrift *Thrift) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
 
 	defer RECOVER("ParseThrift exception")
 
-	stream := tcp.thriftData[dir]
+	stream, _ := tcp.data[dir].(*ThriftStream)
 
 	if stream == nil {
+		settings := thrift.portSettings(tcp.tuple)
 		stream = &ThriftStream{
-			tcpStream: tcp,
-			data:      pkt.payload,
-			message:   &ThriftMessage{Ts: pkt.ts},
+			tcpStream:     tcp,
+			data:          pkt.payload,
+			message:       &ThriftMessage{Ts: pkt.ts},
+			transportType: settings.TransportType,
+			protocolType:  settings.ProtocolType,
 		}
-		tcp.thriftData[dir] = stream
+		tcp.data[dir] = stream
 	} else {
 		if stream.skipInput {
 			// stream currently suspended in this direction
@@ -820,7 +1071,7 @@ func (thrift *Thrift) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
 		stream.data = append(stream.data, pkt.payload...)
 		if len(stream.data) > TCP_MAX_DATA_IN_STREAM {
 			DEBUG("thrift", "Stream data too large, dropping TCP stream")
-			tcp.thriftData[dir] = nil
+			tcp.data[dir] = nil
 			return
 		}
 	}
@@ -830,12 +1081,12 @@ func (thrift *Thrift) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
 			stream.message = &ThriftMessage{Ts: pkt.ts}
 		}
 
-		ok, complete := thrift.messageParser(tcp.thriftData[dir])
+		ok, complete := thrift.messageParser(stream)
 
 		if !ok {
 			// drop this tcp stream. Will retry parsing with the next
 			// segment in it
-			tcp.thriftData[dir] = nil
+			tcp.data[dir] = nil
 			DEBUG("thrift", "Ignore Thrift message. Drop tcp stream. Try parsing with the next segment")
 			return
 		}
@@ -847,7 +1098,7 @@ func (thrift *Thrift) Parse(pkt *Packet, tcp *TcpStream, dir uint8) {
 				DEBUG("thrift", "Thrift request message: %s", stream.message.Method)
 				if !thrift.CaptureReply {
 					// enable the stream in the other direction to get the reply
-					stream_rev := tcp.thriftData[1-dir]
+					stream_rev, _ := tcp.data[1-dir].(*ThriftStream)
 					if stream_rev != nil {
 						stream_rev.skipInput = false
 					}
@@ -896,6 +1147,9 @@ func (thrift *Thrift) receivedRequest(msg *ThriftMessage) {
 	trans := thrift.transMap[tuple.raw]
 	if trans != nil {
 		DEBUG("thrift", "Two requests without reply, assuming the old one is oneway")
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
 		thrift.PublishQueue <- trans
 	}
 
@@ -979,12 +1233,75 @@ func (thrift *Thrift) ReceivedFin(tcp *TcpStream, dir uint8) {
 	}
 }
 
+func (thrift *Thrift) GapInStream(tcp *TcpStream, dir uint8) {
+	// nothing to do, the parser starts over after the gap
+}
+
+func (thrift *Thrift) ConnectionExpired(tcp *TcpStream) {
+	// nothing to do, the pending transactions expire on their own
+}
+
+// Recognizes the message header of the strict binary or compact
+// protocols, optionally preceded by the frame size of the framed
+// transport.
+func (thrift *Thrift) Detect(data []byte) int {
+
+	score := thriftDetectAnyMessageBegin(data)
+	if score == 0 && len(data) > 4 {
+		size := Bytes_Ntohl(data[0:4])
+		if size > 0 && size <= TCP_MAX_DATA_IN_STREAM {
+			score = thriftDetectAnyMessageBegin(data[4:])
+		}
+	}
+	return score
+}
+
+func thriftDetectAnyMessageBegin(data []byte) int {
+	score := thriftDetectMessageBegin(data)
+	if score == 0 {
+		score = thriftDetectCompactMessageBegin(data)
+	}
+	return score
+}
+
+func thriftDetectMessageBegin(data []byte) int {
+
+	if len(data) < 8 {
+		return 0
+	}
+
+	sz := Bytes_Ntohl(data[0:4])
+	if sz&ThriftVersionMask != ThriftVersion1 {
+		return 0
+	}
+	msgType := sz & ThriftTypeMask
+	if msgType < ThriftMsgTypeCall || msgType > ThriftMsgTypeOneway {
+		return 0
+	}
+
+	nameLen := int(Bytes_Ntohl(data[4:8]))
+	if nameLen <= 0 || nameLen > 256 {
+		return 0
+	}
+	if len(data) < 8+nameLen {
+		return 50
+	}
+	for _, c := range data[8 : 8+nameLen] {
+		if c < 0x20 || c > 0x7e {
+			return 0
+		}
+	}
+	return DetectionScoreCertain
+}
+
 func (thrift *Thrift) publishTransactions() {
 	for t := range thrift.PublishQueue {
 		event := Event{}
 
 		event.Type = "thrift"
-		if t.Reply != nil && t.Reply.HasException {
+		if t.timedOut {
+			event.Status = TIMEOUT_STATUS
+		} else if t.Reply != nil && t.Reply.HasException {
 			event.Status = ERROR_STATUS
 		} else {
 			event.Status = OK_STATUS
@@ -1001,6 +1318,9 @@ func (thrift *Thrift) publishTransactions() {
 				},
 				"service": t.Request.Service,
 			}
+			if t.Request.ParamsObj != nil {
+				event.Thrift["request"].(bson.M)["params_obj"] = t.Request.ParamsObj
+			}
 
 			if thrift.Send_request {
 				event.RequestRaw = fmt.Sprintf("%s%s", t.Request.Method,
@@ -1036,7 +1356,16 @@ func (thrift *Thrift) publishTransactions() {
 }
 
 func (thrift *Thrift) expireTransaction(trans *ThriftTransaction) {
-	// TODO - also publish?
+
+	if trans.Request != nil && trans.Reply == nil {
+		// oneway calls never get a reply, all the others timed out
+		if trans.Request.Type != ThriftMsgTypeOneway {
+			trans.timedOut = true
+			trans.ResponseTime = TimeoutResponseTime
+		}
+		thrift.PublishQueue <- trans
+	}
+
 	// remove from map
 	delete(thrift.transMap, trans.tuple.raw)
 }
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Decoding of the TCompactProtocol. The values are formatted like the
+// ones of the binary protocol, so the events don't depend on the
+// protocol used by the service.
+
+const (
+	ThriftCompactProtocolId  = 0x82
+	ThriftCompactVersion     = 1
+	ThriftCompactVersionMask = 0x1f
+	ThriftCompactTypeShift   = 5
+)
+
+// Types of the compact protocol
+const (
+	ThriftCompactTypeStop         = 0
+	ThriftCompactTypeBooleanTrue  = 1
+	ThriftCompactTypeBooleanFalse = 2
+	ThriftCompactTypeByte         = 3
+	ThriftCompactTypeI16          = 4
+	ThriftCompactTypeI32          = 5
+	ThriftCompactTypeI64          = 6
+	ThriftCompactTypeDouble       = 7
+	ThriftCompactTypeBinary       = 8
+	ThriftCompactTypeList         = 9
+	ThriftCompactTypeSet          = 10
+	ThriftCompactTypeMap          = 11
+	ThriftCompactTypeStruct       = 12
+)
+
+// Reads an unsigned LEB128 varint, of at most 10 bytes.
+func thriftReadVarint(data []byte) (value uint64, ok bool, complete bool, off int) {
+	var shift uint
+	for i := 0; i < len(data); i++ {
+		if i >= 10 {
+			return 0, false, false, 0
+		}
+		b := data[i]
+		value |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, true, true, i + 1
+		}
+		shift += 7
+	}
+	return 0, true, false, 0
+}
+
+func thriftZigzag(n uint64) int64 {
+	return int64(n>>1) ^ -int64(n&1)
+}
+
+func (thrift *Thrift) readCompactMessageBegin(s *ThriftStream) (bool, bool) {
+
+	m := s.message
+	offset := s.parseOffset
+
+	if len(s.data[offset:]) < 2 {
+		return true, false // ok, not complete
+	}
+	if s.data[offset] != ThriftCompactProtocolId {
+		DEBUG("thrift", "Unexpected protocol id: %d", s.data[offset])
+		return false, false
+	}
+	m.Version = uint32(s.data[offset+1] & ThriftCompactVersionMask)
+	if m.Version != ThriftCompactVersion {
+		DEBUG("thrift", "Unexpected version: %d", m.Version)
+	}
+	m.Type = uint32(s.data[offset+1] >> ThriftCompactTypeShift)
+	offset += 2
+
+	seqId, ok, complete, off := thriftReadVarint(s.data[offset:])
+	if !ok {
+		return false, false
+	}
+	if !complete {
+		return true, false
+	}
+	m.SeqId = uint32(seqId)
+	offset += off
+
+	m.Method, ok, complete, off = thrift.readCompactString(s.data[offset:])
+	if !ok {
+		return false, false // not ok, not complete
+	}
+	if !complete {
+		DEBUG("thriftdetailed", "Method name not complete")
+		return true, false // ok, not complete
+	}
+	offset += off
+
+	DEBUG("thriftdetailed", "method = %s", m.Method)
+
+	s.parseOffset = offset
+
+	if m.Type == ThriftMsgTypeCall || m.Type == ThriftMsgTypeOneway {
+		m.IsRequest = true
+	} else {
+		m.IsRequest = false
+	}
+
+	return true, true
+}
+
+// Same as thriftDetectMessageBegin, for the compact protocol.
+func thriftDetectCompactMessageBegin(data []byte) int {
+
+	if len(data) < 2 || data[0] != ThriftCompactProtocolId {
+		return 0
+	}
+	if data[1]&ThriftCompactVersionMask != ThriftCompactVersion {
+		return 0
+	}
+	msgType := data[1] >> ThriftCompactTypeShift
+	if msgType < ThriftMsgTypeCall || msgType > ThriftMsgTypeOneway {
+		return 0
+	}
+
+	_, ok, complete, off := thriftReadVarint(data[2:])
+	if !ok {
+		return 0
+	}
+	if !complete {
+		return 50
+	}
+	offset := 2 + off
+
+	nameLen, ok, complete, off := thriftReadVarint(data[offset:])
+	if !ok || (complete && (nameLen == 0 || nameLen > 256)) {
+		return 0
+	}
+	if !complete || len(data) < offset+off+int(nameLen) {
+		return 50
+	}
+	offset += off
+	for _, c := range data[offset : offset+int(nameLen)] {
+		if c < 0x20 || c > 0x7e {
+			return 0
+		}
+	}
+	return DetectionScoreCertain
+}
+
+// Same as readString, with the length encoded as a varint.
+func (thrift *Thrift) readCompactString(data []byte) (value string, ok bool, complete bool, off int) {
+	length, ok, complete, off := thriftReadVarint(data)
+	if !ok || !complete {
+		return "", ok, false, 0
+	}
+	if length > uint64(len(data)) {
+		if length > TCP_MAX_DATA_IN_STREAM {
+			return "", false, false, 0 // not ok
+		}
+		return "", true, false, 0 // ok, not complete
+	}
+	sz := int(length)
+	if len(data[off:]) < sz {
+		return "", true, false, 0 // ok, not complete
+	}
+
+	if sz > thrift.StringMaxSize {
+		value = string(data[off : off+thrift.StringMaxSize])
+		value += "..."
+	} else {
+		value = string(data[off : off+sz])
+	}
+
+	return value, true, true, off + sz
+}
+
+func (thrift *Thrift) readCompactAndQuoteString(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	value, ok, complete, off = thrift.readCompactString(data)
+	return thrift.quoteString(value), thrift.stringObject(value), ok, complete, off
+}
+
+// The booleans in collections take one byte, the ones of the fields
+// are in the type of the field.
+func (thrift *Thrift) readCompactBool(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	if len(data) < 1 {
+		return "", nil, true, false, 0
+	}
+	if data[0] == ThriftCompactTypeBooleanTrue {
+		value = "true"
+	} else {
+		value = "false"
+	}
+
+	return value, data[0] == ThriftCompactTypeBooleanTrue, true, true, 1
+}
+
+func (thrift *Thrift) readCompactInt(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	n, ok, complete, off := thriftReadVarint(data)
+	if !ok || !complete {
+		return "", nil, ok, false, 0
+	}
+	i64 := thriftZigzag(n)
+	value = strconv.FormatInt(i64, 10)
+
+	return value, i64, true, true, off
+}
+
+func (thrift *Thrift) readCompactDouble(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	if len(data) < 8 {
+		return "", nil, true, false, 0
+	}
+
+	bits := binary.LittleEndian.Uint64(data[:8])
+	double := math.Float64frombits(bits)
+	value = strconv.FormatFloat(double, 'f', -1, 64)
+
+	return value, double, true, true, 8
+}
+
+// Common implementation for lists and sets. The size is in the high
+// nibble of the header, or in a varint following it when it's 15.
+func (thrift *Thrift) readCompactListOrSet(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	if len(data) < 1 {
+		return "", nil, true, false, 0
+	}
+	type_ := data[0] & 0x0f
+	sz := int(data[0] >> 4)
+	offset := 1
+
+	if sz == 15 {
+		n, ok, complete, bytesRead := thriftReadVarint(data[offset:])
+		if !ok || !complete {
+			return "", nil, ok, false, 0
+		}
+		if n > uint64(len(data)) {
+			DEBUG("thrift", "List/Set too big: %d", n)
+			return "", nil, n <= TCP_MAX_DATA_IN_STREAM, false, 0
+		}
+		sz = int(n)
+		offset += bytesRead
+	}
+
+	funcReader, typeFound := thrift.compactReadersByType(type_)
+	if !typeFound {
+		DEBUG("thrift", "Field type %d not known", type_)
+		return "", nil, false, false, 0
+	}
+
+	fields := []string{}
+	objs := []interface{}{}
+
+	for i := 0; i < sz; i++ {
+		value, obj, ok, complete, bytesRead := funcReader(data[offset:])
+		if !ok {
+			return "", nil, false, false, 0
+		}
+		if !complete {
+			return "", nil, true, false, 0
+		}
+
+		if i < thrift.CollectionMaxSize {
+			fields = append(fields, value)
+			objs = append(objs, obj)
+		} else if i == thrift.CollectionMaxSize {
+			fields = append(fields, "...")
+		}
+		offset += bytesRead
+	}
+
+	return strings.Join(fields, ", "), objs, true, true, offset
+}
+
+func (thrift *Thrift) readCompactSet(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	value, obj, ok, complete, off = thrift.readCompactListOrSet(data)
+	if value != "" {
+		value = "{" + value + "}"
+	}
+	return value, obj, ok, complete, off
+}
+
+func (thrift *Thrift) readCompactList(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	value, obj, ok, complete, off = thrift.readCompactListOrSet(data)
+	if value != "" {
+		value = "[" + value + "]"
+	}
+	return value, obj, ok, complete, off
+}
+
+// The size comes first as a varint, followed by the types of the keys
+// and values in one byte, unless the map is empty.
+func (thrift *Thrift) readCompactMap(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+	n, ok, complete, offset := thriftReadVarint(data)
+	if !ok || !complete {
+		return "", nil, ok, false, 0
+	}
+	if n == 0 {
+		return "{}", bson.M{}, true, true, offset
+	}
+	if n > uint64(len(data)) {
+		DEBUG("thrift", "Map too big: %d", n)
+		return "", nil, n <= TCP_MAX_DATA_IN_STREAM, false, 0
+	}
+	sz := int(n)
+
+	if len(data[offset:]) < 1 {
+		return "", nil, true, false, 0
+	}
+	type_key := data[offset] >> 4
+	type_value := data[offset] & 0x0f
+	offset += 1
+
+	funcReaderKey, typeFound := thrift.compactReadersByType(type_key)
+	if !typeFound {
+		DEBUG("thrift", "Field type %d not known", type_key)
+		return "", nil, false, false, 0
+	}
+
+	funcReaderValue, typeFound := thrift.compactReadersByType(type_value)
+	if !typeFound {
+		DEBUG("thrift", "Field type %d not known", type_value)
+		return "", nil, false, false, 0
+	}
+
+	fields := []string{}
+	objs := bson.M{}
+
+	for i := 0; i < sz; i++ {
+		key, key_obj, ok, complete, bytesRead := funcReaderKey(data[offset:])
+		if !ok {
+			return "", nil, false, false, 0
+		}
+		if !complete {
+			return "", nil, true, false, 0
+		}
+		offset += bytesRead
+
+		value, obj, ok, complete, bytesRead := funcReaderValue(data[offset:])
+		if !ok {
+			return "", nil, false, false, 0
+		}
+		if !complete {
+			return "", nil, true, false, 0
+		}
+		offset += bytesRead
+
+		if i < thrift.CollectionMaxSize {
+			fields = append(fields, key+": "+value)
+			objs[thriftMapKey(key, key_obj)] = obj
+		} else if i == thrift.CollectionMaxSize {
+			fields = append(fields, "...")
+		}
+	}
+
+	return "{" + strings.Join(fields, ", ") + "}", objs, true, true, offset
+}
+
+// Reads the header of a field: the delta from the previous field id
+// in the high nibble and the type in the low nibble. With a delta of
+// zero, the id follows as a zigzag varint. The booleans are read here,
+// their value is in the type.
+func (thrift *Thrift) readCompactFieldHeader(data []byte, lastId uint16) (field ThriftField,
+	ok bool, complete bool, off int) {
+
+	if len(data) < 1 {
+		return field, true, false, 0
+	}
+	field.Type = data[0] & 0x0f
+	if field.Type == ThriftCompactTypeStop {
+		return field, true, true, 1
+	}
+
+	delta := uint16(data[0] >> 4)
+	off = 1
+	if delta != 0 {
+		field.Id = lastId + delta
+	} else {
+		id, ok, complete, bytesRead := thriftReadVarint(data[off:])
+		if !ok || !complete {
+			return field, ok, false, 0
+		}
+		field.Id = uint16(thriftZigzag(id))
+		off += bytesRead
+	}
+
+	switch field.Type {
+	case ThriftCompactTypeBooleanTrue:
+		field.Value = "true"
+		field.Obj = true
+	case ThriftCompactTypeBooleanFalse:
+		field.Value = "false"
+		field.Obj = false
+	}
+
+	return field, true, true, off
+}
+
+func (thrift *Thrift) readCompactFieldValue(field *ThriftField, data []byte) (ok bool, complete bool, off int) {
+
+	if field.Type == ThriftCompactTypeBooleanTrue || field.Type == ThriftCompactTypeBooleanFalse {
+		// already read from the header
+		return true, true, 0
+	}
+
+	funcReader, typeFound := thrift.compactReadersByType(field.Type)
+	if !typeFound {
+		DEBUG("thrift", "Field type %d not known", field.Type)
+		return false, false, 0
+	}
+
+	field.Value, field.Obj, ok, complete, off = funcReader(data)
+	return ok, complete, off
+}
+
+func (thrift *Thrift) readCompactStruct(data []byte) (value string, obj interface{}, ok bool, complete bool, off int) {
+
+	var lastId uint16
+	offset := 0
+	fields := []ThriftField{}
+
+	// Loop until hitting a STOP or reaching the maximum number of elements
+	// we follow in a stream (at which point, we assume we interpreted something
+	// wrong).
+	for i := 0; ; i++ {
+		if i >= thrift.DropAfterNStructFields {
+			DEBUG("thrift", "Too many fields in struct. Dropping as error")
+			return "", nil, false, false, 0
+		}
+
+		field, ok, complete, bytesRead := thrift.readCompactFieldHeader(data[offset:], lastId)
+		if !ok {
+			return "", nil, false, false, 0
+		}
+		if !complete {
+			return "", nil, true, false, 0
+		}
+		offset += bytesRead
+		if field.Type == ThriftCompactTypeStop {
+			return thrift.formatStruct(fields, false, []*string{}), thrift.structObject(fields),
+				true, true, offset
+		}
+
+		ok, complete, bytesRead = thrift.readCompactFieldValue(&field, data[offset:])
+		if !ok {
+			return "", nil, false, false, 0
+		}
+		if !complete {
+			return "", nil, true, false, 0
+		}
+		fields = append(fields, field)
+		offset += bytesRead
+		lastId = field.Id
+	}
+}
+
+// Dictionary wrapped in a function to avoid "initialization loop"
+func (thrift *Thrift) compactReadersByType(type_ byte) (func_ ThriftFieldReader, exists bool) {
+	switch type_ {
+	case ThriftCompactTypeBooleanTrue, ThriftCompactTypeBooleanFalse:
+		return thrift.readCompactBool, true
+	case ThriftCompactTypeByte:
+		return thrift.readByte, true
+	case ThriftCompactTypeI16, ThriftCompactTypeI32, ThriftCompactTypeI64:
+		return thrift.readCompactInt, true
+	case ThriftCompactTypeDouble:
+		return thrift.readCompactDouble, true
+	case ThriftCompactTypeBinary:
+		return thrift.readCompactAndQuoteString, true
+	case ThriftCompactTypeList:
+		return thrift.readCompactList, true
+	case ThriftCompactTypeSet:
+		return thrift.readCompactSet, true
+	case ThriftCompactTypeMap:
+		return thrift.readCompactMap, true
+	case ThriftCompactTypeStruct:
+		return thrift.readCompactStruct, true
+	default:
+		return nil, false
+	}
+}
+
+// Same as readField, for the fields of the compact protocol. The ids
+// are relative to the previous field of the message.
+func (thrift *Thrift) readCompactField(s *ThriftStream) (ok bool, complete bool, field *ThriftField) {
+
+	m := s.message
+
+	if len(s.data[s.parseOffset:]) == 0 {
+		return true, false, nil // ok, not complete
+	}
+
+	header, ok, complete, off := thrift.readCompactFieldHeader(s.data[s.parseOffset:], m.lastFieldId)
+	if !ok {
+		return false, false, nil
+	}
+	if !complete {
+		return true, false, nil // ok, not complete
+	}
+	offset := s.parseOffset + off
+	if header.Type == ThriftCompactTypeStop {
+		s.parseOffset = offset
+		return true, true, nil // done
+	}
+
+	ok, complete, off = thrift.readCompactFieldValue(&header, s.data[offset:])
+	if !ok {
+		return false, false, nil
+	}
+	if !complete {
+		return true, false, nil
+	}
+	offset += off
+
+	s.parseOffset = offset
+	m.lastFieldId = header.Id
+	return true, false, &header
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestThrift_thriftReadVarint(t *testing.T) {
+
+	type io struct {
+		Input    []byte
+		Value    uint64
+		Ok       bool
+		Complete bool
+		Off      int
+	}
+	var tests = []io{
+		io{Input: []byte{0x00}, Value: 0, Ok: true, Complete: true, Off: 1},
+		io{Input: []byte{0x7f, 0xff}, Value: 127, Ok: true, Complete: true, Off: 1},
+		io{Input: []byte{0xac, 0x02}, Value: 300, Ok: true, Complete: true, Off: 2},
+		io{Input: []byte{0xac}, Ok: true, Complete: false},
+		io{Input: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, Ok: false},
+	}
+
+	for _, test := range tests {
+		value, ok, complete, off := thriftReadVarint(test.Input)
+		if ok != test.Ok || complete != test.Complete {
+			t.Errorf("Input %v: expected ok %t complete %t, got %t %t",
+				test.Input, test.Ok, test.Complete, ok, complete)
+			continue
+		}
+		if complete && (value != test.Value || off != test.Off) {
+			t.Errorf("Input %v: expected %d at %d, got %d at %d",
+				test.Input, test.Value, test.Off, value, off)
+		}
+	}
+
+	if thriftZigzag(0) != 0 || thriftZigzag(1) != -1 || thriftZigzag(2) != 1 || thriftZigzag(599) != -300 {
+		t.Errorf("Wrong zigzag decoding")
+	}
+}
+
+func TestThrift_ParseSimpleTCompact(t *testing.T) {
+
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.ProtocolType = ThriftTCompact
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// add(1, -3, "hi", true, [1, 2], {"a": 300}, (1: 1.5))
+	req := createTestPacket(t, "82210103616464150215051802686911192502041b01860161d8041c17000000000000f83f0000")
+	repl := createTestPacket(t, "8241010361646405000300")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans := expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "add" ||
+		trans.Request.Params != `(1: 1, 2: -3, 3: "hi", 4: true, 5: [1, 2], 6: {"a": 300}, 7: (1: 1.5))` ||
+		trans.Reply.ReturnValue != "-2" ||
+		trans.Reply.HasException {
+
+		t.Error("Bad result:", trans)
+	}
+}
+
+func TestThrift_Parse_CompactException(t *testing.T) {
+
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.ProtocolType = ThriftTCompact
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	req := createTestPacket(t, "822102036164640000")
+	repl := createTestPacket(t, "824102036164641c18036261640000")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans := expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "add" ||
+		trans.Request.Params != "()" ||
+		trans.Reply.Exceptions != `(1: (1: "bad"))` ||
+		!trans.Reply.HasException {
+
+		t.Error("Bad result:", trans)
+	}
+}
+
+func TestThrift_CompactStructuredParams(t *testing.T) {
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.ProtocolType = ThriftTCompact
+	thrift.StructuredParams = true
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	req := createTestPacket(t, "82210103616464150215051802686911192502041b01860161d8041c17000000000000f83f0000")
+	thrift.Parse(req, &tcp, 0)
+
+	trans := thrift.transMap[TcpTupleFromIpPort(tcp.tuple, tcp.id).raw]
+	if trans == nil {
+		t.Fatal("No transaction")
+	}
+	expected := bson.M{
+		"1": int64(1),
+		"2": int64(-3),
+		"3": "hi",
+		"4": true,
+		"5": []interface{}{int64(1), int64(2)},
+		"6": bson.M{"a": int64(300)},
+		"7": bson.M{"1": 1.5},
+	}
+	if !reflect.DeepEqual(trans.Request.ParamsObj, expected) {
+		t.Errorf("Wrong structured params: %v", trans.Request.ParamsObj)
+	}
+}
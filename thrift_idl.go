@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/samuel/go-thrift/parser"
+	"labix.org/v2/mgo/bson"
 )
 
 type ThriftIdlMethod struct {
@@ -16,6 +19,13 @@ type ThriftIdlMethod struct {
 
 type ThriftIdl struct {
 	MethodsByName map[string]*ThriftIdlMethod
+
+	// methods of each service, for the multiplexed protocol where the
+	// same method name can be used by several services
+	MethodsByService map[string]map[string]*ThriftIdlMethod
+
+	// structs and exceptions, to name the fields of the structured params
+	StructsByName map[string]*parser.Struct
 }
 
 func fieldsToArrayById(fields []*parser.Field) []*string {
@@ -41,24 +51,58 @@ func fieldsToArrayById(fields []*parser.Field) []*string {
 	return output
 }
 
-func BuildMethodsMap(thrift_files map[string]parser.Thrift) map[string]*ThriftIdlMethod {
+func BuildServicesMap(thrift_files map[string]parser.Thrift) map[string]map[string]*ThriftIdlMethod {
 
-	output := make(map[string]*ThriftIdlMethod)
+	output := make(map[string]map[string]*ThriftIdlMethod)
 
 	for _, thrift := range thrift_files {
 		for _, service := range thrift.Services {
+			if _, exists := output[service.Name]; exists {
+				WARN("Thrift IDL: Service %s is defined more than once", service.Name)
+			}
+			methods := make(map[string]*ThriftIdlMethod)
 			for _, method := range service.Methods {
-				if _, exists := output[method.Name]; exists {
-					WARN("Thrift IDL: Method %s is defined in more services: %s and %s",
-						output[method.Name].Service.Name, service.Name)
-				}
-				output[method.Name] = &ThriftIdlMethod{
+				methods[method.Name] = &ThriftIdlMethod{
 					Service:    service,
 					Method:     method,
 					Params:     fieldsToArrayById(method.Arguments),
 					Exceptions: fieldsToArrayById(method.Exceptions),
 				}
 			}
+			output[service.Name] = methods
+		}
+	}
+
+	return output
+}
+
+func BuildMethodsMap(services map[string]map[string]*ThriftIdlMethod) map[string]*ThriftIdlMethod {
+
+	output := make(map[string]*ThriftIdlMethod)
+
+	for _, methods := range services {
+		for name, method := range methods {
+			if _, exists := output[name]; exists {
+				WARN("Thrift IDL: Method %s is defined in more services: %s and %s",
+					name, output[name].Service.Name, method.Service.Name)
+			}
+			output[name] = method
+		}
+	}
+
+	return output
+}
+
+func BuildStructsMap(thrift_files map[string]parser.Thrift) map[string]*parser.Struct {
+
+	output := make(map[string]*parser.Struct)
+
+	for _, thrift := range thrift_files {
+		for name, st := range thrift.Structs {
+			output[name] = st
+		}
+		for name, st := range thrift.Exceptions {
+			output[name] = st
 		}
 	}
 
@@ -84,7 +128,12 @@ func ReadFiles(files []string) (map[string]parser.Thrift, error) {
 	return output, nil
 }
 
-func (thriftidl *ThriftIdl) FindMethod(name string) *ThriftIdlMethod {
+// Looks up the method in the given service, or in all services when
+// the service is empty or not defined in the IDL.
+func (thriftidl *ThriftIdl) FindMethod(service string, name string) *ThriftIdlMethod {
+	if methods, exists := thriftidl.MethodsByService[service]; exists {
+		return methods[name]
+	}
 	return thriftidl.MethodsByName[name]
 }
 
@@ -98,7 +147,69 @@ func NewThriftIdl(idl_files []string) (*ThriftIdl, error) {
 		return nil, err
 	}
 
+	services := BuildServicesMap(thrift_files)
+
 	return &ThriftIdl{
-		MethodsByName: BuildMethodsMap(thrift_files),
+		MethodsByName:    BuildMethodsMap(services),
+		MethodsByService: services,
+		StructsByName:    BuildStructsMap(thrift_files),
 	}, nil
 }
+
+// Replaces the ids by the names of the fields in a structured struct,
+// and in the structs it contains.
+func (thriftidl *ThriftIdl) NameFields(obj bson.M, fields []*parser.Field) bson.M {
+	output := bson.M{}
+	for id, value := range obj {
+		output[id] = value
+	}
+	for _, field := range fields {
+		id := strconv.Itoa(field.Id)
+		value, exists := output[id]
+		if !exists || len(field.Name) == 0 {
+			continue
+		}
+		delete(output, id)
+		output[field.Name] = thriftidl.nameValue(value, field.Type)
+	}
+	return output
+}
+
+func (thriftidl *ThriftIdl) nameValue(value interface{}, typ *parser.Type) interface{} {
+	if typ == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		if typ.ValueType == nil {
+			return value
+		}
+		output := make([]interface{}, len(v))
+		for i, elem := range v {
+			output[i] = thriftidl.nameValue(elem, typ.ValueType)
+		}
+		return output
+	case bson.M:
+		if typ.Name == "map" {
+			if typ.ValueType == nil {
+				return value
+			}
+			output := bson.M{}
+			for key, elem := range v {
+				output[key] = thriftidl.nameValue(elem, typ.ValueType)
+			}
+			return output
+		}
+		// types of other files are prefixed by the file name
+		name := typ.Name
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		st, exists := thriftidl.StructsByName[name]
+		if !exists {
+			return value
+		}
+		return thriftidl.NameFields(v, st.Fields)
+	}
+	return value
+}
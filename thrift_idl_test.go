@@ -51,3 +51,30 @@ service Test {
 		t.Error("Non empty exceptions", m.Exceptions)
 	}
 }
+
+func TestThriftIdl_findMethodByService(t *testing.T) {
+
+	idl := thriftIdlForTesting(t, `
+service Calc {
+       i32 add(1:i32 a, 2: i32 b)
+}
+service Strings {
+       string add(1:string left, 2: string right)
+}
+`)
+
+	m := idl.FindMethod("Calc", "add")
+	if m == nil || m.Service.Name != "Calc" || *m.Params[1] != "a" {
+		t.Error("Bad Calc method:", m)
+	}
+	m = idl.FindMethod("Strings", "add")
+	if m == nil || m.Service.Name != "Strings" || *m.Params[1] != "left" {
+		t.Error("Bad Strings method:", m)
+	}
+	if idl.FindMethod("Calc", "sub") != nil {
+		t.Error("Found method not defined in the service")
+	}
+	if idl.FindMethod("", "add") == nil {
+		t.Error("Method not found without service")
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"encoding/hex"
 	"net"
+	"reflect"
 	"testing"
+
+	"labix.org/v2/mgo/bson"
 )
 
 func TestThrift_thriftReadString(t *testing.T) {
@@ -1049,3 +1052,256 @@ func TestThrift_ExceptionName(t *testing.T) {
 		t.Error("Bad result:", trans)
 	}
 }
+
+func TestThrift_expireTransaction(t *testing.T) {
+
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+	req := createTestPacket(t, "800100010000000470696e670000000000")
+
+	thrift.Parse(req, &tcp, 0)
+
+	tuple := TcpTupleFromIpPort(tcp.tuple, tcp.id)
+	trans := thrift.transMap[tuple.raw]
+	if trans == nil {
+		t.Fatal("No pending transaction")
+	}
+	trans.timer.Stop()
+	thrift.expireTransaction(trans)
+
+	trans = expectThriftTransaction(t, thrift)
+	if trans == nil || !trans.timedOut || trans.ResponseTime != TimeoutResponseTime {
+		t.Error("Bad result:", trans)
+	}
+	if _, exists := thrift.transMap[tuple.raw]; exists {
+		t.Error("Expired transaction still in the map")
+	}
+}
+
+func TestThrift_ParseAutoDetect(t *testing.T) {
+
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.TransportType = ThriftAutoDetect
+	thrift.ProtocolType = ThriftAutoDetect
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	// framed compact
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+	req := createTestPacket(t, "0000000a82210103616464150200")
+	repl := createTestPacket(t, "0000000b8241010361646405000400")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans := expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "add" ||
+		trans.Request.Params != "(1: 1)" ||
+		trans.Reply.ReturnValue != "2" ||
+		trans.Request.FrameSize != 10 {
+
+		t.Error("Bad result:", trans)
+	}
+
+	// socket binary, on another connection
+	var tcp2 TcpStream
+	tcp2.tuple = testIpPortTuple()
+	tcp2.id = 1
+	req = createTestPacket(t, "800100010000000470696e670000000000")
+	repl = createTestPacket(t, "800100020000000470696e670000000000")
+
+	thrift.Parse(req, &tcp2, 0)
+	thrift.Parse(repl, &tcp2, 1)
+
+	trans = expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "ping" ||
+		trans.Request.Params != "()" ||
+		trans.Request.FrameSize != 17 {
+
+		t.Error("Bad result:", trans)
+	}
+
+	// garbage drops the stream
+	var tcp3 TcpStream
+	tcp3.tuple = testIpPortTuple()
+	thrift.Parse(createTestPacket(t, "474554202f20485454502f312e310d0a"), &tcp3, 0)
+	if tcp3.data[0] != nil {
+		t.Error("Stream not dropped")
+	}
+}
+
+func TestThrift_ParsePortSettings(t *testing.T) {
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.PortSettings[9201] = ThriftPortSettings{ThriftTFramed, ThriftTCompact}
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+	req := createTestPacket(t, "0000000a82210103616464150200")
+	repl := createTestPacket(t, "0000000b8241010361646405000400")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans := expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "add" ||
+		trans.Reply.ReturnValue != "2" {
+
+		t.Error("Bad result:", trans)
+	}
+
+	stream, _ := tcp.data[0].(*ThriftStream)
+	if stream == nil || stream.transportType != ThriftTFramed || stream.protocolType != ThriftTCompact {
+		t.Error("Port settings not used by the stream")
+	}
+}
+
+func TestThrift_MultiplexedServices(t *testing.T) {
+
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.Idl = thriftIdlForTesting(t, `
+		exception Overflow {
+		  1: string why
+		}
+		service Calc {
+		   i32 add(1:i32 a, 2:i32 b) throws (1:Overflow overflow),
+		}
+		service Strings {
+		   string add(1:string left, 2:string right),
+		}
+		`)
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	req := createTestPacket(t, "800100010000000843616c633a616464000000010800010000"+
+		"00010800020000000200")
+	repl := createTestPacket(t, "8001000200000003616464000000010c00010b00010000000362"+
+		"69670000")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans := expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "add" ||
+		trans.Request.Service != "Calc" ||
+		trans.Request.Params != "(a: 1, b: 2)" ||
+		trans.Reply.Exceptions != `(overflow: (1: "big"))` {
+
+		t.Error("Bad result:", trans)
+	}
+
+	req = createTestPacket(t, "800100010000000b537472696e67733a616464000000020b0001"+
+		"00000001780b0002000000017900")
+	repl = createTestPacket(t, "8001000200000003616464000000020b000000000002787900")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans = expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "add" ||
+		trans.Request.Service != "Strings" ||
+		trans.Request.Params != `(left: "x", right: "y")` ||
+		trans.Reply.ReturnValue != `"xy"` {
+
+		t.Error("Bad result:", trans)
+	}
+}
+
+func TestThrift_StructuredParams(t *testing.T) {
+
+	if testing.Verbose() {
+		LogInit(LOG_DEBUG, "", false, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.StructuredParams = true
+	thrift.CollectionMaxSize = 2
+	thrift.Idl = thriftIdlForTesting(t, `
+		struct Work {
+		  1: i32 num
+		}
+		service Test {
+		   i32 sum(1:list<Work> works, 2:map<string,Work> named),
+		}
+		`)
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	req := createTestPacket(t, "800100010000000373756d000000010f00010c000000030800010000"+
+		"000100080001000000020008000100000004000d00020b0c00000001000000016b080001000000030000")
+	repl := createTestPacket(t, "800100020000000373756d000000010800000000000300")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans := expectThriftTransaction(t, thrift)
+	expected := bson.M{
+		"works": []interface{}{bson.M{"num": int32(1)}, bson.M{"num": int32(2)}},
+		"named": bson.M{"k": bson.M{"num": int32(3)}},
+	}
+	if !reflect.DeepEqual(trans.Request.ParamsObj, expected) {
+		t.Errorf("Wrong structured params: %v", trans.Request.ParamsObj)
+	}
+	if trans.Request.Params != `(works: [(1: 1), (1: 2), ...], named: {"k": (1: 3)})` {
+		t.Errorf("Wrong params: %s", trans.Request.Params)
+	}
+}
+
+func TestThrift_StructuredParamsAllFields(t *testing.T) {
+
+	var thrift Thrift
+	thrift.Init(true)
+	thrift.StructuredParams = true
+	thrift.CollectionMaxSize = 2
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	var tcp TcpStream
+	tcp.tuple = testIpPortTuple()
+
+	// f(1: byte -56, 2: i32 1, 3: i32 2)
+	req := createTestPacket(t, "800100010000000166000000010300"+
+		"01c8080002000000010800030000000200")
+	repl := createTestPacket(t, "80010002000000016600000001080000000000030000")
+
+	thrift.Parse(req, &tcp, 0)
+	thrift.Parse(repl, &tcp, 1)
+
+	trans := expectThriftTransaction(t, thrift)
+	expected := bson.M{"1": int8(-56), "2": int32(1), "3": int32(2)}
+	if !reflect.DeepEqual(trans.Request.ParamsObj, expected) {
+		t.Errorf("Wrong structured params: %v", trans.Request.ParamsObj)
+	}
+	if trans.Request.Params != "(1: -56, 2: 1, ...)" {
+		t.Errorf("Wrong params: %s", trans.Request.Params)
+	}
+}
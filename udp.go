@@ -0,0 +1,227 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Implemented by the protocol analyzers that also decode datagrams.
+// Each UDP packet is passed as is, there is no stream to follow.
+type UdpProtocolPlugin interface {
+	// Called for every UDP packet that carries data.
+	ParseUdp(pkt *Packet)
+}
+
+var udpPortMap map[uint16]UdpProtocolPlugin
+
+func decideUdpProtocol(tuple *IpPortTuple) UdpProtocolPlugin {
+	protocol, exists := udpPortMap[tuple.Src_port]
+	if exists {
+		return protocol
+	}
+
+	protocol, exists = udpPortMap[tuple.Dst_port]
+	if exists {
+		return protocol
+	}
+
+	return nil
+}
+
+// As for TCP, a port can only be configured for one protocol.
+func configToUdpPortsMap(config *tomlConfig) (map[uint16]UdpProtocolPlugin, error) {
+	var res = map[uint16]UdpProtocolPlugin{}
+	var names = map[uint16]string{}
+
+	for name, plugin := range protocolPlugins {
+		udpPlugin, ok := plugin.(UdpProtocolPlugin)
+		if !ok {
+			continue
+		}
+
+		protoConfig, exists := config.Protocols[name]
+		if !exists {
+			// skip
+			continue
+		}
+
+		// the protocol runs on the same ports for both transports
+		// unless the UDP ones are given
+		ports := protoConfig.Ports
+		if len(protoConfig.Udp_ports) > 0 {
+			ports = protoConfig.Udp_ports
+		}
+		for _, port := range ports {
+			if other, exists := names[uint16(port)]; exists {
+				first, second := other, name
+				if second < first {
+					first, second = second, first
+				}
+				return nil, MsgError("Port %d is configured for both %s and %s",
+					port, first, second)
+			}
+			res[uint16(port)] = udpPlugin
+			names[uint16(port)] = name
+		}
+	}
+
+	return res, nil
+}
+
+func FollowUdp(pkt *Packet) {
+	protocol := decideUdpProtocol(&pkt.tuple)
+	if protocol == nil {
+		// not on a port of a protocol decoding datagrams
+		return
+	}
+	protocol.ParseUdp(pkt)
+}
+
+// Identifies a request: the tuple in the direction of the request and
+// the ID the protocol gives to it.
+type IdTransactionKey struct {
+	tuple HashableIpPortTuple
+	id    uint32
+}
+
+// A request waiting for its response.
+type IdTransaction struct {
+	key          IdTransactionKey
+	Src          Endpoint
+	Dst          Endpoint
+	Ts           time.Time
+	ResponseTime int32
+
+	// the request, as decoded by the analyzer
+	Data ProtocolData
+
+	timer *time.Timer
+}
+
+// Matches the responses to their requests by an ID found in the
+// messages, for the datagram analyzers and the TCP protocols that don't
+// answer in order. The requests are identified by the tuple and the ID,
+// those not answered within Timeout are handed to OnTimeout. The
+// messages are located by a tuple and the direction relative to it,
+// which is TcpDirectionOriginal for a datagram.
+type IdTransactions struct {
+	Timeout   time.Duration
+	OnTimeout func(trans *IdTransaction)
+
+	// the expiration timers run on their own goroutines
+	mutex        sync.Mutex
+	transactions map[IdTransactionKey]*IdTransaction
+}
+
+func NewIdTransactions(onTimeout func(trans *IdTransaction)) *IdTransactions {
+	return &IdTransactions{
+		Timeout:      TransactionTimeout,
+		OnTimeout:    onTimeout,
+		transactions: make(map[IdTransactionKey]*IdTransaction, TransactionsHashSize),
+	}
+}
+
+// Reads the transaction_timeout of a protocol, in milliseconds. Returns
+// TransactionTimeout if it is not set.
+func configTransactionTimeout(name string) (time.Duration, error) {
+	if !_ConfigMeta.IsDefined("protocols", name, "transaction_timeout") {
+		return TransactionTimeout, nil
+	}
+	timeout := _Config.Protocols[name].Transaction_timeout
+	if timeout <= 0 {
+		return 0, MsgError("Invalid transaction_timeout for %s: %d", name, timeout)
+	}
+	return time.Duration(timeout) * time.Millisecond, nil
+}
+
+func idTransactionKey(tuple *IpPortTuple, requestDir uint8, id uint32) IdTransactionKey {
+	if requestDir == TcpDirectionOriginal {
+		return IdTransactionKey{tuple: tuple.raw, id: id}
+	}
+	return IdTransactionKey{tuple: tuple.revRaw, id: id}
+}
+
+// Registers a request sent in the given direction of the tuple. Returns
+// nil if the request is already waiting for its response, as
+// retransmissions are.
+func (transactions *IdTransactions) AddRequest(tuple *IpPortTuple, dir uint8, id uint32,
+	ts time.Time, data ProtocolData) *IdTransaction {
+
+	transactions.mutex.Lock()
+	defer transactions.mutex.Unlock()
+
+	key := idTransactionKey(tuple, dir, id)
+	if _, exists := transactions.transactions[key]; exists {
+		DEBUG("transactions", "Request %d retransmitted", id)
+		return nil
+	}
+
+	cmdline := procWatcher.FindProcessesTuple(tuple)
+	trans := &IdTransaction{key: key, Ts: ts, Data: data}
+	trans.Src = Endpoint{
+		Ip:   tuple.Src_ip.String(),
+		Port: tuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	trans.Dst = Endpoint{
+		Ip:   tuple.Dst_ip.String(),
+		Port: tuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+	if dir == TcpDirectionReverse {
+		trans.Src, trans.Dst = trans.Dst, trans.Src
+	}
+
+	transactions.transactions[key] = trans
+	trans.timer = time.AfterFunc(transactions.Timeout, func() { transactions.expire(trans) })
+
+	return trans
+}
+
+// Returns the request answered by a response sent in the given
+// direction, or nil if it is not known. The transaction is removed.
+func (transactions *IdTransactions) MatchResponse(tuple *IpPortTuple, dir uint8, id uint32,
+	ts time.Time) *IdTransaction {
+
+	transactions.mutex.Lock()
+	defer transactions.mutex.Unlock()
+
+	key := idTransactionKey(tuple, 1-dir, id)
+	trans, exists := transactions.transactions[key]
+	if !exists {
+		DEBUG("transactions", "Response %d without a known request", id)
+		return nil
+	}
+	delete(transactions.transactions, key)
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+
+	trans.ResponseTime = int32(ts.Sub(trans.Ts).Nanoseconds() / 1e6)
+
+	return trans
+}
+
+// Number of requests waiting for their response.
+func (transactions *IdTransactions) Pending() int {
+	transactions.mutex.Lock()
+	defer transactions.mutex.Unlock()
+
+	return len(transactions.transactions)
+}
+
+func (transactions *IdTransactions) expire(trans *IdTransaction) {
+	transactions.mutex.Lock()
+	if transactions.transactions[trans.key] != trans {
+		// answered, the key may be in use by a newer request
+		transactions.mutex.Unlock()
+		return
+	}
+	delete(transactions.transactions, trans.key)
+	transactions.mutex.Unlock()
+
+	trans.ResponseTime = int32(transactions.Timeout / time.Millisecond)
+	if transactions.OnTimeout != nil {
+		transactions.OnTimeout(trans)
+	}
+}
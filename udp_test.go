@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUdp_configToUdpPortsMap(t *testing.T) {
+
+	config := tomlConfig{
+		Protocols: map[string]tomlProtocol{
+			"dns":  tomlProtocol{Ports: []int{53}},
+			"http": tomlProtocol{Ports: []int{80}},
+		},
+	}
+
+	portsMap, err := configToUdpPortsMap(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(portsMap) != 1 || portsMap[53] != UdpProtocolPlugin(&DnsMod) {
+		t.Errorf("Wrong UDP ports: %v", portsMap)
+	}
+
+	// the UDP ports replace the TCP ones
+	config.Protocols["dns"] = tomlProtocol{Ports: []int{53}, Udp_ports: []int{5353}}
+	portsMap, err = configToUdpPortsMap(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(portsMap) != 1 || portsMap[5353] != UdpProtocolPlugin(&DnsMod) {
+		t.Errorf("Wrong UDP ports: %v", portsMap)
+	}
+
+	// memcache on the UDP port of dns
+	config.Protocols["memcache"] = tomlProtocol{Ports: []int{11211}, Udp_ports: []int{5353}}
+	_, err = configToUdpPortsMap(&config)
+	if err == nil || err.Error() != "Port 5353 is configured for both dns and memcache" {
+		t.Errorf("Expected the duplicate port to be refused: %v", err)
+	}
+}
+
+func TestUdp_idTransactions(t *testing.T) {
+
+	expired := make(chan *IdTransaction, 1)
+	transactions := NewIdTransactions(func(trans *IdTransaction) { expired <- trans })
+	transactions.Timeout = 10 * time.Millisecond
+
+	request := NewIpPortTuple(4, net.IPv4(192, 168, 0, 1), 34567, net.IPv4(192, 168, 0, 2), 11211)
+	response := NewIpPortTuple(4, net.IPv4(192, 168, 0, 2), 11211, net.IPv4(192, 168, 0, 1), 34567)
+	ts := time.Now()
+
+	if transactions.AddRequest(&request, TcpDirectionOriginal, 1, ts, "first") == nil {
+		t.Fatalf("Request not added")
+	}
+	if transactions.AddRequest(&request, TcpDirectionOriginal, 1, ts, "again") != nil {
+		t.Errorf("Retransmitted request added")
+	}
+	transactions.AddRequest(&request, TcpDirectionOriginal, 2, ts, "second")
+
+	// same ID from another client
+	other := NewIpPortTuple(4, net.IPv4(192, 168, 0, 3), 34567, net.IPv4(192, 168, 0, 2), 11211)
+	if transactions.MatchResponse(&other, TcpDirectionReverse, 1, ts) != nil {
+		t.Errorf("Response matched a request of another tuple")
+	}
+
+	trans := transactions.MatchResponse(&response, TcpDirectionOriginal, 1, ts.Add(3*time.Millisecond))
+	if trans == nil || trans.Data != "first" || trans.ResponseTime != 3 {
+		t.Fatalf("Wrong transaction: %v", trans)
+	}
+	if trans.Src.Port != 34567 || trans.Dst.Port != 11211 {
+		t.Errorf("Wrong endpoints: %v -> %v", trans.Src, trans.Dst)
+	}
+	if transactions.Pending() != 1 {
+		t.Errorf("Expected 1 pending request, got %d", transactions.Pending())
+	}
+
+	select {
+	case trans = <-expired:
+		if trans.Data != "second" || trans.ResponseTime != 10 {
+			t.Errorf("Wrong expired transaction: %v", trans)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Request didn't expire")
+	}
+}
+
+func TestUdp_idTransactionsReusedId(t *testing.T) {
+
+	expired := 0
+	transactions := NewIdTransactions(func(trans *IdTransaction) { expired++ })
+
+	request := NewIpPortTuple(4, net.IPv4(192, 168, 0, 1), 34567, net.IPv4(192, 168, 0, 2), 53)
+	response := NewIpPortTuple(4, net.IPv4(192, 168, 0, 2), 53, net.IPv4(192, 168, 0, 1), 34567)
+	ts := time.Now()
+
+	transactions.AddRequest(&request, TcpDirectionOriginal, 1, ts, "first")
+	first := transactions.MatchResponse(&response, TcpDirectionOriginal, 1, ts)
+	transactions.AddRequest(&request, TcpDirectionOriginal, 1, ts, "second")
+
+	// the timer of the answered request fires late
+	transactions.expire(first)
+
+	if expired != 0 || transactions.Pending() != 1 {
+		t.Errorf("The newer request with the same ID was expired")
+	}
+	trans := transactions.MatchResponse(&response, TcpDirectionOriginal, 1, ts)
+	if trans == nil || trans.Data != "second" {
+		t.Errorf("Wrong transaction: %v", trans)
+	}
+}